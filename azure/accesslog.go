@@ -0,0 +1,279 @@
+package azure
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// maxUsageBodySize bounds the json response bodies buffered to read their usage
+const maxUsageBodySize = 4 << 20
+
+// accessLog collects what is known about a request for its access log line
+type accessLog struct {
+	start      time.Time
+	requestID  string
+	traceID    string
+	method     string
+	path       string
+	keyID      string
+	tenant     *tenant
+	model      string
+	deployment string
+	rc         *rewriteContext
+}
+
+func newAccessLog(c *gin.Context, start time.Time, requestID string) *accessLog {
+	return &accessLog{
+		start:     start,
+		requestID: requestID,
+		method:    c.Request.Method,
+		path:      c.Request.URL.Path,
+		keyID:     callerKeyID(c.Request),
+	}
+}
+
+// write emits one logfmt line: caller key, model, deployment, status, token usage, latency and stream flag,
+// and accounts the usage of successful requests to the caller key
+func (l *accessLog) write(status int) {
+	if l.rc != nil && status < http.StatusBadRequest {
+		record := UsageRecord{
+			Time:       l.start,
+			RequestID:  l.requestID,
+			KeyID:      l.keyID,
+			Tenant:     l.tenant.name(),
+			Model:      l.model,
+			Deployment: l.deployment,
+			Stream:     l.rc.stream,
+		}
+		if l.rc.usage != nil {
+			record.PromptTokens, record.CompletionTokens = l.rc.usage.PromptTokens, l.rc.usage.CompletionTokens
+			record.Estimated = l.rc.usageEstimated
+			record.Cost = requestCostOf(l.model, record.PromptTokens, record.CompletionTokens)
+			if record.Cost > 0 {
+				requestCost.WithLabelValues(logValue(l.keyID), l.model, l.tenant.name()).Add(record.Cost)
+			}
+		}
+		accountant.record(record)
+		consumeVirtualKey(l.keyID, record.PromptTokens+record.CompletionTokens)
+		consumeTenant(record)
+	}
+
+	latency := time.Since(l.start)
+	if appInsights != nil {
+		appInsights.trackRequest(l, status, latency)
+	}
+
+	event := RequestEvent{
+		Time:       l.start.UTC(),
+		RequestID:  l.requestID,
+		KeyID:      l.keyID,
+		Tenant:     l.tenant.name(),
+		Model:      l.model,
+		Deployment: l.deployment,
+		Status:     status,
+		LatencyMs:  latency.Milliseconds(),
+	}
+	prompt, completion := "-", "-"
+	if l.rc != nil {
+		event.Stream = l.rc.stream
+		if l.rc.usage != nil {
+			event.PromptTokens, event.CompletionTokens = l.rc.usage.PromptTokens, l.rc.usage.CompletionTokens
+			prompt = strconv.FormatInt(l.rc.usage.PromptTokens, 10)
+			completion = strconv.FormatInt(l.rc.usage.CompletionTokens, 10)
+		}
+	}
+	publishEvent(event)
+	var usage *Usage
+	if l.rc != nil {
+		usage = l.rc.usage
+	}
+	stats.record(l.model, l.deployment, status, usage, latency)
+	l.logIfSlow(status, latency)
+	line := fmt.Sprintf("access request_id=%s key_id=%s tenant=%s model=%s deployment=%s status=%d prompt_tokens=%s completion_tokens=%s latency_ms=%d stream=%t",
+		logValue(l.requestID), logValue(l.keyID), logValue(l.tenant.name()), logValue(l.model), logValue(l.deployment), status,
+		prompt, completion, latency.Milliseconds(), event.Stream)
+	util.Infof("%s", line)
+	if util.Enabled(util.LevelInfo) {
+		l.tenant.logf("%s", line)
+	}
+}
+
+func logValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	if strings.ContainsAny(value, " \"=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// callerKeyID identifies the caller by a short hash of its bearer token, the token itself is never logged,
+// or by the id of its virtual key
+func callerKeyID(req *http.Request) string {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return ""
+	}
+	if key := virtualKeys.lookup(token); key != nil {
+		return key.ID
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4])
+}
+
+// observeUsage records the usage object of the response body on its way to the client, the body is not modified
+func observeUsage(resp *http.Response, rc *rewriteContext) {
+	if resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	contentType := resp.Header.Get("Content-Type")
+	stream := strings.HasPrefix(contentType, "text/event-stream")
+	if !stream && !strings.HasPrefix(contentType, "application/json") {
+		return
+	}
+	resp.Body = &usageObserver{ReadCloser: resp.Body, rc: rc, stream: stream}
+}
+
+// usageObserver scans json bodies, or the data events of streams, for the usage object
+type usageObserver struct {
+	io.ReadCloser
+	rc       *rewriteContext
+	stream   bool
+	events   int
+	buf      []byte
+	overflow bool
+	finished bool
+}
+
+func (o *usageObserver) Read(p []byte) (int, error) {
+	n, err := o.ReadCloser.Read(p)
+	o.observe(p[:n])
+	if err == io.EOF {
+		o.finish()
+	}
+	return n, err
+}
+
+func (o *usageObserver) Close() error {
+	o.finish()
+	return o.ReadCloser.Close()
+}
+
+func (o *usageObserver) observe(data []byte) {
+	if o.overflow || len(data) == 0 {
+		return
+	}
+	o.buf = append(o.buf, data...)
+	if o.stream {
+		for {
+			i := bytes.IndexByte(o.buf, '\n')
+			if i < 0 {
+				break
+			}
+			line := o.buf[:i]
+			if bytes.HasPrefix(line, sseDataPrefix) {
+				o.observeEvent(bytes.TrimSpace(line[len(sseDataPrefix):]))
+			}
+			o.buf = o.buf[i+1:]
+		}
+	}
+	if len(o.buf) > maxUsageBodySize {
+		o.overflow = true
+		o.buf = nil
+	}
+}
+
+func (o *usageObserver) observeEvent(data []byte) {
+	if len(data) == 0 || bytes.Equal(data, sseDone) {
+		return
+	}
+	o.events++
+	if bytes.Contains(data, []byte(`"usage"`)) {
+		o.record(data)
+	}
+}
+
+func (o *usageObserver) finish() {
+	if o.finished {
+		return
+	}
+	o.finished = true
+	if !o.stream && !o.overflow {
+		o.record(o.buf)
+	}
+	if o.stream && o.rc.usage == nil && o.events > 0 {
+		// counted by rewriteUsageEstimate as the chunks passed
+		o.rc.usage = o.rc.estimatedUsage()
+	}
+	o.buf = nil
+}
+
+func (o *usageObserver) record(data []byte) {
+	var payload struct {
+		Usage *Usage `json:"usage"`
+	}
+	if util.JSONUnmarshal(data, &payload) == nil && payload.Usage != nil {
+		o.rc.usage = payload.Usage
+	}
+}
+
+type SlowRequestConfig struct {
+	TTFT  time.Duration `yaml:"ttft" mapstructure:"ttft"`   // time to the first token of streams, or to the response headers otherwise, 0 disables it
+	Total time.Duration `yaml:"total" mapstructure:"total"` // total request latency, 0 disables it
+}
+
+// logIfSlow logs the routing of requests exceeding the slow request thresholds
+func (l *accessLog) logIfSlow(status int, latency time.Duration) {
+	cfg := C.SlowRequest
+	if (cfg.TTFT <= 0 && cfg.Total <= 0) || l.rc == nil {
+		return
+	}
+
+	var ttft time.Duration
+	switch {
+	case !l.rc.firstToken.IsZero():
+		ttft = l.rc.firstToken.Sub(l.start)
+	case !l.rc.firstByte.IsZero():
+		ttft = l.rc.firstByte.Sub(l.start)
+	}
+	if (cfg.TTFT <= 0 || ttft <= cfg.TTFT) && (cfg.Total <= 0 || latency <= cfg.Total) {
+		return
+	}
+
+	endpoint := "-"
+	if l.rc.deployment != nil && l.rc.deployment.EndpointUrl != nil {
+		endpoint = l.rc.deployment.EndpointUrl.Host
+	}
+	recordSlowRequest(SlowRequest{
+		Time:       l.start.UTC(),
+		RequestID:  l.requestID,
+		KeyID:      l.keyID,
+		Tenant:     l.tenant.name(),
+		Model:      l.model,
+		Deployment: l.deployment,
+		Endpoint:   endpoint,
+		Path:       l.path,
+		Status:     status,
+		TTFTMs:     ttft.Milliseconds(),
+		LatencyMs:  latency.Milliseconds(),
+		Stream:     l.rc.stream,
+	})
+	line := fmt.Sprintf("slow request request_id=%s key_id=%s tenant=%s model=%s deployment=%s endpoint=%s api_version=%s path=%s status=%d ttft_ms=%d latency_ms=%d stream=%t",
+		logValue(l.requestID), logValue(l.keyID), logValue(l.tenant.name()), logValue(l.model), logValue(l.deployment), endpoint,
+		logValue(l.rc.deployment.ApiVersion), logValue(l.path), status, ttft.Milliseconds(), latency.Milliseconds(), l.rc.stream)
+	util.Warnf("%s", line)
+	if util.Enabled(util.LevelWarn) {
+		l.tenant.logf("WARN %s", line)
+	}
+}
@@ -0,0 +1,168 @@
+package azure
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+type UsageConfig struct {
+	FlushInterval time.Duration    `yaml:"flush_interval" mapstructure:"flush_interval"` // how often usage records are written to the store, defaults to 1m
+	Store         UsageStoreConfig `yaml:"store" mapstructure:"store"`                   // optional database the usage records are persisted to
+}
+
+// UsageRecord is the token usage of one proxied request
+type UsageRecord struct {
+	Time             time.Time `json:"time"`
+	RequestID        string    `json:"request_id"`
+	KeyID            string    `json:"key_id"`
+	Tenant           string    `json:"tenant"`
+	Model            string    `json:"model"`
+	Deployment       string    `json:"deployment"`
+	PromptTokens     int64     `json:"prompt_tokens"`
+	CompletionTokens int64     `json:"completion_tokens"`
+	Cost             float64   `json:"cost"`
+	Estimated        bool      `json:"estimated"`
+	Stream           bool      `json:"stream"`
+}
+
+// UsageStore persists usage records flushed from memory
+type UsageStore interface {
+	WriteUsage(records []UsageRecord) error
+}
+
+// KeyUsage is the usage of one caller key since the proxy started
+type KeyUsage struct {
+	KeyID            string  `json:"key_id"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+	// Models breaks the usage down by model
+	Models map[string]*ModelUsage `json:"models"`
+}
+
+// ModelUsage is the usage of one model by a caller key
+type ModelUsage struct {
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// usageAccountant aggregates usage per caller key and buffers the records for the usage store
+type usageAccountant struct {
+	mu      sync.Mutex
+	keys    map[string]*KeyUsage
+	pending []UsageRecord
+	store   UsageStore
+}
+
+var accountant = &usageAccountant{keys: map[string]*KeyUsage{}}
+
+// SetUsageStore configures where usage records are flushed, without a store they are only aggregated in memory
+func SetUsageStore(store UsageStore) {
+	accountant.mu.Lock()
+	defer accountant.mu.Unlock()
+	accountant.store = store
+}
+
+func (a *usageAccountant) record(record UsageRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := a.keys[record.KeyID]
+	if key == nil {
+		key = &KeyUsage{KeyID: record.KeyID, Models: map[string]*ModelUsage{}}
+		a.keys[record.KeyID] = key
+	}
+	key.Requests++
+	key.PromptTokens += record.PromptTokens
+	key.CompletionTokens += record.CompletionTokens
+	key.TotalTokens += record.PromptTokens + record.CompletionTokens
+	key.Cost += record.Cost
+
+	model := key.Models[record.Model]
+	if model == nil {
+		model = &ModelUsage{}
+		key.Models[record.Model] = model
+	}
+	model.Requests++
+	model.PromptTokens += record.PromptTokens
+	model.CompletionTokens += record.CompletionTokens
+	model.Cost += record.Cost
+	if a.store != nil {
+		a.pending = append(a.pending, record)
+	}
+}
+
+// flush writes the buffered records to the store, they are kept for the next flush when it fails
+func (a *usageAccountant) flush() {
+	a.mu.Lock()
+	records, store := a.pending, a.store
+	a.pending = nil
+	a.mu.Unlock()
+	if store == nil || len(records) == 0 {
+		return
+	}
+
+	if err := store.WriteUsage(records); err != nil {
+		log.Printf("flush %d usage records error: %v", len(records), err)
+		a.mu.Lock()
+		a.pending = append(records, a.pending...)
+		a.mu.Unlock()
+	}
+}
+
+func (a *usageAccountant) snapshot() []KeyUsage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	keys := make([]KeyUsage, 0, len(a.keys))
+	for _, key := range a.keys {
+		usage := *key
+		usage.Models = make(map[string]*ModelUsage, len(key.Models))
+		for name, model := range key.Models {
+			m := *model
+			usage.Models[name] = &m
+		}
+		keys = append(keys, usage)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].TotalTokens > keys[j].TotalTokens
+	})
+	return keys
+}
+
+// startUsageFlusher flushes the usage records to the store every interval
+func startUsageFlusher(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go func() {
+		for range time.Tick(interval) {
+			accountant.flush()
+			virtualKeys.flush()
+		}
+	}()
+}
+
+// FlushUsage writes the buffered usage records to the store, used on shutdown
+func FlushUsage() {
+	accountant.flush()
+	virtualKeys.flush()
+}
+
+// KeyUsageHandler lists the token usage per caller key since start
+func KeyUsageHandler(c *gin.Context) {
+	util.SendJSON(c, http.StatusOK, gin.H{
+		"object": "list",
+		"data":   accountant.snapshot(),
+	})
+}
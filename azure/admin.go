@@ -0,0 +1,77 @@
+package azure
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+type AdminConfig struct {
+	Token string `yaml:"token" mapstructure:"token"` // bearer token of the /admin endpoints, they are disabled when empty
+}
+
+// AdminAuth guards the admin endpoints with the configured admin token
+func AdminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if C.Admin.Token == "" {
+			util.SendOpenAIError(c, http.StatusNotFound, "invalid_request_error", "admin_disabled", "",
+				errors.New("the admin api is disabled, set admin.token to enable it"))
+			c.Abort()
+			return
+		}
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		dashboard := isDashboardRoute(c)
+		if _, password, ok := c.Request.BasicAuth(); ok && dashboard {
+			// browsers opening the dashboard send the token as password of any user
+			token = password
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(C.Admin.Token)) != 1 {
+			if dashboard {
+				c.Header("WWW-Authenticate", `Basic realm="azure-openai-proxy admin"`)
+			}
+			util.SendOpenAIError(c, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "",
+				errors.New("invalid admin token"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// isDashboardRoute reports the read only dashboard routes, the only admin routes accepting basic auth so a browser
+// holding the credentials can't be made to change anything
+func isDashboardRoute(c *gin.Context) bool {
+	if c.Request.Method != http.MethodGet {
+		return false
+	}
+	route := c.FullPath()
+	return strings.HasSuffix(route, "/admin/dashboard") || strings.HasSuffix(route, "/admin/dashboard/data")
+}
+
+// LogLevelHandler returns the log level on GET and changes it on PUT with {"level": "debug|info|warn|error"}
+func LogLevelHandler(c *gin.Context) {
+	if c.Request.Method == http.MethodPut {
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := util.NewJSONDecoder(c.Request.Body).Decode(&body); err != nil {
+			body.Level = c.Query("level")
+		}
+		level, err := util.ParseLogLevel(body.Level)
+		if err != nil || body.Level == "" {
+			if err == nil {
+				err = errors.New("level is required")
+			}
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "level", err)
+			return
+		}
+		previous := util.GetLogLevel()
+		util.SetLogLevel(level)
+		util.Warnf("log level changed from %s to %s", previous, level)
+	}
+	util.SendJSON(c, http.StatusOK, gin.H{"level": util.GetLogLevel().String()})
+}
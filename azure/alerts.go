@@ -0,0 +1,141 @@
+package azure
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+const (
+	// AlertQuotaExceeded is fired when a caller key runs out of quota or a tenant spends its budget
+	AlertQuotaExceeded = "quota_exceeded"
+	// AlertErrorRate is fired when the upstream error rate of a deployment crosses the threshold
+	AlertErrorRate = "error_rate"
+)
+
+type AlertsConfig struct {
+	Webhooks  []WebhookConfig `yaml:"webhooks" mapstructure:"webhooks"`     // receivers of all alerts
+	ErrorRate ErrorRateAlert  `yaml:"error_rate" mapstructure:"error_rate"` // upstream error rate alert per deployment
+	Cooldown  time.Duration   `yaml:"cooldown" mapstructure:"cooldown"`     // minimum time between two alerts of the same kind and subject, defaults to 10m
+}
+
+type WebhookConfig struct {
+	Url    string `yaml:"url" mapstructure:"url"`
+	Format string `yaml:"format" mapstructure:"format"` // slack, teams or generic (the alert as json), defaults to generic
+}
+
+type ErrorRateAlert struct {
+	Threshold   float64       `yaml:"threshold" mapstructure:"threshold"`       // share of 429, 5xx and failed upstream calls, 0 disables the alert
+	Window      time.Duration `yaml:"window" mapstructure:"window"`             // defaults to 5m
+	MinRequests int           `yaml:"min_requests" mapstructure:"min_requests"` // calls needed in a window before alerting, defaults to 20
+}
+
+// Alert is the payload of generic webhooks
+type Alert struct {
+	Kind    string    `json:"kind"`
+	Subject string    `json:"subject"` // deployment, caller key id or tenant the alert is about
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+type alerter struct {
+	client *http.Client
+	mu     sync.Mutex
+	sent   map[string]time.Time
+	rates  map[string]*errorRateWindow
+}
+
+type errorRateWindow struct {
+	start  time.Time
+	total  int
+	errors int
+}
+
+var alerts = &alerter{
+	client: &http.Client{Timeout: 10 * time.Second},
+	sent:   map[string]time.Time{},
+	rates:  map[string]*errorRateWindow{},
+}
+
+// sendAlert posts the alert to all webhooks in the background, repeated alerts are held back for the cooldown
+func sendAlert(kind, subject, format string, args ...interface{}) {
+	cfg := C.Alerts
+	if len(cfg.Webhooks) == 0 {
+		return
+	}
+	cooldown := cfg.Cooldown
+	if cooldown <= 0 {
+		cooldown = 10 * time.Minute
+	}
+
+	alert := Alert{Kind: kind, Subject: subject, Message: fmt.Sprintf(format, args...), Time: time.Now().UTC()}
+	key := kind + "/" + subject
+	alerts.mu.Lock()
+	if last, ok := alerts.sent[key]; ok && alert.Time.Sub(last) < cooldown {
+		alerts.mu.Unlock()
+		return
+	}
+	alerts.sent[key] = alert.Time
+	alerts.mu.Unlock()
+
+	util.Warnf("alert %s for %s: %s", kind, subject, alert.Message)
+	for _, webhook := range cfg.Webhooks {
+		go alerts.post(webhook, alert)
+	}
+}
+
+func (a *alerter) post(webhook WebhookConfig, alert Alert) {
+	var payload interface{} = alert
+	switch webhook.Format {
+	case "slack", "teams":
+		payload = map[string]string{"text": fmt.Sprintf("[azure-openai-proxy] %s %s: %s", alert.Kind, alert.Subject, alert.Message)}
+	}
+	body, _ := util.JSONMarshal(payload)
+	resp, err := a.client.Post(webhook.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("send alert to webhook error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		log.Printf("send alert to webhook error: status %d", resp.StatusCode)
+	}
+}
+
+// observeErrorRate counts an upstream call of deployment and alerts when the window's error rate crosses the threshold
+func observeErrorRate(deployment string, failed bool) {
+	cfg := C.Alerts.ErrorRate
+	if cfg.Threshold <= 0 || len(C.Alerts.Webhooks) == 0 {
+		return
+	}
+	window, minRequests := cfg.Window, cfg.MinRequests
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	if minRequests <= 0 {
+		minRequests = 20
+	}
+
+	now := time.Now()
+	alerts.mu.Lock()
+	w := alerts.rates[deployment]
+	if w == nil || now.Sub(w.start) > window {
+		w = &errorRateWindow{start: now}
+		alerts.rates[deployment] = w
+	}
+	w.total++
+	if failed {
+		w.errors++
+	}
+	rate, total := float64(w.errors)/float64(w.total), w.total
+	alerts.mu.Unlock()
+
+	if total >= minRequests && rate >= cfg.Threshold {
+		sendAlert(AlertErrorRate, deployment, "%.0f%% of %d upstream calls failed in the last %s", rate*100, total, window)
+	}
+}
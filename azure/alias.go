@@ -0,0 +1,30 @@
+package azure
+
+// ModelAlias routes requests for a model to the deployment of another one
+type ModelAlias struct {
+	From string `yaml:"from" mapstructure:"from"` // model requested by clients
+	To   string `yaml:"to" mapstructure:"to"`     // model the request is served by
+}
+
+// resolveModelAlias returns the model an aliased model is served by
+func resolveModelAlias(model string) (string, bool) {
+	for _, alias := range C.ModelAliases {
+		if alias.From == model {
+			return alias.To, true
+		}
+	}
+	return model, false
+}
+
+// restoreModelName reports the requested model name in responses instead of the one it was aliased to,
+// it returns false for a body whose model is already the requested one, stream events are always kept
+func restoreModelName(model string) responseRewriter {
+	return func(payload map[string]interface{}, stream bool) bool {
+		current, ok := payload["model"]
+		if !ok || current == model {
+			return stream
+		}
+		payload["model"] = model
+		return true
+	}
+}
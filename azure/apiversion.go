@@ -0,0 +1,60 @@
+package azure
+
+import "net/http"
+
+// ApiVersionHeader lets clients override the api-version of the deployment for a single request
+const ApiVersionHeader = "X-Api-Version"
+
+const (
+	// DataSourcesApiVersion is the first api-version accepting data_sources on chat completions
+	DataSourcesApiVersion = "2024-02-01"
+	// StructuredOutputsApiVersion is the first api-version accepting response_format json_schema
+	StructuredOutputsApiVersion = "2024-08-01-preview"
+)
+
+// apiVersionAtLeast reports whether api-version v is not older than min, versions are compared by date
+func apiVersionAtLeast(v, min string) bool {
+	return apiVersionDate(v) >= apiVersionDate(min)
+}
+
+// apiVersionDate returns the date part of an api-version like 2024-02-15-preview
+func apiVersionDate(v string) string {
+	if len(v) > 10 {
+		return v[:10]
+	}
+	return v
+}
+
+// ensureApiVersion raises the deployment api-version to min if it is older,
+// deployments with a pinned api-version get an error naming the feature instead
+func ensureApiVersion(deployment *DeploymentConfig, min, feature string) error {
+	if deployment.openAICompatible() {
+		// azure openai api-versions don't apply to other servers
+		return nil
+	}
+	if apiVersionAtLeast(deployment.ApiVersion, min) {
+		return nil
+	}
+	if deployment.PinApiVersion {
+		return newRequestError("", "%s requires api-version %s or later, deployment %s is pinned to %s",
+			feature, min, deployment.DeploymentName, deployment.ApiVersion)
+	}
+	deployment.ApiVersion = min
+	return nil
+}
+
+// overrideApiVersion applies the api-version requested in the X-Api-Version header when api_version_overrides allows it,
+// the deployment is pinned to it for this request so features never raise it silently
+func overrideApiVersion(req *http.Request, deployment *DeploymentConfig) error {
+	version := req.Header.Get(ApiVersionHeader)
+	if version == "" {
+		return nil
+	}
+	req.Header.Del(ApiVersionHeader)
+	if !containsString(C.ApiVersionOverrides, "*") && !containsString(C.ApiVersionOverrides, version) {
+		return newRequestError(ApiVersionHeader, "api-version %s is not allowed in %s", version, ApiVersionHeader)
+	}
+	deployment.ApiVersion = version
+	deployment.PinApiVersion = true
+	return nil
+}
@@ -0,0 +1,248 @@
+package azure
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+const (
+	defaultIngestionEndpoint = "https://dc.services.visualstudio.com"
+	// maxAppInsightsBuffer drops telemetry instead of growing without bound while the ingestion endpoint is down
+	maxAppInsightsBuffer = 10000
+)
+
+type AppInsightsConfig struct {
+	ConnectionString string        `yaml:"connection_string" mapstructure:"connection_string"` // APPLICATIONINSIGHTS_CONNECTION_STRING is used when empty
+	RoleName         string        `yaml:"role_name" mapstructure:"role_name"`                 // cloud role shown in the application map, defaults to azure-openai-proxy
+	FlushInterval    time.Duration `yaml:"flush_interval" mapstructure:"flush_interval"`       // defaults to 10s
+}
+
+// appInsightsExporter ships request telemetry and token metrics to the Application Insights track api
+type appInsightsExporter struct {
+	iKey     string
+	endpoint string
+	roleName string
+	client   *http.Client
+
+	mu        sync.Mutex
+	envelopes []appInsightsEnvelope
+}
+
+type appInsightsEnvelope struct {
+	Name string            `json:"name"`
+	Time string            `json:"time"`
+	IKey string            `json:"iKey"`
+	Tags map[string]string `json:"tags,omitempty"`
+	Data appInsightsData   `json:"data"`
+}
+
+type appInsightsData struct {
+	BaseType string      `json:"baseType"`
+	BaseData interface{} `json:"baseData"`
+}
+
+type appInsightsRequest struct {
+	Ver          int                `json:"ver"`
+	Id           string             `json:"id"`
+	Name         string             `json:"name"`
+	Duration     string             `json:"duration"`
+	ResponseCode string             `json:"responseCode"`
+	Success      bool               `json:"success"`
+	Url          string             `json:"url,omitempty"`
+	Properties   map[string]string  `json:"properties,omitempty"`
+	Measurements map[string]float64 `json:"measurements,omitempty"`
+}
+
+type appInsightsMetric struct {
+	Ver        int                    `json:"ver"`
+	Metrics    []appInsightsDataPoint `json:"metrics"`
+	Properties map[string]string      `json:"properties,omitempty"`
+}
+
+type appInsightsDataPoint struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	Count int     `json:"count"`
+}
+
+var appInsights *appInsightsExporter
+
+// initAppInsights starts the exporter when a connection string is configured
+func initAppInsights(cfg AppInsightsConfig) error {
+	connectionString := cfg.ConnectionString
+	if connectionString == "" {
+		connectionString = os.Getenv("APPLICATIONINSIGHTS_CONNECTION_STRING")
+	}
+	if connectionString == "" {
+		return nil
+	}
+
+	exporter, err := newAppInsightsExporter(connectionString, cfg.RoleName)
+	if err != nil {
+		return err
+	}
+	interval := cfg.FlushInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	go func() {
+		for range time.Tick(interval) {
+			exporter.flush()
+		}
+	}()
+	appInsights = exporter
+	log.Printf("exporting telemetry to application insights at %s", exporter.endpoint)
+	return nil
+}
+
+// newAppInsightsExporter parses a connection string like InstrumentationKey=...;IngestionEndpoint=https://...
+func newAppInsightsExporter(connectionString, roleName string) (*appInsightsExporter, error) {
+	exporter := &appInsightsExporter{
+		endpoint: defaultIngestionEndpoint,
+		roleName: roleName,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, part := range strings.Split(connectionString, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "instrumentationkey":
+			exporter.iKey = value
+		case "ingestionendpoint":
+			exporter.endpoint = strings.TrimSuffix(value, "/")
+		}
+	}
+	if exporter.iKey == "" {
+		return nil, errors.New("application insights connection string has no InstrumentationKey")
+	}
+	if exporter.roleName == "" {
+		exporter.roleName = "azure-openai-proxy"
+	}
+	return exporter, nil
+}
+
+// trackRequest queues the request telemetry of l and its token usage as custom metrics
+func (e *appInsightsExporter) trackRequest(l *accessLog, status int, duration time.Duration) {
+	properties := map[string]string{
+		"model":      l.model,
+		"deployment": l.deployment,
+		"key_id":     l.keyID,
+	}
+	if l.tenant != nil {
+		properties["tenant"] = l.tenant.id
+	}
+	measurements := map[string]float64{}
+	var metrics []appInsightsDataPoint
+	if l.rc != nil {
+		properties["stream"] = strconv.FormatBool(l.rc.stream)
+		if l.rc.usage != nil {
+			measurements["prompt_tokens"] = float64(l.rc.usage.PromptTokens)
+			measurements["completion_tokens"] = float64(l.rc.usage.CompletionTokens)
+			metrics = []appInsightsDataPoint{
+				{Name: "prompt_tokens", Value: float64(l.rc.usage.PromptTokens), Count: 1},
+				{Name: "completion_tokens", Value: float64(l.rc.usage.CompletionTokens), Count: 1},
+			}
+		}
+	}
+
+	tags := map[string]string{"ai.cloud.role": e.roleName}
+	if l.traceID != "" {
+		tags["ai.operation.id"] = l.traceID
+	}
+	now := l.start.UTC().Format(time.RFC3339Nano)
+	envelopes := []appInsightsEnvelope{{
+		Name: "Microsoft.ApplicationInsights.Request",
+		Time: now,
+		IKey: e.iKey,
+		Tags: tags,
+		Data: appInsightsData{BaseType: "RequestData", BaseData: appInsightsRequest{
+			Ver:          2,
+			Id:           l.requestID,
+			Name:         l.method + " " + l.path,
+			Duration:     formatAppInsightsDuration(duration),
+			ResponseCode: strconv.Itoa(status),
+			Success:      status < http.StatusBadRequest,
+			Url:          l.path,
+			Properties:   properties,
+			Measurements: measurements,
+		}},
+	}}
+	if len(metrics) > 0 {
+		envelopes = append(envelopes, appInsightsEnvelope{
+			Name: "Microsoft.ApplicationInsights.Metric",
+			Time: now,
+			IKey: e.iKey,
+			Tags: tags,
+			Data: appInsightsData{BaseType: "MetricData", BaseData: appInsightsMetric{
+				Ver:        2,
+				Metrics:    metrics,
+				Properties: map[string]string{"model": l.model, "deployment": l.deployment, "key_id": l.keyID},
+			}},
+		})
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.envelopes)+len(envelopes) > maxAppInsightsBuffer {
+		return
+	}
+	e.envelopes = append(e.envelopes, envelopes...)
+}
+
+// flush posts the queued telemetry to the track endpoint, failed batches are dropped
+func (e *appInsightsExporter) flush() {
+	e.mu.Lock()
+	envelopes := e.envelopes
+	e.envelopes = nil
+	e.mu.Unlock()
+	if len(envelopes) == 0 {
+		return
+	}
+
+	body, err := util.JSONMarshal(envelopes)
+	if err != nil {
+		log.Printf("encode application insights telemetry error: %v", err)
+		return
+	}
+	resp, err := e.client.Post(e.endpoint+"/v2/track", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("send %d application insights items error: %v", len(envelopes), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("send %d application insights items error: status %d", len(envelopes), resp.StatusCode)
+	}
+}
+
+// FlushAppInsights sends the telemetry not yet exported, used on shutdown
+func FlushAppInsights() {
+	if appInsights != nil {
+		appInsights.flush()
+	}
+}
+
+// formatAppInsightsDuration formats d as d.hh:mm:ss.ffffff
+func formatAppInsightsDuration(d time.Duration) string {
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	minutes := d / time.Minute
+	d -= minutes * time.Minute
+	seconds := d / time.Second
+	d -= seconds * time.Second
+	return fmt.Sprintf("%d.%02d:%02d:%02d.%06d", days, hours, minutes, seconds, d/time.Microsecond)
+}
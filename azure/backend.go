@@ -0,0 +1,181 @@
+package azure
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// backend types of deployments, also the values of the X-Proxy-Backend response header
+	BackendAzure            = "azure"
+	BackendOpenAI           = "openai"
+	BackendOpenAICompatible = "openai-compatible"
+	BackendServerless       = "serverless"
+	BackendInference        = "inference"
+	BackendOllama           = "ollama"
+
+	// defaultOllamaEndpoint is the openai api of a local ollama server
+	defaultOllamaEndpoint = "http://localhost:11434/v1"
+
+	// ExtraParametersHeader tells the azure ai model inference api what to do with parameters it does not know
+	ExtraParametersHeader = "extra-parameters"
+
+	// serverlessHostSuffix is the host of azure ai foundry serverless (models as a service) endpoints
+	serverlessHostSuffix = ".models.ai.azure.com"
+)
+
+// backendType returns the type of the deployment, endpoints on models.ai.azure.com are serverless when not set
+func (config *DeploymentConfig) backendType() string {
+	if config.Type != "" {
+		return config.Type
+	}
+	if config.EndpointUrl != nil && strings.HasSuffix(config.EndpointUrl.Hostname(), serverlessHostSuffix) {
+		return BackendServerless
+	}
+	return BackendAzure
+}
+
+// openAICompatible tells whether the deployment speaks the openai api instead of the azure openai deployment api:
+// openai-compatible servers (vLLM, TGI, ...), azure ai foundry serverless endpoints and the azure ai model
+// inference api, they are called at the endpoint followed by the route, e.g. /chat/completions
+func (config *DeploymentConfig) openAICompatible() bool {
+	switch config.backendType() {
+	case BackendOpenAICompatible, BackendServerless, BackendInference, BackendOllama:
+		return true
+	}
+	return false
+}
+
+// optionalAuth tells whether the deployment may be called without a key, local ollama or llama.cpp servers
+// never get one, not even the key of the client
+func (config *DeploymentConfig) optionalAuth() bool {
+	switch config.backendType() {
+	case BackendOpenAICompatible, BackendOllama:
+		return true
+	}
+	return false
+}
+
+// bearerAuth tells whether the key goes upstream as a bearer token by default instead of an api-key header
+func (config *DeploymentConfig) bearerAuth() bool {
+	switch config.backendType() {
+	case BackendOpenAICompatible, BackendServerless:
+		return true
+	}
+	return false
+}
+
+// initBackend validates the type of the deployment and fills in its defaults, it runs before the endpoint is parsed
+func initBackend(deployment *DeploymentConfig) error {
+	switch deployment.Type {
+	case "", BackendAzure, BackendOpenAICompatible, BackendServerless, BackendInference:
+	case BackendOllama:
+		if deployment.Endpoint == "" {
+			deployment.Endpoint = defaultOllamaEndpoint
+		}
+	default:
+		return errors.Errorf("deployment %s: invalid type %q, use azure, openai-compatible, serverless, inference or ollama", deployment.DeploymentName, deployment.Type)
+	}
+	switch deployment.ExtraParameters {
+	case "", "pass-through", "drop", "error":
+	default:
+		return errors.Errorf("deployment %s: invalid extra_parameters %q, use pass-through, drop or error", deployment.DeploymentName, deployment.ExtraParameters)
+	}
+	return nil
+}
+
+// deploymentRoute returns the route of an azure deployment path, e.g. /chat/completions
+// of /openai/deployments/gpt4/chat/completions
+func deploymentRoute(path string, config *DeploymentConfig) (string, bool) {
+	prefix := "/openai/deployments/" + config.DeploymentName
+	if !strings.HasPrefix(path, prefix+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(path, prefix), true
+}
+
+// convertOpenAICompatible moves a request converted for azure onto the endpoint of an openai-compatible deployment
+func convertOpenAICompatible(req *http.Request, config *DeploymentConfig) (*http.Request, error) {
+	route, ok := deploymentRoute(req.URL.Path, config)
+	if !ok {
+		return req, errors.Errorf("no openai-compatible route for %s", req.URL.Path)
+	}
+	base := strings.TrimSuffix(config.EndpointUrl.Path, "/")
+	if config.backendType() == BackendInference {
+		// the unified endpoint of azure ai services resources, the deployment is picked by the model field
+		base += "/models"
+	}
+	req.URL.Path = base + route
+	req.URL.RawPath = req.URL.EscapedPath()
+	switch config.backendType() {
+	case BackendServerless, BackendInference:
+		// the azure ai model inference api takes an api-version of its own, e.g. 2024-05-01-preview
+		if config.ApiVersion != "" {
+			query := req.URL.Query()
+			query.Set("api-version", config.ApiVersion)
+			req.URL.RawQuery = query.Encode()
+		}
+		if config.ExtraParameters != "" {
+			req.Header.Set(ExtraParametersHeader, config.ExtraParameters)
+		}
+	}
+	setDeploymentHeaders(req, config)
+	return req, nil
+}
+
+// deploymentModelsURL is where the models of a deployment are listed, the azure deployments of the resource
+// or the models served by an openai-compatible server
+func deploymentModelsURL(config *DeploymentConfig) string {
+	switch config.backendType() {
+	case BackendServerless:
+		// serverless endpoints serve a single model and describe it at /info
+		return strings.TrimSuffix(config.Endpoint, "/") + "/info?api-version=" + config.ApiVersion
+	case BackendInference:
+		return strings.TrimSuffix(config.Endpoint, "/") + "/models/info?api-version=" + config.ApiVersion
+	}
+	if config.openAICompatible() {
+		return strings.TrimSuffix(config.Endpoint, "/") + "/models"
+	}
+	return strings.TrimSuffix(config.Endpoint, "/") + "/openai/deployments?api-version=2022-12-01"
+}
+
+// rewriteCompatibleModel sends the deployment name as model to openai-compatible and model inference deployments,
+// it is the name the server knows the model by, serverless endpoints ignore the model
+func rewriteCompatibleModel(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	switch rc.deployment.backendType() {
+	case BackendOpenAICompatible, BackendInference, BackendOllama:
+	default:
+		return false, nil
+	}
+	if model, _ := payload["model"].(string); model == rc.deployment.DeploymentName {
+		return false, nil
+	}
+	payload["model"] = rc.deployment.DeploymentName
+	return true, nil
+}
+
+// rewriteOllama translates the parts of the openai schema local ollama and llama.cpp servers don't understand:
+// max_completion_tokens becomes max_tokens and developer messages become system messages
+func rewriteOllama(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if rc.deployment.backendType() != BackendOllama {
+		return false, nil
+	}
+	changed := false
+	if maxTokens, ok := payload["max_completion_tokens"]; ok {
+		if _, ok := payload["max_tokens"]; !ok {
+			payload["max_tokens"] = maxTokens
+		}
+		delete(payload, "max_completion_tokens")
+		changed = true
+	}
+	messages, _ := payload["messages"].([]interface{})
+	for _, item := range messages {
+		if message, ok := item.(map[string]interface{}); ok && message["role"] == "developer" {
+			message["role"] = "system"
+			changed = true
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,189 @@
+package azure
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// RequestError is returned by body rewriters when the request can not be forwarded as is
+type RequestError struct {
+	Param   string
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+func newRequestError(param, format string, args ...interface{}) *RequestError {
+	return &RequestError{Param: param, Message: fmt.Sprintf(format, args...)}
+}
+
+// rewriteContext carries the per request state shared by request and response rewriters
+type rewriteContext struct {
+	req               *http.Request
+	deployment        *DeploymentConfig
+	stream            bool
+	start             time.Time
+	firstByte         time.Time // upstream response headers received
+	firstToken        time.Time // first generated token of a chat stream
+	requestID         string
+	keyID             string
+	tenant            *tenant // nil for untagged requests
+	responseRewriters []responseRewriter
+	streamEndHooks    []streamEndHook
+	streamCutHooks    []streamEndHook
+	warnings          []string
+	usage             *Usage
+	// usageEstimated is set when usage was estimated locally from promptEstimate and completionEstimate, see
+	// rewriteUsageEstimate
+	usageEstimated     bool
+	promptEstimate     int64
+	completionEstimate int64
+	// synthesizeStream re-emits a blocking upstream response as SSE, see rewriteSynthesizeStream
+	synthesizeStream   bool
+	streamIncludeUsage bool
+	// debug logs the debug messages of this request whatever the log level, see DebugHeader
+	debug bool
+}
+
+// addResponseRewriter registers a rewriter applied to the upstream response of this request
+func (rc *rewriteContext) addResponseRewriter(rewriter responseRewriter) {
+	rc.responseRewriters = append(rc.responseRewriters, rewriter)
+}
+
+// addStreamEndHook registers a hook emitting extra events at the end of a streamed response
+func (rc *rewriteContext) addStreamEndHook(hook streamEndHook) {
+	rc.streamEndHooks = append(rc.streamEndHooks, hook)
+}
+
+// addStreamCutHook registers a hook emitting the final events of a stream that upstream ended without [DONE],
+// registering one makes sure such streams are terminated with [DONE]
+func (rc *rewriteContext) addStreamCutHook(hook streamEndHook) {
+	rc.streamCutHooks = append(rc.streamCutHooks, hook)
+}
+
+// addWarning records a warning returned to the client in the X-Proxy-Warning header
+func (rc *rewriteContext) addWarning(warning string) {
+	rc.warnings = append(rc.warnings, warning)
+}
+
+// bodyRewriter mutates the decoded request body for the target deployment and reports whether it changed
+type bodyRewriter func(rc *rewriteContext, payload map[string]interface{}) (bool, error)
+
+var bodyRewriters = []bodyRewriter{
+	rewriteTemplate,
+	rewriteValidate,
+	rewriteScrubPII,
+	rewriteStreamTermination,
+	rewriteStripAzureFields,
+	rewriteDataSources,
+	rewriteSystemPrompt,
+	rewriteSamplingPolicy,
+	rewriteInjectUser,
+	rewriteResponseFormat,
+	rewriteTools,
+	rewriteVision,
+	rewriteTruncate,
+	rewriteEmbeddings,
+	rewriteReasoning,
+	rewriteSynthesizeStream,
+	rewriteStreamUsage,
+	rewriteStreamMetrics,
+	rewriteUsageEstimate,
+	rewriteCompletionHooks,
+	rewriteMutators,
+	rewriteCompatibleModel,
+	rewriteOllama,
+}
+
+// rewriteBody applies all body rewriters to a json request body, non-json bodies are returned untouched
+func rewriteBody(rc *rewriteContext, body []byte) ([]byte, error) {
+	if len(bytes.TrimSpace(body)) == 0 || bytes.TrimSpace(body)[0] != '{' {
+		return body, nil
+	}
+
+	payload, err := decodeJSON(body)
+	if err != nil {
+		return body, nil
+	}
+
+	rc.stream = payload["stream"] == true
+	changed := false
+	for _, rewriter := range bodyRewriters {
+		var before map[string]string
+		if rc.debug {
+			before = payloadSnapshot(payload)
+		}
+		c, err := rewriter(rc, payload)
+		if err != nil {
+			return nil, err
+		}
+		if c && rc.debug {
+			rc.debugf("%s: %s", rewriterName(rewriter), payloadChanges(before, payload))
+		}
+		changed = changed || c
+	}
+	if !changed {
+		return body, nil
+	}
+	return util.JSONMarshal(payload)
+}
+
+// decodeJSON decodes a json object keeping numbers as json.Number so they are re-encoded unchanged
+func decodeJSON(data []byte) (map[string]interface{}, error) {
+	var payload map[string]interface{}
+	decoder := util.NewJSONDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func isChatCompletions(req *http.Request) bool {
+	return strings.HasSuffix(req.URL.Path, "/chat/completions")
+}
+
+// rewriteDataSources handles the Azure "On Your Data" extension, data_sources is passed through untouched
+// and the deployment default is injected when the client did not send one
+func rewriteDataSources(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if !isChatCompletions(rc.req) {
+		return false, nil
+	}
+	// on your data is an azure only feature, the openai api of the other backends rejects it
+	if rc.deployment.openAICompatible() {
+		_, ok := payload["data_sources"]
+		delete(payload, "data_sources")
+		return ok, nil
+	}
+
+	changed := false
+	if _, ok := payload["data_sources"]; !ok && len(rc.deployment.DataSources) > 0 {
+		payload["data_sources"] = rc.deployment.DataSources
+		changed = true
+	}
+	if _, ok := payload["data_sources"]; ok {
+		if err := ensureApiVersion(rc.deployment, DataSourcesApiVersion, "data_sources"); err != nil {
+			return false, err
+		}
+	}
+	return changed, nil
+}
+
+// rewriteResponseFormat selects an api-version supporting structured outputs, the body is forwarded untouched
+func rewriteResponseFormat(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	responseFormat, ok := payload["response_format"].(map[string]interface{})
+	if !ok || responseFormat["type"] != "json_schema" {
+		return false, nil
+	}
+	if _, ok := responseFormat["json_schema"].(map[string]interface{}); !ok {
+		return false, newRequestError("response_format.json_schema", "response_format.json_schema must be an object when type is json_schema")
+	}
+	return false, ensureApiVersion(rc.deployment, StructuredOutputsApiVersion, "response_format json_schema")
+}
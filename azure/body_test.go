@@ -0,0 +1,605 @@
+package azure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+func TestRewriteDataSources(t *testing.T) {
+	deployment := &DeploymentConfig{
+		ApiVersion:  "2023-07-01-preview",
+		DataSources: []map[string]interface{}{{"type": "azure_search"}},
+	}
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+	body, err := rewriteBody(&rewriteContext{req: req, deployment: deployment}, []byte(`{"model":"gpt-4","messages":[]}`))
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `"data_sources":[{"type":"azure_search"}]`)
+	assert.Equal(t, DataSourcesApiVersion, deployment.ApiVersion)
+
+	req = httptest.NewRequest("POST", "/v1/embeddings", nil)
+	body, err = rewriteBody(&rewriteContext{req: req, deployment: deployment}, []byte(`{"model":"ada","input":"hi"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"model":"ada","input":"hi"}`, string(body))
+}
+
+func TestRewriteResponseFormat(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	body := []byte(`{"model":"gpt-4o","response_format":{"type":"json_schema","json_schema":{"name":"x","schema":{}}}}`)
+
+	deployment := &DeploymentConfig{ApiVersion: "2024-02-01"}
+	_, err := rewriteBody(&rewriteContext{req: req, deployment: deployment}, body)
+	assert.NoError(t, err)
+	assert.Equal(t, StructuredOutputsApiVersion, deployment.ApiVersion)
+
+	deployment = &DeploymentConfig{ApiVersion: "2024-02-01", PinApiVersion: true}
+	_, err = rewriteBody(&rewriteContext{req: req, deployment: deployment}, body)
+	var reqErr *RequestError
+	assert.ErrorAs(t, err, &reqErr)
+}
+
+func TestRewriteTools(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	body := []byte(`{"model":"gpt-4","tools":[{"type":"function","function":{"name":"get_weather"}}],"tool_choice":"auto",` +
+		`"messages":[{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{}"}}]},` +
+		`{"role":"tool","tool_call_id":"call_1","content":"sunny"}]}`)
+
+	rc := &rewriteContext{req: req, deployment: &DeploymentConfig{ApiVersion: "2023-07-01-preview"}}
+	body, err := rewriteBody(rc, body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `"functions":[{"name":"get_weather"}]`)
+	assert.Contains(t, string(body), `"function_call":"auto"`)
+	assert.Contains(t, string(body), `{"content":"sunny","name":"get_weather","role":"function"}`)
+	assert.NotContains(t, string(body), `"tools"`)
+	assert.Len(t, rc.responseRewriters, 1)
+
+	payload := map[string]interface{}{"choices": []interface{}{map[string]interface{}{
+		"finish_reason": "function_call",
+		"message":       map[string]interface{}{"function_call": map[string]interface{}{"name": "get_weather"}},
+	}}}
+	assert.True(t, rc.responseRewriters[0](payload, false))
+	choice := payload["choices"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "tool_calls", choice["finish_reason"])
+	assert.Contains(t, choice["message"], "tool_calls")
+
+	// every choice of n>1 gets its own call id, the chunks of a streamed choice keep theirs
+	toolCallId := func(message interface{}) interface{} {
+		return message.(map[string]interface{})["tool_calls"].([]interface{})[0].(map[string]interface{})["id"]
+	}
+	callIdOf := func(choice interface{}, key string) interface{} {
+		return toolCallId(choice.(map[string]interface{})[key])
+	}
+	rewriter := newFunctionsToToolsRewriter()
+	payload = map[string]interface{}{"choices": []interface{}{
+		map[string]interface{}{"index": json.Number("0"), "message": map[string]interface{}{"function_call": map[string]interface{}{"name": "get_weather"}}},
+		map[string]interface{}{"index": json.Number("1"), "message": map[string]interface{}{"function_call": map[string]interface{}{"name": "get_weather"}}},
+	}}
+	assert.True(t, rewriter(payload, false))
+	choices := payload["choices"].([]interface{})
+	assert.NotEqual(t, callIdOf(choices[0], "message"), callIdOf(choices[1], "message"))
+
+	rewriter = newFunctionsToToolsRewriter()
+	chunk := func(index, name string) []interface{} {
+		functionCall := map[string]interface{}{"arguments": "{}"}
+		if name != "" {
+			functionCall["name"] = name
+		}
+		payload := map[string]interface{}{"choices": []interface{}{
+			map[string]interface{}{"index": json.Number(index), "delta": map[string]interface{}{"function_call": functionCall}},
+		}}
+		assert.True(t, rewriter(payload, true))
+		return payload["choices"].([]interface{})
+	}
+	first, second := callIdOf(chunk("0", "get_weather")[0], "delta"), callIdOf(chunk("1", "get_weather")[0], "delta")
+	assert.NotEqual(t, first, second)
+	assert.NotContains(t, chunk("0", "")[0].(map[string]interface{})["delta"].(map[string]interface{})["tool_calls"].([]interface{})[0], "id")
+
+	// two calls to the same function get their own ids, each result answers its call
+	rc = &rewriteContext{req: req, deployment: &DeploymentConfig{ApiVersion: ToolsApiVersion}}
+	body, err = rewriteBody(rc, []byte(`{"model":"gpt-4","functions":[{"name":"get_weather"}],"messages":[`+
+		`{"role":"assistant","function_call":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}},{"role":"function","name":"get_weather","content":"sunny"},`+
+		`{"role":"assistant","function_call":{"name":"get_weather","arguments":"{\"city\":\"Oslo\"}"}},{"role":"function","name":"get_weather","content":"rainy"}]}`))
+	assert.NoError(t, err)
+	request, err := decodeJSON(body)
+	assert.NoError(t, err)
+	messages := request["messages"].([]interface{})
+	firstCall, secondCall := toolCallId(messages[0]), toolCallId(messages[2])
+	assert.NotEqual(t, firstCall, secondCall)
+	assert.Equal(t, firstCall, messages[1].(map[string]interface{})["tool_call_id"])
+	assert.Equal(t, secondCall, messages[3].(map[string]interface{})["tool_call_id"])
+}
+
+func TestSplitEmbeddingsInput(t *testing.T) {
+	bodies, err := splitEmbeddingsInput([]byte(`{"model":"ada","input":["a","b","c"]}`), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`{"input":["a","b"],"model":"ada"}`, `{"input":["c"],"model":"ada"}`},
+		[]string{string(bodies[0]), string(bodies[1])})
+
+	bodies, err = splitEmbeddingsInput([]byte(`{"model":"ada","input":[1,2,3]}`), 2)
+	assert.NoError(t, err)
+	assert.Nil(t, bodies)
+
+	merged, err := mergeEmbeddingsResponses([][]byte{
+		[]byte(`{"object":"list","data":[{"index":0,"embedding":[0.1]},{"index":1,"embedding":[0.2]}],"usage":{"prompt_tokens":2,"total_tokens":2}}`),
+		[]byte(`{"object":"list","data":[{"index":0,"embedding":[0.3]}],"usage":{"prompt_tokens":1,"total_tokens":1}}`),
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"object":"list","data":[{"index":0,"embedding":[0.1]},{"index":1,"embedding":[0.2]},{"index":2,"embedding":[0.3]}],`+
+		`"usage":{"prompt_tokens":3,"total_tokens":3}}`, string(merged))
+
+	_, err = mergeEmbeddingsResponses([][]byte{[]byte(`{"object":"list","data":[{"index":"0","embedding":[0.1]}]}`)})
+	assert.Error(t, err)
+
+	payload := map[string]interface{}{"data": []interface{}{
+		map[string]interface{}{"embedding": []interface{}{json.Number("1")}},
+		map[string]interface{}{"embedding": []interface{}{"x"}},
+	}}
+	assert.True(t, embeddingsToBase64(payload, false))
+	assert.Equal(t, "AACAPw==", payload["data"].([]interface{})[0].(map[string]interface{})["embedding"])
+	assert.Equal(t, []interface{}{"x"}, payload["data"].([]interface{})[1].(map[string]interface{})["embedding"])
+}
+
+func TestRewriteEmbeddings(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v1/embeddings", nil)
+	rewrite := func(deployment *DeploymentConfig, body string) (*rewriteContext, map[string]interface{}, bool, error) {
+		rc := &rewriteContext{req: req, deployment: deployment}
+		payload, err := decodeJSON([]byte(body))
+		assert.NoError(t, err)
+		changed, err := rewriteEmbeddings(rc, payload)
+		return rc, payload, changed, err
+	}
+
+	// an old api-version is raised for dimensions, float encoding needs nothing
+	deployment := &DeploymentConfig{DeploymentName: "ada", ApiVersion: "2023-05-15"}
+	_, _, changed, err := rewrite(deployment, `{"input":"hi","encoding_format":"float"}`)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, "2023-05-15", deployment.ApiVersion)
+	_, payload, changed, err := rewrite(deployment, `{"input":"hi","dimensions":256}`)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, EmbeddingsParamsApiVersion, deployment.ApiVersion)
+	assert.Contains(t, payload, "dimensions")
+
+	// a pinned deployment rejects the parameter
+	_, _, _, err = rewrite(&DeploymentConfig{DeploymentName: "ada", ApiVersion: "2023-05-15", PinApiVersion: true}, `{"input":"hi","dimensions":256}`)
+	var reqErr *RequestError
+	if assert.ErrorAs(t, err, &reqErr) {
+		assert.Equal(t, "dimensions", reqErr.Param)
+	}
+
+	// or strips it with a warning, base64 is then encoded by the proxy
+	pinned := &DeploymentConfig{DeploymentName: "ada", ApiVersion: "2023-05-15", PinApiVersion: true, StripUnsupportedParams: true}
+	rc, payload, changed, err := rewrite(pinned, `{"input":"hi","dimensions":256,"encoding_format":"base64"}`)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.NotContains(t, payload, "dimensions")
+	assert.NotContains(t, payload, "encoding_format")
+	assert.Len(t, rc.warnings, 2)
+	if assert.Len(t, rc.responseRewriters, 1) {
+		response := map[string]interface{}{"data": []interface{}{
+			map[string]interface{}{"embedding": []interface{}{json.Number("0.5"), json.Number("-2")}},
+		}}
+		assert.True(t, rc.responseRewriters[0](response, false))
+		encoded := response["data"].([]interface{})[0].(map[string]interface{})["embedding"].(string)
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		assert.NoError(t, err)
+		if assert.Len(t, raw, 8) {
+			assert.Equal(t, float32(0.5), math.Float32frombits(binary.LittleEndian.Uint32(raw)))
+			assert.Equal(t, float32(-2), math.Float32frombits(binary.LittleEndian.Uint32(raw[4:])))
+		}
+	}
+
+	// a recent api-version is left alone
+	_, payload, changed, err = rewrite(&DeploymentConfig{ApiVersion: "2024-10-21", PinApiVersion: true}, `{"input":"hi","dimensions":256}`)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Contains(t, payload, "dimensions")
+}
+
+func TestRequestCost(t *testing.T) {
+	C.Pricing = []ModelPrice{{Model: "gpt-3.5-turbo", Input: 0.5, Output: 1.5}}
+	defer func() { C.Pricing = nil }()
+
+	assert.InDelta(t, 2.0, requestCostOf("gpt-3.5-turbo", 1000, 1000), 1e-9)
+	assert.Zero(t, requestCostOf("gpt-4", 1000, 1000))
+}
+
+func TestSystemPrompt(t *testing.T) {
+	C.SystemPrompts = []SystemPromptConfig{
+		{PolicyMatch: PolicyMatch{Keys: []string{"k1"}}, Content: "guardrails", Mode: SystemPromptEnforce},
+		{PolicyMatch: PolicyMatch{Tenants: []string{"acme"}}, Content: "acme"},
+		{Content: "default"},
+	}
+	defer func() { C.SystemPrompts = nil }()
+
+	var caller *tenant
+	rewrite := func(keyID string) string {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		rc := &rewriteContext{req: req, deployment: &DeploymentConfig{ModelName: "gpt-4"}, keyID: keyID, tenant: caller}
+		body, err := rewriteBody(rc, []byte(`{"messages":[{"role":"system","content":"client"},{"role":"user","content":"hi"}]}`))
+		assert.NoError(t, err)
+		return string(body)
+	}
+
+	assert.JSONEq(t, `{"messages":[{"role":"system","content":"guardrails"},{"role":"user","content":"hi"}]}`, rewrite("k1"))
+	assert.JSONEq(t, `{"messages":[{"role":"system","content":"default"},{"role":"system","content":"client"},{"role":"user","content":"hi"}]}`, rewrite("k2"))
+	caller = &tenant{id: "acme"}
+	assert.JSONEq(t, `{"messages":[{"role":"system","content":"acme"},{"role":"system","content":"client"},{"role":"user","content":"hi"}]}`, rewrite("k2"))
+}
+
+func TestSamplingPolicy(t *testing.T) {
+	maxTemperature, topP := 0.7, 0.9
+	C.SamplingPolicies = []SamplingPolicy{{
+		PolicyMatch: PolicyMatch{Keys: []string{"k1"}},
+		Temperature: &ParamBound{Max: &maxTemperature},
+		TopP:        &ParamBound{Set: &topP},
+	}}
+	defer func() { C.SamplingPolicies = nil }()
+
+	rewriteAt := func(path, keyID, body string) (string, []string) {
+		req := httptest.NewRequest("POST", path, nil)
+		rc := &rewriteContext{req: req, deployment: &DeploymentConfig{ModelName: "gpt-4"}, keyID: keyID}
+		out, err := rewriteBody(rc, []byte(body))
+		assert.NoError(t, err)
+		return string(out), rc.warnings
+	}
+	rewrite := func(keyID, body string) (string, []string) {
+		return rewriteAt("/v1/chat/completions", keyID, body)
+	}
+
+	body, warnings := rewrite("k1", `{"temperature":1.2}`)
+	assert.JSONEq(t, `{"temperature":0.7,"top_p":0.9}`, body)
+	assert.Equal(t, []string{"temperature changed from 1.2 to 0.7 by policy"}, warnings)
+
+	body, _ = rewrite("k1", `{"temperature":0.2,"top_p":0.9}`)
+	assert.JSONEq(t, `{"temperature":0.2,"top_p":0.9}`, body)
+
+	body, _ = rewrite("k1", `{}`)
+	assert.JSONEq(t, `{"temperature":0.7,"top_p":0.9}`, body)
+
+	body, _ = rewrite("k2", `{"temperature":1.2}`)
+	assert.JSONEq(t, `{"temperature":1.2}`, body)
+
+	// only completions take sampling parameters
+	body, _ = rewriteAt("/v1/completions", "k1", `{"prompt":"hi"}`)
+	assert.JSONEq(t, `{"prompt":"hi","temperature":0.7,"top_p":0.9}`, body)
+	body, _ = rewriteAt("/v1/images/generations", "k1", `{"prompt":"hi"}`)
+	assert.JSONEq(t, `{"prompt":"hi"}`, body)
+	body, _ = rewriteAt("/v1/audio/speech", "k1", `{"input":"hi"}`)
+	assert.JSONEq(t, `{"input":"hi"}`, body)
+}
+
+func TestInjectUser(t *testing.T) {
+	C.InjectUser = true
+	defer func() { C.InjectUser = false }()
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	rc := &rewriteContext{req: req, deployment: &DeploymentConfig{}, keyID: "1a2b3c4d"}
+	body, err := rewriteBody(rc, []byte(`{"messages":[]}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"messages":[],"user":"key-1a2b3c4d"}`, string(body))
+
+	body, err = rewriteBody(rc, []byte(`{"messages":[],"user":"alice"}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"messages":[],"user":"alice"}`, string(body))
+
+	rc.tenant = &tenant{id: "acme"}
+	body, err = rewriteBody(rc, []byte(`{"messages":[]}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"messages":[],"user":"tenant-acme/key-1a2b3c4d"}`, string(body))
+}
+
+func TestScriptPolicies(t *testing.T) {
+	assert.NoError(t, compileScriptPolicies([]ScriptPolicy{
+		{Route: "/v1/chat/completions", Reject: `len(body.messages) > 1`, Message: "too many messages"},
+		{When: `key_id == "k1"`, Model: `model + "-mini"`, Headers: map[string]string{"x-team": `"blue"`}},
+	}))
+	defer func() { scriptPolicies = nil }()
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	model, err := applyScriptPolicies(req, "/v1/chat/completions", "gpt-4o", "k1", map[string]interface{}{"messages": []interface{}{map[string]interface{}{}}})
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-4o-mini", model)
+	assert.Equal(t, "blue", req.Header.Get("X-Team"))
+
+	_, err = applyScriptPolicies(req, "/v1/chat/completions", "gpt-4o", "k2", map[string]interface{}{"messages": []interface{}{map[string]interface{}{}, map[string]interface{}{}}})
+	var reqErr *RequestError
+	assert.ErrorAs(t, err, &reqErr)
+	assert.Equal(t, "too many messages", reqErr.Message)
+
+	// a body without messages fails the reject expression at runtime, it doesn't match
+	model, err = applyScriptPolicies(req, "/v1/chat/completions", "gpt-4o", "k2", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-4o", model)
+
+	assert.Error(t, compileScriptPolicies([]ScriptPolicy{{Model: `1 +`}}))
+}
+
+func TestValidateRequests(t *testing.T) {
+	C.ValidateRequests = true
+	defer func() { C.ValidateRequests = false }()
+
+	validate := func(path, body string) error {
+		req := httptest.NewRequest("POST", path, nil)
+		_, err := rewriteBody(&rewriteContext{req: req, deployment: &DeploymentConfig{}}, []byte(body))
+		return err
+	}
+
+	assert.NoError(t, validate("/v1/chat/completions", `{"messages":[{"role":"user","content":[{"type":"text","text":"hi"}]},{"role":"assistant","content":null,"tool_calls":[]}]}`))
+	assert.NoError(t, validate("/v1/embeddings", `{"input":[[1,2],"hi"]}`))
+
+	cases := map[string][2]string{
+		"messages[2].content must be a string or array":                               {"/v1/chat/completions", `{"messages":[{"role":"user","content":"a"},{"role":"user","content":"b"},{"role":"user","content":1}]}`},
+		"messages is required and must be an array":                                   {"/v1/chat/completions", `{"prompt":"hi"}`},
+		"messages[0].tool_call_id is required for tool messages and must be a string": {"/v1/chat/completions", `{"messages":[{"role":"tool","content":"x"}]}`},
+		"temperature must be between 0 and 2, got 3":                                  {"/v1/chat/completions", `{"messages":[{"role":"user","content":"a"}],"temperature":3}`},
+		"max_tokens must be an integer":                                               {"/v1/completions", `{"prompt":"a","max_tokens":"10"}`},
+		"input must not be empty":                                                     {"/v1/embeddings", `{"input":[]}`},
+	}
+	for message, c := range cases {
+		err := validate(c[0], c[1])
+		var reqErr *RequestError
+		if assert.ErrorAs(t, err, &reqErr, message) {
+			assert.Equal(t, message, reqErr.Message)
+		}
+	}
+}
+
+func TestPromptTemplates(t *testing.T) {
+	assert.NoError(t, compilePromptTemplates([]PromptTemplate{{
+		Name:     "summarize",
+		Messages: []TemplateMessage{{Role: "system", Content: "Summarize in {{.language}}."}},
+	}}))
+	defer func() { promptTemplates = nil }()
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	rc := &rewriteContext{req: req, deployment: &DeploymentConfig{}}
+	body, err := rewriteBody(rc, []byte(`{"template":{"name":"summarize","variables":{"language":"French"}},"messages":[{"role":"user","content":"hi"}]}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"messages":[{"role":"system","content":"Summarize in French."},{"role":"user","content":"hi"}]}`, string(body))
+
+	_, err = rewriteBody(rc, []byte(`{"template":"summarize","messages":[]}`))
+	var reqErr *RequestError
+	assert.ErrorAs(t, err, &reqErr)
+	assert.Equal(t, "template.variables", reqErr.Param)
+
+	_, err = rewriteBody(rc, []byte(`{"template":"missing"}`))
+	assert.ErrorAs(t, err, &reqErr)
+	assert.Equal(t, `unknown prompt template "missing"`, reqErr.Message)
+
+	// the listing shows the compiled templates, not the config
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	TemplateListHandler(c)
+	assert.JSONEq(t, `{"object":"list","data":[{"name":"summarize","model":"","object":"prompt_template"}]}`, w.Body.String())
+
+	assert.Error(t, compilePromptTemplates([]PromptTemplate{{Name: "a"}, {Name: "a"}}))
+}
+
+func TestTruncatePrompt(t *testing.T) {
+	C.Truncation = TruncationConfig{Enabled: true}
+	defer func() { C.Truncation = TruncationConfig{} }()
+
+	long := strings.Repeat("word ", 400)
+	body := []byte(`{"max_tokens":100,"messages":[{"role":"system","content":"be brief"},` +
+		`{"role":"user","content":"` + long + `"},{"role":"assistant","content":"` + long + `"},{"role":"user","content":"last"}]}`)
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	rc := &rewriteContext{req: req, deployment: &DeploymentConfig{ModelName: "gpt-4", ContextWindow: 600}}
+	out, err := rewriteBody(rc, body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"max_tokens":100,"messages":[{"role":"system","content":"be brief"},{"role":"assistant","content":"`+long+`"},{"role":"user","content":"last"}]}`, string(out))
+	assert.Len(t, rc.warnings, 1)
+
+	C.Truncation.Strategy = TruncateDropMiddle
+	rc = &rewriteContext{req: req, deployment: &DeploymentConfig{ModelName: "gpt-4", ContextWindow: 600}}
+	out, err = rewriteBody(rc, body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"max_tokens":100,"messages":[{"role":"system","content":"be brief"},{"role":"user","content":"`+long+`"},{"role":"user","content":"last"}]}`, string(out))
+
+	rc = &rewriteContext{req: req, deployment: &DeploymentConfig{ModelName: "gpt-4", ContextWindow: 100000}}
+	out, err = rewriteBody(rc, body)
+	assert.NoError(t, err)
+	assert.Equal(t, string(body), string(out))
+}
+
+func TestDroppableUnits(t *testing.T) {
+	var messages []interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`[{"role":"system"},{"role":"user"},{"role":"assistant","tool_calls":[]},{"role":"tool"},{"role":"user"},{"role":"assistant","tool_calls":[]},{"role":"tool"}]`), &messages))
+	assert.Equal(t, [][]int{{1}, {2, 3}, {4}}, droppableUnits(messages))
+}
+
+func TestScrubPII(t *testing.T) {
+	assert.NoError(t, compilePIIDetectors(PIIConfig{Enabled: true, Patterns: []PIIPattern{{Name: "employee_id", Regex: `EMP-\d{6}`}}}))
+	defer func() { activeDetectors = nil }()
+
+	masked, changed := scrubPII("mail jane.doe@example.com or call +1 415-555-0132, card 4111 1111 1111 1111, id EMP-123456")
+	assert.True(t, changed)
+	assert.Equal(t, "mail [EMAIL] or call [PHONE], card [CREDIT_CARD], id [EMPLOYEE_ID]", masked)
+
+	_, changed = scrubPII("order 1234 5678 9012 3456 shipped")
+	assert.False(t, changed)
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	rc := &rewriteContext{req: req, deployment: &DeploymentConfig{}}
+	C.PII = PIIConfig{Enabled: true}
+	defer func() { C.PII = PIIConfig{} }()
+	body, err := rewriteBody(rc, []byte(`{"messages":[{"role":"user","content":[{"type":"text","text":"ssn 123-45-6789"}]}]}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"messages":[{"role":"user","content":[{"type":"text","text":"ssn [SSN]"}]}]}`, string(body))
+
+	C.PII.Keys = []string{"other"}
+	body, err = rewriteBody(rc, []byte(`{"input":"a@b.io"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"input":"a@b.io"}`, string(body))
+}
+
+func TestCappedContent(t *testing.T) {
+	C.LogContentLimit = 4
+	defer func() { C.LogContentLimit = 0 }()
+
+	body := []byte("abcdefgh")
+	assert.Equal(t, "abcd... (4 more bytes)", string(cappedContent(body)))
+	assert.Equal(t, "abcdefgh", string(body))
+	assert.Equal(t, "abc", string(cappedContent([]byte("abc"))))
+}
+
+func TestJSONEngines(t *testing.T) {
+	defer util.SetJSONEngine(util.GetJSONEngine())
+	_, err := util.ParseJSONEngine("simdjson")
+	assert.Error(t, err)
+
+	deployment := &DeploymentConfig{ApiVersion: "2024-02-01"}
+	input := `{"model":"gpt-4","temperature":0.70,"max_tokens":12345678901234567,"messages":[{"role":"user","content":"<b>&</b>"}],"response_format":{"type":"json_object"}}`
+	var outputs []string
+	for _, name := range []string{util.JSONEngineStd, util.JSONEngineSonic} {
+		engine, err := util.ParseJSONEngine(name)
+		assert.NoError(t, err)
+		util.SetJSONEngine(engine)
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		body, err := rewriteBody(&rewriteContext{req: req, deployment: deployment}, []byte(input))
+		assert.NoError(t, err)
+		outputs = append(outputs, string(body))
+	}
+	assert.Contains(t, outputs[0], `"temperature":0.70`)
+	assert.Contains(t, outputs[0], `"max_tokens":12345678901234567`)
+	assert.Equal(t, outputs[0], outputs[1])
+}
+
+func TestRewriteReasoning(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	rewrite := func(deployment *DeploymentConfig) map[string]interface{} {
+		body, err := rewriteBody(&rewriteContext{req: req, deployment: deployment},
+			[]byte(`{"model":"x","max_tokens":100,"temperature":0.2,"messages":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]}`))
+		assert.NoError(t, err)
+		payload, err := decodeJSON(body)
+		assert.NoError(t, err)
+		return payload
+	}
+	role := func(payload map[string]interface{}) interface{} {
+		return payload["messages"].([]interface{})[0].(map[string]interface{})["role"]
+	}
+
+	deployment := &DeploymentConfig{ModelName: "o3-mini", ApiVersion: "2024-02-01"}
+	payload := rewrite(deployment)
+	assert.Equal(t, ReasoningApiVersion, deployment.ApiVersion)
+	assert.Equal(t, json.Number("100"), payload["max_completion_tokens"])
+	assert.NotContains(t, payload, "max_tokens")
+	assert.NotContains(t, payload, "temperature")
+	assert.Equal(t, "developer", role(payload))
+
+	// the o1 previews reject the developer role too
+	assert.Equal(t, "user", role(rewrite(&DeploymentConfig{ModelName: "o1-mini", ApiVersion: ReasoningApiVersion})))
+	assert.Equal(t, "user", role(rewrite(&DeploymentConfig{ModelName: "o1-preview-2024-09-12", ApiVersion: ReasoningApiVersion})))
+	assert.Equal(t, "developer", role(rewrite(&DeploymentConfig{ModelName: "o1", ApiVersion: ReasoningApiVersion})))
+
+	// other models are left alone
+	payload = rewrite(&DeploymentConfig{ModelName: "gpt-4o", ApiVersion: "2024-02-01"})
+	assert.Equal(t, "system", role(payload))
+	assert.Contains(t, payload, "temperature")
+
+	_, err := rewriteBody(&rewriteContext{req: req, deployment: &DeploymentConfig{ModelName: "o1", ApiVersion: "2024-02-01", PinApiVersion: true}},
+		[]byte(`{"model":"o1","messages":[]}`))
+	assert.Error(t, err)
+}
+
+// noisyPNG encodes a png of random pixels, noise keeps the encoding about as large as the pixels
+func noisyPNG(t *testing.T, width, height int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(rnd.Intn(256)), G: uint8(rnd.Intn(256)), B: uint8(rnd.Intn(256)), A: 255})
+		}
+	}
+	buf := new(bytes.Buffer)
+	assert.NoError(t, png.Encode(buf, img))
+	return buf.Bytes()
+}
+
+func TestRewriteVision(t *testing.T) {
+	defer func() { C.Vision = VisionConfig{} }()
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	dataUrl := func(data []byte) string {
+		return "data:image/png;base64," + base64.StdEncoding.EncodeToString(data)
+	}
+	rewrite := func(urls ...string) (map[string]interface{}, bool, error) {
+		var parts []interface{}
+		for _, url := range urls {
+			parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": url}})
+		}
+		payload := map[string]interface{}{"messages": []interface{}{map[string]interface{}{"role": "user", "content": parts}}}
+		changed, err := rewriteVision(&rewriteContext{req: req, deployment: &DeploymentConfig{}}, payload)
+		return payload, changed, err
+	}
+	small := dataUrl(noisyPNG(t, 8, 8))
+
+	// the count limit includes images given by url
+	C.Vision = VisionConfig{MaxImages: 2}
+	_, changed, err := rewrite(small, "https://example.com/cat.png")
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	_, _, err = rewrite(small, small, small)
+	if assert.Error(t, err) {
+		assert.Equal(t, "messages[0].content[2]", err.(*RequestError).Param)
+	}
+
+	// a single image over max_image_bytes is rejected unless downscaling is on
+	large := noisyPNG(t, 120, 120)
+	C.Vision = VisionConfig{MaxImageBytes: len(large) / 2}
+	_, _, err = rewrite(small)
+	assert.NoError(t, err)
+	_, _, err = rewrite(dataUrl(large))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "the limit is")
+	}
+
+	C.Vision.Downscale = true
+	payload, changed, err := rewrite(dataUrl(large))
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	url := payload["messages"].([]interface{})[0].(map[string]interface{})["content"].([]interface{})[0].(map[string]interface{})["image_url"].(map[string]interface{})["url"].(string)
+	mediaType, scaled, ok := parseDataUrl(url)
+	if assert.True(t, ok) {
+		assert.Equal(t, "image/png", mediaType)
+		assert.LessOrEqual(t, len(scaled), C.Vision.MaxImageBytes)
+		config, err := png.DecodeConfig(bytes.NewReader(scaled))
+		assert.NoError(t, err)
+		assert.Less(t, config.Width, 120)
+	}
+
+	// the total limit adds up the images of all messages
+	C.Vision = VisionConfig{MaxTotalImageBytes: len(large) + len(large)/2}
+	_, _, err = rewrite(dataUrl(large))
+	assert.NoError(t, err)
+	_, _, err = rewrite(dataUrl(large), dataUrl(large))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "total limit")
+	}
+
+	// a small file declaring a huge canvas is rejected before its pixels are decoded
+	huge := noisyPNG(t, 1, 1)
+	binary.BigEndian.PutUint32(huge[16:], 100000)
+	binary.BigEndian.PutUint32(huge[20:], 100000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+	C.Vision = VisionConfig{MaxImageBytes: len(huge) - 1, Downscale: true}
+	_, _, err = rewrite(dataUrl(huge))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "pixels exceed the limit")
+	}
+}
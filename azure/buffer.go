@@ -0,0 +1,52 @@
+package azure
+
+import (
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+const defaultBufferSize = 32 * 1024
+
+type StreamingConfig struct {
+	FlushInterval time.Duration `yaml:"flush_interval" mapstructure:"flush_interval"` // flush interval for non-SSE bodies of known size, 0 or negative flushes after every write
+	BufferSize    int           `yaml:"buffer_size" mapstructure:"buffer_size"`       // max bytes buffered per response copy, default 32KB
+}
+
+// flushInterval returns the ReverseProxy flush interval, SSE responses are always flushed immediately
+func (cfg StreamingConfig) flushInterval() time.Duration {
+	if cfg.FlushInterval <= 0 {
+		return -1
+	}
+	return cfg.FlushInterval
+}
+
+// bufferPool hands out response copy buffers of a fixed size
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	return &bufferPool{pool: sync.Pool{New: func() interface{} {
+		return make([]byte, size)
+	}}}
+}
+
+func (p *bufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	p.pool.Put(b)
+}
+
+// proxyBufferPool is shared by all proxied responses, buffer_size is a restart setting so Init sizes it once
+var proxyBufferPool httputil.BufferPool = newBufferPool(defaultBufferSize)
+
+// initBufferPool sizes the response copy buffers by the streaming config
+func initBufferPool(config StreamingConfig) {
+	proxyBufferPool = newBufferPool(config.BufferSize)
+}
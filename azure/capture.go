@@ -0,0 +1,312 @@
+package azure
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+const (
+	defaultCaptureLimit = 64 << 10
+	maxCaptureCount     = 1000
+)
+
+type CaptureConfig struct {
+	Dir   string `yaml:"dir" mapstructure:"dir"`     // directory of the capture files, the temp dir by default
+	Limit int    `yaml:"limit" mapstructure:"limit"` // bytes of a request or response body captured, 65536 by default
+}
+
+// TrafficCapture records the next requests of one caller key to a json lines file, set through PUT /admin/capture
+type TrafficCapture struct {
+	KeyID     string    `json:"key_id"`    // caller key id as shown in the access log
+	Remaining int       `json:"remaining"` // requests still to capture, the capture stops at 0
+	Captured  int       `json:"captured"`  // requests written to the file
+	File      string    `json:"file"`
+	Started   time.Time `json:"started"`
+
+	file    *os.File
+	pending int // claimed requests whose record isn't written yet
+}
+
+// captureRecord is one line of a capture file
+type captureRecord struct {
+	Time            time.Time           `json:"time"`
+	RequestID       string              `json:"request_id"`
+	KeyID           string              `json:"key_id"`
+	Method          string              `json:"method"`
+	URL             string              `json:"url"`
+	Model           string              `json:"model,omitempty"`
+	Deployment      string              `json:"deployment,omitempty"`
+	RequestHeaders  map[string][]string `json:"request_headers"`
+	RequestBody     string              `json:"request_body"`
+	Status          int                 `json:"status"`
+	ResponseHeaders map[string][]string `json:"response_headers"`
+	ResponseBody    string              `json:"response_body"`
+	DurationMs      int64               `json:"duration_ms"`
+}
+
+var (
+	captureMu     sync.Mutex
+	activeCapture *TrafficCapture
+
+	// secretFieldNames are the fields of the credentials clients may put in bodies, e.g. the authentication of
+	// data_sources
+	secretFieldNames = []string{"key", "api_key", "encoded_api_key", "secret", "client_secret", "password", "access_token", "connection_string"}
+	// secretFields matches the string values of secretFieldNames in a json body
+	secretFields = regexp.MustCompile(`("(?:` + strings.Join(secretFieldNames, "|") + `)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+)
+
+// claimCapture reserves a record of the active capture for a request of the key, nil when the key isn't captured
+func claimCapture(keyID string) *TrafficCapture {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	capture := activeCapture
+	if capture == nil || keyID == "" || capture.KeyID != keyID || capture.Remaining <= 0 {
+		return nil
+	}
+	capture.Remaining--
+	capture.pending++
+	if capture.Remaining == 0 {
+		// the next requests of the key pass uncaptured, the file is closed once the last record is written
+		activeCapture = nil
+	}
+	return capture
+}
+
+// write appends the record and closes the file after the last one
+func (capture *TrafficCapture) write(record *captureRecord) {
+	data, err := util.JSONMarshal(record)
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	capture.pending--
+	if err == nil && capture.file != nil {
+		if _, err = capture.file.Write(append(data, '\n')); err == nil {
+			capture.Captured++
+		}
+	}
+	if err != nil {
+		util.Warnf("capture of key %s: %v", capture.KeyID, err)
+	}
+	capture.closeIfDone()
+}
+
+// closeIfDone closes the file of a finished capture, captureMu must be held
+func (capture *TrafficCapture) closeIfDone() {
+	if capture.Remaining > 0 || capture.pending > 0 || capture.file == nil {
+		return
+	}
+	if err := capture.file.Close(); err != nil {
+		util.Warnf("capture of key %s: %v", capture.KeyID, err)
+	}
+	capture.file = nil
+	util.Warnf("capture of key %s finished, %d requests written to %s", capture.KeyID, capture.Captured, capture.File)
+}
+
+// requestCapture tees the body of a captured request and the response written to the client
+type requestCapture struct {
+	capture  *TrafficCapture
+	start    time.Time
+	request  *cappedBuffer
+	response *cappedBuffer
+	writer   *captureWriter
+	header   http.Header
+}
+
+// startCapture starts recording the request when its caller key is captured, nil otherwise
+func startCapture(c *gin.Context, keyID string, start time.Time) *requestCapture {
+	capture := claimCapture(keyID)
+	if capture == nil {
+		return nil
+	}
+	limit := C.Capture.Limit
+	if limit <= 0 {
+		limit = defaultCaptureLimit
+	}
+	rc := &requestCapture{
+		capture:  capture,
+		start:    start,
+		request:  &cappedBuffer{limit: limit},
+		response: &cappedBuffer{limit: limit},
+		header:   c.Request.Header.Clone(),
+	}
+	if c.Request.Body != nil {
+		c.Request.Body = &captureReader{ReadCloser: c.Request.Body, buf: rc.request}
+	}
+	rc.writer = &captureWriter{ResponseWriter: c.Writer, buf: rc.response}
+	c.Writer = rc.writer
+	return rc
+}
+
+// finish writes the record of the request once the response was relayed
+func (rc *requestCapture) finish(c *gin.Context, access *accessLog) {
+	c.Writer = rc.writer.ResponseWriter
+	deployment := &DeploymentConfig{}
+	if access.rc != nil {
+		deployment = access.rc.deployment
+	}
+	rc.capture.write(&captureRecord{
+		Time:            rc.start,
+		RequestID:       access.requestID,
+		KeyID:           rc.capture.KeyID,
+		Method:          c.Request.Method,
+		URL:             c.Request.URL.String(),
+		Model:           access.model,
+		Deployment:      access.deployment,
+		RequestHeaders:  redactedHeaders(rc.header, deployment),
+		RequestBody:     capturedBody(rc.request, rc.header.Get("Content-Type")),
+		Status:          c.Writer.Status(),
+		ResponseHeaders: redactedHeaders(c.Writer.Header(), deployment),
+		ResponseBody:    capturedBody(rc.response, c.Writer.Header().Get("Content-Type")),
+		DurationMs:      time.Since(rc.start).Milliseconds(),
+	})
+}
+
+func redactedHeaders(header http.Header, deployment *DeploymentConfig) map[string][]string {
+	headers := make(map[string][]string, len(header))
+	for name, values := range header {
+		if redactedHeader(name, deployment) {
+			values = []string{"REDACTED"}
+		}
+		headers[name] = values
+	}
+	return headers
+}
+
+// capturedBody returns the captured text of a body with the credentials in it redacted, uploads are left out and
+// only the hash is kept once log_content was turned to never during the capture
+func capturedBody(buf *cappedBuffer, contentType string) string {
+	if isMultipart(contentType) {
+		return fmt.Sprintf("(multipart body of %d bytes)", buf.total)
+	}
+	if C.LogContent == LogContentNever {
+		return fmt.Sprintf("(body %s of %d bytes)", contentDigest(buf.Bytes()), buf.total)
+	}
+	body := secretFields.ReplaceAll(buf.Bytes(), []byte(`$1"REDACTED"`))
+	if buf.total > buf.Len() {
+		body = append(body, fmt.Sprintf("... (%d more bytes)", buf.total-buf.Len())...)
+	}
+	return string(body)
+}
+
+// cappedBuffer keeps the first limit bytes written and counts the rest
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+	total int
+}
+
+func (b *cappedBuffer) keep(p []byte) {
+	b.total += len(p)
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			p = p[:room]
+		}
+		b.Buffer.Write(p)
+	}
+}
+
+type captureReader struct {
+	io.ReadCloser
+	buf *cappedBuffer
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.buf.keep(p[:n])
+	return n, err
+}
+
+type captureWriter struct {
+	gin.ResponseWriter
+	buf *cappedBuffer
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.buf.keep(p[:n])
+	return n, err
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+	w.buf.keep([]byte(s[:n]))
+	return n, err
+}
+
+// CaptureHandler shows the active capture on GET, starts one on PUT with {"key_id": "...", "count": 10}
+// replacing the active one, and stops it on DELETE. Captures are refused with log_content never
+func CaptureHandler(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodPut:
+		var body struct {
+			KeyID string `json:"key_id"`
+			Count int    `json:"count"`
+		}
+		if err := util.NewJSONDecoder(c.Request.Body).Decode(&body); err != nil {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+			return
+		}
+		if body.KeyID == "" {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "key_id", errors.New("key_id is required"))
+			return
+		}
+		if C.LogContent == LogContentNever {
+			util.SendOpenAIError(c, http.StatusConflict, "invalid_request_error", "content_logging_disabled", "",
+				errors.New("log_content is never, request and response bodies can't be captured"))
+			return
+		}
+		if body.Count <= 0 || body.Count > maxCaptureCount {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "count",
+				errors.Errorf("count must be between 1 and %d", maxCaptureCount))
+			return
+		}
+		dir := C.Capture.Dir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		now := time.Now()
+		path := filepath.Join(dir, fmt.Sprintf("capture-%s-%s.jsonl", filepath.Base(body.KeyID), now.Format("20060102T150405")))
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			util.SendOpenAIError(c, http.StatusInternalServerError, "server_error", "capture_failed", "", errors.Wrap(err, "create capture file"))
+			return
+		}
+		captureMu.Lock()
+		stopCapture()
+		activeCapture = &TrafficCapture{KeyID: body.KeyID, Remaining: body.Count, File: path, Started: now, file: file}
+		captureMu.Unlock()
+		util.Warnf("capturing the next %d requests of key %s to %s", body.Count, body.KeyID, path)
+	case http.MethodDelete:
+		captureMu.Lock()
+		stopCapture()
+		captureMu.Unlock()
+	}
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	if activeCapture == nil {
+		util.SendJSON(c, http.StatusOK, gin.H{"capture": nil})
+		return
+	}
+	util.SendJSON(c, http.StatusOK, gin.H{"capture": *activeCapture})
+}
+
+// stopCapture ends the active capture, captureMu must be held
+func stopCapture() {
+	if activeCapture == nil {
+		return
+	}
+	activeCapture.Remaining = 0
+	activeCapture.closeIfDone()
+	activeCapture = nil
+}
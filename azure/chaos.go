@@ -0,0 +1,192 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// ChaosRule injects faults into a share of the upstream calls of some models, set through PUT /admin/chaos
+type ChaosRule struct {
+	Models   []string `json:"models,omitempty"`    // requested models the rule applies to, empty matches every model
+	Rate     float64  `json:"rate"`                // share of the matching requests that get the faults, 0 to 1
+	Latency  string   `json:"latency,omitempty"`   // delay added before the upstream call, e.g. "2s"
+	Status   int      `json:"status,omitempty"`    // answer with this status (429, 500, 503, ...) instead of calling azure
+	CutAfter int      `json:"cut_after,omitempty"` // cut the response after relaying this many bytes, e.g. mid-stream
+
+	latency time.Duration
+}
+
+var (
+	chaosMu    sync.RWMutex
+	chaosRules []ChaosRule
+
+	chaosInjected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aoai_proxy_chaos_injected_total",
+		Help: "Faults injected by chaos rules, by model and fault: latency, status or cut.",
+	}, []string{"model", "fault", "tenant"})
+)
+
+func validateChaosRules(rules []ChaosRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Rate < 0 || rule.Rate > 1 {
+			return errors.Errorf("rules[%d]: rate must be between 0 and 1", i)
+		}
+		if rule.Latency != "" {
+			latency, err := time.ParseDuration(rule.Latency)
+			if err != nil || latency < 0 {
+				return errors.Errorf("rules[%d]: invalid latency %q", i, rule.Latency)
+			}
+			rule.latency = latency
+		}
+		if rule.Status != 0 && (rule.Status < 400 || rule.Status > 599) {
+			return errors.Errorf("rules[%d]: status must be a 4xx or 5xx code", i)
+		}
+		if rule.CutAfter < 0 {
+			return errors.Errorf("rules[%d]: cut_after must not be negative", i)
+		}
+		if rule.latency == 0 && rule.Status == 0 && rule.CutAfter == 0 {
+			return errors.Errorf("rules[%d]: set latency, status or cut_after", i)
+		}
+	}
+	return nil
+}
+
+// chaosRuleFor picks the first rule matching the model whose dice roll hits, nil for most requests
+func chaosRuleFor(model string) *ChaosRule {
+	chaosMu.RLock()
+	defer chaosMu.RUnlock()
+	for i := range chaosRules {
+		rule := chaosRules[i]
+		if len(rule.Models) > 0 && !containsString(rule.Models, model) {
+			continue
+		}
+		if rand.Float64() < rule.Rate {
+			return &rule
+		}
+	}
+	return nil
+}
+
+// withChaos wraps the transport of the deployment to inject the faults of a chaos rule hit by the request,
+// it sits below the openai fallback so failover paths can be exercised too
+func withChaos(transport http.RoundTripper, rc *rewriteContext, model string) http.RoundTripper {
+	rule := chaosRuleFor(model)
+	if rule == nil {
+		return transport
+	}
+	return &chaosTransport{transport: transport, rc: rc, model: model, rule: rule}
+}
+
+type chaosTransport struct {
+	transport http.RoundTripper
+	rc        *rewriteContext
+	model     string
+	rule      *ChaosRule
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.rule.latency > 0 {
+		chaosInjected.WithLabelValues(t.model, "latency", t.rc.tenant.name()).Inc()
+		t.rc.warnf("chaos: delaying request [%s] by %s", t.model, t.rule.latency)
+		select {
+		case <-time.After(t.rule.latency):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if t.rule.Status != 0 {
+		chaosInjected.WithLabelValues(t.model, "status", t.rc.tenant.name()).Inc()
+		t.rc.warnf("chaos: answering request [%s] with %d", t.model, t.rule.Status)
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		body := []byte(`{"error":{"code":"` + strconv.Itoa(t.rule.Status) + `","message":"injected by the proxy chaos mode"}}`)
+		resp := &http.Response{
+			StatusCode:    t.rule.Status,
+			Status:        strconv.Itoa(t.rule.Status) + " " + http.StatusText(t.rule.Status),
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}
+		if t.rule.Status == http.StatusTooManyRequests {
+			resp.Header.Set("Retry-After", "1")
+		}
+		return resp, nil
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || t.rule.CutAfter == 0 {
+		return resp, err
+	}
+	chaosInjected.WithLabelValues(t.model, "cut", t.rc.tenant.name()).Inc()
+	t.rc.warnf("chaos: cutting the response of request [%s] after %d bytes", t.model, t.rule.CutAfter)
+	resp.Body = &cutBody{ReadCloser: resp.Body, remaining: t.rule.CutAfter}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+// cutBody fails like a dropped connection once remaining bytes were read
+type cutBody struct {
+	io.ReadCloser
+	remaining int
+}
+
+func (b *cutBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= n
+	return n, err
+}
+
+// ChaosHandler shows the chaos rules on GET, replaces them on PUT with {"rules": [...]} and removes them on DELETE
+func ChaosHandler(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodPut:
+		var body struct {
+			Rules []ChaosRule `json:"rules"`
+		}
+		if err := util.NewJSONDecoder(c.Request.Body).Decode(&body); err != nil {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "rules", err)
+			return
+		}
+		if err := validateChaosRules(body.Rules); err != nil {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "rules", err)
+			return
+		}
+		chaosMu.Lock()
+		chaosRules = body.Rules
+		chaosMu.Unlock()
+		util.Warnf("chaos mode: %d rules active", len(body.Rules))
+	case http.MethodDelete:
+		chaosMu.Lock()
+		chaosRules = nil
+		chaosMu.Unlock()
+		util.Warnf("chaos mode disabled")
+	}
+	chaosMu.RLock()
+	rules := append([]ChaosRule{}, chaosRules...)
+	chaosMu.RUnlock()
+	util.SendJSON(c, http.StatusOK, gin.H{"rules": rules})
+}
@@ -0,0 +1,165 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	CloudPublic     = "public"
+	CloudChina      = "china"
+	CloudGovernment = "government"
+)
+
+// cloudEnvironment holds the endpoints that differ between the azure clouds
+type cloudEnvironment struct {
+	authority      string // AAD authority issuing tokens
+	scope          string // token scope of azure openai
+	endpointSuffix string // host suffix of azure openai resources
+}
+
+var clouds = map[string]cloudEnvironment{
+	CloudPublic:     {"https://login.microsoftonline.com", "https://cognitiveservices.azure.com/.default", ".openai.azure.com"},
+	CloudChina:      {"https://login.chinacloudapi.cn", "https://cognitiveservices.azure.cn/.default", ".openai.azure.cn"},
+	CloudGovernment: {"https://login.microsoftonline.us", "https://cognitiveservices.azure.us/.default", ".openai.azure.us"},
+}
+
+// AADConfig authenticates to azure with a service principal instead of an api key,
+// the token authority and scope follow the cloud of the deployment
+type AADConfig struct {
+	TenantID     string `yaml:"tenant_id" json:"tenant_id" mapstructure:"tenant_id"`
+	ClientID     string `yaml:"client_id" json:"client_id" mapstructure:"client_id"`
+	ClientSecret string `yaml:"client_secret" json:"-" mapstructure:"client_secret"`
+}
+
+// deploymentCloud returns the configured cloud of the deployment or detects it from the endpoint host
+func deploymentCloud(deployment *DeploymentConfig) string {
+	if deployment.Cloud != "" {
+		return deployment.Cloud
+	}
+	if deployment.EndpointUrl != nil {
+		for name, cloud := range clouds {
+			if strings.HasSuffix(deployment.EndpointUrl.Hostname(), cloud.endpointSuffix) {
+				return name
+			}
+		}
+	}
+	return CloudPublic
+}
+
+// validateCloud checks the cloud and the AAD settings of a deployment
+func validateCloud(deployment *DeploymentConfig) error {
+	if _, ok := clouds[deploymentCloud(deployment)]; !ok {
+		return errors.Errorf("deployment %s: invalid cloud %q, use public, china or government", deployment.DeploymentName, deployment.Cloud)
+	}
+	if aad := deployment.AAD; aad != nil && (aad.TenantID == "" || aad.ClientID == "" || aad.ClientSecret == "") {
+		return errors.Errorf("deployment %s: aad needs tenant_id, client_id and client_secret", deployment.DeploymentName)
+	}
+	return nil
+}
+
+type aadToken struct {
+	value   string
+	expires time.Time
+}
+
+var (
+	aadTokensMu sync.Mutex
+	aadTokens   = map[string]aadToken{}
+	// aadFetches coalesces the token requests of a credential, requests don't wait on each other's fetch under aadTokensMu
+	aadFetches singleflight.Group
+)
+
+// upstreamToken returns the credential sent to the deployment, an AAD access token for deployments
+// with aad and the api key otherwise, tokens are cached until shortly before they expire
+func upstreamToken(ctx context.Context, deployment *DeploymentConfig) (string, error) {
+	if mockUpstream {
+		return "mock", nil
+	}
+	if deployment.AAD == nil {
+		return deployment.ApiKey, nil
+	}
+
+	cloud := clouds[deploymentCloud(deployment)]
+	aad := deployment.AAD
+	cacheKey := cloud.authority + "|" + aad.TenantID + "|" + aad.ClientID
+	if token, ok := cachedAADToken(cacheKey); ok {
+		return token, nil
+	}
+	fetch := aadFetches.DoChan(cacheKey, func() (interface{}, error) {
+		if token, ok := cachedAADToken(cacheKey); ok {
+			return token, nil
+		}
+		return fetchAADToken(deployment, cloud, cacheKey)
+	})
+	select {
+	case result := <-fetch:
+		if result.Err != nil {
+			return "", result.Err
+		}
+		return result.Val.(string), nil
+	case <-ctx.Done():
+		return "", errors.Wrap(ctx.Err(), "request aad token")
+	}
+}
+
+// cachedAADToken returns the cached token of the credential, false when it is missing or expires soon
+func cachedAADToken(cacheKey string) (string, bool) {
+	aadTokensMu.Lock()
+	defer aadTokensMu.Unlock()
+	token, ok := aadTokens[cacheKey]
+	return token.value, ok && time.Now().Before(token.expires)
+}
+
+// fetchAADToken requests a token of the aad credential and caches it, the fetch is shared by the waiting requests
+// so it isn't bound to the context of one of them
+func fetchAADToken(deployment *DeploymentConfig, cloud cloudEnvironment, cacheKey string) (string, error) {
+	aad := deployment.AAD
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {aad.ClientID},
+		"client_secret": {aad.ClientSecret},
+		"scope":         {cloud.scope},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tokenURL := cloud.authority + "/" + url.PathEscape(aad.TenantID) + "/oauth2/v2.0/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "create aad token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := &http.Client{Transport: transportFor(deployment)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "request aad token")
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := util.NewJSONDecoder(resp.Body).Decode(&result); err != nil {
+		return "", errors.Wrap(err, "decode aad token response")
+	}
+	if resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", errors.Errorf("aad token request failed with status %d: %s", resp.StatusCode, result.ErrorDescription)
+	}
+	aadTokensMu.Lock()
+	defer aadTokensMu.Unlock()
+	aadTokens[cacheKey] = aadToken{
+		value:   result.AccessToken,
+		expires: time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - 5*time.Minute),
+	}
+	return result.AccessToken, nil
+}
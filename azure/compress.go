@@ -0,0 +1,99 @@
+package azure
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type CompressionConfig struct {
+	Gzip         bool `yaml:"gzip" mapstructure:"gzip"`                   // gzip non-streaming responses for clients accepting it
+	MinSize      int  `yaml:"min_size" mapstructure:"min_size"`           // responses with a known smaller size are sent uncompressed
+	UpstreamGzip bool `yaml:"upstream_gzip" mapstructure:"upstream_gzip"` // always ask azure for gzip responses to save bandwidth
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip
+func acceptsGzip(acceptEncoding string) bool {
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		if strings.TrimSpace(name) != "gzip" && strings.TrimSpace(name) != "*" {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// shouldCompress reports whether a response body should be gzipped for the client
+func shouldCompress(cfg CompressionConfig, req *http.Request, header http.Header, size int64) bool {
+	return cfg.Gzip &&
+		acceptsGzip(req.Header.Get("Accept-Encoding")) &&
+		header.Get("Content-Encoding") == "" &&
+		!strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") &&
+		(size < 0 || size >= int64(cfg.MinSize))
+}
+
+// compressResponse gzips a non-streaming upstream response on the fly, upstream compressed responses pass through,
+// force recompresses a response decoded for rewriting whenever the client accepts gzip
+func compressResponse(resp *http.Response, req *http.Request, cfg CompressionConfig, force bool) {
+	if force {
+		cfg = CompressionConfig{Gzip: true}
+	}
+	if !shouldCompress(cfg, req, resp.Header, resp.ContentLength) {
+		return
+	}
+
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, body)
+		if err == nil {
+			err = gz.Close()
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Add("Vary", "Accept-Encoding")
+}
+
+// decodeGzipResponse transparently decompresses a gzip encoded upstream response and reports whether it did
+func decodeGzipResponse(resp *http.Response) (bool, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return false, nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{gz, resp.Body}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Content-Encoding")
+	return true, nil
+}
+
+// gzipBytes compresses a response body built by the proxy itself
+func gzipBytes(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,87 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// ConcurrencyConfig caps the requests in flight to azure over all deployments
+type ConcurrencyConfig struct {
+	MaxUpstream  int           `yaml:"max_upstream" mapstructure:"max_upstream"`   // concurrent upstream requests, 0 for no limit
+	QueueTimeout time.Duration `yaml:"queue_timeout" mapstructure:"queue_timeout"` // max wait for a free slot before answering 503, 0 fails at once
+}
+
+// statusClientClosedRequest answers requests whose client went away while they waited for a slot
+const statusClientClosedRequest = 499
+
+var (
+	upstreamSlots chan struct{}
+
+	upstreamInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "aoai_proxy_upstream_in_flight",
+		Help: "Requests currently forwarded to azure.",
+	})
+	upstreamRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "aoai_proxy_upstream_concurrency_rejected_total",
+		Help: "Requests answered with 503 because the upstream concurrency cap was reached.",
+	})
+)
+
+func initConcurrency(config ConcurrencyConfig) {
+	upstreamSlots = nil
+	if config.MaxUpstream > 0 {
+		upstreamSlots = make(chan struct{}, config.MaxUpstream)
+	}
+}
+
+// acquireUpstream takes an upstream slot, waiting up to the queue timeout, the returned func releases it;
+// only requests holding a slot count as in flight, not the ones still waiting
+func acquireUpstream(ctx context.Context) (func(), error) {
+	if upstreamSlots == nil {
+		upstreamInFlight.Inc()
+		return upstreamInFlight.Dec, nil
+	}
+	slots := upstreamSlots
+	acquired := func() (func(), error) {
+		upstreamInFlight.Inc()
+		return func() {
+			<-slots
+			upstreamInFlight.Dec()
+		}, nil
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return acquired()
+	default:
+	}
+	if timeout := C.Concurrency.QueueTimeout; timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case slots <- struct{}{}:
+			return acquired()
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "request canceled while waiting for an upstream slot")
+		case <-timer.C:
+		}
+	}
+	upstreamRejected.Inc()
+	return nil, errors.Errorf("too many concurrent upstream requests, limit is %d", cap(slots))
+}
+
+func sendConcurrencyError(c *gin.Context, err error) {
+	if errors.Is(err, context.Canceled) {
+		util.SendOpenAIError(c, statusClientClosedRequest, "invalid_request_error", "client_closed_request", "", err)
+		return
+	}
+	c.Header("Retry-After", "1")
+	util.SendOpenAIError(c, http.StatusServiceUnavailable, "server_error", "upstream_concurrency_limit", "", err)
+}
@@ -0,0 +1,371 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	CheckOK      = "ok"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+// ConfigProblem is a mistake found in the config file, Line is 0 when the position is unknown
+type ConfigProblem struct {
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+// DeploymentCheck is the outcome of the live call against a deployment: ok, failed or skipped
+type DeploymentCheck struct {
+	Model      string
+	Deployment string
+	Status     string
+	Detail     string
+}
+
+// configIssue is a problem of a setting, path locates the setting in the config file
+type configIssue struct {
+	path []string
+	err  error
+}
+
+// prepareDeployment validates a configured deployment and fills in what Init derives from it
+func prepareDeployment(deployment *DeploymentConfig) error {
+	if err := initBackend(deployment); err != nil {
+		return err
+	}
+	u, err := url.Parse(deployment.Endpoint)
+	if err != nil {
+		return fmt.Errorf("parse endpoint error: %w", err)
+	}
+	deployment.EndpointUrl = u
+	if err := validateCloud(deployment); err != nil {
+		return err
+	}
+	return validateFallback(deployment)
+}
+
+// checkSettings checks the settings Init rejects apart from the deployments, without applying any of them
+func checkSettings(config *Config) []configIssue {
+	var issues []configIssue
+	if _, err := util.ParseJSONEngine(config.JSONEngine); err != nil {
+		issues = append(issues, configIssue{[]string{"json_engine"}, err})
+	}
+	if _, err := util.ParseLogLevel(config.LogLevel); err != nil {
+		issues = append(issues, configIssue{[]string{"log_level"}, err})
+	}
+	for i, prompt := range config.SystemPrompts {
+		if prompt.Mode != "" && prompt.Mode != SystemPromptPrepend && prompt.Mode != SystemPromptEnforce {
+			issues = append(issues, configIssue{[]string{"system_prompts", strconv.Itoa(i), "mode"},
+				fmt.Errorf("invalid system prompt mode %q, use prepend or enforce", prompt.Mode)})
+		}
+	}
+	switch config.Truncation.Strategy {
+	case "", TruncateDropOldest, TruncateDropMiddle:
+	default:
+		issues = append(issues, configIssue{[]string{"truncation", "strategy"},
+			fmt.Errorf("invalid truncation strategy %q, use drop_oldest or drop_middle", config.Truncation.Strategy)})
+	}
+	switch config.StreamUsage {
+	case "", StreamUsageInject, StreamUsageEstimate:
+	default:
+		issues = append(issues, configIssue{[]string{"stream_usage"},
+			fmt.Errorf("invalid stream_usage %q, use inject or estimate", config.StreamUsage)})
+	}
+	switch config.LogContent {
+	case "", LogContentNever, LogContentErrorsOnly, LogContentAlways:
+	default:
+		issues = append(issues, configIssue{[]string{"log_content"},
+			fmt.Errorf("invalid log_content %q, use never, errors_only or always", config.LogContent)})
+	}
+	tenantIDs := map[string]bool{}
+	for i, tenant := range config.Tenants {
+		switch {
+		case tenant.ID == "":
+			issues = append(issues, configIssue{[]string{"tenants", strconv.Itoa(i)}, errors.New("tenant id is required")})
+		case tenantIDs[tenant.ID]:
+			issues = append(issues, configIssue{[]string{"tenants", strconv.Itoa(i), "id"}, fmt.Errorf("duplicate tenant %s", tenant.ID)})
+		}
+		tenantIDs[tenant.ID] = true
+		switch tenant.BudgetPeriod {
+		case "", "day", "month":
+		default:
+			issues = append(issues, configIssue{[]string{"tenants", strconv.Itoa(i), "budget_period"},
+				fmt.Errorf("invalid budget_period %q, use day or month", tenant.BudgetPeriod)})
+		}
+	}
+	return issues
+}
+
+var yamlLinePattern = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlProblem turns a yaml error message into a problem, taking the line out of the message
+func yamlProblem(message string) ConfigProblem {
+	if m := yamlLinePattern.FindStringSubmatch(message); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return ConfigProblem{Line: line, Message: m[2]}
+	}
+	return ConfigProblem{Message: strings.TrimPrefix(message, "yaml: ")}
+}
+
+// nodeLine returns the line of the setting at path, mapping keys and sequence indexes,
+// the line of the closest parent when the setting isn't in the document
+func nodeLine(node *yaml.Node, path ...string) int {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+	for _, key := range path {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					next, line = node.Content[i+1], node.Content[i].Line
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node.Content) {
+				next = node.Content[i]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+	}
+	return line
+}
+
+// CheckConfigFile parses the config file strictly, unknown keys and values of the wrong type are problems,
+// and runs the checks of Init on it without starting anything, problems carry the line of the setting
+func CheckConfigFile(path string) (*Config, []ConfigProblem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read config file")
+	}
+	config, problems := checkConfig(data, path)
+	return config, problems, nil
+}
+
+// checkConfig validates the content of a config file, path resolves the relative litellm_config
+func checkConfig(data []byte, path string) (*Config, []ConfigProblem) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, []ConfigProblem{yamlProblem(err.Error())}
+	}
+
+	var problems []ConfigProblem
+	config := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return config, []ConfigProblem{yamlProblem(err.Error())}
+		}
+		for _, message := range typeErr.Errors {
+			problems = append(problems, yamlProblem(message))
+		}
+	}
+
+	configured := len(config.DeploymentConfig)
+	if config.LiteLLMConfig != "" {
+		if err := loadLiteLLMConfig(config, liteLLMConfigPath(path, config.LiteLLMConfig)); err != nil {
+			problems = append(problems, ConfigProblem{Line: nodeLine(&root, "litellm_config"), Message: err.Error()})
+		}
+	}
+	models := map[string]int{}
+	for i, deployment := range config.DeploymentConfig {
+		line := nodeLine(&root, "deployment_config", strconv.Itoa(i))
+		where := fmt.Sprintf("deployment_config[%d]", i)
+		if i >= configured {
+			line, where = nodeLine(&root, "litellm_config"), "litellm_config model "+deployment.ModelName
+		}
+		if deployment.ModelName == "" {
+			problems = append(problems, ConfigProblem{Line: line, Message: where + ": model_name is required"})
+		} else if first, ok := models[deployment.ModelName]; ok {
+			problems = append(problems, ConfigProblem{Line: line,
+				Message: fmt.Sprintf("%s: model %s is configured on line %d too, only this entry is used", where, deployment.ModelName, first)})
+		}
+		models[deployment.ModelName] = line
+		problems = append(problems, deploymentProblems(deployment, line, where)...)
+	}
+	for i, tenant := range config.Tenants {
+		tenantModels := map[string]bool{}
+		for j, deployment := range tenant.DeploymentConfig {
+			line := nodeLine(&root, "tenants", strconv.Itoa(i), "deployment_config", strconv.Itoa(j))
+			where := fmt.Sprintf("tenants[%d].deployment_config[%d]", i, j)
+			if deployment.ModelName == "" {
+				problems = append(problems, ConfigProblem{Line: line, Message: where + ": model_name is required"})
+			} else if tenantModels[deployment.ModelName] {
+				problems = append(problems, ConfigProblem{Line: line,
+					Message: fmt.Sprintf("%s: model %s is configured twice for tenant %s, only this entry is used", where, deployment.ModelName, tenant.ID)})
+			}
+			tenantModels[deployment.ModelName] = true
+			problems = append(problems, deploymentProblems(deployment, line, where)...)
+		}
+	}
+
+	issues := checkSettings(config)
+	if _, err := buildScriptPolicies(config.Policies); err != nil {
+		issues = append(issues, configIssue{[]string{"policies"}, err})
+	}
+	if _, err := buildPromptTemplates(config.PromptTemplates); err != nil {
+		issues = append(issues, configIssue{[]string{"prompt_templates"}, err})
+	}
+	if _, err := buildPIIDetectors(config.PII); err != nil {
+		issues = append(issues, configIssue{[]string{"pii"}, err})
+	}
+	for _, issue := range issues {
+		problems = append(problems, ConfigProblem{Line: nodeLine(&root, issue.path...), Message: issue.err.Error()})
+	}
+	return config, problems
+}
+
+// deploymentProblems checks the settings of a deployment every entry of a deployment_config needs
+func deploymentProblems(deployment DeploymentConfig, line int, where string) []ConfigProblem {
+	var problems []ConfigProblem
+	if deployment.DeploymentName == "" {
+		problems = append(problems, ConfigProblem{Line: line, Message: where + ": deployment_name is required"})
+	}
+	if err := prepareDeployment(&deployment); err != nil {
+		problems = append(problems, ConfigProblem{Line: line, Message: where + ": " + err.Error()})
+	} else if deployment.Endpoint == "" {
+		problems = append(problems, ConfigProblem{Line: line, Message: where + ": endpoint is required"})
+	}
+	return problems
+}
+
+// CheckDeployments makes one tiny call against every deployment of the config, it checks the key, the api-version
+// and that the deployment exists without generating anything, the outbound transports of the config are set up
+// for the calls so it must not be used next to Init
+func CheckDeployments(config *Config, timeout time.Duration) ([]DeploymentCheck, error) {
+	var err error
+	if upstreamTransport, err = newUpstreamTransport(config.Outbound); err != nil {
+		return nil, fmt.Errorf("init outbound transport error: %w", err)
+	}
+	var deployments []DeploymentConfig
+	byModel := map[string]DeploymentConfig{}
+	for _, deployment := range config.DeploymentConfig {
+		if prepareDeployment(&deployment) == nil && deployment.Endpoint != "" {
+			deployments = append(deployments, deployment)
+			byModel[deployment.ModelName] = deployment
+		}
+	}
+	if err := initDeploymentTransports(config.Outbound, byModel); err != nil {
+		return nil, fmt.Errorf("init outbound transport error: %w", err)
+	}
+
+	checks := make([]DeploymentCheck, len(deployments))
+	var wg sync.WaitGroup
+	for i := range deployments {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			checks[i] = checkDeployment(&deployments[i], timeout)
+		}(i)
+	}
+	wg.Wait()
+	return checks, nil
+}
+
+func checkDeployment(deployment *DeploymentConfig, timeout time.Duration) DeploymentCheck {
+	check := DeploymentCheck{Model: deployment.ModelName, Deployment: deployment.DeploymentName}
+	if deployment.ApiKey == "" && deployment.AAD == nil && !deployment.optionalAuth() {
+		check.Status, check.Detail = CheckSkipped, "no api_key, keys come from the clients"
+		return check
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	token, err := upstreamToken(ctx, deployment)
+	if err != nil {
+		check.Status, check.Detail = CheckFailed, err.Error()
+		return check
+	}
+
+	var req *http.Request
+	if deployment.openAICompatible() {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, deploymentModelsURL(deployment), nil)
+	} else {
+		// azure rejects an empty message list only after the key, the api-version and the deployment passed,
+		// so nothing is generated or billed
+		target := fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s", strings.TrimSuffix(deployment.Endpoint, "/"),
+			url.PathEscape(deployment.DeploymentName), url.QueryEscape(deployment.ApiVersion))
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader(`{"messages":[]}`))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+	if err != nil {
+		check.Status, check.Detail = CheckFailed, err.Error()
+		return check
+	}
+	if token != "" {
+		setAuthHeader(req, deployment, token)
+	}
+	setDeploymentHeaders(req, deployment)
+
+	resp, err := (&http.Client{Transport: transportFor(deployment)}).Do(req)
+	if err != nil {
+		check.Status, check.Detail = CheckFailed, err.Error()
+		return check
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	check.Status, check.Detail = checkOutcome(deployment, resp.StatusCode, body)
+	return check
+}
+
+// checkOutcome reads the answer to the live call of a deployment
+func checkOutcome(deployment *DeploymentConfig, status int, body []byte) (string, string) {
+	var code, message string
+	var azureErr azureError
+	if util.JSONUnmarshal(body, &azureErr) == nil {
+		message = azureErr.Message
+		if azureErr.Error != nil {
+			code, message = errorCodeString(azureErr.Error.Code), azureErr.Error.Message
+		}
+	}
+
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return CheckFailed, fmt.Sprintf("authentication failed (%d): %s", status, message)
+	case status == http.StatusTooManyRequests:
+		return CheckOK, "reachable, currently throttled"
+	case deployment.openAICompatible():
+		if status >= http.StatusBadRequest {
+			return CheckFailed, fmt.Sprintf("models listing failed (%d): %s", status, message)
+		}
+		return CheckOK, ""
+	case code == "DeploymentNotFound":
+		return CheckFailed, fmt.Sprintf("deployment %s does not exist on %s", deployment.DeploymentName, deployment.Endpoint)
+	case status == http.StatusNotFound:
+		return CheckFailed, fmt.Sprintf("not found, check the endpoint and api_version %s: %s", deployment.ApiVersion, message)
+	case status == http.StatusBadRequest && strings.Contains(strings.ToLower(message), "api version"),
+		status == http.StatusBadRequest && strings.Contains(strings.ToLower(message), "api-version"):
+		return CheckFailed, fmt.Sprintf("api_version %s rejected: %s", deployment.ApiVersion, message)
+	case status < http.StatusBadRequest || status == http.StatusBadRequest:
+		// the empty message list was rejected, everything before it passed
+		return CheckOK, ""
+	}
+	return CheckFailed, fmt.Sprintf("unexpected status %d: %s", status, message)
+}
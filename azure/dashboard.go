@@ -0,0 +1,82 @@
+package azure
+
+import (
+	_ "embed"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// maxSlowRequests is the number of recent slow requests shown by the dashboard
+const maxSlowRequests = 20
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// SlowRequest is a request exceeding the slow_request thresholds
+type SlowRequest struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	KeyID      string    `json:"key_id"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Model      string    `json:"model"`
+	Deployment string    `json:"deployment"`
+	Endpoint   string    `json:"endpoint"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	TTFTMs     int64     `json:"ttft_ms"`
+	LatencyMs  int64     `json:"latency_ms"`
+	Stream     bool      `json:"stream"`
+}
+
+var (
+	slowMu       sync.Mutex
+	slowRequests []SlowRequest
+)
+
+// recordSlowRequest keeps the request among the recent slow ones
+func recordSlowRequest(request SlowRequest) {
+	slowMu.Lock()
+	defer slowMu.Unlock()
+	slowRequests = append(slowRequests, request)
+	if len(slowRequests) > maxSlowRequests {
+		slowRequests = slowRequests[len(slowRequests)-maxSlowRequests:]
+	}
+}
+
+// recentSlowRequests returns the recent slow requests, newest first
+func recentSlowRequests() []SlowRequest {
+	slowMu.Lock()
+	defer slowMu.Unlock()
+	result := make([]SlowRequest, len(slowRequests))
+	for i, request := range slowRequests {
+		result[len(slowRequests)-1-i] = request
+	}
+	return result
+}
+
+// DashboardHandler serves the web dashboard, a single page polling DashboardDataHandler
+func DashboardHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardPage)
+}
+
+// DashboardDataHandler returns everything the dashboard shows: the counters of /admin/stats, the request rate of
+// the last 10 minutes, the deployment health and the recent slow requests
+func DashboardDataHandler(c *gin.Context) {
+	total, models := stats.snapshot()
+	util.SendJSON(c, http.StatusOK, gin.H{
+		"since":          stats.start.UTC(),
+		"uptime_seconds": int64(time.Since(stats.start).Seconds()),
+		"total":          total,
+		"models":         models,
+		"rate":           stats.rate(),
+		"deployments":    deploymentHealth(),
+		"slow_requests":  recentSlowRequests(),
+		"slow_request":   C.SlowRequest != SlowRequestConfig{},
+		"features":       EnabledFeatures(),
+	})
+}
@@ -0,0 +1,102 @@
+package azure
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// DebugHeader asks for the conversion pipeline of a single request to be logged, whatever the log level
+const DebugHeader = "X-Proxy-Debug"
+
+type DebugConfig struct {
+	Keys []string `yaml:"keys" mapstructure:"keys"` // caller key ids (see the access log) allowed to send X-Proxy-Debug, empty disables the header
+}
+
+// isDebugRequest tells whether the request asks for debug logging and its caller is allowed to
+func isDebugRequest(req *http.Request, keyID string) bool {
+	switch strings.ToLower(req.Header.Get(DebugHeader)) {
+	case "1", "true", "on":
+	default:
+		return false
+	}
+	return keyID != "" && containsString(C.Debug.Keys, keyID)
+}
+
+// debugRequest logs the resolved deployment and the converted upstream request of a debugged request
+func (rc *rewriteContext) debugRequest(req *http.Request, body []byte) {
+	deployment := rc.deployment
+	rc.debugf("upstream request %s %s, deployment %s (%s, api-version %s)", req.Method, req.URL.String(),
+		deployment.DeploymentName, deployment.backendType(), deployment.ApiVersion)
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.Join(req.Header.Values(name), ", ")
+		if redactedHeader(name, deployment) {
+			value = "REDACTED"
+		}
+		rc.debugf("upstream header %s: %s", name, value)
+	}
+	if body != nil && C.LogContent != LogContentNever {
+		rc.debugf("upstream body: %s", cappedContent(body))
+	}
+}
+
+// rewriterName is the function name of a body rewriter, e.g. rewriteReasoning
+func rewriterName(rewriter bodyRewriter) string {
+	name := runtime.FuncForPC(reflect.ValueOf(rewriter).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// payloadSnapshot encodes every top level field so the changes of a rewriter can be listed
+func payloadSnapshot(payload map[string]interface{}) map[string]string {
+	snapshot := make(map[string]string, len(payload))
+	for key, value := range payload {
+		data, err := util.JSONMarshal(value)
+		if err != nil {
+			data = []byte(fmt.Sprint(value))
+		}
+		snapshot[key] = string(data)
+	}
+	return snapshot
+}
+
+// payloadChanges lists the top level fields added, removed or changed since the snapshot
+func payloadChanges(before map[string]string, payload map[string]interface{}) string {
+	after := payloadSnapshot(payload)
+	var added, removed, changed []string
+	for key, value := range after {
+		if old, ok := before[key]; !ok {
+			added = append(added, key)
+		} else if old != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	var parts []string
+	for _, group := range []struct {
+		label string
+		keys  []string
+	}{{"added", added}, {"removed", removed}, {"changed", changed}} {
+		if len(group.keys) > 0 {
+			sort.Strings(group.keys)
+			parts = append(parts, group.label+" "+strings.Join(group.keys, ", "))
+		}
+	}
+	if len(parts) == 0 {
+		return "no field changed"
+	}
+	return strings.Join(parts, "; ")
+}
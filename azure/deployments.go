@@ -0,0 +1,311 @@
+package azure
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// deploymentsMu guards the swaps of ModelDeploymentConfig and deploymentTransports, both maps are replaced
+	// as a whole and never modified once published
+	deploymentsMu sync.RWMutex
+	// deploymentChangeMu serializes runtime changes of the deployments and of the config file
+	deploymentChangeMu sync.Mutex
+)
+
+// currentDeployments returns the deployments by model, the map must not be modified
+func currentDeployments() map[string]DeploymentConfig {
+	deploymentsMu.RLock()
+	defer deploymentsMu.RUnlock()
+	return ModelDeploymentConfig
+}
+
+// swapDeployments publishes a new set of deployments and their transports, requests in flight keep the
+// deployment and the transport they already resolved
+func swapDeployments(deployments map[string]DeploymentConfig, transports map[string]*http.Transport) {
+	deploymentsMu.Lock()
+	previous := ModelDeploymentConfig
+	unused := keepTransports(deploymentTransports, transports)
+	ModelDeploymentConfig, deploymentTransports = deployments, transports
+	deploymentsMu.Unlock()
+
+	for _, transport := range unused {
+		transport.CloseIdleConnections()
+	}
+	for model := range previous {
+		if _, ok := deployments[model]; !ok {
+			deploymentModels.forget(model)
+		}
+	}
+	pruneDrains()
+}
+
+// decodeDeployment decodes a deployment_config entry sent to the admin api and validates it like Init does
+func decodeDeployment(model string, entry map[string]interface{}) (DeploymentConfig, error) {
+	var deployment DeploymentConfig
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           &deployment,
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+	})
+	if err != nil {
+		return deployment, err
+	}
+	if err := decoder.Decode(entry); err != nil {
+		return deployment, err
+	}
+	if deployment.ModelName == "" {
+		deployment.ModelName = model
+		entry["model_name"] = model
+	} else if deployment.ModelName != model {
+		return deployment, errors.Errorf("model_name %s doesn't match the model %s of the path", deployment.ModelName, model)
+	}
+	if deployment.DeploymentName == "" {
+		return deployment, errors.New("deployment_name is required")
+	}
+	if err := prepareDeployment(&deployment); err != nil {
+		return deployment, err
+	}
+	if deployment.Endpoint == "" {
+		return deployment, errors.New("endpoint is required")
+	}
+	return deployment, nil
+}
+
+// maskedDeployment hides the secrets of a deployment shown by the admin api
+func maskedDeployment(deployment DeploymentConfig) DeploymentConfig {
+	if deployment.ApiKey != "" {
+		deployment.ApiKey = "REDACTED"
+	}
+	if len(deployment.Headers) > 0 {
+		headers := make(map[string]string, len(deployment.Headers))
+		for name, value := range deployment.Headers {
+			if redactedHeader(name, &deployment) {
+				value = "REDACTED"
+			}
+			headers[name] = value
+		}
+		deployment.Headers = headers
+	}
+	if len(deployment.DataSources) > 0 {
+		deployment.DataSources = redactedDataSources(deployment.DataSources)
+	}
+	return deployment
+}
+
+// redactedDataSources returns a copy of data_sources with the credentials of their authentication masked like the
+// bodies of a capture
+func redactedDataSources(sources []map[string]interface{}) []map[string]interface{} {
+	data, err := util.JSONMarshal(sources)
+	if err != nil {
+		return nil
+	}
+	var redacted []map[string]interface{}
+	if err := util.JSONUnmarshal(secretFields.ReplaceAll(data, []byte(`$1"REDACTED"`)), &redacted); err != nil {
+		return nil
+	}
+	return redacted
+}
+
+// DeploymentsHandler lists the deployments on GET, secrets are masked
+func DeploymentsHandler(c *gin.Context) {
+	deployments := currentDeployments()
+	result := make([]DeploymentConfig, 0, len(deployments))
+	for _, deployment := range deployments {
+		result = append(result, maskedDeployment(deployment))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ModelName < result[j].ModelName
+	})
+	util.SendJSON(c, http.StatusOK, gin.H{"deployments": result})
+}
+
+// DeploymentHandler adds or replaces the deployment of a model on PUT, with the keys of a deployment_config entry,
+// and removes it on DELETE, changes are written back to the config file and serve new requests at once
+func DeploymentHandler(c *gin.Context) {
+	// a catch-all parameter, model names of openai-compatible servers may contain slashes
+	model := strings.TrimPrefix(c.Param("model"), "/")
+	if model == "" {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "model", errors.New("model is required"))
+		return
+	}
+	deploymentChangeMu.Lock()
+	defer deploymentChangeMu.Unlock()
+
+	current := currentDeployments()
+	next := make(map[string]DeploymentConfig, len(current)+1)
+	for name, deployment := range current {
+		next[name] = deployment
+	}
+	var entry map[string]interface{}
+	switch c.Request.Method {
+	case http.MethodPut:
+		if err := util.NewJSONDecoder(c.Request.Body).Decode(&entry); err != nil || entry == nil {
+			if err == nil {
+				err = errors.New("a deployment_config entry is required")
+			}
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+			return
+		}
+		deployment, err := decodeDeployment(model, entry)
+		if err != nil {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+			return
+		}
+		next[model] = deployment
+	case http.MethodDelete:
+		if _, ok := next[model]; !ok {
+			util.SendOpenAIError(c, http.StatusNotFound, "invalid_request_error", "model_not_found", "model",
+				errors.Errorf("deployment config for %s not found", model))
+			return
+		}
+		delete(next, model)
+	}
+
+	transports, err := buildDeploymentTransports(C.Outbound, next)
+	if err != nil {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+		return
+	}
+	persisted, err := persistDeployment(loadedConfigFile, model, entry)
+	if err != nil {
+		util.SendOpenAIError(c, http.StatusInternalServerError, "server_error", "config_not_written", "",
+			errors.Wrap(err, "the config file was not updated, nothing changed"))
+		return
+	}
+	swapDeployments(next, transports)
+	if entry != nil {
+		util.Warnf("deployment of model %s set to %s at %s", model, next[model].DeploymentName, next[model].Endpoint)
+		util.SendJSON(c, http.StatusOK, gin.H{"deployment": maskedDeployment(next[model]), "persisted": persisted})
+		return
+	}
+	util.Warnf("deployment of model %s removed", model)
+	util.SendJSON(c, http.StatusOK, gin.H{"deleted": model, "persisted": persisted})
+}
+
+// persistDeployment replaces the deployment_config entries of the model in the config file with entry,
+// or removes them when entry is nil, the rest of the file is kept, false when the proxy has no config file
+func persistDeployment(path, model string, entry map[string]interface{}) (bool, error) {
+	return persistListEntry(path, "deployment_config", "model_name", model, entry)
+}
+
+// persistListEntry replaces the items of the top level list setting whose key is value with entry, or removes them
+// when entry is nil, the rest of the file is kept, false when the proxy has no config file
+func persistListEntry(path, setting, key, value string, entry map[string]interface{}) (bool, error) {
+	if path == "" {
+		return false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false, errors.Wrap(err, "parse config file")
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return false, errors.New("config file is not a mapping")
+	}
+
+	var list *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == setting {
+			list = root.Content[i+1]
+		}
+	}
+	if list == nil {
+		list = &yaml.Node{}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: setting}, list)
+	}
+	if list.Kind != yaml.SequenceNode {
+		// an empty list setting is a null scalar
+		*list = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+
+	var replacement *yaml.Node
+	if entry != nil {
+		replacement = &yaml.Node{}
+		if err := replacement.Encode(entry); err != nil {
+			return false, err
+		}
+	}
+	items := make([]*yaml.Node, 0, len(list.Content)+1)
+	for _, item := range list.Content {
+		if scalarValue(item, key) != value {
+			items = append(items, item)
+			continue
+		}
+		if replacement != nil {
+			items = append(items, replacement)
+			replacement = nil
+		}
+	}
+	if replacement != nil {
+		items = append(items, replacement)
+	}
+	list.Content = items
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return false, err
+	}
+	if err := encoder.Close(); err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(path, out.Bytes())
+}
+
+// scalarValue returns the value of a key of a yaml mapping, empty when missing
+func scalarValue(node *yaml.Node, key string) string {
+	if node.Kind != yaml.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1].Value
+		}
+	}
+	return ""
+}
+
+// writeFileAtomic replaces the file through a rename so readers never see it half written, the mode is kept
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,205 @@
+package azure
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// DeploymentDrain takes a deployment out of rotation for maintenance, set through PUT /admin/drain
+type DeploymentDrain struct {
+	Model      string    `json:"model"`
+	Tenant     string    `json:"tenant,omitempty"` // tenant owning the deployment, empty for the default deployments
+	Endpoint   string    `json:"endpoint"`
+	Deployment string    `json:"deployment"`
+	To         string    `json:"to,omitempty"` // model whose deployment serves the new requests, they are refused with a 503 without it
+	Since      time.Time `json:"since"`
+	InFlight   int64     `json:"in_flight"` // requests still served by the drained deployment, maintenance is safe at 0
+}
+
+var (
+	drainMu sync.Mutex
+	// drains by drainKey, a deployment shared by several models or tenants is drained for all of them
+	drains = map[string]*DeploymentDrain{}
+	// inFlight counts the requests being served by each deployment by drainKey
+	inFlight = map[string]int64{}
+)
+
+// drainKey identifies the azure deployment behind a deployment config
+func drainKey(deployment *DeploymentConfig) string {
+	return deployment.Endpoint + "|" + deployment.DeploymentName
+}
+
+// deploymentDrain returns the drain of the deployment, nil when it isn't drained
+func deploymentDrain(deployment *DeploymentConfig) *DeploymentDrain {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	if drain := drains[drainKey(deployment)]; drain != nil {
+		copied := *drain
+		return &copied
+	}
+	return nil
+}
+
+// trackInFlight counts a request served by the deployment until the returned func is called
+func trackInFlight(deployment *DeploymentConfig) func() {
+	key := drainKey(deployment)
+	drainMu.Lock()
+	inFlight[key]++
+	drainMu.Unlock()
+	return func() {
+		drainMu.Lock()
+		defer drainMu.Unlock()
+		if inFlight[key]--; inFlight[key] <= 0 {
+			delete(inFlight, key)
+		}
+	}
+}
+
+// pruneDrains ends the drains of deployments no longer configured by the defaults nor by a tenant
+func pruneDrains() {
+	deploymentsMu.RLock()
+	live := map[string]bool{}
+	for _, deployment := range ModelDeploymentConfig {
+		live[drainKey(&deployment)] = true
+	}
+	for _, t := range tenants {
+		for _, deployment := range t.deployments {
+			live[drainKey(&deployment)] = true
+		}
+	}
+	deploymentsMu.RUnlock()
+
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	for key := range drains {
+		if !live[key] {
+			delete(drains, key)
+		}
+	}
+}
+
+// drainTarget resolves the deployment serving the model for the tenant of a drain, nil when there is none
+func drainTarget(t *tenant, model string) *DeploymentConfig {
+	if deployment := t.deployment(model); deployment != nil {
+		return deployment
+	}
+	if t != nil && !t.fallback {
+		return nil
+	}
+	deployment, err := GetDeploymentByModel(model)
+	if err != nil {
+		return nil
+	}
+	return deployment
+}
+
+// DrainsHandler lists the drained deployments with the requests they still serve
+func DrainsHandler(c *gin.Context) {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	result := make([]DeploymentDrain, 0, len(drains))
+	for key, drain := range drains {
+		d := *drain
+		d.InFlight = inFlight[key]
+		result = append(result, d)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Tenant != result[j].Tenant {
+			return result[i].Tenant < result[j].Tenant
+		}
+		return result[i].Model < result[j].Model
+	})
+	util.SendJSON(c, http.StatusOK, gin.H{"drains": result})
+}
+
+// DrainHandler drains the deployment of a model on PUT, optionally with {"to": "other-model"} to shift the new
+// requests to the deployment of another model, and puts it back into rotation on DELETE, requests in flight complete
+// on the drained deployment either way. ?tenant=<id> drains the deployment serving the model for that tenant
+func DrainHandler(c *gin.Context) {
+	model := strings.TrimPrefix(c.Param("model"), "/")
+	var t *tenant
+	if id := c.Query("tenant"); id != "" {
+		deploymentsMu.RLock()
+		t = tenants[id]
+		deploymentsMu.RUnlock()
+		if t == nil {
+			util.SendOpenAIError(c, http.StatusNotFound, "invalid_request_error", "unknown_tenant", "tenant",
+				errors.Errorf("unknown tenant %q", id))
+			return
+		}
+	}
+	deployment := drainTarget(t, model)
+	if deployment == nil {
+		util.SendOpenAIError(c, http.StatusNotFound, "invalid_request_error", "model_not_found", "model",
+			errors.Errorf("deployment config for %s not found", model))
+		return
+	}
+	key := drainKey(deployment)
+
+	if c.Request.Method == http.MethodDelete {
+		drainMu.Lock()
+		_, drained := drains[key]
+		delete(drains, key)
+		drainMu.Unlock()
+		if !drained {
+			util.SendOpenAIError(c, http.StatusNotFound, "invalid_request_error", "not_draining", "model",
+				errors.Errorf("deployment of %s is not draining", model))
+			return
+		}
+		util.Warnf("deployment %s of model %s back in rotation", deployment.DeploymentName, model)
+		util.SendJSON(c, http.StatusOK, gin.H{"undrained": model})
+		return
+	}
+
+	var body struct {
+		To string `json:"to"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := util.NewJSONDecoder(c.Request.Body).Decode(&body); err != nil {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+			return
+		}
+	}
+	drain := &DeploymentDrain{Model: model, Tenant: t.name(), Endpoint: deployment.Endpoint,
+		Deployment: deployment.DeploymentName, To: body.To, Since: time.Now().UTC()}
+
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	if body.To != "" {
+		target := drainTarget(t, body.To)
+		if target == nil {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "to",
+				errors.Errorf("deployment config for %s not found", body.To))
+			return
+		}
+		if drainKey(target) == key {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "to",
+				errors.New("to must name a model served by another deployment"))
+			return
+		}
+		if drains[drainKey(target)] != nil {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "to",
+				errors.Errorf("deployment of %s is draining as well", body.To))
+			return
+		}
+	}
+	if previous := drains[key]; previous != nil {
+		drain.Since = previous.Since
+	}
+	drains[key] = drain
+	if drain.To != "" {
+		util.Warnf("deployment %s of model %s draining, new requests go to %s", drain.Deployment, model, drain.To)
+	} else {
+		util.Warnf("deployment %s of model %s draining, new requests are refused", drain.Deployment, model)
+	}
+	d := *drain
+	d.InFlight = inFlight[key]
+	util.SendJSON(c, http.StatusOK, gin.H{"drain": d})
+}
@@ -0,0 +1,74 @@
+package azure
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// DryRunHeader asks for the converted upstream request instead of sending it, when dry_run is enabled
+const DryRunHeader = "X-Proxy-Dry-Run"
+
+// DryRunRequest is the upstream request a dry run answers with, secrets are redacted
+type DryRunRequest struct {
+	Deployment string              `json:"deployment"`
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	Headers    map[string][]string `json:"headers"`
+	Body       interface{}         `json:"body,omitempty"` // the json body, or the raw body as a string
+	Warnings   []string            `json:"warnings,omitempty"`
+}
+
+func isDryRun(req *http.Request) bool {
+	switch strings.ToLower(req.Header.Get(DryRunHeader)) {
+	case "1", "true", "yes":
+		return C.DryRun
+	}
+	return false
+}
+
+// redactedHeader tells whether the value of an upstream header is a secret
+func redactedHeader(name string, deployment *DeploymentConfig) bool {
+	name = strings.ToLower(name)
+	if deployment.AuthHeader != "" && name == strings.ToLower(deployment.AuthHeader) {
+		return true
+	}
+	for _, secret := range []string{"authorization", "key", "secret", "token", "cookie"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendDryRun answers with the converted upstream request, body is nil for streamed uploads
+func sendDryRun(c *gin.Context, req *http.Request, rc *rewriteContext, body []byte) {
+	headers := make(map[string][]string, len(req.Header))
+	for name, values := range req.Header {
+		if redactedHeader(name, rc.deployment) {
+			values = []string{"REDACTED"}
+		}
+		headers[name] = values
+	}
+	result := DryRunRequest{
+		Deployment: rc.deployment.DeploymentName,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Headers:    headers,
+		Warnings:   rc.warnings,
+	}
+	switch {
+	case body == nil:
+		result.Body = "streamed upload, not shown"
+	default:
+		if payload, err := decodeJSON(body); err == nil {
+			result.Body = payload
+		} else {
+			result.Body = string(cappedContent(body))
+		}
+	}
+	rc.logf("dry run, request not sent")
+	util.SendJSON(c, http.StatusOK, result)
+}
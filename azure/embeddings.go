@@ -0,0 +1,170 @@
+package azure
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// EmbeddingsParamsApiVersion is the first api-version accepting dimensions and encoding_format on embeddings
+const EmbeddingsParamsApiVersion = "2024-02-01"
+
+func isEmbeddings(req *http.Request) bool {
+	return strings.HasSuffix(req.URL.Path, "/embeddings")
+}
+
+// rewriteEmbeddings makes sure dimensions and encoding_format reach a deployment that understands them,
+// pinned deployments either reject them or strip them with a warning header
+func rewriteEmbeddings(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if !isEmbeddings(rc.req) || rc.deployment.openAICompatible() || apiVersionAtLeast(rc.deployment.ApiVersion, EmbeddingsParamsApiVersion) {
+		return false, nil
+	}
+
+	changed := false
+	for _, param := range []string{"dimensions", "encoding_format"} {
+		value, ok := payload[param]
+		if !ok || (param == "encoding_format" && value == "float") {
+			continue
+		}
+		if !rc.deployment.PinApiVersion {
+			return changed, ensureApiVersion(rc.deployment, EmbeddingsParamsApiVersion, param)
+		}
+		if !rc.deployment.StripUnsupportedParams {
+			return false, newRequestError(param, "%s requires api-version %s or later, deployment %s is pinned to %s",
+				param, EmbeddingsParamsApiVersion, rc.deployment.DeploymentName, rc.deployment.ApiVersion)
+		}
+
+		delete(payload, param)
+		changed = true
+		rc.addWarning(fmt.Sprintf("%s is not supported by api-version %s and was removed", param, rc.deployment.ApiVersion))
+		if param == "encoding_format" && value == "base64" {
+			rc.addResponseRewriter(embeddingsToBase64)
+		}
+	}
+	return changed, nil
+}
+
+// embeddingsToBase64 encodes float embeddings as base64 little endian float32, like openai does for encoding_format base64,
+// an embedding that isn't a list of numbers is left as is
+func embeddingsToBase64(payload map[string]interface{}, stream bool) bool {
+	changed := false
+	data, _ := payload["data"].([]interface{})
+	for _, item := range data {
+		embedding, _ := item.(map[string]interface{})
+		values, ok := embedding["embedding"].([]interface{})
+		if !ok {
+			continue
+		}
+		if buf, err := float32Bytes(values); err == nil {
+			embedding["embedding"] = base64.StdEncoding.EncodeToString(buf)
+			changed = true
+		} else {
+			util.Warnf("encode embedding as base64 error: %v", err)
+		}
+	}
+	return changed
+}
+
+// float32Bytes encodes numbers as little endian float32
+func float32Bytes(values []interface{}) ([]byte, error) {
+	buf := make([]byte, 4*len(values))
+	for i, v := range values {
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, errors.Errorf("embedding value %d is %T, not a number", i, v)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(f)))
+	}
+	return buf, nil
+}
+
+// splitEmbeddingsInput splits the input array of an embeddings body into bodies of at most batchSize inputs,
+// nil is returned when the body doesn't need splitting
+func splitEmbeddingsInput(body []byte, batchSize int) ([][]byte, error) {
+	if batchSize <= 0 {
+		return nil, nil
+	}
+	payload, err := decodeJSON(body)
+	if err != nil {
+		return nil, nil
+	}
+	inputs, ok := payload["input"].([]interface{})
+	if !ok || len(inputs) <= batchSize {
+		return nil, nil
+	}
+	// a flat token array is a single input
+	if _, ok := inputs[0].(json.Number); ok {
+		return nil, nil
+	}
+
+	var bodies [][]byte
+	for start := 0; start < len(inputs); start += batchSize {
+		end := start + batchSize
+		if end > len(inputs) {
+			end = len(inputs)
+		}
+		payload["input"] = inputs[start:end]
+		b, err := util.JSONMarshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, b)
+	}
+	return bodies, nil
+}
+
+// mergeEmbeddingsResponses concatenates the data of batched embeddings responses in input order and sums the usage
+func mergeEmbeddingsResponses(bodies [][]byte) ([]byte, error) {
+	var merged map[string]interface{}
+	var data []interface{}
+	usage := map[string]int64{}
+	for _, body := range bodies {
+		payload, err := decodeJSON(body)
+		if err != nil {
+			return nil, err
+		}
+		offset := int64(len(data))
+		items, _ := payload["data"].([]interface{})
+		for _, item := range items {
+			embedding, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			n, ok := embedding["index"].(json.Number)
+			if !ok {
+				return nil, errors.Errorf("embeddings response has an index of %T, not a number", embedding["index"])
+			}
+			index, err := n.Int64()
+			if err != nil {
+				return nil, err
+			}
+			embedding["index"] = offset + index
+		}
+		data = append(data, items...)
+		if u, ok := payload["usage"].(map[string]interface{}); ok {
+			for k, v := range u {
+				if n, ok := v.(json.Number); ok {
+					i, _ := n.Int64()
+					usage[k] += i
+				}
+			}
+		}
+		if merged == nil {
+			merged = payload
+		}
+	}
+	merged["data"] = data
+	merged["usage"] = usage
+	return util.JSONMarshal(merged)
+}
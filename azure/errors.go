@@ -0,0 +1,108 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// azureErrorCodes maps azure error codes to the codes openai uses for the same condition
+var azureErrorCodes = map[string]string{
+	"DeploymentNotFound": "model_not_found",
+	"401":                "invalid_api_key",
+	"429":                "rate_limit_exceeded",
+}
+
+// azureError covers the error shapes returned by azure openai and api management
+type azureError struct {
+	Error *struct {
+		Code    interface{} `json:"code"`
+		Message string      `json:"message"`
+		Type    string      `json:"type"`
+		Param   string      `json:"param"`
+	} `json:"error"`
+	StatusCode int    `json:"statusCode"`
+	Message    string `json:"message"`
+}
+
+// normalizeErrorResponse rewrites azure error payloads of failed responses into the openai error format
+func normalizeErrorResponse(resp *http.Response) error {
+	if resp.StatusCode < http.StatusBadRequest || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	var azureErr azureError
+	if err = util.JSONUnmarshal(body, &azureErr); err != nil {
+		return nil
+	}
+
+	status := resp.StatusCode
+	description := util.ErrorDescription{Message: azureErr.Message}
+	if azureErr.Error != nil {
+		description = util.ErrorDescription{
+			Code:    errorCodeString(azureErr.Error.Code),
+			Message: azureErr.Error.Message,
+			Type:    azureErr.Error.Type,
+			Param:   azureErr.Error.Param,
+		}
+	}
+	if description.Code == "" {
+		description.Code = strconv.Itoa(status)
+	}
+	if code, ok := azureErrorCodes[description.Code]; ok {
+		description.Code = code
+	}
+	if description.Code == "model_not_found" {
+		status = http.StatusNotFound
+	}
+	if description.Type == "" {
+		description.Type = errorTypeForStatus(status)
+	}
+
+	body, err = util.JSONMarshal(util.ApiResponse{Error: description})
+	if err != nil {
+		return err
+	}
+	resp.StatusCode = status
+	resp.Status = strconv.Itoa(status) + " " + http.StatusText(status)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func errorCodeString(code interface{}) string {
+	switch c := code.(type) {
+	case string:
+		return c
+	case float64:
+		return strconv.Itoa(int(c))
+	}
+	return ""
+}
+
+// errorTypeForStatus returns the openai error type used for a http status
+func errorTypeForStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= http.StatusInternalServerError:
+		return "server_error"
+	}
+	return "invalid_request_error"
+}
@@ -0,0 +1,222 @@
+package azure
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+const (
+	EventsKafka = "kafka"
+	EventsNats  = "nats"
+)
+
+type EventsConfig struct {
+	Driver        string        `yaml:"driver" mapstructure:"driver"`                 // kafka or nats, events are disabled when empty
+	Brokers       []string      `yaml:"brokers" mapstructure:"brokers"`               // kafka brokers
+	Topic         string        `yaml:"topic" mapstructure:"topic"`                   // kafka topic or nats subject
+	Url           string        `yaml:"url" mapstructure:"url"`                       // nats server url
+	BufferSize    int           `yaml:"buffer_size" mapstructure:"buffer_size"`       // events queued before new ones are dropped, defaults to 10000
+	BatchSize     int           `yaml:"batch_size" mapstructure:"batch_size"`         // events per publish, defaults to 100
+	FlushInterval time.Duration `yaml:"flush_interval" mapstructure:"flush_interval"` // max time an event waits for its batch, defaults to 1s
+}
+
+// RequestEvent is published once per completed request
+type RequestEvent struct {
+	Time             time.Time `json:"time"`
+	RequestID        string    `json:"request_id"`
+	KeyID            string    `json:"key_id"`
+	Tenant           string    `json:"tenant,omitempty"`
+	Model            string    `json:"model"`
+	Deployment       string    `json:"deployment"`
+	Status           int       `json:"status"`
+	PromptTokens     int64     `json:"prompt_tokens"`
+	CompletionTokens int64     `json:"completion_tokens"`
+	LatencyMs        int64     `json:"latency_ms"`
+	Stream           bool      `json:"stream"`
+}
+
+// eventPublisher sends a batch of encoded events to the broker
+type eventPublisher interface {
+	publish(ctx context.Context, events [][]byte) error
+	close() error
+}
+
+var (
+	droppedEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "aoai_proxy_events_dropped_total",
+		Help: "Request events dropped because the event queue was full or publishing failed.",
+	})
+
+	// eventsMu guards eventQueue, sends hold it for reading so CloseEvents never closes the queue under a send
+	eventsMu   sync.RWMutex
+	eventQueue chan []byte
+	eventsDone chan struct{}
+)
+
+// initEvents connects the configured broker and starts the batching publisher
+func initEvents(cfg EventsConfig) error {
+	if cfg.Driver == "" {
+		return nil
+	}
+	if cfg.Topic == "" {
+		return errors.New("events.topic is required")
+	}
+
+	var publisher eventPublisher
+	switch cfg.Driver {
+	case EventsKafka:
+		if len(cfg.Brokers) == 0 {
+			return errors.New("events.brokers is required for kafka")
+		}
+		publisher = &kafkaPublisher{writer: &kafka.Writer{
+			Addr:                   kafka.TCP(cfg.Brokers...),
+			Topic:                  cfg.Topic,
+			Balancer:               &kafka.Hash{},
+			AllowAutoTopicCreation: true,
+		}}
+	case EventsNats:
+		conn, err := nats.Connect(cfg.Url)
+		if err != nil {
+			return errors.Wrap(err, "connect nats error")
+		}
+		publisher = &natsPublisher{conn: conn, subject: cfg.Topic}
+	default:
+		return errors.Errorf("unknown events driver %q, use kafka or nats", cfg.Driver)
+	}
+
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 10000
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	queue := make(chan []byte, cfg.BufferSize)
+	eventsMu.Lock()
+	eventQueue, eventsDone = queue, make(chan struct{})
+	go runEventPublisher(publisher, cfg, queue, eventsDone)
+	eventsMu.Unlock()
+	log.Printf("publishing request events to %s %s", cfg.Driver, cfg.Topic)
+	return nil
+}
+
+// publishEvent queues the event without blocking the request, it is dropped when the queue is full
+func publishEvent(event RequestEvent) {
+	eventsMu.RLock()
+	defer eventsMu.RUnlock()
+	if eventQueue == nil {
+		return
+	}
+	data, err := util.JSONMarshal(event)
+	if err != nil {
+		return
+	}
+	select {
+	case eventQueue <- data:
+	default:
+		droppedEvents.Inc()
+	}
+}
+
+func runEventPublisher(publisher eventPublisher, cfg EventsConfig, queue <-chan []byte, done chan<- struct{}) {
+	defer close(done)
+	defer publisher.close()
+
+	batch := make([][]byte, 0, cfg.BatchSize)
+	ticker := time.NewTicker(cfg.FlushInterval)
+	defer ticker.Stop()
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := publisher.publish(ctx, batch); err != nil {
+			log.Printf("publish %d request events error: %v", len(batch), err)
+			droppedEvents.Add(float64(len(batch)))
+		}
+		cancel()
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case data, ok := <-queue:
+			if !ok {
+				send()
+				return
+			}
+			if batch = append(batch, data); len(batch) >= cfg.BatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		}
+	}
+}
+
+// CloseEvents publishes the queued events and disconnects from the broker, used on shutdown
+func CloseEvents() {
+	eventsMu.Lock()
+	queue, done := eventQueue, eventsDone
+	eventQueue = nil
+	if queue != nil {
+		close(queue)
+	}
+	eventsMu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func (p *kafkaPublisher) publish(ctx context.Context, events [][]byte) error {
+	messages := make([]kafka.Message, len(events))
+	for i, event := range events {
+		messages[i] = kafka.Message{Value: event}
+	}
+	return p.writer.WriteMessages(ctx, messages...)
+}
+
+func (p *kafkaPublisher) close() error {
+	return p.writer.Close()
+}
+
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func (p *natsPublisher) publish(ctx context.Context, events [][]byte) error {
+	var errs []string
+	for _, event := range events {
+		if err := p.conn.Publish(p.subject, event); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := p.conn.FlushWithContext(ctx); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (p *natsPublisher) close() error {
+	return p.conn.Drain()
+}
@@ -0,0 +1,170 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+const (
+	// BackendHeader tells clients of deployments with an openai fallback which backend served the response
+	BackendHeader = "X-Proxy-Backend"
+
+	defaultOpenAIBaseURL = "https://api.openai.com/v1"
+)
+
+// OpenAIFallback is the api.openai.com backend of a deployment, used as last resort when azure is down or throttled
+type OpenAIFallback struct {
+	ApiKey       string `yaml:"api_key" mapstructure:"api_key"`           // openai api key
+	Model        string `yaml:"model" mapstructure:"model"`               // openai model, the model_name of the deployment by default
+	BaseURL      string `yaml:"base_url" mapstructure:"base_url"`         // https://api.openai.com/v1 by default
+	Organization string `yaml:"organization" mapstructure:"organization"` // sent as OpenAI-Organization when set
+}
+
+var openAIFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "aoai_proxy_openai_fallback_total",
+	Help: "Requests served by the openai fallback of a deployment, by the azure failure causing it: 429, 5xx or error.",
+}, []string{"deployment", "reason", "tenant"})
+
+func validateFallback(deployment *DeploymentConfig) error {
+	fallback := deployment.OpenAIFallback
+	if fallback == nil {
+		return nil
+	}
+	if fallback.ApiKey == "" {
+		return errors.Errorf("deployment %s: openai_fallback needs an api_key", deployment.DeploymentName)
+	}
+	if fallback.BaseURL != "" {
+		if _, err := url.Parse(fallback.BaseURL); err != nil {
+			return errors.Wrapf(err, "deployment %s: invalid openai_fallback base_url", deployment.DeploymentName)
+		}
+	}
+	return nil
+}
+
+// withFallback wraps the transport of the deployment to retry failed calls against openai,
+// body is the request body sent upstream, requests with a streamed body are never retried
+func withFallback(transport http.RoundTripper, rc *rewriteContext, body []byte) http.RoundTripper {
+	if rc.deployment.OpenAIFallback == nil || body == nil {
+		return transport
+	}
+	return &fallbackTransport{azure: transport, rc: rc, body: body}
+}
+
+type fallbackTransport struct {
+	azure http.RoundTripper
+	rc    *rewriteContext
+	body  []byte
+}
+
+// needsFallback tells whether azure failed in a way another backend may succeed with
+func needsFallback(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// RoundTrip calls azure and, when it fails, openai, the azure outcome is returned when openai fails as well
+func (t *fallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.azure.RoundTrip(req)
+	if !needsFallback(resp, err) || req.Context().Err() != nil {
+		return t.azureOutcome(resp, err)
+	}
+
+	deployment := t.rc.deployment
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	fallbackReq, buildErr := t.openAIRequest(req)
+	if buildErr != nil {
+		t.rc.warnf("openai fallback of deployment %s skipped: %v", deployment.DeploymentName, buildErr)
+		return t.azureOutcome(resp, err)
+	}
+	t.rc.warnf("azure deployment %s failed (%s), falling back to openai", deployment.DeploymentName, statusClass(status))
+	fallbackResp, fallbackErr := upstreamTransport.RoundTrip(fallbackReq)
+	if needsFallback(fallbackResp, fallbackErr) {
+		if fallbackErr != nil {
+			t.rc.warnf("openai fallback of deployment %s failed: %v", deployment.DeploymentName, fallbackErr)
+		} else {
+			t.rc.warnf("openai fallback of deployment %s failed with %d", deployment.DeploymentName, fallbackResp.StatusCode)
+			fallbackResp.Body.Close()
+		}
+		return t.azureOutcome(resp, err)
+	}
+
+	if resp != nil {
+		resp.Body.Close()
+	}
+	observeUpstream(t.rc, deployment, start, status)
+	openAIFallbacks.WithLabelValues(deployment.DeploymentName, statusClass(status), t.rc.tenant.name()).Inc()
+	fallbackResp.Header.Set(BackendHeader, BackendOpenAI)
+	return fallbackResp, nil
+}
+
+func (t *fallbackTransport) azureOutcome(resp *http.Response, err error) (*http.Response, error) {
+	if resp != nil {
+		resp.Header.Set(BackendHeader, BackendAzure)
+	}
+	return resp, err
+}
+
+// openAIRequest maps the converted azure request back onto the openai api of the fallback
+func (t *fallbackTransport) openAIRequest(req *http.Request) (*http.Request, error) {
+	deployment, fallback := t.rc.deployment, t.rc.deployment.OpenAIFallback
+	route, ok := deploymentRoute(req.URL.Path, deployment)
+	if !ok {
+		return nil, errors.Errorf("no openai route for %s", req.URL.Path)
+	}
+	base := fallback.BaseURL
+	if base == "" {
+		base = defaultOpenAIBaseURL
+	}
+	target, err := url.Parse(strings.TrimSuffix(base, "/") + route)
+	if err != nil {
+		return nil, err
+	}
+
+	body := t.body
+	if payload, err := decodeJSON(body); err == nil {
+		model := fallback.Model
+		if model == "" {
+			model = deployment.ModelName
+		}
+		payload["model"] = model
+		// on your data is an azure only feature
+		delete(payload, "data_sources")
+		if body, err = util.JSONMarshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	fallbackReq, err := http.NewRequestWithContext(req.Context(), req.Method, target.String(), io.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		return nil, err
+	}
+	fallbackReq.Header = req.Header.Clone()
+	for name := range deployment.Headers {
+		fallbackReq.Header.Del(name)
+	}
+	fallbackReq.Header.Del(AuthHeaderKey)
+	if deployment.AuthHeader != "" {
+		fallbackReq.Header.Del(deployment.AuthHeader)
+	}
+	fallbackReq.Header.Set("Authorization", "Bearer "+fallback.ApiKey)
+	if fallback.Organization != "" {
+		fallbackReq.Header.Set("OpenAI-Organization", fallback.Organization)
+	}
+	fallbackReq.ContentLength = int64(len(body))
+	return fallbackReq, nil
+}
@@ -0,0 +1,33 @@
+package azure
+
+// EnabledFeatures lists the optional features turned on by the configuration
+func EnabledFeatures() []string {
+	features := []string{}
+	add := func(enabled bool, name string) {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+
+	add(C.StreamUsage != "", "stream_usage:"+C.StreamUsage)
+	add(C.StripAzureFields, "strip_azure_fields")
+	add(C.Vision != VisionConfig{}, "vision_limits")
+	add(C.Timeout != TimeoutConfig{}, "timeouts")
+	add(C.Compression.Gzip, "gzip")
+	add(C.Compression.UpstreamGzip, "upstream_gzip")
+	add(C.Tracing.Enabled, "tracing")
+	add(C.Admin.Token != "", "admin_api")
+	add(C.Usage.Store.Driver != "", "usage_store:"+C.Usage.Store.Driver)
+	add(len(C.Pricing) > 0, "pricing")
+	add(appInsights != nil, "app_insights")
+	add(len(C.Alerts.Webhooks) > 0, "alerts")
+	add(C.Events.Driver != "", "events:"+C.Events.Driver)
+	add(C.Health.Probe, "health_probe")
+	add(C.SlowRequest != SlowRequestConfig{}, "slow_request_log")
+	add(C.LogContent != "", "log_content:"+C.LogContent)
+	add(len(streamMiddlewares) > 0, "stream_middleware")
+	add(virtualKeys.enabled(), "virtual_keys")
+	add(C.Maintenance.Enabled, "maintenance")
+	add(tenantsConfigured(), "tenants")
+	return features
+}
@@ -0,0 +1,214 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+type HealthConfig struct {
+	Probe         bool          `yaml:"probe" mapstructure:"probe"`                   // actively probe every deployment endpoint, health is otherwise learned from proxied calls
+	ProbeInterval time.Duration `yaml:"probe_interval" mapstructure:"probe_interval"` // defaults to 30s
+	ProbeTimeout  time.Duration `yaml:"probe_timeout" mapstructure:"probe_timeout"`   // defaults to 5s
+}
+
+// DeploymentHealth is the last known health of a deployment
+type DeploymentHealth struct {
+	Model       string    `json:"model"`
+	Deployment  string    `json:"deployment"`
+	Healthy     bool      `json:"healthy"`
+	Known       bool      `json:"known"`
+	LastStatus  int       `json:"last_status,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastChecked time.Time `json:"last_checked,omitempty"`
+	Draining    bool      `json:"draining,omitempty"` // out of rotation through PUT /admin/drain
+}
+
+type healthRegistry struct {
+	mu          sync.Mutex
+	deployments map[string]*DeploymentHealth
+}
+
+var health = &healthRegistry{deployments: map[string]*DeploymentHealth{}}
+
+// recordHealth updates the health of deployment from an upstream call, status 0 stands for a transport error
+func recordHealth(deployment *DeploymentConfig, status int, err error) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	h := health.deployments[deployment.DeploymentName]
+	if h == nil {
+		h = &DeploymentHealth{Deployment: deployment.DeploymentName}
+		health.deployments[deployment.DeploymentName] = h
+	}
+	h.Model = deployment.ModelName
+	h.Known = true
+	h.Healthy = status > 0 && status < http.StatusInternalServerError
+	h.LastStatus = status
+	h.LastError = ""
+	if err != nil {
+		h.LastError = err.Error()
+	}
+	h.LastChecked = time.Now().UTC()
+}
+
+// deploymentHealth returns the health of all configured deployments, unknown when never called nor probed
+func deploymentHealth() []DeploymentHealth {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	deployments := currentDeployments()
+	result := make([]DeploymentHealth, 0, len(deployments))
+	for _, deployment := range deployments {
+		h := DeploymentHealth{Model: deployment.ModelName, Deployment: deployment.DeploymentName}
+		if known := health.deployments[deployment.DeploymentName]; known != nil {
+			h = *known
+			h.Model = deployment.ModelName
+		}
+		h.Draining = deploymentDrain(&deployment) != nil
+		result = append(result, h)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Model < result[j].Model
+	})
+	return result
+}
+
+// startHealthProbes probes every deployment endpoint periodically
+func startHealthProbes(cfg HealthConfig) {
+	if !cfg.Probe {
+		return
+	}
+	interval, timeout := cfg.ProbeInterval, cfg.ProbeTimeout
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	go func() {
+		for {
+			probeDeployments(timeout)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func probeDeployments(timeout time.Duration) {
+	for _, deployment := range currentDeployments() {
+		deployment := deployment
+		if deployment.ApiKey == "" && deployment.AAD == nil && !deployment.openAICompatible() {
+			// keys come from the clients, nothing to probe with
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		url := strings.TrimSuffix(deployment.Endpoint, "/") + "/openai/models?api-version=" + deployment.ApiVersion
+		if deployment.openAICompatible() {
+			url = deploymentModelsURL(&deployment)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			cancel()
+			recordHealth(&deployment, 0, err)
+			continue
+		}
+		token, err := upstreamToken(ctx, &deployment)
+		if err != nil {
+			cancel()
+			recordHealth(&deployment, 0, err)
+			continue
+		}
+		setAuthHeader(req, &deployment, token)
+		setDeploymentHeaders(req, &deployment)
+		client := &http.Client{Transport: transportFor(&deployment), Timeout: timeout}
+		resp, err := client.Do(req)
+		cancel()
+		if err != nil {
+			recordHealth(&deployment, 0, err)
+			continue
+		}
+		resp.Body.Close()
+		recordHealth(&deployment, resp.StatusCode, nil)
+	}
+}
+
+// HealthzHandler reports process health and the last known health of each deployment,
+// it answers 200 as long as the process serves requests
+func HealthzHandler(c *gin.Context) {
+	deployments := deploymentHealth()
+	healthy := 0
+	for _, d := range deployments {
+		if d.Healthy {
+			healthy++
+		}
+	}
+	util.SendJSON(c, http.StatusOK, gin.H{
+		"status":              "ok",
+		"healthy_deployments": healthy,
+		"deployments":         deployments,
+	})
+}
+
+var readiness struct {
+	sync.Mutex
+	draining    bool
+	configError error
+}
+
+// SetDraining marks the proxy as shutting down, readiness fails from then on
+func SetDraining() {
+	readiness.Lock()
+	defer readiness.Unlock()
+	readiness.draining = true
+}
+
+// SetConfigError records the outcome of the last config reload, a failed reload fails readiness until one succeeds
+func SetConfigError(err error) {
+	readiness.Lock()
+	defer readiness.Unlock()
+	readiness.configError = err
+}
+
+// notReadyReason explains why the proxy should not receive traffic, empty when ready
+func notReadyReason() string {
+	readiness.Lock()
+	draining, configError := readiness.draining, readiness.configError
+	readiness.Unlock()
+	if draining {
+		return "draining"
+	}
+	if configError != nil {
+		return "config reload failed: " + configError.Error()
+	}
+
+	deployments := deploymentHealth()
+	for _, d := range deployments {
+		if !d.Known || d.Healthy {
+			return ""
+		}
+	}
+	if len(deployments) > 0 {
+		return "all deployments are unhealthy"
+	}
+	return ""
+}
+
+// LivezHandler reports the process is alive, it never checks dependencies
+func LivezHandler(c *gin.Context) {
+	util.SendJSON(c, http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ReadyzHandler fails while draining, after a failed config reload or when every deployment is unhealthy
+func ReadyzHandler(c *gin.Context) {
+	if reason := notReadyReason(); reason != "" {
+		util.SendJSON(c, http.StatusServiceUnavailable, gin.H{"status": "not ready", "reason": reason})
+		return
+	}
+	util.SendJSON(c, http.StatusOK, gin.H{"status": "ok"})
+}
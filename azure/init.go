@@ -5,9 +5,12 @@ import (
 	"github.com/spf13/viper"
 	"github.com/stulzq/azure-openai-proxy/constant"
 	"github.com/stulzq/azure-openai-proxy/util"
+	"gopkg.in/yaml.v3"
 	"log"
 	"net/url"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -18,9 +21,26 @@ const (
 var (
 	C                     Config
 	ModelDeploymentConfig = map[string]DeploymentConfig{}
+	// loadedConfigFile is the config file read at startup, deployment changes of the admin api are written back to it
+	loadedConfigFile string
+	// fileConfig is the config file as last loaded, decoded like a reload decodes it so both compare
+	fileConfig Config
 )
 
 func Init() error {
+	if err := LoadConfig(); err != nil {
+		return err
+	}
+	if err := setup(); err != nil {
+		return err
+	}
+	viper.Set("api_base", C.ApiBase)
+	return nil
+}
+
+// LoadConfig reads C from the environment variables or the config file, flags and environment variables override
+// the settings of the file, nothing is applied until Init
+func LoadConfig() error {
 	var (
 		apiVersion        string
 		endpoint          string
@@ -28,6 +48,9 @@ func Init() error {
 		err               error
 	)
 
+	if mockUpstream = viper.GetBool("mock_upstream"); mockUpstream {
+		log.Println("mock mode: completions are faked, azure is never called")
+	}
 	apiVersion = viper.GetString(constant.ENV_AZURE_OPENAI_API_VER)
 	endpoint = viper.GetString(constant.ENV_AZURE_OPENAI_ENDPOINT)
 	openaiModelMapper = viper.GetString(constant.ENV_AZURE_OPENAI_MODEL_MAPPER)
@@ -37,31 +60,136 @@ func Init() error {
 		}
 		InitFromEnvironmentVariables(apiVersion, endpoint, openaiModelMapper)
 	} else {
-		if err = InitFromConfigFile(); err != nil {
+		// mock mode runs without a config file, a broken one still fails
+		if err = InitFromConfigFile(); err != nil && !(mockUpstream && os.IsNotExist(err)) {
 			return err
 		}
 	}
 
-	// ensure apiBase likes /v1
 	viper.SetDefault("api_base", "/v1")
-	apiBase := viper.GetString("api_base")
-	if !strings.HasPrefix(apiBase, "/") {
-		apiBase = "/" + apiBase
+	C.ApiBase = viper.GetString("api_base")
+	for key, setting := range map[string]*string{"log_level": &C.LogLevel, "json_engine": &C.JSONEngine, "admin.token": &C.Admin.Token} {
+		if value := viper.GetString(key); value != "" {
+			*setting = value
+		}
+	}
+	return nil
+}
+
+// EffectiveConfig is C as loaded, with the deployments of AZURE_OPENAI_MODEL_MAPPER when they come from the environment
+func EffectiveConfig() Config {
+	config := C
+	if len(config.DeploymentConfig) == 0 {
+		models := make([]string, 0, len(ModelDeploymentConfig))
+		for model := range ModelDeploymentConfig {
+			models = append(models, model)
+		}
+		sort.Strings(models)
+		for _, model := range models {
+			config.DeploymentConfig = append(config.DeploymentConfig, ModelDeploymentConfig[model])
+		}
+	}
+	return config
+}
+
+// Setup configures the proxy from cfg instead of the config file and the environment, for services mounting it with
+// RegisterRoutes or NewHandler. Like Init it is called once, before serving
+func Setup(cfg Config) error {
+	C = cfg
+	if C.LiteLLMConfig != "" {
+		if err := loadLiteLLMConfig(&C, C.LiteLLMConfig); err != nil {
+			return err
+		}
 	}
-	if strings.HasSuffix(apiBase, "/") {
-		apiBase = apiBase[:len(apiBase)-1]
+	ModelDeploymentConfig = map[string]DeploymentConfig{}
+	return setup()
+}
+
+// setup applies C once it is loaded
+func setup() error {
+	if issues := checkSettings(&C); len(issues) > 0 {
+		return issues[0].err
+	}
+
+	// the json engine is chosen first, everything below may already encode or decode json
+	jsonEngine := C.JSONEngine
+	if jsonEngine == "" {
+		jsonEngine = viper.GetString(constant.ENV_AZURE_OPENAI_JSON_ENGINE)
 	}
-	viper.Set("api_base", apiBase)
-	log.Printf("apiBase is: %s", apiBase)
+	engine, err := util.ParseJSONEngine(jsonEngine)
+	if err != nil {
+		return err
+	}
+	util.SetJSONEngine(engine)
+	log.Printf("json engine is: %s", engine.Name())
+
+	// ensure apiBase likes /v1
+	if C.ApiBase == "" {
+		C.ApiBase = "/v1"
+	}
+	if !strings.HasPrefix(C.ApiBase, "/") {
+		C.ApiBase = "/" + C.ApiBase
+	}
+	if strings.HasSuffix(C.ApiBase, "/") {
+		C.ApiBase = C.ApiBase[:len(C.ApiBase)-1]
+	}
+	log.Printf("apiBase is: %s", C.ApiBase)
 	for _, itemConfig := range C.DeploymentConfig {
-		u, err := url.Parse(itemConfig.Endpoint)
-		if err != nil {
-			return fmt.Errorf("parse endpoint error: %w", err)
+		if err := prepareDeployment(&itemConfig); err != nil {
+			return err
 		}
-		itemConfig.EndpointUrl = u
 		ModelDeploymentConfig[itemConfig.ModelName] = itemConfig
 	}
-	return err
+	if upstreamTransport, err = newUpstreamTransport(C.Outbound); err != nil {
+		return fmt.Errorf("init outbound transport error: %w", err)
+	}
+	if err := initDeploymentTransports(C.Outbound, ModelDeploymentConfig); err != nil {
+		return fmt.Errorf("init outbound transport error: %w", err)
+	}
+	if err := initTenants(C.Outbound, C.Tenants); err != nil {
+		return fmt.Errorf("init tenants error: %w", err)
+	}
+	initConcurrency(C.Concurrency)
+	initBufferPool(C.Streaming)
+	if err := initTracing(C.Tracing); err != nil {
+		return fmt.Errorf("init tracing error: %w", err)
+	}
+	if C.Usage.Store.Driver != "" {
+		store, err := openUsageStore(C.Usage.Store)
+		if err != nil {
+			return err
+		}
+		SetUsageStore(store)
+		seedTenantBudgets(store)
+		log.Printf("usage records are persisted to %s", C.Usage.Store.Driver)
+	}
+	if err := loadVirtualKeys(C.VirtualKeys.File); err != nil {
+		return err
+	}
+	startUsageFlusher(C.Usage.FlushInterval)
+	if err := initAppInsights(C.AppInsights); err != nil {
+		return fmt.Errorf("init application insights error: %w", err)
+	}
+	if err := initEvents(C.Events); err != nil {
+		return fmt.Errorf("init events error: %w", err)
+	}
+	level, err := util.ParseLogLevel(C.LogLevel)
+	if err != nil {
+		return err
+	}
+	util.SetLogLevel(level)
+	if err := compileScriptPolicies(C.Policies); err != nil {
+		return err
+	}
+	if err := compilePromptTemplates(C.PromptTemplates); err != nil {
+		return err
+	}
+	if err := compilePIIDetectors(C.PII); err != nil {
+		return err
+	}
+	startHealthProbes(C.Health)
+	initMaintenance(C.Maintenance)
+	return nil
 }
 
 func InitFromEnvironmentVariables(apiVersion, endpoint, openaiModelMapper string) {
@@ -91,15 +219,21 @@ func InitFromEnvironmentVariables(apiVersion, endpoint, openaiModelMapper string
 	}
 }
 
-func InitFromConfigFile() error {
-	log.Println("Init from config file")
-
+// ConfigFilePath is the config file set with --configFile, relative to the workdir, config.yaml by default
+func ConfigFilePath() string {
 	configFile := viper.GetString("configFile")
 	if configFile == "" {
-		configFile = filepath.Join(util.GetWorkdir(), "config.yaml")
+		return filepath.Join(util.GetWorkdir(), "config.yaml")
 	} else if !filepath.IsAbs(configFile) {
-		configFile = filepath.Join(util.GetWorkdir(), configFile)
+		return filepath.Join(util.GetWorkdir(), configFile)
 	}
+	return configFile
+}
+
+func InitFromConfigFile() error {
+	log.Println("Init from config file")
+
+	configFile := ConfigFilePath()
 
 	viper.SetConfigType("yaml")
 	viper.SetConfigFile(configFile)
@@ -112,10 +246,20 @@ func InitFromConfigFile() error {
 		log.Printf("unmarshal config file error: %+v\n", err)
 		return err
 	}
+	if C.LiteLLMConfig != "" {
+		if err := loadLiteLLMConfig(&C, liteLLMConfigPath(configFile, C.LiteLLMConfig)); err != nil {
+			log.Printf("load litellm config error: %+v\n", err)
+			return err
+		}
+	}
 	for _, configItem := range C.DeploymentConfig {
 		ModelDeploymentConfig[configItem.ModelName] = configItem
 	}
 
+	loadedConfigFile = configFile
+	if data, err := os.ReadFile(configFile); err == nil {
+		_ = yaml.Unmarshal(data, &fileConfig)
+	}
 	log.Println("read config file success")
 	return nil
 }
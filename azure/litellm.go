@@ -0,0 +1,198 @@
+package azure
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+	"gopkg.in/yaml.v3"
+)
+
+// liteLLMConfig is the part of a litellm proxy config.yaml mapped onto deployments
+type liteLLMConfig struct {
+	ModelList []struct {
+		ModelName string        `yaml:"model_name"`
+		Params    liteLLMParams `yaml:"litellm_params"`
+	} `yaml:"model_list"`
+}
+
+type liteLLMParams struct {
+	Model        string            `yaml:"model"` // provider/name, e.g. azure/my-gpt4-deployment
+	ApiBase      string            `yaml:"api_base"`
+	ApiKey       string            `yaml:"api_key"`
+	ApiVersion   string            `yaml:"api_version"`
+	TenantID     string            `yaml:"tenant_id"`
+	ClientID     string            `yaml:"client_id"`
+	ClientSecret string            `yaml:"client_secret"`
+	ExtraHeaders map[string]string `yaml:"extra_headers"`
+}
+
+// liteLLMValue resolves the os.environ/NAME references litellm uses for secrets
+func liteLLMValue(value string) string {
+	if name, ok := strings.CutPrefix(value, "os.environ/"); ok {
+		return os.Getenv(name)
+	}
+	return value
+}
+
+// ConvertLiteLLMConfig maps the model_list of a litellm config.yaml onto deployments, secrets referenced as
+// os.environ/NAME are resolved, entries of unsupported providers and further entries of a model_name
+// (litellm load balancing) are skipped with a warning
+func ConvertLiteLLMConfig(data []byte) ([]DeploymentConfig, []string, error) {
+	return convertLiteLLMConfig(data, liteLLMValue)
+}
+
+// ConvertLiteLLMConfigRedacted converts like ConvertLiteLLMConfig for printing, the api keys and client secrets
+// referenced as os.environ/NAME are REDACTED instead of resolved, with a warning naming the variable
+func ConvertLiteLLMConfigRedacted(data []byte) ([]DeploymentConfig, []string, error) {
+	var redacted []string
+	secret := func(value string) string {
+		if name, ok := strings.CutPrefix(value, "os.environ/"); ok {
+			redacted = append(redacted, fmt.Sprintf("the secret of os.environ/%s is printed as REDACTED, fill it in", name))
+			return "REDACTED"
+		}
+		return value
+	}
+	deployments, warnings, err := convertLiteLLMConfig(data, secret)
+	return deployments, append(warnings, redacted...), err
+}
+
+// convertLiteLLMConfig converts the model_list, the api keys and client secrets are mapped through secret
+func convertLiteLLMConfig(data []byte, secret func(string) string) ([]DeploymentConfig, []string, error) {
+	var config liteLLMConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, nil, errors.Wrap(err, "parse litellm config")
+	}
+
+	var (
+		deployments []DeploymentConfig
+		warnings    []string
+		seen        = map[string]bool{}
+	)
+	for i, entry := range config.ModelList {
+		params := entry.Params
+		if entry.ModelName == "" || params.Model == "" {
+			warnings = append(warnings, fmt.Sprintf("model_list[%d]: model_name and litellm_params.model are required, skipped", i))
+			continue
+		}
+		if seen[entry.ModelName] {
+			warnings = append(warnings, fmt.Sprintf("model_list[%d]: %s has several deployments, only the first one is used", i, entry.ModelName))
+			continue
+		}
+		provider, name, _ := strings.Cut(params.Model, "/")
+		deployment := DeploymentConfig{
+			DeploymentName: name,
+			ModelName:      entry.ModelName,
+			Endpoint:       liteLLMValue(params.ApiBase),
+			ApiKey:         secret(params.ApiKey),
+			ApiVersion:     liteLLMValue(params.ApiVersion),
+			Headers:        params.ExtraHeaders,
+		}
+		switch provider {
+		case "azure":
+			if params.TenantID != "" {
+				deployment.AAD = &AADConfig{
+					TenantID:     liteLLMValue(params.TenantID),
+					ClientID:     liteLLMValue(params.ClientID),
+					ClientSecret: secret(params.ClientSecret),
+				}
+			}
+		case "azure_ai":
+			deployment.Type = BackendServerless
+			if u, err := url.Parse(deployment.Endpoint); err == nil && strings.HasSuffix(u.Hostname(), ".services.ai.azure.com") {
+				deployment.Type = BackendInference
+				deployment.Endpoint = strings.TrimSuffix(strings.TrimSuffix(deployment.Endpoint, "/"), "/models")
+			}
+		case "openai", "hosted_vllm":
+			deployment.Type = BackendOpenAICompatible
+			if deployment.Endpoint == "" {
+				deployment.Endpoint = "https://api.openai.com/v1"
+			}
+		case "ollama", "ollama_chat":
+			// litellm calls the native ollama api, the openai api of the server lives under /v1
+			deployment.Type = BackendOllama
+			if deployment.Endpoint != "" {
+				deployment.Endpoint = strings.TrimSuffix(deployment.Endpoint, "/") + "/v1"
+			}
+			deployment.ApiKey = ""
+		default:
+			warnings = append(warnings, fmt.Sprintf("model_list[%d]: provider %q of %s is not supported, skipped", i, provider, entry.ModelName))
+			continue
+		}
+		if deployment.Endpoint == "" && deployment.Type != BackendOllama {
+			warnings = append(warnings, fmt.Sprintf("model_list[%d]: %s has no api_base, skipped", i, entry.ModelName))
+			continue
+		}
+		seen[entry.ModelName] = true
+		deployments = append(deployments, deployment)
+	}
+	return deployments, warnings, nil
+}
+
+// liteLLMDeployment is the deployment_config entry written for a converted deployment
+type liteLLMDeployment struct {
+	DeploymentName string            `yaml:"deployment_name"`
+	Type           string            `yaml:"type,omitempty"`
+	ModelName      string            `yaml:"model_name"`
+	Endpoint       string            `yaml:"endpoint,omitempty"`
+	ApiKey         string            `yaml:"api_key,omitempty"`
+	ApiVersion     string            `yaml:"api_version,omitempty"`
+	Headers        map[string]string `yaml:"headers,omitempty"`
+	AAD            *AADConfig        `yaml:"aad,omitempty"`
+}
+
+// MarshalDeploymentConfig renders deployments as the deployment_config section of config.yaml
+func MarshalDeploymentConfig(deployments []DeploymentConfig) ([]byte, error) {
+	entries := make([]liteLLMDeployment, 0, len(deployments))
+	for _, d := range deployments {
+		entries = append(entries, liteLLMDeployment{
+			DeploymentName: d.DeploymentName,
+			Type:           d.Type,
+			ModelName:      d.ModelName,
+			Endpoint:       d.Endpoint,
+			ApiKey:         d.ApiKey,
+			ApiVersion:     d.ApiVersion,
+			Headers:        d.Headers,
+			AAD:            d.AAD,
+		})
+	}
+	return yaml.Marshal(map[string]interface{}{"deployment_config": entries})
+}
+
+// liteLLMConfigPath resolves litellm_config relative to the directory of the config file
+func liteLLMConfigPath(configFile, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configFile), path)
+}
+
+// loadLiteLLMConfig adds the deployments of the litellm config file to the configured ones,
+// models configured in deployment_config win
+func loadLiteLLMConfig(config *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "read litellm config")
+	}
+	deployments, warnings, err := ConvertLiteLLMConfig(data)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		util.Warnf("litellm config: %s", warning)
+	}
+	configured := map[string]bool{}
+	for _, d := range config.DeploymentConfig {
+		configured[d.ModelName] = true
+	}
+	for _, d := range deployments {
+		if !configured[d.ModelName] {
+			config.DeploymentConfig = append(config.DeploymentConfig, d)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package azure
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+const defaultMaintenanceMessage = "The service is down for maintenance and will be back shortly."
+
+// maintenanceExempt are the paths answered in maintenance mode, so probes keep the proxy in rotation and the
+// admin api can end it
+var maintenanceExempt = []string{"/admin", "/health", "/livez", "/readyz", "/metrics", "/version"}
+
+type MaintenanceConfig struct {
+	Enabled    bool          `yaml:"enabled" mapstructure:"enabled"`         // answer the routes with a 503 from startup
+	Message    string        `yaml:"message" mapstructure:"message"`         // error message of the 503
+	Routes     []string      `yaml:"routes" mapstructure:"routes"`           // path prefixes in maintenance, e.g. /v1/chat/completions, empty for all routes
+	RetryAfter time.Duration `yaml:"retry_after" mapstructure:"retry_after"` // sent as Retry-After, omitted when 0
+}
+
+// MaintenanceMode is the active maintenance as shown by GET /admin/maintenance
+type MaintenanceMode struct {
+	Message    string    `json:"message"`
+	Routes     []string  `json:"routes"`
+	RetryAfter string    `json:"retry_after,omitempty"`
+	Since      time.Time `json:"since"`
+
+	retryAfter time.Duration
+}
+
+var (
+	maintenanceMu sync.RWMutex
+	maintenance   *MaintenanceMode
+)
+
+func newMaintenanceMode(message string, routes []string, retryAfter time.Duration) *MaintenanceMode {
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	if routes == nil {
+		routes = []string{}
+	}
+	mode := &MaintenanceMode{Message: message, Routes: routes, Since: time.Now().UTC(), retryAfter: retryAfter}
+	if retryAfter > 0 {
+		mode.RetryAfter = retryAfter.String()
+	}
+	return mode
+}
+
+// initMaintenance starts in maintenance mode when the config says so
+func initMaintenance(cfg MaintenanceConfig) {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	maintenance = nil
+	if cfg.Enabled {
+		maintenance = newMaintenanceMode(cfg.Message, cfg.Routes, cfg.RetryAfter)
+	}
+}
+
+// inMaintenance returns the maintenance covering the path, nil when it is served
+func inMaintenance(path string) *MaintenanceMode {
+	maintenanceMu.RLock()
+	mode := maintenance
+	maintenanceMu.RUnlock()
+	if mode == nil || path == "/" {
+		return nil
+	}
+	for _, exempt := range maintenanceExempt {
+		if strings.HasPrefix(path, exempt) {
+			return nil
+		}
+	}
+	if len(mode.Routes) == 0 {
+		return mode
+	}
+	for _, route := range mode.Routes {
+		if strings.HasPrefix(path, route) {
+			return mode
+		}
+	}
+	return nil
+}
+
+// Maintenance answers the requests of the routes in maintenance with a 503 in the openai error format
+func Maintenance() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mode := inMaintenance(c.Request.URL.Path)
+		if mode == nil {
+			c.Next()
+			return
+		}
+		if mode.retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(mode.retryAfter.Seconds())))
+		}
+		util.SendOpenAIError(c, http.StatusServiceUnavailable, "server_error", "maintenance", "", errors.New(mode.Message))
+		c.Abort()
+	}
+}
+
+// MaintenanceHandler shows the maintenance on GET, starts it on PUT with {"message": "...", "routes": ["/v1/chat"],
+// "retry_after": "10m"}, all fields optional, and ends it on DELETE
+func MaintenanceHandler(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodPut:
+		var body struct {
+			Message    string   `json:"message"`
+			Routes     []string `json:"routes"`
+			RetryAfter string   `json:"retry_after"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := util.NewJSONDecoder(c.Request.Body).Decode(&body); err != nil {
+				util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+				return
+			}
+		}
+		var retryAfter time.Duration
+		if body.RetryAfter != "" {
+			var err error
+			if retryAfter, err = time.ParseDuration(body.RetryAfter); err != nil || retryAfter < 0 {
+				util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "retry_after",
+					errors.Errorf("invalid retry_after %q", body.RetryAfter))
+				return
+			}
+		}
+		mode := newMaintenanceMode(body.Message, body.Routes, retryAfter)
+		maintenanceMu.Lock()
+		maintenance = mode
+		maintenanceMu.Unlock()
+		util.Warnf("maintenance mode on for %s", routesText(mode.Routes))
+	case http.MethodDelete:
+		maintenanceMu.Lock()
+		maintenance = nil
+		maintenanceMu.Unlock()
+		util.Warnf("maintenance mode off")
+	}
+	maintenanceMu.RLock()
+	defer maintenanceMu.RUnlock()
+	util.SendJSON(c, http.StatusOK, gin.H{"maintenance": maintenance})
+}
+
+func routesText(routes []string) string {
+	if len(routes) == 0 {
+		return "all routes"
+	}
+	return strings.Join(routes, ", ")
+}
@@ -0,0 +1,117 @@
+package azure
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	timeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aoai_proxy_time_to_first_token_seconds",
+		Help:    "Time from receiving a streaming request to the first generated token.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"model", "deployment", "tenant"})
+
+	outputTokensPerSecond = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aoai_proxy_output_tokens_per_second",
+		Help:    "Completion token throughput of streaming responses after the first token.",
+		Buckets: prometheus.ExponentialBuckets(5, 1.5, 12),
+	}, []string{"model", "deployment", "tenant"})
+
+	upstreamResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aoai_proxy_upstream_responses_total",
+		Help: "Upstream responses per deployment by status: 2xx, 3xx, 429, 4xx, 5xx or error when azure could not be reached.",
+	}, []string{"deployment", "endpoint", "status", "tenant"})
+
+	upstreamLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aoai_proxy_upstream_latency_seconds",
+		Help:    "Time until azure answered with response headers, per deployment.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"deployment", "endpoint", "tenant"})
+)
+
+// observeUpstream records the outcome of an upstream call of rc, status 0 stands for a transport error
+func observeUpstream(rc *rewriteContext, deployment *DeploymentConfig, start time.Time, status int) {
+	endpoint := ""
+	if deployment.EndpointUrl != nil {
+		endpoint = deployment.EndpointUrl.Host
+	}
+	upstreamResponses.WithLabelValues(deployment.DeploymentName, endpoint, statusClass(status), rc.tenant.name()).Inc()
+	recordHealth(deployment, status, nil)
+	observeErrorRate(deployment.DeploymentName, status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError)
+	if status > 0 {
+		upstreamLatency.WithLabelValues(deployment.DeploymentName, endpoint, rc.tenant.name()).Observe(time.Since(start).Seconds())
+	}
+}
+
+func statusClass(status int) string {
+	switch {
+	case status == 0:
+		return "error"
+	case status == http.StatusTooManyRequests:
+		return "429"
+	default:
+		return strconv.Itoa(status/100) + "xx"
+	}
+}
+
+// rewriteStreamMetrics instruments chat streams with time to first token and output throughput
+func rewriteStreamMetrics(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if !isChatCompletions(rc.req) || !rc.stream {
+		return false, nil
+	}
+
+	recorder := &streamMetricsRecorder{rc: rc}
+	rc.addResponseRewriter(recorder.rewrite)
+	rc.addStreamEndHook(recorder.end)
+	return false, nil
+}
+
+// streamMetricsRecorder observes the first content chunk of a stream
+type streamMetricsRecorder struct {
+	rc         *rewriteContext
+	firstToken time.Time
+}
+
+func (r *streamMetricsRecorder) rewrite(payload map[string]interface{}, stream bool) bool {
+	if !stream {
+		return true
+	}
+
+	choices, _ := payload["choices"].([]interface{})
+	for _, item := range choices {
+		choice, _ := item.(map[string]interface{})
+		delta, _ := choice["delta"].(map[string]interface{})
+		content := stringValue(delta["content"])
+		if content == "" && delta["tool_calls"] == nil {
+			continue
+		}
+		if r.firstToken.IsZero() {
+			r.firstToken = time.Now()
+			r.rc.firstToken = r.firstToken
+			timeToFirstToken.WithLabelValues(r.rc.deployment.ModelName, r.rc.deployment.DeploymentName, r.rc.tenant.name()).
+				Observe(r.firstToken.Sub(r.rc.start).Seconds())
+		}
+	}
+	return true
+}
+
+func (r *streamMetricsRecorder) end() []map[string]interface{} {
+	if r.firstToken.IsZero() {
+		return nil
+	}
+
+	tokens := r.rc.completionEstimate
+	if r.rc.usage != nil {
+		tokens = r.rc.usage.CompletionTokens
+	}
+	if elapsed := time.Since(r.firstToken).Seconds(); elapsed > 0 && tokens > 0 {
+		outputTokensPerSecond.WithLabelValues(r.rc.deployment.ModelName, r.rc.deployment.DeploymentName, r.rc.tenant.name()).
+			Observe(float64(tokens) / elapsed)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package azure
+
+import "net/http"
+
+// StreamMeta describes the stream a chunk belongs to
+type StreamMeta struct {
+	Model      string // model requested by the client
+	Deployment string // azure deployment serving the stream
+	Index      int    // position of the chunk within the stream, starting at 0
+}
+
+// StreamMiddleware inspects or transforms the json payload of one SSE chunk on the fly,
+// returning nil drops the chunk
+type StreamMiddleware func(chunk []byte, meta StreamMeta) []byte
+
+var streamMiddlewares []StreamMiddleware
+
+// RegisterStreamMiddleware adds a middleware applied to every streamed chunk in registration order,
+// it must be called before the server starts
+func RegisterStreamMiddleware(middleware StreamMiddleware) {
+	streamMiddlewares = append(streamMiddlewares, middleware)
+}
+
+// newStreamMiddlewareChain returns a func applying the registered middlewares to the chunks of one stream
+func newStreamMiddlewareChain(deployment *DeploymentConfig) func(chunk []byte) []byte {
+	meta := StreamMeta{Model: deployment.ModelName, Deployment: deployment.DeploymentName}
+	return func(chunk []byte) []byte {
+		for _, middleware := range streamMiddlewares {
+			if chunk == nil {
+				break
+			}
+			chunk = middleware(chunk, meta)
+		}
+		meta.Index++
+		return chunk
+	}
+}
+
+// RequestMeta describes the request a request or response mutator runs for
+type RequestMeta struct {
+	Model      string      // model the request is served by
+	Deployment string      // azure deployment serving the request
+	RequestID  string      // id of the request, see X-Request-ID
+	KeyID      string      // caller key id as shown in the access log
+	Stream     bool        // the client asked for a streamed response
+	Header     http.Header // request headers, changes are forwarded to azure
+}
+
+// RequestMutator transforms the decoded json body of a request right before it is forwarded to azure,
+// after the built-in rewrites, returning a *RequestError rejects the request with a 400
+type RequestMutator interface {
+	MutateRequest(body map[string]interface{}, meta *RequestMeta) (changed bool, err error)
+}
+
+// RequestMutatorFunc adapts a func to a RequestMutator
+type RequestMutatorFunc func(body map[string]interface{}, meta *RequestMeta) (bool, error)
+
+func (f RequestMutatorFunc) MutateRequest(body map[string]interface{}, meta *RequestMeta) (bool, error) {
+	return f(body, meta)
+}
+
+// ResponseMutator transforms a decoded json response, or a single SSE event when stream is true,
+// after the built-in rewrites, returning false drops the event
+type ResponseMutator interface {
+	MutateResponse(payload map[string]interface{}, stream bool, meta RequestMeta) bool
+}
+
+// ResponseMutatorFunc adapts a func to a ResponseMutator
+type ResponseMutatorFunc func(payload map[string]interface{}, stream bool, meta RequestMeta) bool
+
+func (f ResponseMutatorFunc) MutateResponse(payload map[string]interface{}, stream bool, meta RequestMeta) bool {
+	return f(payload, stream, meta)
+}
+
+var (
+	requestMutators  []RequestMutator
+	responseMutators []ResponseMutator
+)
+
+// RegisterRequestMutator adds a mutator applied to json request bodies in registration order,
+// it must be called before the server starts
+func RegisterRequestMutator(mutator RequestMutator) {
+	requestMutators = append(requestMutators, mutator)
+}
+
+// RegisterResponseMutator adds a mutator applied to json responses and SSE events in registration order,
+// it must be called before the server starts
+func RegisterResponseMutator(mutator ResponseMutator) {
+	responseMutators = append(responseMutators, mutator)
+}
+
+// rewriteMutators runs the registered request mutators and hooks the response mutators into the response
+func rewriteMutators(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if len(requestMutators) == 0 && len(responseMutators) == 0 {
+		return false, nil
+	}
+
+	meta := &RequestMeta{
+		Model:      rc.deployment.ModelName,
+		Deployment: rc.deployment.DeploymentName,
+		RequestID:  rc.requestID,
+		KeyID:      rc.keyID,
+		Stream:     rc.stream,
+		Header:     rc.req.Header,
+	}
+	changed := false
+	for _, mutator := range requestMutators {
+		c, err := mutator.MutateRequest(payload, meta)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || c
+	}
+
+	if len(responseMutators) > 0 {
+		responseMeta := *meta
+		rc.addResponseRewriter(func(payload map[string]interface{}, stream bool) bool {
+			for _, mutator := range responseMutators {
+				if !mutator.MutateResponse(payload, stream, responseMeta) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	return changed, nil
+}
+
+// CompletionHook rewrites the generated text of chat and text completions, text is the whole completion
+// of a choice for blocking responses and one delta for streams, final is set for the whole completion
+// and for the last chunk of a streamed choice, e.g. to append a disclaimer
+type CompletionHook func(text string, final bool, meta RequestMeta) string
+
+var completionHooks []CompletionHook
+
+// RegisterCompletionHook adds a hook applied to generated text in registration order,
+// it must be called before the server starts
+func RegisterCompletionHook(hook CompletionHook) {
+	completionHooks = append(completionHooks, hook)
+}
+
+// rewriteCompletionHooks hooks the registered completion hooks into the response
+func rewriteCompletionHooks(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if len(completionHooks) == 0 {
+		return false, nil
+	}
+
+	meta := RequestMeta{
+		Model:      rc.deployment.ModelName,
+		Deployment: rc.deployment.DeploymentName,
+		RequestID:  rc.requestID,
+		KeyID:      rc.keyID,
+		Stream:     rc.stream,
+		Header:     rc.req.Header,
+	}
+	rc.addResponseRewriter(func(payload map[string]interface{}, stream bool) bool {
+		choices, _ := payload["choices"].([]interface{})
+		for _, item := range choices {
+			choice, _ := item.(map[string]interface{})
+			if choice == nil {
+				continue
+			}
+			// chat completions carry the text in message or delta, text completions in text
+			holder, key := choice, "text"
+			if message, ok := choice["message"].(map[string]interface{}); ok && !stream {
+				holder, key = message, "content"
+			} else if delta, ok := choice["delta"].(map[string]interface{}); ok && stream {
+				holder, key = delta, "content"
+			}
+			text, isText := holder[key].(string)
+			if !isText && holder[key] != nil {
+				continue
+			}
+			final := !stream || choice["finish_reason"] != nil
+			result := text
+			for _, hook := range completionHooks {
+				result = hook(result, final, meta)
+			}
+			if result != text {
+				holder[key] = result
+			}
+		}
+		return true
+	})
+	return false, nil
+}
@@ -0,0 +1,223 @@
+package azure
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+const (
+	defaultMockContent    = "This is a mock response from azure-openai-proxy."
+	defaultMockDimensions = 8
+)
+
+type MockConfig struct {
+	Content    string        `yaml:"content" mapstructure:"content"`         // completion text of every response, a fixed sentence by default
+	Latency    time.Duration `yaml:"latency" mapstructure:"latency"`         // delay before the response headers
+	ChunkDelay time.Duration `yaml:"chunk_delay" mapstructure:"chunk_delay"` // delay between two streamed chunks
+}
+
+// mockUpstream answers upstream requests with fake completions instead of calling azure, set with --mock
+var mockUpstream bool
+
+// mockDeployment serves models missing from the config in mock mode, so no config is needed at all
+func mockDeployment(model string) *DeploymentConfig {
+	endpoint, _ := url.Parse("http://mock")
+	return &DeploymentConfig{
+		DeploymentName: model,
+		ModelName:      model,
+		Endpoint:       endpoint.String(),
+		EndpointUrl:    endpoint,
+		ApiKey:         "mock",
+		ApiVersion:     "2024-10-21",
+	}
+}
+
+// mockTransport fakes azure: chat completions and completions, streamed or not, answer with the configured content
+// and embeddings with small deterministic vectors, everything else is a 404
+type mockTransport struct {
+	config MockConfig
+}
+
+func (t mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var payload map[string]interface{}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		payload, _ = decodeJSON(body)
+	}
+	if t.config.Latency > 0 {
+		select {
+		case <-time.After(t.config.Latency):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	model, _ := payload["model"].(string)
+	if model == "" {
+		model = "mock"
+	}
+	content := t.config.Content
+	if content == "" {
+		content = defaultMockContent
+	}
+	promptTokens := estimateTokens(model, fmt.Sprint(payload["messages"], payload["prompt"], payload["input"]))
+	completionTokens := estimateTokens(model, content)
+	usage := map[string]interface{}{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": completionTokens,
+		"total_tokens":      promptTokens + completionTokens,
+	}
+	id := fmt.Sprintf("mock-%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/chat/completions"), strings.HasSuffix(req.URL.Path, "/completions"):
+		chat := strings.HasSuffix(req.URL.Path, "/chat/completions")
+		if payload["stream"] == true {
+			return t.stream(req, chat, id, created, model, content, usage), nil
+		}
+		choice := map[string]interface{}{"index": 0, "finish_reason": "stop"}
+		object := "text_completion"
+		if chat {
+			choice["message"] = map[string]interface{}{"role": "assistant", "content": content}
+			object = "chat.completion"
+		} else {
+			choice["text"] = content
+		}
+		return mockJSON(req, http.StatusOK, map[string]interface{}{
+			"id": id, "object": object, "created": created, "model": model,
+			"choices": []interface{}{choice}, "usage": usage,
+		}), nil
+	case strings.HasSuffix(req.URL.Path, "/embeddings"):
+		return mockJSON(req, http.StatusOK, mockEmbeddings(payload, model, promptTokens)), nil
+	case strings.HasSuffix(req.URL.Path, "/openai/deployments"), strings.HasSuffix(req.URL.Path, "/models"):
+		return mockJSON(req, http.StatusOK, map[string]interface{}{"object": "list", "data": []interface{}{}}), nil
+	}
+	return mockJSON(req, http.StatusNotFound, map[string]interface{}{
+		"error": map[string]interface{}{"code": "404", "message": "mock mode does not serve " + req.URL.Path},
+	}), nil
+}
+
+// stream sends the content word by word as SSE chunks, followed by a usage chunk and [DONE]
+func (t mockTransport) stream(req *http.Request, chat bool, id string, created int64, model, content string, usage map[string]interface{}) *http.Response {
+	reader, writer := io.Pipe()
+	go func() {
+		object := "text_completion"
+		if chat {
+			object = "chat.completion.chunk"
+		}
+		send := func(choices []interface{}, extra map[string]interface{}) error {
+			chunk := map[string]interface{}{"id": id, "object": object, "created": created, "model": model, "choices": choices}
+			for k, v := range extra {
+				chunk[k] = v
+			}
+			data, err := util.JSONMarshal(chunk)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(writer, "data: %s\n\n", data)
+			return err
+		}
+		words := strings.SplitAfter(content, " ")
+		for i, word := range words {
+			if i > 0 && t.config.ChunkDelay > 0 {
+				select {
+				case <-time.After(t.config.ChunkDelay):
+				case <-req.Context().Done():
+					writer.CloseWithError(req.Context().Err())
+					return
+				}
+			}
+			choice := map[string]interface{}{"index": 0, "finish_reason": nil}
+			if chat {
+				choice["delta"] = map[string]interface{}{"content": word}
+			} else {
+				choice["text"] = word
+			}
+			if i == len(words)-1 {
+				choice["finish_reason"] = "stop"
+			}
+			if err := send([]interface{}{choice}, nil); err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		if err := send([]interface{}{}, map[string]interface{}{"usage": usage}); err != nil {
+			writer.CloseWithError(err)
+			return
+		}
+		_, _ = io.WriteString(writer, "data: [DONE]\n\n")
+		writer.Close()
+	}()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"text/event-stream"}},
+		Body:       reader,
+		Request:    req,
+	}
+}
+
+// mockEmbeddings returns one vector per input, derived from a hash of the input so equal inputs get equal vectors
+func mockEmbeddings(payload map[string]interface{}, model string, promptTokens int64) map[string]interface{} {
+	var inputs []interface{}
+	switch input := payload["input"].(type) {
+	case []interface{}:
+		inputs = input
+	case nil:
+	default:
+		inputs = []interface{}{input}
+	}
+	dimensions := defaultMockDimensions
+	if n, ok := numberValue(payload["dimensions"]); ok && n > 0 {
+		dimensions = int(n)
+	}
+	data := make([]interface{}, 0, len(inputs))
+	for i, input := range inputs {
+		h := fnv.New64a()
+		_, _ = fmt.Fprint(h, input)
+		seed := h.Sum64()
+		vector := make([]float64, dimensions)
+		for j := range vector {
+			seed = seed*6364136223846793005 + 1442695040888963407
+			vector[j] = float64(seed>>11)/float64(1<<53)*2 - 1
+		}
+		data = append(data, map[string]interface{}{"object": "embedding", "index": i, "embedding": vector})
+	}
+	return map[string]interface{}{
+		"object": "list",
+		"model":  model,
+		"data":   data,
+		"usage":  map[string]interface{}{"prompt_tokens": promptTokens, "total_tokens": promptTokens},
+	}
+}
+
+func mockJSON(req *http.Request, status int, v interface{}) *http.Response {
+	data, _ := util.JSONMarshal(v)
+	return &http.Response{
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}
+}
@@ -13,17 +13,79 @@ import (
 )
 
 type DeploymentConfig struct {
-	DeploymentName string   `yaml:"deployment_name" json:"deployment_name" mapstructure:"deployment_name"` // azure openai deployment name
-	ModelName      string   `yaml:"model_name" json:"model_name" mapstructure:"model_name"`                // corresponding model name in openai
-	Endpoint       string   `yaml:"endpoint" json:"endpoint" mapstructure:"endpoint"`                      // deployment endpoint
-	ApiKey         string   `yaml:"api_key" json:"api_key" mapstructure:"api_key"`                         // secrect key1 or 2
-	ApiVersion     string   `yaml:"api_version" json:"api_version" mapstructure:"api_version"`             // deployment version, not required
-	EndpointUrl    *url.URL // url.URL form deployment endpoint
+	DeploymentName         string                   `yaml:"deployment_name" json:"deployment_name" mapstructure:"deployment_name"`                            // azure openai deployment name
+	Type                   string                   `yaml:"type" json:"type" mapstructure:"type"`                                                             // azure (default), openai-compatible, serverless or inference, see backend.go
+	ExtraParameters        string                   `yaml:"extra_parameters" json:"extra_parameters" mapstructure:"extra_parameters"`                         // extra-parameters header of the model inference api: pass-through, drop or error
+	ModelName              string                   `yaml:"model_name" json:"model_name" mapstructure:"model_name"`                                           // corresponding model name in openai
+	Endpoint               string                   `yaml:"endpoint" json:"endpoint" mapstructure:"endpoint"`                                                 // deployment endpoint
+	ApiKey                 string                   `yaml:"api_key" json:"api_key" mapstructure:"api_key"`                                                    // secrect key1 or 2
+	ApiVersion             string                   `yaml:"api_version" json:"api_version" mapstructure:"api_version"`                                        // deployment version, not required
+	PinApiVersion          bool                     `yaml:"pin_api_version" json:"pin_api_version" mapstructure:"pin_api_version"`                            // never raise api_version automatically for newer features
+	StripUnsupportedParams bool                     `yaml:"strip_unsupported_params" json:"strip_unsupported_params" mapstructure:"strip_unsupported_params"` // drop params a pinned api_version doesn't support instead of rejecting the request
+	Reasoning              bool                     `yaml:"reasoning" json:"reasoning" mapstructure:"reasoning"`                                              // o-series reasoning model, detected from model_name (o1, o3-mini, ...) when not set
+	SynthesizeStream       bool                     `yaml:"synthesize_stream" json:"synthesize_stream" mapstructure:"synthesize_stream"`                      // strip stream for deployments rejecting it and re-emit the response as SSE
+	StripAzureFields       bool                     `yaml:"strip_azure_fields" json:"strip_azure_fields" mapstructure:"strip_azure_fields"`                   // remove content filter results and empty chunks from responses
+	EmbeddingsBatchSize    int                      `yaml:"embeddings_batch_size" json:"embeddings_batch_size" mapstructure:"embeddings_batch_size"`          // max inputs per upstream embeddings call, larger requests are split, 0 disables splitting
+	ContextWindow          int                      `yaml:"context_window" json:"context_window" mapstructure:"context_window"`                               // context window in tokens for prompt truncation, detected from model_name when not set
+	Proxy                  string                   `yaml:"proxy" json:"proxy" mapstructure:"proxy"`                                                          // egress proxy of this deployment overriding outbound.proxy and the environment, direct for none
+	ClientCert             string                   `yaml:"client_cert" json:"client_cert" mapstructure:"client_cert"`                                        // PEM client certificate presented to this deployment for mutual TLS, overrides outbound.tls.cert_file
+	ClientKey              string                   `yaml:"client_key" json:"-" mapstructure:"client_key"`                                                    // PEM private key of client_cert
+	Cloud                  string                   `yaml:"cloud" json:"cloud" mapstructure:"cloud"`                                                          // public, china or government, detected from the endpoint host when not set
+	AAD                    *AADConfig               `yaml:"aad" json:"aad" mapstructure:"aad"`                                                                // service principal used instead of api_key, tokens are requested from the authority of the cloud
+	OpenAIFallback         *OpenAIFallback          `yaml:"openai_fallback" json:"-" mapstructure:"openai_fallback"`                                          // api.openai.com backend used as last resort when the deployment is down or throttled
+	AuthHeader             string                   `yaml:"auth_header" json:"auth_header" mapstructure:"auth_header"`                                        // header carrying the key upstream, api-key by default, e.g. Authorization for bearer-token endpoints
+	AuthScheme             string                   `yaml:"auth_scheme" json:"auth_scheme" mapstructure:"auth_scheme"`                                        // scheme put in front of the key, e.g. Bearer, empty sends the bare key
+	Headers                map[string]string        `yaml:"headers" json:"headers" mapstructure:"headers"`                                                    // static headers sent with every upstream request, e.g. Ocp-Apim-Subscription-Key for API Management
+	DataSources            []map[string]interface{} `yaml:"data_sources" json:"data_sources" mapstructure:"data_sources"`                                     // default "On Your Data" data_sources for chat completions, not required
+	EndpointUrl            *url.URL                 `yaml:"-" json:"-" mapstructure:"-"`                                                                      // url.URL form deployment endpoint
 }
 
 type Config struct {
-	ApiBase          string             `yaml:"api_base" mapstructure:"api_base"`                   // if you use openai、langchain as sdk, it will be useful
-	DeploymentConfig []DeploymentConfig `yaml:"deployment_config" mapstructure:"deployment_config"` // deployment config
+	ApiBase             string               `yaml:"api_base" mapstructure:"api_base"`                           // if you use openai、langchain as sdk, it will be useful
+	DeploymentConfig    []DeploymentConfig   `yaml:"deployment_config" mapstructure:"deployment_config"`         // deployment config
+	LiteLLMConfig       string               `yaml:"litellm_config" mapstructure:"litellm_config"`               // litellm config.yaml whose model_list is added to deployment_config
+	Mock                MockConfig           `yaml:"mock" mapstructure:"mock"`                                   // fake completions served in mock mode (--mock), azure is never called
+	Vision              VisionConfig         `yaml:"vision" mapstructure:"vision"`                               // image input limits for chat completions
+	StripAzureFields    bool                 `yaml:"strip_azure_fields" mapstructure:"strip_azure_fields"`       // remove content filter results and empty chunks from all responses
+	Timeout             TimeoutConfig        `yaml:"timeout" mapstructure:"timeout"`                             // upstream first byte, stream idle and total timeouts
+	Compression         CompressionConfig    `yaml:"compression" mapstructure:"compression"`                     // gzip of non-streaming responses
+	Streaming           StreamingConfig      `yaml:"streaming" mapstructure:"streaming"`                         // response flushing and buffering
+	StreamUsage         string               `yaml:"stream_usage" mapstructure:"stream_usage"`                   // end every chat stream with a usage chunk: inject or estimate, empty disables it
+	Outbound            OutboundConfig       `yaml:"outbound" mapstructure:"outbound"`                           // connection pool, tls, proxy and dns settings of the connections to azure
+	Models              ModelsConfig         `yaml:"models" mapstructure:"models"`                               // caching and deadline of the deployment listings behind /v1/models
+	Concurrency         ConcurrencyConfig    `yaml:"concurrency" mapstructure:"concurrency"`                     // cap of the requests in flight to azure
+	Tracing             TracingConfig        `yaml:"tracing" mapstructure:"tracing"`                             // opentelemetry spans of proxied requests
+	Admin               AdminConfig          `yaml:"admin" mapstructure:"admin"`                                 // admin endpoints
+	Usage               UsageConfig          `yaml:"usage" mapstructure:"usage"`                                 // token usage accounting
+	Pricing             []ModelPrice         `yaml:"pricing" mapstructure:"pricing"`                             // price per 1K tokens of models, for cost estimation
+	AppInsights         AppInsightsConfig    `yaml:"app_insights" mapstructure:"app_insights"`                   // request telemetry and token metrics exported to application insights
+	Alerts              AlertsConfig         `yaml:"alerts" mapstructure:"alerts"`                               // webhook alerts on error rate and quota events
+	Events              EventsConfig         `yaml:"events" mapstructure:"events"`                               // one event per completed request published to kafka or nats
+	Health              HealthConfig         `yaml:"health" mapstructure:"health"`                               // deployment health shown by /healthz
+	SlowRequest         SlowRequestConfig    `yaml:"slow_request" mapstructure:"slow_request"`                   // log requests slower than the thresholds with their routing
+	LogContent          string               `yaml:"log_content" mapstructure:"log_content"`                     // when request bodies are logged: never, errors_only (default) or always
+	LogContentLimit     int                  `yaml:"log_content_limit" mapstructure:"log_content_limit"`         // bytes of a request body logged, 8192 by default
+	LogLevel            string               `yaml:"log_level" mapstructure:"log_level"`                         // debug, info (default), warn or error, can be changed at runtime with PUT /admin/loglevel
+	JSONEngine          string               `yaml:"json_engine" mapstructure:"json_engine"`                     // sonic (default) or std for encoding/json, used for every json body and payload
+	SystemPrompts       []SystemPromptConfig `yaml:"system_prompts" mapstructure:"system_prompts"`               // system messages applied to chat completions per caller key, the first match wins
+	ModelAliases        []ModelAlias         `yaml:"model_aliases" mapstructure:"model_aliases"`                 // requested models served by the deployment of another model
+	SamplingPolicies    []SamplingPolicy     `yaml:"sampling_policies" mapstructure:"sampling_policies"`         // forced or bounded sampling parameters per caller key or model, the first match wins
+	InjectUser          bool                 `yaml:"inject_user" mapstructure:"inject_user"`                     // set the user field of requests lacking one to the caller key id
+	Policies            []ScriptPolicy       `yaml:"policies" mapstructure:"policies"`                           // expression policies evaluated per request, see ScriptPolicy
+	Truncation          TruncationConfig     `yaml:"truncation" mapstructure:"truncation"`                       // trim chat prompts exceeding the context window of the deployment
+	PII                 PIIConfig            `yaml:"pii" mapstructure:"pii"`                                     // mask personal data in prompts before they leave for azure
+	ApiVersionOverrides []string             `yaml:"api_version_overrides" mapstructure:"api_version_overrides"` // api-versions clients may select per request with X-Api-Version, "*" allows any
+	QueryPassthrough    []QueryPassthrough   `yaml:"query_passthrough" mapstructure:"query_passthrough"`         // per route allowlist of query parameters forwarded to azure, empty forwards all of them
+	PromptTemplates     []PromptTemplate     `yaml:"prompt_templates" mapstructure:"prompt_templates"`           // named prompts expanded into chat messages, see PromptTemplate
+	ValidateRequests    bool                 `yaml:"validate_requests" mapstructure:"validate_requests"`         // reject malformed chat, completion, embeddings and image requests with a precise 400
+	DryRun              bool                 `yaml:"dry_run" mapstructure:"dry_run"`                             // answer requests with the X-Proxy-Dry-Run header with the converted upstream request instead of sending it
+	Debug               DebugConfig          `yaml:"debug" mapstructure:"debug"`                                 // log the conversion pipeline of requests sent with the X-Proxy-Debug header
+	Capture             CaptureConfig        `yaml:"capture" mapstructure:"capture"`                             // traffic captures of one caller key started with PUT /admin/capture
+	VirtualKeys         VirtualKeysConfig    `yaml:"virtual_keys" mapstructure:"virtual_keys"`                   // client keys issued through /admin/keys, required by every request once enabled
+	Maintenance         MaintenanceConfig    `yaml:"maintenance" mapstructure:"maintenance"`                     // answer the api routes with a 503 maintenance message, toggled with /admin/maintenance
+	TenantHeader        string               `yaml:"tenant_header" mapstructure:"tenant_header"`                 // request header naming the tenant, X-Tenant-ID by default
+	TrustTenantHeader   bool                 `yaml:"trust_tenant_header" mapstructure:"trust_tenant_header"`     // serve any caller as the tenant of the header, only behind a gateway setting it; else tenants are selected by their virtual keys
+	Tenants             []TenantConfig       `yaml:"tenants" mapstructure:"tenants"`                             // customers served by deployments of their own, untagged requests use deployment_config
 }
 
 type RequestConverter interface {
@@ -44,12 +106,40 @@ func (c *StripPrefixConverter) Convert(req *http.Request, config *DeploymentConf
 	req.URL.Host = config.EndpointUrl.Host
 	req.URL.Path = path.Join(fmt.Sprintf("/openai/deployments/%s", config.DeploymentName), strings.Replace(req.URL.Path, c.Prefix+"/", "/", 1))
 	req.URL.RawPath = req.URL.EscapedPath()
+	if config.openAICompatible() {
+		return convertOpenAICompatible(req, config)
+	}
 
 	query := req.URL.Query()
-	query.Add("api-version", config.ApiVersion)
+	query.Set("api-version", config.ApiVersion)
 	req.URL.RawQuery = query.Encode()
+	setDeploymentHeaders(req, config)
 	return req, nil
 }
+
+// setAuthHeader sets the key in the auth header of the deployment, api-key unless auth_header says otherwise
+// and a bearer Authorization header for AAD tokens, openai-compatible servers and serverless endpoints
+func setAuthHeader(req *http.Request, config *DeploymentConfig, token string) {
+	name, scheme := config.AuthHeader, config.AuthScheme
+	if name == "" && (config.AAD != nil || config.bearerAuth()) {
+		name, scheme = "Authorization", "Bearer"
+	}
+	if name == "" {
+		name = AuthHeaderKey
+	}
+	if scheme != "" {
+		token = scheme + " " + token
+	}
+	req.Header.Set(name, token)
+}
+
+// setDeploymentHeaders sets the static headers of the deployment on an upstream request
+func setDeploymentHeaders(req *http.Request, config *DeploymentConfig) {
+	for name, value := range config.Headers {
+		req.Header.Set(name, value)
+	}
+}
+
 func NewStripPrefixConverter(prefix string) *StripPrefixConverter {
 	return &StripPrefixConverter{
 		Prefix: prefix,
@@ -82,10 +172,14 @@ func (c *TemplateConverter) Convert(req *http.Request, config *DeploymentConfig)
 	req.URL.Host = config.EndpointUrl.Host
 	req.URL.Path = buff.String()
 	req.URL.RawPath = req.URL.EscapedPath()
+	if config.openAICompatible() {
+		return convertOpenAICompatible(req, config)
+	}
 
 	query := req.URL.Query()
-	query.Add("api-version", config.ApiVersion)
+	query.Set("api-version", config.ApiVersion)
 	req.URL.RawQuery = query.Encode()
+	setDeploymentHeaders(req, config)
 	return req, nil
 }
 func NewTemplateConverter(tpl string) *TemplateConverter {
@@ -0,0 +1,197 @@
+package azure
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultModelsCacheTTL    = time.Minute
+	defaultModelsTimeout     = 10 * time.Second
+	defaultModelsConcurrency = 8
+)
+
+// ModelsConfig controls the deployment listings merged into /v1/models
+type ModelsConfig struct {
+	CacheTTL    time.Duration `yaml:"cache_ttl" mapstructure:"cache_ttl"`     // listings older than it are refreshed in the background, 1m by default, negative disables caching
+	Timeout     time.Duration `yaml:"timeout" mapstructure:"timeout"`         // deadline of the listing call to one deployment, 10s by default
+	Concurrency int           `yaml:"concurrency" mapstructure:"concurrency"` // deployments listed in parallel, 8 by default
+}
+
+// modelListCache keeps the last successful listing of every deployment, a failing deployment keeps its previous listing
+type modelListCache struct {
+	mu      sync.Mutex
+	entries map[string][]map[string]interface{}
+	fetched time.Time
+	// refreshes coalesces the refreshes of concurrent requests
+	refreshes singleflight.Group
+}
+
+var deploymentModels = &modelListCache{entries: map[string][]map[string]interface{}{}}
+
+// list returns the merged listings of all deployments, stale listings are served while a refresh runs
+func (m *modelListCache) list(ctx context.Context, key *VirtualKey) []map[string]interface{} {
+	ttl := C.Models.CacheTTL
+	if ttl == 0 {
+		ttl = defaultModelsCacheTTL
+	}
+	if ttl < 0 {
+		return mergeModelLists(fetchDeploymentModels(ctx), key)
+	}
+
+	m.mu.Lock()
+	fetched := m.fetched
+	m.mu.Unlock()
+	if fetched.IsZero() || time.Since(fetched) > ttl {
+		refresh := m.refreshes.DoChan("refresh", func() (interface{}, error) {
+			m.refresh()
+			return nil, nil
+		})
+		if fetched.IsZero() {
+			// nothing listed yet, wait for the refresh as long as the client does
+			select {
+			case <-refresh:
+			case <-ctx.Done():
+			}
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return mergeModelLists(m.entries, key)
+}
+
+// refresh lists the deployments again, detached from the request starting it since other requests wait for it too.
+// The cache only counts as fetched when a deployment answered, so a failed first listing is retried by the next request
+func (m *modelListCache) refresh() {
+	timeout, limit := modelsListing()
+	rounds := (len(currentDeployments()) + limit - 1) / limit
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rounds+1)*timeout)
+	defer cancel()
+	lists := fetchDeploymentModels(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	listed := len(lists) == 0
+	for model, list := range lists {
+		if list != nil {
+			m.entries[model] = list
+			listed = true
+		}
+	}
+	if listed {
+		m.fetched = time.Now()
+	}
+}
+
+// forget drops the listing of a removed model
+func (m *modelListCache) forget(model string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, model)
+}
+
+// mergeModelLists concatenates the listings in model order so responses are stable, only keeping the models the
+// caller key may use, all of them without key
+func mergeModelLists(lists map[string][]map[string]interface{}, key *VirtualKey) []map[string]interface{} {
+	models := make([]string, 0, len(lists))
+	for model := range lists {
+		if key == nil || key.allowsModel(model) {
+			models = append(models, model)
+		}
+	}
+	sort.Strings(models)
+	var result []map[string]interface{}
+	for _, model := range models {
+		result = append(result, lists[model]...)
+	}
+	return result
+}
+
+// modelsListing returns the timeout of a deployment listing and the number of listings run in parallel
+func modelsListing() (time.Duration, int) {
+	timeout := C.Models.Timeout
+	if timeout <= 0 {
+		timeout = defaultModelsTimeout
+	}
+	limit := C.Models.Concurrency
+	if limit <= 0 {
+		limit = defaultModelsConcurrency
+	}
+	return timeout, limit
+}
+
+// fetchDeploymentModels lists the deployments of every configured endpoint, at most models.concurrency
+// at a time and each within models.timeout, the listing of a failing deployment is nil
+func fetchDeploymentModels(ctx context.Context) map[string][]map[string]interface{} {
+	timeout, limit := modelsListing()
+
+	var mu sync.Mutex
+	deployments := currentDeployments()
+	lists := make(map[string][]map[string]interface{}, len(deployments))
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(limit)
+	for model, deployment := range deployments {
+		model, deployment := model, deployment
+		group.Go(func() error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			data, err := fetchDeploymentList(ctx, &deployment)
+			if err != nil {
+				// a failing deployment must not cancel the others, so the error is not returned
+				log.Printf("error listing deployments for deployment %s: %v", deployment.DeploymentName, err)
+			}
+			mu.Lock()
+			lists[model] = data
+			mu.Unlock()
+			return nil
+		})
+	}
+	_ = group.Wait()
+	return lists
+}
+
+func fetchDeploymentList(ctx context.Context, deployment *DeploymentConfig) ([]map[string]interface{}, error) {
+	if backend := deployment.backendType(); backend == BackendServerless || backend == BackendInference {
+		// the configured model is the only one served through this deployment, there is nothing to list
+		return []map[string]interface{}{{"id": deployment.ModelName, "object": "model", "owned_by": "azure-ai"}}, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, deploymentModelsURL(deployment), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create request")
+	}
+	token, err := upstreamToken(ctx, deployment)
+	if err != nil {
+		return nil, err
+	}
+	setAuthHeader(req, deployment, token)
+	setDeploymentHeaders(req, deployment)
+
+	client := &http.Client{Transport: transportFor(deployment)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "send request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "read response body")
+	}
+	var info DeploymentInfo
+	if err := util.JSONUnmarshal(body, &info); err != nil {
+		return nil, errors.Wrap(err, "parse response body")
+	}
+	return info.Data, nil
+}
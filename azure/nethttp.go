@@ -0,0 +1,48 @@
+package azure
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeParams are the route parameters read by the handlers of the package
+var routeParams = []string{"model", "deployment", "name", "id"}
+
+// ParamFunc reads a route parameter of the request, e.g. chi.URLParam, or r.PathValue of the go 1.22 ServeMux.
+// Parameters it doesn't know are returned empty
+type ParamFunc func(r *http.Request, name string) string
+
+// HTTPHandler serves a handler of the package, such as ModelProxy or ProxyWithConverter, on net/http for routers
+// other than gin. Route parameters are read with param, which may be nil when the route has none. Like RegisterRoutes
+// it answers panics and maintenance in the openai error format.
+//
+// This is an adapter, the core isn't decoupled from gin: the handler still runs on a gin.Context inside a private
+// gin engine built once per call of HTTPHandler, so build the handlers at startup rather than per request
+func HTTPHandler(handler gin.HandlerFunc, param ParamFunc) http.Handler {
+	engine := gin.New()
+	engine.Use(RequestID(), Recovery(), Maintenance())
+	engine.Any("/*path", func(c *gin.Context) {
+		c.Params = c.Params[:0]
+		if param != nil {
+			for _, name := range routeParams {
+				if value := param(c.Request, name); value != "" {
+					c.Params = append(c.Params, gin.Param{Key: name, Value: value})
+				}
+			}
+		}
+		handler(c)
+	})
+	return engine
+}
+
+// ProxyHandler serves openai api requests on net/http, the model is read from the model route parameter, else from
+// the request body
+func ProxyHandler(requestConverter RequestConverter, param ParamFunc) http.Handler {
+	return HTTPHandler(ProxyWithConverter(requestConverter), param)
+}
+
+// AzureDeploymentHandler serves azure openai api requests on net/http, param must return the deployment route parameter
+func AzureDeploymentHandler(param ParamFunc) http.Handler {
+	return HTTPHandler(AzureDeploymentProxy, param)
+}
@@ -0,0 +1,233 @@
+package azure
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// PIIConfig masks personal data in prompts before they are forwarded to azure
+type PIIConfig struct {
+	Enabled     bool `yaml:"enabled" mapstructure:"enabled"` // scrub prompts of the matching keys and models
+	PolicyMatch `yaml:",inline" mapstructure:",squash"`
+	Detectors   []string     `yaml:"detectors" mapstructure:"detectors"` // built-in or registered detectors to run, empty runs all of them
+	Patterns    []PIIPattern `yaml:"patterns" mapstructure:"patterns"`   // additional regex detectors
+}
+
+// PIIPattern is a regex detector configured in the config file
+type PIIPattern struct {
+	Name  string `yaml:"name" mapstructure:"name"`   // kind of data, used in the mask, e.g. [EMPLOYEE_ID]
+	Regex string `yaml:"regex" mapstructure:"regex"` // go regexp matching the data
+}
+
+// PIIDetector finds personal data of one kind in a text
+type PIIDetector interface {
+	// Name is the kind of data found, matches are masked as [NAME]
+	Name() string
+	// Find returns the [start, end) byte offsets of the matches in text
+	Find(text string) [][]int
+}
+
+var (
+	piiDetectors    = map[string]PIIDetector{}
+	activeDetectors []PIIDetector
+
+	piiMasked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aoai_proxy_pii_masked_total",
+		Help: "Personal data matches masked in prompts, per kind of data.",
+	}, []string{"kind"})
+)
+
+// RegisterPIIDetector adds a detector selectable in pii.detectors, it must be called before the server starts
+func RegisterPIIDetector(detector PIIDetector) {
+	piiDetectors[detector.Name()] = detector
+}
+
+type regexDetector struct {
+	name  string
+	re    *regexp.Regexp
+	check func(match string) bool
+}
+
+func (d *regexDetector) Name() string {
+	return d.name
+}
+
+func (d *regexDetector) Find(text string) [][]int {
+	matches := d.re.FindAllStringIndex(text, -1)
+	if d.check == nil {
+		return matches
+	}
+	result := matches[:0]
+	for _, m := range matches {
+		if d.check(text[m[0]:m[1]]) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func init() {
+	RegisterPIIDetector(&regexDetector{name: "email", re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)})
+	RegisterPIIDetector(&regexDetector{name: "credit_card", re: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), check: luhnValid})
+	RegisterPIIDetector(&regexDetector{name: "ssn", re: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)})
+	RegisterPIIDetector(&regexDetector{name: "phone", re: regexp.MustCompile(`(?:\+\d{1,3}[ .-]?\(?\d{1,4}\)?(?:[ .-]?\d{2,4}){2,4}|\(\d{3}\)[ .-]?\d{3}[ .-]\d{4}|\b\d{3}[.-]\d{3}[.-]\d{4})\b`)})
+	RegisterPIIDetector(&regexDetector{name: "ip_address", re: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`)})
+}
+
+// luhnValid reports whether the digits of s pass the luhn checksum of card numbers
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// compilePIIDetectors selects the configured detectors, credit cards are checked before phone numbers
+func compilePIIDetectors(config PIIConfig) error {
+	detectors, err := buildPIIDetectors(config)
+	if err != nil {
+		return err
+	}
+	activeDetectors = detectors
+	return nil
+}
+
+func buildPIIDetectors(config PIIConfig) ([]PIIDetector, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	var detectors []PIIDetector
+	names := config.Detectors
+	if len(names) == 0 {
+		for name := range piiDetectors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		detector, ok := piiDetectors[name]
+		if !ok {
+			return nil, errors.Errorf("unknown pii detector %q", name)
+		}
+		detectors = append(detectors, detector)
+	}
+	for _, p := range config.Patterns {
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return nil, errors.Wrapf(err, "compile pii pattern %q", p.Name)
+		}
+		detectors = append(detectors, &regexDetector{name: p.Name, re: re})
+	}
+	sort.SliceStable(detectors, func(i, j int) bool {
+		return detectors[i].Name() == "credit_card" && detectors[j].Name() != "credit_card"
+	})
+	return detectors, nil
+}
+
+// scrubPII masks the matches of the active detectors in text, earlier detectors win on overlaps
+func scrubPII(text string) (string, bool) {
+	type span struct {
+		start, end int
+		kind       string
+	}
+	var spans []span
+	for _, detector := range activeDetectors {
+	matches:
+		for _, m := range detector.Find(text) {
+			for _, s := range spans {
+				if m[0] < s.end && s.start < m[1] {
+					continue matches
+				}
+			}
+			spans = append(spans, span{m[0], m[1], detector.Name()})
+		}
+	}
+	if len(spans) == 0 {
+		return text, false
+	}
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	result := make([]byte, 0, len(text))
+	last := 0
+	for _, s := range spans {
+		result = append(result, text[last:s.start]...)
+		result = append(result, fmt.Sprintf("[%s]", upperName(s.kind))...)
+		last = s.end
+		piiMasked.WithLabelValues(s.kind).Inc()
+	}
+	result = append(result, text[last:]...)
+	return string(result), true
+}
+
+func upperName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' {
+			b[i] = c - 'a' + 'A'
+		}
+	}
+	return string(b)
+}
+
+// rewriteScrubPII masks personal data in chat messages, completion prompts and embeddings inputs
+func rewriteScrubPII(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if len(activeDetectors) == 0 || !C.PII.matches(rc) {
+		return false, nil
+	}
+
+	changed := false
+	scrub := func(v interface{}) interface{} {
+		if s, ok := v.(string); ok {
+			if masked, c := scrubPII(s); c {
+				changed = true
+				return masked
+			}
+		}
+		return v
+	}
+	messages, _ := payload["messages"].([]interface{})
+	for _, item := range messages {
+		message, _ := item.(map[string]interface{})
+		switch content := message["content"].(type) {
+		case string:
+			message["content"] = scrub(content)
+		case []interface{}:
+			for _, p := range content {
+				if part, ok := p.(map[string]interface{}); ok && part["type"] == "text" {
+					part["text"] = scrub(part["text"])
+				}
+			}
+		}
+	}
+	for _, field := range []string{"prompt", "input"} {
+		switch value := payload[field].(type) {
+		case string:
+			payload[field] = scrub(value)
+		case []interface{}:
+			for i := range value {
+				value[i] = scrub(value[i])
+			}
+		}
+	}
+	if changed {
+		rc.debugf("masked personal data in the prompt")
+	}
+	return changed, nil
+}
@@ -0,0 +1,135 @@
+package azure
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// ScriptPolicy is a request policy written as expr expressions (https://expr-lang.org), evaluated per request
+// with the variables model, key_id, path, stream, body (the decoded json request) and header
+type ScriptPolicy struct {
+	Route   string            `yaml:"route" mapstructure:"route"`     // path the policy applies to, e.g. /v1/chat/completions, empty matches every route
+	When    string            `yaml:"when" mapstructure:"when"`       // bool expression selecting the requests, empty matches all
+	Reject  string            `yaml:"reject" mapstructure:"reject"`   // bool expression rejecting the request with a 400
+	Message string            `yaml:"message" mapstructure:"message"` // error message of rejected requests
+	Model   string            `yaml:"model" mapstructure:"model"`     // string expression replacing the requested model
+	Headers map[string]string `yaml:"headers" mapstructure:"headers"` // string expressions of headers added to the upstream request
+}
+
+type compiledPolicy struct {
+	*ScriptPolicy
+	when, reject, model *vm.Program
+	headers             map[string]*vm.Program
+}
+
+var scriptPolicies []compiledPolicy
+
+// policyEnv is the environment of policy expressions
+type policyEnv struct {
+	Model  string                 `expr:"model"`
+	KeyID  string                 `expr:"key_id"`
+	Path   string                 `expr:"path"`
+	Stream bool                   `expr:"stream"`
+	Body   map[string]interface{} `expr:"body"`
+	Header func(string) string    `expr:"header"`
+}
+
+// compileScriptPolicies compiles the configured policies, invalid expressions fail the startup
+func compileScriptPolicies(policies []ScriptPolicy) error {
+	compiled, err := buildScriptPolicies(policies)
+	if err != nil {
+		return err
+	}
+	scriptPolicies = compiled
+	return nil
+}
+
+func buildScriptPolicies(policies []ScriptPolicy) ([]compiledPolicy, error) {
+	compiled := make([]compiledPolicy, 0, len(policies))
+	for i := range policies {
+		p := compiledPolicy{ScriptPolicy: &policies[i], headers: map[string]*vm.Program{}}
+		var err error
+		compile := func(source string, options ...expr.Option) *vm.Program {
+			if source == "" || err != nil {
+				return nil
+			}
+			var program *vm.Program
+			program, err = expr.Compile(source, append(options, expr.Env(policyEnv{}))...)
+			if err != nil {
+				err = errors.Wrapf(err, "policy %d: compile %q", i, source)
+			}
+			return program
+		}
+		p.when = compile(p.When, expr.AsBool())
+		p.reject = compile(p.Reject, expr.AsBool())
+		p.model = compile(p.Model, expr.AsKind(reflect.String))
+		for name, source := range p.Headers {
+			p.headers[http.CanonicalHeaderKey(name)] = compile(source, expr.AsKind(reflect.String))
+		}
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, p)
+	}
+	return compiled, nil
+}
+
+// applyScriptPolicies evaluates the policies of the route against the decoded json body, nil for other bodies, it
+// returns the model to use and a *RequestError when a policy rejects the request. An expression failing at runtime,
+// e.g. on a body field of another type, is logged and doesn't match
+func applyScriptPolicies(req *http.Request, route, model, keyID string, payload map[string]interface{}) (string, error) {
+	if len(scriptPolicies) == 0 {
+		return model, nil
+	}
+
+	env := policyEnv{
+		Model:  model,
+		KeyID:  keyID,
+		Path:   route,
+		Stream: payload["stream"] == true,
+		Body:   payload,
+		Header: req.Header.Get,
+	}
+	run := func(program *vm.Program, source string) interface{} {
+		result, err := expr.Run(program, env)
+		if err != nil {
+			util.Warnf("policy %q failed on %s, treated as no match: %v", source, route, err)
+			return nil
+		}
+		return result
+	}
+
+	for _, p := range scriptPolicies {
+		if p.Route != "" && p.Route != route {
+			continue
+		}
+		if p.when != nil && run(p.when, p.When) != true {
+			continue
+		}
+		if p.reject != nil && run(p.reject, p.Reject) == true {
+			message := p.Message
+			if message == "" {
+				message = fmt.Sprintf("request rejected by policy %q", p.Reject)
+			}
+			return model, &RequestError{Message: message}
+		}
+		if p.model != nil {
+			if m, _ := run(p.model, p.Model).(string); m != "" {
+				env.Model = m
+			}
+		}
+		for name, program := range p.headers {
+			if value, _ := run(program, name).(string); value != "" {
+				req.Header.Set(name, strings.TrimSpace(value))
+			}
+		}
+	}
+	return env.Model, nil
+}
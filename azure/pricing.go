@@ -0,0 +1,28 @@
+package azure
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ModelPrice is the price of a model per 1K tokens, in the currency of the azure bill
+type ModelPrice struct {
+	Model  string  `yaml:"model" mapstructure:"model"`   // model name as sent by clients
+	Input  float64 `yaml:"input" mapstructure:"input"`   // per 1K prompt tokens
+	Output float64 `yaml:"output" mapstructure:"output"` // per 1K completion tokens
+}
+
+var requestCost = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "aoai_proxy_cost_total",
+	Help: "Estimated cost of proxied requests from the configured price table, per caller key, model and tenant.",
+}, []string{"key_id", "model", "tenant"})
+
+// requestCostOf prices the usage of a request, models missing from the price table cost nothing
+func requestCostOf(model string, promptTokens, completionTokens int64) float64 {
+	for _, price := range C.Pricing {
+		if price.Model == model {
+			return float64(promptTokens)/1000*price.Input + float64(completionTokens)/1000*price.Output
+		}
+	}
+	return 0
+}
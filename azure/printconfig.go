@@ -0,0 +1,64 @@
+package azure
+
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretSettings are the settings holding credentials, MarshalRedactedConfig masks them
+var secretSettings = map[string]bool{
+	"api_key":           true,
+	"client_secret":     true,
+	"client_key":        true,
+	"token":             true,
+	"dsn":               true,
+	"connection_string": true,
+	"password":          true,
+	"secret":            true,
+}
+
+// MarshalRedactedConfig returns the config file form of cfg with the credentials in it redacted: keys, tokens,
+// connection strings and the values of headers named like a credential
+func MarshalRedactedConfig(cfg Config) ([]byte, error) {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	redactNode(&doc, false, false)
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// redactNode masks the secret settings below node, every value of a headers mapping is checked by its header name
+// and the data_sources of the deployments by the credential fields of request bodies
+func redactNode(node *yaml.Node, headers, dataSources bool) {
+	if node.Kind != yaml.MappingNode {
+		for _, child := range node.Content {
+			redactNode(child, false, dataSources)
+		}
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		secret := secretSettings[key.Value] || headers && redactedHeader(key.Value, &DeploymentConfig{}) ||
+			dataSources && containsString(secretFieldNames, key.Value)
+		if secret && value.Kind == yaml.ScalarNode && value.Value != "" {
+			value.Value, value.Tag, value.Style = "REDACTED", "!!str", 0
+			continue
+		}
+		redactNode(value, key.Value == "headers", dataSources || key.Value == "data_sources")
+	}
+}
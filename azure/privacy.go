@@ -0,0 +1,53 @@
+package azure
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	// LogContentNever keeps prompts and responses out of the logs, only their hash and size are logged
+	LogContentNever = "never"
+	// LogContentErrorsOnly logs the request body of failed requests, the default
+	LogContentErrorsOnly = "errors_only"
+	// LogContentAlways logs the request body of every request
+	LogContentAlways = "always"
+
+	defaultLogContentLimit = 8 << 10
+)
+
+// logRequestContent logs the request body as allowed by the log_content setting
+func (rc *rewriteContext) logRequestContent(status int, body []byte) {
+	failed := status != 200
+	switch C.LogContent {
+	case LogContentNever:
+		if failed {
+			rc.warnf("encountering error with body %s", contentDigest(body))
+		}
+	case LogContentAlways:
+		rc.logf("request body (status %d): %s", status, cappedContent(body))
+	default:
+		if failed {
+			rc.warnf("encountering error with body: %s", cappedContent(body))
+		}
+	}
+}
+
+// cappedContent returns the first log_content_limit bytes of content for logging, noting what was cut
+func cappedContent(content []byte) []byte {
+	limit := C.LogContentLimit
+	if limit <= 0 {
+		limit = defaultLogContentLimit
+	}
+	if len(content) <= limit {
+		return content
+	}
+	return append(content[:limit:limit], fmt.Sprintf("... (%d more bytes)", len(content)-limit)...)
+}
+
+// contentDigest identifies content in logs without revealing it
+func contentDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return fmt.Sprintf("sha256=%s bytes=%d", hex.EncodeToString(sum[:8]), len(content))
+}
@@ -2,18 +2,20 @@ package azure
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httputil"
 	"strings"
+	"time"
 
 	"github.com/stulzq/azure-openai-proxy/util"
 
-	"github.com/bytedance/sonic"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func ProxyWithConverter(requestConverter RequestConverter) gin.HandlerFunc {
@@ -27,69 +29,11 @@ type DeploymentInfo struct {
 	Object string                   `json:"object"`
 }
 
+// ModelProxy merges the deployment listings of all endpoints, served from a cache refreshed in the background
 func ModelProxy(c *gin.Context) {
-	// Create a channel to receive the results of each request
-	results := make(chan []map[string]interface{}, len(ModelDeploymentConfig))
-
-	// Send a request for each deployment in the map
-	for _, deployment := range ModelDeploymentConfig {
-		go func(deployment DeploymentConfig) {
-			// Create the request
-			req, err := http.NewRequest(http.MethodGet, deployment.Endpoint+"/openai/deployments?api-version=2022-12-01", nil)
-			if err != nil {
-				log.Printf("error parsing response body for deployment %s: %v", deployment.DeploymentName, err)
-				results <- nil
-				return
-			}
-
-			// Set the auth header
-			req.Header.Set(AuthHeaderKey, deployment.ApiKey)
-
-			// Send the request
-			client := &http.Client{}
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Printf("error sending request for deployment %s: %v", deployment.DeploymentName, err)
-				results <- nil
-				return
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != http.StatusOK {
-				log.Printf("unexpected status code %d for deployment %s", resp.StatusCode, deployment.DeploymentName)
-				results <- nil
-				return
-			}
-
-			// Read the response body
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Printf("error reading response body for deployment %s: %v", deployment.DeploymentName, err)
-				results <- nil
-				return
-			}
-
-			// Parse the response body as JSON
-			var deplotmentInfo DeploymentInfo
-			err = json.Unmarshal(body, &deplotmentInfo)
-			if err != nil {
-				log.Printf("error parsing response body for deployment %s: %v", deployment.DeploymentName, err)
-				results <- nil
-				return
-			}
-			results <- deplotmentInfo.Data
-		}(deployment)
-	}
-
-	// Wait for all requests to finish and collect the results
-	var allResults []map[string]interface{}
-	for i := 0; i < len(ModelDeploymentConfig); i++ {
-		result := <-results
-		if result != nil {
-			allResults = append(allResults, result...)
-		}
-	}
+	allResults := deploymentModels.list(c.Request.Context(), callerVirtualKey(c.Request))
 	var info = DeploymentInfo{Data: allResults, Object: "list"}
-	combinedResults, err := json.Marshal(info)
+	combinedResults, err := util.JSONMarshal(info)
 	if err != nil {
 		log.Printf("error marshalling results: %v", err)
 		util.SendError(c, err)
@@ -101,8 +45,47 @@ func ModelProxy(c *gin.Context) {
 	c.String(http.StatusOK, string(combinedResults))
 }
 
+type ModelInfo struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// ModelRetrieveProxy resolves a single model against the configured deployments
+func ModelRetrieveProxy(c *gin.Context) {
+	model := c.Param("model")
+	target, _ := resolveModelAlias(model)
+	key := callerVirtualKey(c.Request)
+	tenant, ok := selectTenant(c, key)
+	if !ok {
+		return
+	}
+	found := tenant.deployment(target) != nil
+	if !found && (tenant == nil || tenant.fallback) {
+		_, err := GetDeploymentByModel(target)
+		found = err == nil
+	}
+	// models the key of the caller may not use are hidden like missing ones
+	if key != nil && !key.allowsModel(model) {
+		found = false
+	}
+	if !found {
+		util.SendOpenAIError(c, http.StatusNotFound, "invalid_request_error", "model_not_found", "model",
+			errors.Errorf("The model '%s' does not exist", model))
+		return
+	}
+
+	util.SendJSON(c, http.StatusOK, ModelInfo{
+		Id:      model,
+		Object:  "model",
+		OwnedBy: "azure-openai",
+	})
+}
+
 // Proxy Azure OpenAI
 func Proxy(c *gin.Context, requestConverter RequestConverter) {
+	start := time.Now()
 	if c.Request.Method == http.MethodOptions {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Methods", "GET, OPTIONS, POST")
@@ -111,14 +94,60 @@ func Proxy(c *gin.Context, requestConverter RequestConverter) {
 		return
 	}
 
+	id := requestID(c)
+	access := newAccessLog(c, start, id)
+	defer func() {
+		access.write(c.Writer.Status())
+	}()
+	if capture := startCapture(c, access.keyID, start); capture != nil {
+		defer capture.finish(c, access)
+	}
+
+	// Trace the request, continuing the trace of an incoming traceparent
+	ctx, span := startRequestSpan(c.Request)
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		access.traceID = sc.TraceID().String()
+	}
+	defer func() {
+		endSpan(span, c.Writer.Status(), nil)
+	}()
+
+	// Authenticate proxy-issued keys, they are never forwarded to azure
+	virtualKey, ok := authorizeVirtualKey(c, c.Request)
+	if !ok {
+		return
+	}
+
+	// Select the deployments of the tenant of the caller, untagged requests use the default ones
+	tenant, ok := selectTenant(c, virtualKey)
+	if !ok {
+		return
+	}
+	if tenant != nil {
+		access.tenant = tenant
+		c.Set(tenantKey, tenant.id)
+	}
+	if !admitTenant(c, tenant) {
+		return
+	}
+
 	// Check if the request body is empty
 	if c.Request.Body == nil {
 		util.SendError(c, errors.New("request body is empty"))
 		return
 	}
 
-	// Read the request body
-	body, err := io.ReadAll(c.Request.Body)
+	// Wait for a free upstream slot before buffering the body, the slot is held until the response is fully relayed
+	release, err := acquireUpstream(ctx)
+	if err != nil {
+		(&rewriteContext{requestID: id, tenant: tenant}).warnf("%v", err)
+		sendConcurrencyError(c, err)
+		return
+	}
+	defer release()
+
+	// Read the request body, large uploads are streamed through and only their prefix is kept
+	body, streamedBody, err := readRequestBody(c.Request)
 	if err != nil {
 		util.SendError(c, errors.Wrap(err, "error reading request body"))
 		return
@@ -126,119 +155,381 @@ func Proxy(c *gin.Context, requestConverter RequestConverter) {
 	defer c.Request.Body.Close()
 
 	// Create a new request object with the original request's properties
-	req := c.Request.WithContext(c.Request.Context())
+	req := c.Request.WithContext(ctx)
+	dryRun := isDryRun(req)
+	req.Header.Del(DryRunHeader)
+	req.Header.Del(tenantHeader())
+	debug := isDebugRequest(req, access.keyID)
+	req.Header.Del(DebugHeader)
 	req.Body = io.NopCloser(bytes.NewReader(body))
 
-	// Get model from URL params or body
+	// Get model from URL params, the deployment of azure style requests, the multipart form or the json body
 	model := c.Param("model")
+	if deployment := c.Param("deployment"); model == "" && deployment != "" {
+		model = deploymentModel(deployment)
+	}
+	if model == "" && isMultipart(c.Request.Header.Get("Content-Type")) {
+		if model = multipartModel(body, c.Request.Header.Get("Content-Type")); model == "" {
+			util.SendError(c, errors.New("get model error: multipart body without model field before the file"))
+			return
+		}
+	}
+	// Decode the json body once for the model and the scripted policies
+	var payload map[string]interface{}
+	var payloadErr error
+	if model == "" || len(scriptPolicies) > 0 {
+		payload, payloadErr = decodeJSON(body)
+	}
 	if model == "" {
-		_model, err := sonic.Get(body, "model")
-		if err != nil {
-			util.SendError(c, errors.Wrap(err, "get model error"))
+		if payloadErr != nil {
+			util.SendError(c, errors.Wrap(payloadErr, "get model error"))
 			return
 		}
-		model, err = _model.String()
-		if err != nil {
-			util.SendError(c, errors.Wrap(err, "get model name error"))
+		if model, _ = payload["model"].(string); model == "" {
+			util.SendError(c, errors.New("get model error: model is required"))
 			return
 		}
 	}
+	if virtualKey != nil && !virtualKey.allowsModel(model) {
+		util.SendOpenAIError(c, http.StatusForbidden, "invalid_request_error", "model_not_allowed", "model",
+			errors.Errorf("api key %s may not use the model %s", virtualKey.ID, model))
+		return
+	}
+	// Evaluate the scripted request policies, they may reject the request or pick another model
+	requestedModel := model
+	if model, err = applyScriptPolicies(req, c.Request.URL.Path, model, access.keyID, payload); err != nil {
+		sendRewriteError(c, err)
+		return
+	}
+
+	// Route aliased models to their target, responses keep the requested name
+	if target, ok := resolveModelAlias(model); ok {
+		model = target
+	}
+	// Tenants are served by their own deployment of the model, else by the default one when they fall back
+	deployment := tenant.deployment(model)
+	if deployment == nil && tenant != nil && !tenant.fallback {
+		util.SendOpenAIError(c, http.StatusNotFound, "invalid_request_error", "model_not_found", "model",
+			errors.Errorf("deployment config for %s not found for tenant %s", model, tenant.id))
+		return
+	}
+	access.model = model
 
 	// Get deployment by model
-	deployment, err := GetDeploymentByModel(model)
-	if err != nil {
-		util.SendError(c, err)
+	if deployment == nil {
+		_, resolveSpan := tracer.Start(ctx, "resolve deployment", trace.WithAttributes(attribute.String("openai.model", model)))
+		deployment, err = GetDeploymentByModel(model)
+		endSpan(resolveSpan, 0, err)
+		if err != nil {
+			util.SendError(c, err)
+			return
+		}
+	}
+	// Shift new requests away from a draining deployment, requests in flight keep theirs
+	if drain := deploymentDrain(deployment); drain != nil {
+		var target *DeploymentConfig
+		if drain.To != "" {
+			target = drainTarget(tenant, drain.To)
+		}
+		if target == nil || deploymentDrain(target) != nil {
+			c.Header("Retry-After", "30")
+			util.SendOpenAIError(c, http.StatusServiceUnavailable, "server_error", "deployment_draining", "model",
+				errors.Errorf("the deployment of %s is down for maintenance, retry later", model))
+			return
+		}
+		model, deployment = drain.To, target
+		access.model = model
+	}
+	defer trackInFlight(deployment)()
+
+	if err := overrideApiVersion(req, deployment); err != nil {
+		sendRewriteError(c, err)
 		return
 	}
 
+	// Rewrite the request body for the deployment
+	rc := &rewriteContext{req: req, deployment: deployment, start: start, requestID: id, keyID: access.keyID, tenant: tenant, debug: debug}
+	access.deployment, access.rc = deployment.DeploymentName, rc
+	rc.debugf("debugging request %s %s of caller %s, model %s served by deployment %s at %s",
+		c.Request.Method, c.Request.URL.String(), access.keyID, model, deployment.DeploymentName, deployment.Endpoint)
+	if requestedModel != model {
+		rc.debugf("model %s aliased to %s", requestedModel, model)
+		rc.addResponseRewriter(restoreModelName(requestedModel))
+	}
+	if streamedBody != nil {
+		req.Body = io.NopCloser(streamedBody)
+		rc.debugf("streaming request body of %d bytes", c.Request.ContentLength)
+	} else {
+		body, err = rewriteBody(rc, body)
+		if err != nil {
+			sendRewriteError(c, err)
+			return
+		}
+		if len(rc.warnings) > 0 {
+			rc.debugf("request warnings: %s", strings.Join(rc.warnings, "; "))
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Del("Content-Length")
+	}
+
 	// Get auth token from header or deployment config
-	token := deployment.ApiKey
-	if token == "" {
+	token, err := upstreamToken(ctx, deployment)
+	if err != nil {
+		util.SendError(c, errors.Wrap(err, "get upstream token error"))
+		return
+	}
+	if token == "" && deployment.backendType() != BackendOllama {
 		rawToken := req.Header.Get("Authorization")
 		token = strings.TrimPrefix(rawToken, "Bearer ")
 	}
-	if token == "" {
+	if token == "" && !deployment.optionalAuth() {
 		util.SendError(c, errors.New("token is empty"))
 		return
 	}
-	req.Header.Set(AuthHeaderKey, token)
 	req.Header.Del("Authorization")
+	if token != "" {
+		setAuthHeader(req, deployment, token)
+	}
 
-	req.Header.Set("Transfer-Encoding", "chunked")
-
-	// Convert request using the request converter
+	// Convert request using the request converter, forwarding only the allowed query parameters
+	filterQuery(req, c.Request.URL.Path)
 	req, err = requestConverter.Convert(req, deployment)
 	if err != nil {
 		util.SendError(c, errors.Wrap(err, "convert request error"))
 		return
 	}
 
-	// Log the proxying request
-	log.Printf("proxying request [%s] %s -> %s", model, c.Request.URL.String(), req.URL.String())
+	if rc.debug {
+		if streamedBody != nil {
+			rc.debugRequest(req, nil)
+		} else {
+			rc.debugRequest(req, body)
+		}
+	}
 
-	// Forward the request to the target URL
-	targetURL := req.URL.String()
-	resp, err := forwardRequest(req, targetURL)
-	if err != nil {
-		util.SendError(c, errors.Wrap(err, "forward request error"))
+	// Answer dry runs with the converted request instead of sending it
+	if dryRun {
+		if streamedBody != nil {
+			body = nil
+		}
+		sendDryRun(c, req, rc, body)
 		return
 	}
-	defer resp.Body.Close()
 
-	// Copy the response headers from the target to the client
-	for key, values := range resp.Header {
-		for _, value := range values {
-			c.Header(key, value)
+	// Log the proxying request
+	rc.logf("proxying request [%s] %s -> %s", model, c.Request.URL.String(), req.URL.String())
+
+	// Split oversized embeddings batches into several upstream calls
+	if isEmbeddings(req) && streamedBody == nil {
+		bodies, err := splitEmbeddingsInput(body, deployment.EmbeddingsBatchSize)
+		if err != nil {
+			util.SendError(c, errors.Wrap(err, "split embeddings input error"))
+			return
+		}
+		if len(bodies) > 1 {
+			rc.logf("splitting embeddings request [%s] into %d batches", model, len(bodies))
+			forwardEmbeddingsBatches(c, req, rc, model, bodies)
+			return
 		}
 	}
 
-	c.Status(resp.StatusCode)
+	// Ask azure for compressed responses, they are decoded again where the proxy rewrites them
+	if C.Compression.UpstreamGzip {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
 
-	// Set the status code of the response
-	// Get the client's response writer
-	clientWriter := c.Writer
+	// Bind the upstream request to the configured timeouts
+	req, timeouts := withTimeouts(req, C.Timeout, rc.stream)
+	defer timeouts.stop()
+	req, upstreamSpan := startUpstreamSpan(req, deployment)
+	upstreamStart, responded := time.Now(), false
+	var fallbackBody []byte
+	if streamedBody == nil {
+		fallbackBody = body
+	}
 
-	// Stream the response body from the target to the client
-	buf := make([]byte, 1024)
-	for {
-		n, err := resp.Body.Read(buf)
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading response body: %v", err)
+	// Forward the request, SSE chunks are written and flushed to the client immediately and in order
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			// the request is already converted, only keep the client address away from azure
+			r.Header["X-Forwarded-For"] = nil
+		},
+		Transport:     withFallback(withChaos(transportFor(deployment), rc, model), rc, fallbackBody),
+		FlushInterval: C.Streaming.flushInterval(),
+		BufferPool:    proxyBufferPool,
+		ModifyResponse: func(resp *http.Response) error {
+			endSpan(upstreamSpan, resp.StatusCode, nil)
+			if resp.Header.Get(BackendHeader) != BackendOpenAI {
+				// the failed azure call was already recorded by the fallback
+				observeUpstream(rc, deployment, upstreamStart, resp.StatusCode)
 			}
-			break
-		}
+			responded = true
+			rc.firstByte = time.Now()
+			rc.debugf("upstream responded %d (%s) after %s", resp.StatusCode, resp.Header.Get("Content-Type"), rc.firstByte.Sub(upstreamStart))
+			if resp.StatusCode >= http.StatusBadRequest {
+				rc.warnf("upstream error %d for request [%s], azure request id %s", resp.StatusCode, model, upstreamRequestID(resp.Header))
+			}
+			decoded := false
+			if rc.rewritesResponse(resp) {
+				var err error
+				if decoded, err = decodeGzipResponse(resp); err != nil {
+					return errors.Wrap(err, "decode upstream gzip error")
+				}
+			}
+			timeouts.gotResponse(resp)
+			if err := rewriteResponse(resp, rc); err != nil {
+				return errors.Wrap(err, "rewrite response error")
+			}
+			// issue: https://github.com/Chanzhaoyu/chatgpt-web/issues/831
+			if resp.Header.Get("Content-Type") == "text/event-stream" {
+				resp.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(resp.Body, strings.NewReader("\n")), resp.Body}
+			}
+			for _, warning := range rc.warnings {
+				resp.Header.Add("X-Proxy-Warning", warning)
+			}
+			if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+				traceStream(ctx, resp)
+			}
+			observeUsage(resp, rc)
+			compressResponse(resp, c.Request, C.Compression, decoded)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			endSpan(upstreamSpan, 0, err)
+			if !responded && c.Request.Context().Err() == nil {
+				observeUpstream(rc, deployment, upstreamStart, 0)
+			}
+			if reason := timeouts.exceeded(); reason != "" {
+				rc.warnf("request [%s] timed out: %s", model, reason)
+				util.SendOpenAIError(c, http.StatusGatewayTimeout, "timeout_error", "timeout", "", errors.New(reason))
+				return
+			}
+			if c.Request.Context().Err() != nil {
+				rc.logf("client closed request [%s], upstream request canceled", model)
+				return
+			}
+			util.SendError(c, errors.Wrap(err, "forward request error"))
+		},
+	}
+	// the upstream request is canceled through the request context as soon as the client goes away
+	proxy.ServeHTTP(contextWriter{c.Writer, c.Writer}, req)
 
-		// Write the chunk of data to the client
-		_, err = clientWriter.Write(buf[:n])
-		if err != nil {
-			log.Printf("Error writing response body to client: %v", err)
-			break
+	rc.logRequestContent(c.Writer.Status(), body)
+}
+
+// forwardEmbeddingsBatches sends the batches upstream one after another and replies with the merged result,
+// the response of the first failing batch is relayed to the client as is
+func forwardEmbeddingsBatches(c *gin.Context, req *http.Request, rc *rewriteContext, model string, bodies [][]byte) {
+	results := make([][]byte, 0, len(bodies))
+	for i, body := range bodies {
+		respBody, ok := forwardEmbeddingsBatch(c, req, rc, model, i, body)
+		if !ok {
+			return
 		}
+		results = append(results, respBody)
+	}
 
-		// Flush the response writer to ensure data is sent immediately
-		clientWriter.Flush()
+	merged, err := mergeEmbeddingsResponses(results)
+	if err != nil {
+		util.SendError(c, errors.Wrap(err, "merge embeddings batches error"))
+		return
 	}
+	(&usageObserver{rc: rc}).record(merged)
+	for _, warning := range rc.warnings {
+		c.Writer.Header().Add("X-Proxy-Warning", warning)
+	}
+	if shouldCompress(C.Compression, c.Request, c.Writer.Header(), int64(len(merged))) {
+		if compressed, err := gzipBytes(merged); err == nil {
+			c.Header("Content-Encoding", "gzip")
+			c.Writer.Header().Add("Vary", "Accept-Encoding")
+			merged = compressed
+		}
+	}
+	c.Data(http.StatusOK, "application/json", merged)
+}
 
-	// issue: https://github.com/Chanzhaoyu/chatgpt-web/issues/831
-	if c.Writer.Header().Get("Content-Type") == "text/event-stream" {
-		log.Println("Content-Type: event-stream")
-		if _, err := c.Writer.Write([]byte{'\n'}); err != nil {
-			log.Printf("rewrite response error: %v", err)
+// forwardEmbeddingsBatch sends one batch through the timeouts, chaos and fallback of a single request and
+// returns its body, any other outcome is answered to the client and reported as not ok
+func forwardEmbeddingsBatch(c *gin.Context, req *http.Request, rc *rewriteContext, model string, i int, body []byte) ([]byte, bool) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	batchReq, timeouts := withTimeouts(req, C.Timeout, false)
+	defer timeouts.stop()
+	batchReq, span := startUpstreamSpan(batchReq, rc.deployment)
+	batchStart := time.Now()
+	transport := withFallback(withChaos(transportFor(rc.deployment), rc, model), rc, body)
+	resp, err := forwardRequest(batchReq, req.URL.String(), transport)
+	if err != nil {
+		endSpan(span, 0, err)
+		if c.Request.Context().Err() == nil {
+			observeUpstream(rc, rc.deployment, batchStart, 0)
+		}
+		if reason := timeouts.exceeded(); reason != "" {
+			rc.warnf("embeddings batch %d of request [%s] timed out: %s", i, model, reason)
+			util.SendOpenAIError(c, http.StatusGatewayTimeout, "timeout_error", "timeout", "", errors.New(reason))
+			return nil, false
+		}
+		util.SendError(c, errors.Wrapf(err, "forward embeddings batch %d error", i))
+		return nil, false
+	}
+	defer resp.Body.Close()
+	endSpan(span, resp.StatusCode, nil)
+	if resp.Header.Get(BackendHeader) != BackendOpenAI {
+		// the failed azure call was already recorded by the fallback
+		observeUpstream(rc, rc.deployment, batchStart, resp.StatusCode)
+	}
+	timeouts.gotResponse(resp)
+	copyUpstreamRequestIDs(c.Writer.Header(), resp.Header)
+	if _, err = decodeGzipResponse(resp); err != nil {
+		util.SendError(c, errors.Wrap(err, "decode upstream gzip error"))
+		return nil, false
+	}
+	if err = rewriteResponse(resp, rc); err != nil {
+		util.SendError(c, errors.Wrap(err, "rewrite response error"))
+		return nil, false
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		if reason := timeouts.exceeded(); reason != "" {
+			util.SendOpenAIError(c, http.StatusGatewayTimeout, "timeout_error", "timeout", "", errors.New(reason))
+			return nil, false
 		}
+		util.SendError(c, errors.Wrapf(err, "read embeddings batch %d error", i))
+		return nil, false
 	}
+	if resp.StatusCode != http.StatusOK {
+		c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), respBody)
+		return nil, false
+	}
+	return respBody, true
+}
 
-	if c.Writer.Status() != 200 {
-		log.Printf("encountering error with body: %s", string(body))
+// sendRewriteError reports a body rewrite error, invalid requests are answered with 400
+func sendRewriteError(c *gin.Context, err error) {
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_request", reqErr.Param, reqErr)
+		return
 	}
+	util.SendError(c, errors.Wrap(err, "rewrite request body error"))
+}
+
+// contextWriter hides the deprecated http.CloseNotifier of gin's writer,
+// so ReverseProxy relies on the request context alone for client disconnects
+type contextWriter struct {
+	http.ResponseWriter
+	http.Flusher
 }
 
-func forwardRequest(req *http.Request, targetURL string) (*http.Response, error) {
-	// Create a new HTTP client
-	client := &http.Client{}
+func forwardRequest(req *http.Request, targetURL string, transport http.RoundTripper) (*http.Response, error) {
+	// Create a new HTTP client on the transport of the deployment
+	client := &http.Client{Transport: transport}
 
-	// Create a new request to the target URL
-	targetReq, err := http.NewRequest(req.Method, targetURL, req.Body)
+	// Create a new request to the target URL, bound to the client request context
+	targetReq, err := http.NewRequestWithContext(req.Context(), req.Method, targetURL, req.Body)
 	if err != nil {
 		return nil, err
 	}
@@ -255,22 +546,11 @@ func forwardRequest(req *http.Request, targetURL string) (*http.Response, error)
 	return resp, nil
 }
 
-// StreamingWriter is a wrapper to handle streaming response bodies
-type customResponseWriter struct {
-	http.ResponseWriter
-	writer io.Writer
-}
-
-func (w *customResponseWriter) Write(p []byte) (int, error) {
-	written, err := w.ResponseWriter.Write(p)
-	if err == nil {
-		w.writer.Write(p)
-	}
-	return written, err
-}
-
 func GetDeploymentByModel(model string) (*DeploymentConfig, error) {
-	deploymentConfig, exist := ModelDeploymentConfig[model]
+	deploymentConfig, exist := currentDeployments()[model]
+	if !exist && mockUpstream {
+		return mockDeployment(model), nil
+	}
 	if !exist {
 		return nil, errors.New(fmt.Sprintf("deployment config for %s not found", model))
 	}
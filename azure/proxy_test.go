@@ -0,0 +1,3115 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stulzq/azure-openai-proxy/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"gopkg.in/yaml.v3"
+)
+
+func newTestUpstream(t testing.TB, handler http.HandlerFunc) *httptest.Server {
+	upstream := httptest.NewServer(handler)
+	u, _ := url.Parse(upstream.URL)
+	ModelDeploymentConfig["gpt-4"] = DeploymentConfig{
+		DeploymentName: "gpt4",
+		ModelName:      "gpt-4",
+		Endpoint:       upstream.URL,
+		EndpointUrl:    u,
+		ApiKey:         "key",
+		ApiVersion:     "2024-02-01",
+	}
+	t.Cleanup(func() {
+		upstream.Close()
+		delete(ModelDeploymentConfig, "gpt-4")
+	})
+	return upstream
+}
+
+func newTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Any("/v1/chat/completions", ProxyWithConverter(NewStripPrefixConverter("/v1")))
+	return r
+}
+
+func TestProxyStream(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/openai/deployments/gpt4/chat/completions", r.URL.Path)
+		assert.Equal(t, "2024-02-01", r.URL.Query().Get("api-version"))
+		assert.Equal(t, "key", r.Header.Get(AuthHeaderKey))
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, int64(len(body)), r.ContentLength)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{"a", "b", "c"} {
+			_, _ = io.WriteString(w, `data: {"choices":[{"delta":{"content":"`+chunk+`"}}]}`+"\n\n")
+			w.(http.Flusher).Flush()
+		}
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	})
+
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4","stream":true}`))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `data: {"choices":[{"delta":{"content":"a"}}]}`+"\n\n"+
+		`data: {"choices":[{"delta":{"content":"b"}}]}`+"\n\n"+
+		`data: {"choices":[{"delta":{"content":"c"}}]}`+"\n\n"+
+		"data: [DONE]\n\n\n", string(body))
+}
+
+// histogramCount returns the number of observations of the histogram of vec with the given labels
+func histogramCount(t *testing.T, vec *prometheus.HistogramVec, labels prometheus.Labels) uint64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(vec)
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			matched := 0
+			for _, label := range metric.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value == label.GetValue() {
+					matched++
+				}
+			}
+			if matched == len(labels) {
+				return metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func TestProxyStreamMetrics(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, `data: {"choices":[{"index":0,"delta":{"role":"assistant"}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		for _, chunk := range []string{"a", "b", "c"} {
+			time.Sleep(10 * time.Millisecond)
+			_, _ = io.WriteString(w, `data: {"choices":[{"index":0,"delta":{"content":"`+chunk+`"}}]}`+"\n\n")
+			w.(http.Flusher).Flush()
+		}
+		_, _ = io.WriteString(w, `data: {"choices":[],"usage":{"prompt_tokens":1,"completion_tokens":3,"total_tokens":4}}`+"\n\n")
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	labels := prometheus.Labels{"model": "gpt-4", "deployment": "gpt4", "tenant": ""}
+	ttft, throughput := histogramCount(t, timeToFirstToken, labels), histogramCount(t, outputTokensPerSecond, labels)
+	post := func(body string) {
+		resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+		assert.NoError(t, err)
+		_, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// a streamed chat completion records the time to its first token and its throughput
+	post(`{"model":"gpt-4","stream":true,"messages":[]}`)
+	assert.Equal(t, ttft+1, histogramCount(t, timeToFirstToken, labels))
+	assert.Equal(t, throughput+1, histogramCount(t, outputTokensPerSecond, labels))
+
+	// blocking requests aren't streams
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[{"message":{"content":"abc"}}],"usage":{"completion_tokens":3}}`)
+	})
+	post(`{"model":"gpt-4","messages":[]}`)
+	assert.Equal(t, ttft+1, histogramCount(t, timeToFirstToken, labels))
+	assert.Equal(t, throughput+1, histogramCount(t, outputTokensPerSecond, labels))
+}
+
+func TestProxyUpstreamMetrics(t *testing.T) {
+	status := http.StatusOK
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	u, _ := url.Parse(upstream.URL)
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	responses := func(class string) float64 {
+		return testutil.ToFloat64(upstreamResponses.WithLabelValues("gpt4", u.Host, class, ""))
+	}
+	latency := func() uint64 {
+		return histogramCount(t, upstreamLatency, prometheus.Labels{"deployment": "gpt4", "endpoint": u.Host, "tenant": ""})
+	}
+	post := func() {
+		resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4","messages":[]}`))
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+	}
+
+	// success and error responses are counted by status class, both with their latency
+	ok, serverErrors, observed := responses("2xx"), responses("5xx"), latency()
+	post()
+	assert.Equal(t, ok+1, responses("2xx"))
+	assert.Equal(t, observed+1, latency())
+	status = http.StatusInternalServerError
+	post()
+	assert.Equal(t, serverErrors+1, responses("5xx"))
+	assert.Equal(t, observed+2, latency())
+
+	// an unreachable upstream is counted as error without a latency
+	errored := responses("error")
+	upstream.Close()
+	post()
+	assert.Equal(t, errored+1, responses("error"))
+	assert.Equal(t, observed+2, latency())
+}
+
+func TestProxyJSON(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Transfer-Encoding"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[{"finish_reason":"stop","message":{"content":"hi"}}]}`)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4"}`))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+	assert.JSONEq(t, `{"choices":[{"finish_reason":"stop","message":{"content":"hi"}}]}`, string(body))
+}
+
+func TestProxyClientDisconnect(t *testing.T) {
+	canceled := make(chan struct{})
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {}\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(5 * time.Second):
+		}
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4","stream":true}`))
+	assert.NoError(t, err)
+	_, _ = resp.Body.Read(make([]byte, 16))
+	resp.Body.Close()
+
+	select {
+	case <-canceled:
+	case <-time.After(3 * time.Second):
+		t.Fatal("upstream request was not canceled")
+	}
+}
+
+func TestProxyNormalizeError(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = io.WriteString(w, `{"error":{"code":"429","message":"Requests have exceeded call rate limit"}}`)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4"}`))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.JSONEq(t, `{"error":{"code":"rate_limit_exceeded","message":"Requests have exceeded call rate limit","type":"rate_limit_error"}}`, string(body))
+}
+
+func TestProxyStreamIdleTimeout(t *testing.T) {
+	C.Timeout = TimeoutConfig{StreamIdle: 100 * time.Millisecond}
+	defer func() { C.Timeout = TimeoutConfig{} }()
+
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, `data: {"choices":[{"delta":{"content":"a"}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4","stream":true}`))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Contains(t, string(body), `"code":"timeout"`)
+	assert.Contains(t, string(body), "data: [DONE]\n\n")
+}
+
+func TestProxyGzip(t *testing.T) {
+	C.Compression = CompressionConfig{Gzip: true}
+	defer func() { C.Compression = CompressionConfig{} }()
+
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"object":"list","data":[]}`)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4"}`))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.True(t, resp.Uncompressed)
+	assert.Equal(t, `{"object":"list","data":[]}`, string(body))
+}
+
+func TestProxyUpstreamGzip(t *testing.T) {
+	C.Compression = CompressionConfig{UpstreamGzip: true}
+	defer func() { C.Compression = CompressionConfig{} }()
+
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+		body, _ := gzipBytes([]byte(`{"error":{"code":"DeploymentNotFound","message":"not found"}}`))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(body)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4"}`))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.True(t, resp.Uncompressed)
+	assert.JSONEq(t, `{"error":{"code":"model_not_found","message":"not found","type":"invalid_request_error"}}`, string(body))
+}
+
+func TestProxyTraceparent(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.Header.Get("traceparent"), "-")
+		assert.Len(t, parts, 4)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", parts[1])
+		assert.NotEqual(t, "00f067aa0ba902b7", parts[2])
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{}`)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4"}`))
+	req.Header.Set("traceparent", incoming)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestProxyTraceparentUntraced(t *testing.T) {
+	assert.NoError(t, initTracing(TracingConfig{}))
+	t.Cleanup(func() {
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	var forwarded string
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{}`)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4"}`))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	parts := strings.Split(forwarded, "-")
+	if assert.Len(t, parts, 4) {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", parts[1])
+	}
+}
+
+func TestProxyRequestID(t *testing.T) {
+	var forwarded string
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(RequestIDHeader)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("apim-request-id", "azure-1")
+		_, _ = io.WriteString(w, `{}`)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4"}`))
+	req.Header.Set(RequestIDHeader, "req-1")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "req-1", forwarded)
+	assert.Equal(t, "req-1", resp.Header.Get(RequestIDHeader))
+	assert.Equal(t, "azure-1", resp.Header.Get("apim-request-id"))
+
+	resp, err = http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4"}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Len(t, resp.Header.Get(RequestIDHeader), 32)
+	assert.Equal(t, forwarded, resp.Header.Get(RequestIDHeader))
+}
+
+func TestKeyUsage(t *testing.T) {
+	C.Admin.Token = "admin"
+	accountant = &usageAccountant{keys: map[string]*KeyUsage{}}
+	defer func() { C.Admin.Token = "" }()
+
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"usage":{"prompt_tokens":5,"completion_tokens":3,"total_tokens":8}}`)
+	})
+	router := newTestRouter()
+	router.GET("/admin/usage/keys", AdminAuth(), KeyUsageHandler)
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4"}`))
+		req.Header.Set("Authorization", "Bearer sk-1")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		_, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(proxy.URL + "/admin/usage/keys")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/admin/usage/keys", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(body), `"requests":2,"prompt_tokens":10,"completion_tokens":6,"total_tokens":16`)
+}
+
+func TestStats(t *testing.T) {
+	stats = &requestStats{start: time.Now(), models: map[string]*ModelStats{}}
+	var calls int32
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			_, _ = io.WriteString(w, `{"usage":{"prompt_tokens":5,"completion_tokens":3,"total_tokens":8}}`)
+		case 2:
+			_, _ = io.WriteString(w, `{"usage":{"prompt_tokens":2000,"completion_tokens":10,"total_tokens":2010,"prompt_tokens_details":{"cached_tokens":1024}}}`)
+		default:
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = io.WriteString(w, `{"error":{"code":"429","message":"rate limited"}}`)
+		}
+	})
+	router := newTestRouter()
+	router.GET("/admin/stats", StatsHandler)
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	for _, model := range []string{"gpt-4", "gpt-4", "gpt-4", "unknown"} {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"`+model+`"}`))
+		req.Header.Set("Authorization", "Bearer key")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		_, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(proxy.URL + "/admin/stats")
+	assert.NoError(t, err)
+	var result struct {
+		Total  RequestStats          `json:"total"`
+		Models map[string]ModelStats `json:"models"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	resp.Body.Close()
+	assert.Equal(t, int64(4), result.Total.Requests)
+	assert.Equal(t, int64(2), result.Total.Errors)
+	gpt4 := result.Models["gpt-4"]
+	assert.Equal(t, int64(3), gpt4.Requests)
+	assert.Equal(t, int64(1), gpt4.Errors)
+	assert.Equal(t, int64(1), gpt4.RateLimited)
+	assert.Equal(t, int64(2018), gpt4.TotalTokens)
+	assert.Equal(t, int64(1), gpt4.CacheHits)
+	assert.Equal(t, int64(1024), gpt4.CachedTokens)
+	if !assert.Contains(t, gpt4.Deployments, "gpt4") {
+		return
+	}
+	assert.Equal(t, gpt4.RequestStats, *gpt4.Deployments["gpt4"])
+	assert.Equal(t, int64(1), result.Models["unknown"].Errors)
+	// the deployments add up to the model
+	if assert.Contains(t, result.Models["unknown"].Deployments, unknownDeployment) {
+		assert.Equal(t, result.Models["unknown"].RequestStats, *result.Models["unknown"].Deployments[unknownDeployment])
+	}
+}
+
+func TestVirtualKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	assert.NoError(t, loadVirtualKeys(path))
+	defer func() { _ = loadVirtualKeys("") }()
+	accountant = &usageAccountant{keys: map[string]*KeyUsage{}}
+
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "key", r.Header.Get("api-key"))
+		assert.Empty(t, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"usage":{"prompt_tokens":5,"completion_tokens":3,"total_tokens":8}}`)
+	})
+	router := newTestRouter()
+	router.GET("/admin/keys", VirtualKeysHandler)
+	router.POST("/admin/keys", VirtualKeysHandler)
+	router.GET("/admin/keys/:id", VirtualKeyHandler)
+	router.PATCH("/admin/keys/:id", VirtualKeyHandler)
+	router.POST("/admin/keys/:id/rotate", RotateVirtualKeyHandler)
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	send := func(method, path, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest(method, proxy.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		var result map[string]interface{}
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		return resp.StatusCode, result
+	}
+	chat := func(secret, model string) int {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"`+model+`","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		_, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, chat("key", "gpt-4"))
+	status, created := send(http.MethodPost, "/admin/keys", `{"name":"portal","models":["gpt-4"],"token_quota":10,"quota_period":"day"}`)
+	if !assert.Equal(t, http.StatusCreated, status) {
+		return
+	}
+	secret := created["secret"].(string)
+	id := created["key"].(map[string]interface{})["id"].(string)
+	assert.True(t, strings.HasPrefix(secret, virtualKeyPrefix))
+	status, _ = send(http.MethodPost, "/admin/keys", `{"quota_period":"week"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	assert.Equal(t, http.StatusOK, chat(secret, "gpt-4"))
+	assert.Equal(t, http.StatusForbidden, chat(secret, "gpt-4o"))
+	assert.Equal(t, http.StatusOK, chat(secret, "gpt-4"))
+	// 16 of 10 tokens used
+	assert.Equal(t, http.StatusTooManyRequests, chat(secret, "gpt-4"))
+	assert.Contains(t, accountant.keys, id)
+
+	status, _ = send(http.MethodPatch, "/admin/keys/"+id, `{"token_quota":0,"disabled":true}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusUnauthorized, chat(secret, "gpt-4"))
+	status, got := send(http.MethodPatch, "/admin/keys/"+id, `{"disabled":false}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "portal", got["key"].(map[string]interface{})["name"])
+	assert.Equal(t, http.StatusOK, chat(secret, "gpt-4"))
+
+	_, rotated := send(http.MethodPost, "/admin/keys/"+id+"/rotate", `{"grace":"1h"}`)
+	graced := rotated["secret"].(string)
+	assert.Equal(t, http.StatusOK, chat(secret, "gpt-4"))
+	assert.Equal(t, http.StatusOK, chat(graced, "gpt-4"))
+	_, rotated = send(http.MethodPost, "/admin/keys/"+id+"/rotate", "")
+	latest := rotated["secret"].(string)
+	assert.Equal(t, http.StatusUnauthorized, chat(secret, "gpt-4"))
+	assert.Equal(t, http.StatusUnauthorized, chat(graced, "gpt-4"))
+	assert.Equal(t, http.StatusOK, chat(latest, "gpt-4"))
+	status, _ = send(http.MethodPost, "/admin/keys/unknown/rotate", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// the keys and their usage survive a restart, the file holds no key
+	virtualKeys.flush()
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), latest)
+	assert.NoError(t, loadVirtualKeys(path))
+	assert.Equal(t, http.StatusOK, chat(latest, "gpt-4"))
+	_, list := send(http.MethodGet, "/admin/keys", "")
+	if !assert.Len(t, list["data"], 1) {
+		return
+	}
+	key := list["data"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, id, key["id"])
+	assert.Equal(t, float64(56), key["used_tokens"])
+}
+
+func TestModelRetrieveProxy(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("retrieving a model doesn't call upstream")
+	})
+	router := newTestRouter()
+	router.GET("/v1/models/:model", ModelRetrieveProxy)
+	router.POST("/admin/keys", VirtualKeysHandler)
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	retrieve := func(secret, model string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/v1/models/"+model, nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		defer resp.Body.Close()
+		var result map[string]interface{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return resp.StatusCode, result
+	}
+
+	status, model := retrieve("key", "gpt-4")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, map[string]interface{}{"id": "gpt-4", "object": "model", "created": float64(0), "owned_by": "azure-openai"}, model)
+
+	status, result := retrieve("key", "gpt-unknown")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, map[string]interface{}{
+		"message": "The model 'gpt-unknown' does not exist",
+		"type":    "invalid_request_error",
+		"param":   "model",
+		"code":    "model_not_found",
+	}, result["error"])
+
+	// models outside the allowlist of the virtual key are hidden like missing ones
+	assert.NoError(t, loadVirtualKeys(filepath.Join(t.TempDir(), "keys.json")))
+	defer func() { _ = loadVirtualKeys("") }()
+	gpt4o := ModelDeploymentConfig["gpt-4"]
+	gpt4o.ModelName = "gpt-4o"
+	ModelDeploymentConfig["gpt-4o"] = gpt4o
+	defer delete(ModelDeploymentConfig, "gpt-4o")
+	resp, err := http.Post(proxy.URL+"/admin/keys", "application/json", strings.NewReader(`{"name":"portal","models":["gpt-4"]}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	var created map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	resp.Body.Close()
+	secret, _ := created["secret"].(string)
+
+	status, _ = retrieve(secret, "gpt-4")
+	assert.Equal(t, http.StatusOK, status)
+	status, result = retrieve(secret, "gpt-4o")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, "model_not_found", result["error"].(map[string]interface{})["code"])
+	lists := map[string][]map[string]interface{}{"gpt-4": {{"id": "gpt4"}}, "gpt-4o": {{"id": "gpt4o"}}}
+	assert.Equal(t, []map[string]interface{}{{"id": "gpt4"}}, mergeModelLists(lists, &VirtualKey{Models: []string{"gpt-4"}}))
+	assert.Len(t, mergeModelLists(lists, nil), 2)
+}
+
+func TestDashboard(t *testing.T) {
+	C.Admin.Token, C.SlowRequest.Total = "admin", time.Nanosecond
+	stats = &requestStats{start: time.Now(), models: map[string]*ModelStats{}}
+	defer func() {
+		C.Admin.Token, C.SlowRequest = "", SlowRequestConfig{}
+		slowRequests = nil
+	}()
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"usage":{"prompt_tokens":5,"completion_tokens":3,"total_tokens":8}}`)
+	})
+	router := newTestRouter()
+	router.GET("/admin/dashboard", AdminAuth(), DashboardHandler)
+	router.GET("/admin/dashboard/data", AdminAuth(), DashboardDataHandler)
+	router.PUT("/admin/loglevel", AdminAuth(), LogLevelHandler)
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4","messages":[]}`))
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	_, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	resp, err = http.Get(proxy.URL + "/admin/dashboard")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Basic")
+
+	req, _ = http.NewRequest(http.MethodGet, proxy.URL+"/admin/dashboard", nil)
+	req.SetBasicAuth("ops", "admin")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+	assert.Contains(t, string(page), "dashboard/data")
+
+	// basic auth only opens the dashboard
+	req, _ = http.NewRequest(http.MethodPut, proxy.URL+"/admin/loglevel", strings.NewReader(`{"level":"debug"}`))
+	req.SetBasicAuth("ops", "admin")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("WWW-Authenticate"))
+
+	req, _ = http.NewRequest(http.MethodGet, proxy.URL+"/admin/dashboard/data", nil)
+	req.SetBasicAuth("ops", "admin")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	var data struct {
+		Total        RequestStats       `json:"total"`
+		Rate         []RateBucket       `json:"rate"`
+		Deployments  []DeploymentHealth `json:"deployments"`
+		SlowRequests []SlowRequest      `json:"slow_requests"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+	resp.Body.Close()
+	assert.Equal(t, int64(1), data.Total.Requests)
+	if assert.Len(t, data.Rate, rateBuckets) {
+		assert.Equal(t, int64(1), data.Rate[rateBuckets-1].Requests+data.Rate[rateBuckets-2].Requests)
+		assert.True(t, data.Rate[0].Time.Before(data.Rate[rateBuckets-1].Time))
+	}
+	assert.NotEmpty(t, data.Deployments)
+	if assert.Len(t, data.SlowRequests, 1) {
+		assert.Equal(t, "gpt4", data.SlowRequests[0].Deployment)
+	}
+}
+
+func TestProxySlowRequests(t *testing.T) {
+	defer func() {
+		C.SlowRequest = SlowRequestConfig{}
+		slowMu.Lock()
+		slowRequests = nil
+		slowMu.Unlock()
+	}()
+	var headerDelay, bodyDelay atomic.Int64
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(headerDelay.Load()))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(time.Duration(bodyDelay.Load()))
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	post := func(header, body time.Duration) {
+		headerDelay.Store(int64(header))
+		bodyDelay.Store(int64(body))
+		resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4","messages":[]}`))
+		if assert.NoError(t, err) {
+			_, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}
+	// the requests run one after another, so only the last one, the slow one, may show up
+	lastSlow := func(requests ...[2]time.Duration) *SlowRequest {
+		slowMu.Lock()
+		slowRequests = nil
+		slowMu.Unlock()
+		for _, delays := range requests {
+			post(delays[0], delays[1])
+		}
+		var recent []SlowRequest
+		assert.Eventually(t, func() bool {
+			recent = recentSlowRequests()
+			return len(recent) > 0
+		}, time.Second, 5*time.Millisecond)
+		if !assert.Len(t, recent, 1) {
+			return nil
+		}
+		return &recent[0]
+	}
+	fast, slowHeaders, slowBody := [2]time.Duration{}, [2]time.Duration{100 * time.Millisecond, 0}, [2]time.Duration{0, 100 * time.Millisecond}
+
+	// late response headers trip the ttft threshold, a slow body doesn't
+	C.SlowRequest = SlowRequestConfig{TTFT: 50 * time.Millisecond}
+	if slow := lastSlow(fast, slowBody, slowHeaders); slow != nil {
+		assert.GreaterOrEqual(t, slow.TTFTMs, int64(100))
+		assert.Equal(t, "gpt4", slow.Deployment)
+	}
+
+	// a slow body trips the total threshold
+	C.SlowRequest = SlowRequestConfig{Total: 50 * time.Millisecond}
+	if slow := lastSlow(fast, slowBody); slow != nil {
+		assert.Less(t, slow.TTFTMs, int64(50))
+		assert.GreaterOrEqual(t, slow.LatencyMs, int64(100))
+	}
+}
+
+func TestAppInsightsExporter(t *testing.T) {
+	var received []map[string]interface{}
+	ingestion := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/track", r.URL.Path)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer ingestion.Close()
+
+	exporter, err := newAppInsightsExporter("InstrumentationKey=ikey;IngestionEndpoint="+ingestion.URL+"/", "")
+	assert.NoError(t, err)
+	exporter.trackRequest(&accessLog{
+		start:     time.Now(),
+		requestID: "req-1",
+		method:    http.MethodPost,
+		path:      "/v1/chat/completions",
+		model:     "gpt-4",
+		rc:        &rewriteContext{usage: &Usage{PromptTokens: 5, CompletionTokens: 3}},
+	}, http.StatusOK, 1500*time.Millisecond)
+	exporter.flush()
+
+	assert.Len(t, received, 2)
+	assert.Equal(t, "ikey", received[0]["iKey"])
+	baseData := received[0]["data"].(map[string]interface{})["baseData"].(map[string]interface{})
+	assert.Equal(t, "0.00:00:01.500000", baseData["duration"])
+	assert.Equal(t, "POST /v1/chat/completions", baseData["name"])
+	assert.Equal(t, "Microsoft.ApplicationInsights.Metric", received[1]["name"])
+
+	_, err = newAppInsightsExporter("IngestionEndpoint=https://example.com", "")
+	assert.Error(t, err)
+}
+
+func TestErrorRateAlert(t *testing.T) {
+	received := make(chan string, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload["text"]
+	}))
+	defer webhook.Close()
+
+	C.Alerts = AlertsConfig{
+		Webhooks:  []WebhookConfig{{Url: webhook.URL, Format: "slack"}},
+		ErrorRate: ErrorRateAlert{Threshold: 0.5, MinRequests: 4},
+	}
+	defer func() { C.Alerts = AlertsConfig{} }()
+
+	for _, failed := range []bool{false, true, false, true, true} {
+		observeErrorRate("alerting", failed)
+	}
+	select {
+	case text := <-received:
+		assert.Contains(t, text, "error_rate alerting: 50% of 4 upstream calls failed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alert received")
+	}
+}
+
+func TestHealthzProbe(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/openai/models", r.URL.Path)
+		assert.Equal(t, "key", r.Header.Get(AuthHeaderKey))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	probeDeployments(time.Second)
+
+	router := newTestRouter()
+	router.GET("/healthz", HealthzHandler)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"healthy_deployments":0`)
+	assert.Contains(t, w.Body.String(), `"deployment":"gpt4","healthy":false,"known":true,"last_status":503`)
+}
+
+func TestReadyz(t *testing.T) {
+	router := newTestRouter()
+	router.GET("/readyz", ReadyzHandler)
+	ready := func() int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	deployment := ModelDeploymentConfig["gpt-4"]
+	recordHealth(&deployment, http.StatusOK, nil)
+	assert.Equal(t, http.StatusOK, ready())
+
+	recordHealth(&deployment, http.StatusBadGateway, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, ready())
+	recordHealth(&deployment, http.StatusOK, nil)
+
+	SetConfigError(errors.New("invalid yaml"))
+	assert.Equal(t, http.StatusServiceUnavailable, ready())
+	SetConfigError(nil)
+	assert.Equal(t, http.StatusOK, ready())
+}
+
+func TestRecovery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RequestID(), Recovery())
+	r.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "req-1", w.Header().Get(RequestIDHeader))
+	assert.JSONEq(t, `{"error":{"code":"internal_error","type":"server_error","message":"the proxy failed to handle the request, request id req-1"}}`, w.Body.String())
+}
+
+func TestProxyModelAlias(t *testing.T) {
+	C.ModelAliases = []ModelAlias{{From: "gpt-4-old", To: "gpt-4"}}
+	defer func() { C.ModelAliases = nil }()
+
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/openai/deployments/gpt4/chat/completions", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"model":"gpt-4-0613","choices":[]}`)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4-old"}`))
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.JSONEq(t, `{"model":"gpt-4-old","choices":[]}`, string(body))
+
+	// the rewriter reports whether it changed the model, stream events are kept either way
+	restore := restoreModelName("gpt-4-old")
+	assert.True(t, restore(map[string]interface{}{"model": "gpt-4"}, false))
+	assert.False(t, restore(map[string]interface{}{"model": "gpt-4-old"}, false))
+	assert.False(t, restore(map[string]interface{}{}, false))
+	assert.True(t, restore(map[string]interface{}{"model": "gpt-4-old"}, true))
+}
+
+func TestProxyApiVersionOverride(t *testing.T) {
+	C.ApiVersionOverrides = []string{"2024-10-21"}
+	defer func() { C.ApiVersionOverrides = nil }()
+
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "2024-10-21", r.URL.Query().Get("api-version"))
+		assert.Empty(t, r.Header.Get(ApiVersionHeader))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	send := func(version string) int {
+		req, _ := http.NewRequest("POST", proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4"}`))
+		req.Header.Set(ApiVersionHeader, version)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, send("2024-10-21"))
+	assert.Equal(t, http.StatusBadRequest, send("2023-05-15"))
+}
+
+func TestProxyQueryPassthrough(t *testing.T) {
+	C.QueryPassthrough = []QueryPassthrough{{Route: "/v1/chat/completions", Params: []string{"keep", "api-version"}}}
+	defer func() { C.QueryPassthrough = nil }()
+
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "api-version=2024-02-01&keep=1", r.URL.RawQuery)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions?keep=1&drop=2&api-version=2020-01-01", "application/json", strings.NewReader(`{"model":"gpt-4"}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestProxyDeploymentHeaders(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "apim", r.Header.Get("Ocp-Apim-Subscription-Key"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	deployment := ModelDeploymentConfig["gpt-4"]
+	deployment.Headers = map[string]string{"ocp-apim-subscription-key": "apim"}
+	ModelDeploymentConfig["gpt-4"] = deployment
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4"}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestProxyAuthHeader(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+		assert.Empty(t, r.Header.Get(AuthHeaderKey))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	deployment := ModelDeploymentConfig["gpt-4"]
+	deployment.AuthHeader, deployment.AuthScheme = "Authorization", "Bearer"
+	ModelDeploymentConfig["gpt-4"] = deployment
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("POST", proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4"}`))
+	req.Header.Set("Authorization", "Bearer client")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestUpstreamTokenAAD(t *testing.T) {
+	var requests atomic.Int64
+	authority := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, "/tenant/oauth2/v2.0/token", r.URL.Path)
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "https://cognitiveservices.azure.cn/.default", r.PostForm.Get("scope"))
+		_, _ = io.WriteString(w, `{"access_token":"aad-token","expires_in":3600}`)
+	}))
+	defer authority.Close()
+	china := clouds[CloudChina]
+	clouds[CloudChina] = cloudEnvironment{authority.URL, china.scope, china.endpointSuffix}
+	defer func() { clouds[CloudChina] = china }()
+
+	u, _ := url.Parse("https://res.openai.azure.cn/")
+	deployment := &DeploymentConfig{EndpointUrl: u, AAD: &AADConfig{TenantID: "tenant", ClientID: "id", ClientSecret: "secret"}}
+	assert.Equal(t, CloudChina, deploymentCloud(deployment))
+	// concurrent requests share one token request
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := upstreamToken(context.Background(), deployment)
+			assert.NoError(t, err)
+			assert.Equal(t, "aad-token", token)
+		}()
+	}
+	wg.Wait()
+	token, err := upstreamToken(context.Background(), deployment)
+	assert.NoError(t, err)
+	assert.Equal(t, "aad-token", token)
+	assert.Equal(t, int64(1), requests.Load())
+
+	req := httptest.NewRequest("POST", "/", nil)
+	setAuthHeader(req, deployment, "aad-token")
+	assert.Equal(t, "Bearer aad-token", req.Header.Get("Authorization"))
+
+	assert.Error(t, validateCloud(&DeploymentConfig{Cloud: "moon"}))
+}
+
+func TestUpstreamTransportCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600))
+
+	transport, err := newUpstreamTransport(OutboundConfig{})
+	assert.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	assert.Error(t, err)
+
+	transport, err = newUpstreamTransport(OutboundConfig{TLS: TLSConfig{CAFile: caFile, MinVersion: "1.3"}})
+	assert.NoError(t, err)
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+
+	_, err = newUpstreamTransport(OutboundConfig{TLS: TLSConfig{MinVersion: "2.0"}})
+	assert.Error(t, err)
+}
+
+func TestProxyDeploymentProxy(t *testing.T) {
+	egress := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "upstream.invalid", r.URL.Host)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	}))
+	defer egress.Close()
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("deployment proxy bypassed")
+	})
+	deployment := ModelDeploymentConfig["gpt-4"]
+	deployment.EndpointUrl, _ = url.Parse("http://upstream.invalid")
+	deployment.Proxy = egress.URL
+	ModelDeploymentConfig["gpt-4"] = deployment
+	assert.NoError(t, initDeploymentTransports(OutboundConfig{}, ModelDeploymentConfig))
+	defer func() { deploymentTransports = map[string]*http.Transport{} }()
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4"}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Same(t, upstreamTransport, transportFor(&DeploymentConfig{}))
+}
+
+func TestUpstreamTransportClientCert(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Len(t, r.TLS.PeerCertificates, 1)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600))
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	outbound := OutboundConfig{TLS: TLSConfig{CAFile: caFile}}
+	deployment := DeploymentConfig{DeploymentName: "apim", ClientCert: certFile, ClientKey: keyFile}
+	assert.NoError(t, initDeploymentTransports(outbound, map[string]DeploymentConfig{"apim": deployment}))
+	defer func() { deploymentTransports = map[string]*http.Transport{} }()
+
+	resp, err := (&http.Client{Transport: transportFor(&deployment)}).Get(server.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	deployment.ClientKey = filepath.Join(dir, "missing.pem")
+	assert.Error(t, initDeploymentTransports(outbound, map[string]DeploymentConfig{"apim": deployment}))
+}
+
+func TestProxyHTTP2Upstream(t *testing.T) {
+	var mu sync.Mutex
+	connections := map[string]bool{}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 2, r.ProtoMajor)
+		mu.Lock()
+		connections[r.RemoteAddr] = true
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, `data: {"choices":[{"delta":{"content":"a"}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0o600))
+	transport, err := newUpstreamTransport(OutboundConfig{TLS: TLSConfig{CAFile: caFile}})
+	assert.NoError(t, err)
+	defer transport.CloseIdleConnections()
+	defer func(previous *http.Transport) { upstreamTransport = previous }(upstreamTransport)
+	upstreamTransport = transport
+
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("plain upstream called")
+	})
+	deployment := ModelDeploymentConfig["gpt-4"]
+	deployment.Endpoint = upstream.URL
+	deployment.EndpointUrl, _ = url.Parse(upstream.URL)
+	ModelDeploymentConfig["gpt-4"] = deployment
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	stream := func() {
+		resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4","stream":true}`))
+		if assert.NoError(t, err) {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Contains(t, string(body), "data: [DONE]")
+		}
+	}
+	// concurrent streams to azure are multiplexed over the http/2 connection of the first request
+	stream()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream()
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, connections, 1)
+}
+
+func TestUpstreamTransportHosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "res.openai.azure.com", r.Host[:strings.Index(r.Host, ":")])
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	transport, err := newUpstreamTransport(OutboundConfig{Hosts: []HostOverride{{Host: "RES.openai.azure.com", IP: u.Hostname()}}})
+	assert.NoError(t, err)
+	resp, err := (&http.Client{Transport: transport}).Get("http://res.openai.azure.com:" + u.Port())
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+
+	_, err = newUpstreamTransport(OutboundConfig{Hosts: []HostOverride{{Host: "res.openai.azure.com", IP: "private"}}})
+	assert.Error(t, err)
+}
+
+func TestUpstreamTransportPool(t *testing.T) {
+	transport, err := newUpstreamTransport(OutboundConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 90*time.Second, transport.IdleConnTimeout)
+
+	transport, err = newUpstreamTransport(OutboundConfig{MaxIdleConnsPerHost: 8, IdleConnTimeout: time.Minute, ResponseHeaderTimeout: 5 * time.Second})
+	assert.NoError(t, err)
+	assert.Equal(t, 8, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+	assert.Equal(t, 5*time.Second, transport.ResponseHeaderTimeout)
+}
+
+func TestBufferPool(t *testing.T) {
+	assert.Len(t, proxyBufferPool.Get(), defaultBufferSize)
+	initBufferPool(StreamingConfig{BufferSize: 1024})
+	defer initBufferPool(StreamingConfig{})
+	assert.Len(t, proxyBufferPool.Get(), 1024)
+}
+
+// countingBufferPool counts the buffers taken from the pool it wraps
+type countingBufferPool struct {
+	httputil.BufferPool
+	gets atomic.Int64
+}
+
+func (p *countingBufferPool) Get() []byte {
+	p.gets.Add(1)
+	return p.BufferPool.Get()
+}
+
+func TestProxyFlushInterval(t *testing.T) {
+	release := make(chan struct{})
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", "10")
+		_, _ = io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "last!")
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+	pool := &countingBufferPool{BufferPool: proxyBufferPool}
+	defer func(previous httputil.BufferPool) { proxyBufferPool = previous }(proxyBufferPool)
+	proxyBufferPool = pool
+	defer func() { C.Streaming = StreamingConfig{} }()
+
+	// firstBytes returns how long the first bytes of a body of known size took to reach the client
+	firstBytes := func() time.Duration {
+		start := time.Now()
+		resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4"}`))
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		defer resp.Body.Close()
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(resp.Body, buf)
+		elapsed := time.Since(start)
+		assert.NoError(t, err)
+		assert.Equal(t, "first", string(buf))
+		release <- struct{}{}
+		rest, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "last!", string(rest))
+		return elapsed
+	}
+
+	// by default every write is flushed at once, the upstream is still writing when the client reads
+	assert.Less(t, firstBytes(), 150*time.Millisecond)
+	assert.Positive(t, pool.gets.Load())
+
+	// a flush interval holds the bytes back until it ticks
+	C.Streaming.FlushInterval = 200 * time.Millisecond
+	assert.GreaterOrEqual(t, firstBytes(), 150*time.Millisecond)
+}
+
+func TestDefaultUpstreamTransport(t *testing.T) {
+	t.Setenv("ALL_PROXY", "ftp://127.0.0.1:21")
+	transport := defaultUpstreamTransport()
+	if assert.NotNil(t, transport) {
+		assert.Nil(t, transport.Proxy)
+	}
+	_, err := newUpstreamTransport(OutboundConfig{})
+	assert.Error(t, err)
+}
+
+func TestKeepTransports(t *testing.T) {
+	kept, dropped, rebuilt, added := &http.Transport{}, &http.Transport{}, &http.Transport{}, &http.Transport{}
+	next := map[string]*http.Transport{"kept": rebuilt, "added": added}
+	unused := keepTransports(map[string]*http.Transport{"kept": kept, "dropped": dropped}, next)
+
+	assert.Same(t, kept, next["kept"])
+	assert.Same(t, added, next["added"])
+	assert.ElementsMatch(t, []*http.Transport{dropped, rebuilt}, unused)
+}
+
+func TestModelListCache(t *testing.T) {
+	C.Models = ModelsConfig{CacheTTL: time.Hour, Timeout: 100 * time.Millisecond, Concurrency: 1}
+	deploymentModels = &modelListCache{entries: map[string][]map[string]interface{}{}}
+	defer func() {
+		C.Models = ModelsConfig{}
+		deploymentModels = &modelListCache{entries: map[string][]map[string]interface{}{}}
+	}()
+
+	var calls atomic.Int32
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_, _ = io.WriteString(w, `{"data":[{"id":"gpt4"}],"object":"list"}`)
+	})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+	ModelDeploymentConfig["gpt-hung"] = DeploymentConfig{DeploymentName: "hung", Endpoint: hung.URL}
+	defer delete(ModelDeploymentConfig, "gpt-hung")
+
+	// concurrent requests of an empty cache wait for one refresh
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, []map[string]interface{}{{"id": "gpt4"}}, deploymentModels.list(context.Background(), nil))
+		}()
+	}
+	wg.Wait()
+	assert.Less(t, time.Since(start), time.Second)
+	data := deploymentModels.list(context.Background(), nil)
+	assert.Equal(t, []map[string]interface{}{{"id": "gpt4"}}, data)
+	assert.EqualValues(t, 1, calls.Load())
+
+	// a listing where every deployment failed isn't cached
+	failing := &modelListCache{entries: map[string][]map[string]interface{}{}}
+	saved := ModelDeploymentConfig
+	ModelDeploymentConfig = map[string]DeploymentConfig{"gpt-hung": saved["gpt-hung"]}
+	assert.Empty(t, failing.list(context.Background(), nil))
+	ModelDeploymentConfig = saved
+	assert.True(t, failing.fetched.IsZero())
+}
+
+func TestAcquireUpstream(t *testing.T) {
+	initConcurrency(ConcurrencyConfig{MaxUpstream: 1})
+	C.Concurrency.QueueTimeout = 50 * time.Millisecond
+	defer func() {
+		initConcurrency(ConcurrencyConfig{})
+		C.Concurrency = ConcurrencyConfig{}
+	}()
+
+	inFlight := testutil.ToFloat64(upstreamInFlight)
+	release, err := acquireUpstream(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, inFlight+1, testutil.ToFloat64(upstreamInFlight))
+	_, err = acquireUpstream(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, inFlight+1, testutil.ToFloat64(upstreamInFlight))
+
+	// a queued request isn't in flight until it holds a slot
+	queued := make(chan struct{})
+	go func() {
+		defer close(queued)
+		release, err := acquireUpstream(context.Background())
+		if assert.NoError(t, err) {
+			release()
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, inFlight+1, testutil.ToFloat64(upstreamInFlight))
+	release()
+	<-queued
+	assert.Equal(t, inFlight, testutil.ToFloat64(upstreamInFlight))
+
+	release, err = acquireUpstream(context.Background())
+	assert.NoError(t, err)
+
+	// a client going away while queued isn't a 503
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = acquireUpstream(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	sendConcurrencyError(c, err)
+	assert.Equal(t, statusClientClosedRequest, w.Code)
+	release()
+}
+
+func TestProxyStreamedUpload(t *testing.T) {
+	audio := bytes.Repeat([]byte{0xff}, 3*requestBodyPrefix)
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/openai/deployments/gpt4/audio/transcriptions", r.URL.Path)
+		assert.NoError(t, r.ParseMultipartForm(1<<20))
+		file, _, err := r.FormFile("file")
+		if assert.NoError(t, err) {
+			data, _ := io.ReadAll(file)
+			assert.Equal(t, audio, data)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"text":"hi"}`)
+	})
+	router := newTestRouter()
+	router.Any("/v1/audio/transcriptions", ProxyWithConverter(NewStripPrefixConverter("/v1")))
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	_ = writer.WriteField("model", "gpt-4")
+	part, _ := writer.CreateFormFile("file", "audio.mp3")
+	_, _ = part.Write(audio)
+	_ = writer.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/audio/transcriptions", writer.FormDataContentType(), &form)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"text":"hi"}`, string(body))
+}
+
+func TestProxyOpenAIFallback(t *testing.T) {
+	azureStatus := http.StatusTooManyRequests
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(azureStatus)
+		_, _ = io.WriteString(w, `{"error":{"code":"429","message":"rate limited"}}`)
+	})
+	openaiStatus := http.StatusOK
+	openai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		assert.Equal(t, "Bearer sk-openai", r.Header.Get("Authorization"))
+		assert.Empty(t, r.Header.Get(AuthHeaderKey))
+		body, _ := io.ReadAll(r.Body)
+		assert.Contains(t, string(body), `"model":"gpt-4o"`)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(openaiStatus)
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	}))
+	defer openai.Close()
+	deployment := ModelDeploymentConfig["gpt-4"]
+	deployment.OpenAIFallback = &OpenAIFallback{ApiKey: "sk-openai", Model: "gpt-4o", BaseURL: openai.URL + "/v1"}
+	ModelDeploymentConfig["gpt-4"] = deployment
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	post := func() *http.Response {
+		resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4","messages":[]}`))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	resp := post()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, BackendOpenAI, resp.Header.Get(BackendHeader))
+
+	// openai failing as well, the azure response is relayed
+	openaiStatus = http.StatusServiceUnavailable
+	resp = post()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, BackendAzure, resp.Header.Get(BackendHeader))
+
+	azureStatus = http.StatusOK
+	resp = post()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, BackendAzure, resp.Header.Get(BackendHeader))
+}
+
+// embeddingsFor answers an embeddings request with one embedding per input, the value of the embedding is the input
+func embeddingsFor(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Input []string `json:"input"`
+	}
+	assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+	data := make([]map[string]interface{}, len(req.Input))
+	for i, input := range req.Input {
+		value, _ := strconv.Atoi(input)
+		data[i] = map[string]interface{}{"object": "embedding", "index": i, "embedding": []int{value}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"object": "list", "data": data,
+		"usage": map[string]int{"prompt_tokens": len(req.Input), "total_tokens": len(req.Input)}})
+}
+
+func TestProxyEmbeddingsBatches(t *testing.T) {
+	var slow, limited atomic.Bool
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/openai/deployments/gpt4/embeddings", r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		if slow.Load() && strings.Contains(string(body), `"4"`) {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if limited.Load() && strings.Contains(string(body), `"2"`) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		embeddingsFor(t, w, httptest.NewRequest(r.Method, r.URL.String(), bytes.NewReader(body)))
+	})
+	var fallbacks atomic.Int64
+	openai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/embeddings", r.URL.Path)
+		fallbacks.Add(1)
+		embeddingsFor(t, w, r)
+	}))
+	defer openai.Close()
+	deployment := ModelDeploymentConfig["gpt-4"]
+	deployment.EmbeddingsBatchSize = 2
+	deployment.OpenAIFallback = &OpenAIFallback{ApiKey: "sk-openai", BaseURL: openai.URL + "/v1"}
+	ModelDeploymentConfig["gpt-4"] = deployment
+	r := newTestRouter()
+	r.Any("/v1/embeddings", ProxyWithConverter(NewStripPrefixConverter("/v1")))
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	post := func() (*http.Response, map[string]interface{}) {
+		resp, err := http.Post(proxy.URL+"/v1/embeddings", "application/json",
+			strings.NewReader(`{"model":"gpt-4","input":["0","1","2","3","4"]}`))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		var payload map[string]interface{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&payload))
+		return resp, payload
+	}
+	// the batches are merged in input order and their usage is summed
+	assertMerged := func(payload map[string]interface{}) {
+		data, _ := payload["data"].([]interface{})
+		if assert.Len(t, data, 5) {
+			for i, item := range data {
+				embedding := item.(map[string]interface{})
+				assert.Equal(t, float64(i), embedding["index"])
+				assert.Equal(t, []interface{}{float64(i)}, embedding["embedding"])
+			}
+		}
+		assert.Equal(t, map[string]interface{}{"prompt_tokens": float64(5), "total_tokens": float64(5)}, payload["usage"])
+	}
+	resp, payload := post()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assertMerged(payload)
+
+	// a rate limited batch falls back to openai like a single request
+	limited.Store(true)
+	resp, payload = post()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assertMerged(payload)
+	assert.Equal(t, int64(1), fallbacks.Load())
+	limited.Store(false)
+
+	// every batch is bound to the timeouts
+	C.Timeout = TimeoutConfig{FirstByte: 50 * time.Millisecond}
+	defer func() { C.Timeout = TimeoutConfig{} }()
+	slow.Store(true)
+	resp, payload = post()
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Equal(t, "timeout", payload["error"].(map[string]interface{})["code"])
+}
+
+func TestProxyOpenAICompatible(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		assert.Empty(t, r.URL.Query().Get("api-version"))
+		assert.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+		assert.Empty(t, r.Header.Get(AuthHeaderKey))
+		body, _ := io.ReadAll(r.Body)
+		assert.Contains(t, string(body), `"model":"meta-llama/Llama-3-8B-Instruct"`)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	deployment := ModelDeploymentConfig["gpt-4"]
+	deployment.Type = BackendOpenAICompatible
+	deployment.DeploymentName = "meta-llama/Llama-3-8B-Instruct"
+	deployment.Endpoint = upstream.URL + "/v1"
+	deployment.EndpointUrl, _ = url.Parse(deployment.Endpoint)
+	assert.NoError(t, initBackend(&deployment))
+	assert.Equal(t, upstream.URL+"/v1/models", deploymentModelsURL(&deployment))
+	ModelDeploymentConfig["gpt-4"] = deployment
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4","messages":[]}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	deployment.Type = "vllm"
+	assert.Error(t, initBackend(&deployment))
+}
+
+func TestProxyServerless(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/chat/completions", r.URL.Path)
+		assert.Equal(t, "2024-05-01-preview", r.URL.Query().Get("api-version"))
+		assert.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+		body, _ := io.ReadAll(r.Body)
+		assert.Contains(t, string(body), `"model":"mistral-large"`)
+		assert.NotContains(t, string(body), "data_sources")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	deployment := ModelDeploymentConfig["gpt-4"]
+	deployment.Type = BackendServerless
+	deployment.ModelName, deployment.DeploymentName = "mistral-large", "mistral-large"
+	deployment.ApiVersion = "2024-05-01-preview"
+	ModelDeploymentConfig["mistral-large"] = deployment
+	defer delete(ModelDeploymentConfig, "mistral-large")
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	// features never raise the api-version of the model inference api, azure only fields are stripped
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"mistral-large","messages":[],"response_format":{"type":"json_schema","json_schema":{"name":"x","schema":{}}},`+
+			`"data_sources":[{"type":"azure_search"}]}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// nor are the data_sources of the deployment injected
+	deployment.DataSources = []map[string]interface{}{{"type": "azure_search"}}
+	ModelDeploymentConfig["mistral-large"] = deployment
+	resp, err = http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"mistral-large","messages":[]}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, upstream.URL+"/info?api-version=2024-05-01-preview", deploymentModelsURL(&deployment))
+
+	endpoint, _ := url.Parse("https://mistral-large-xyz.eastus2.models.ai.azure.com")
+	assert.Equal(t, BackendServerless, (&DeploymentConfig{EndpointUrl: endpoint}).backendType())
+	endpoint, _ = url.Parse("https://xxx.openai.azure.com")
+	assert.Equal(t, BackendAzure, (&DeploymentConfig{EndpointUrl: endpoint}).backendType())
+}
+
+func TestProxyModelInference(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/models/chat/completions", r.URL.Path)
+		assert.Equal(t, "2024-05-01-preview", r.URL.Query().Get("api-version"))
+		assert.Equal(t, "key", r.Header.Get(AuthHeaderKey))
+		assert.Equal(t, "pass-through", r.Header.Get(ExtraParametersHeader))
+		body, _ := io.ReadAll(r.Body)
+		assert.Contains(t, string(body), `"model":"Phi-4"`)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	deployment := ModelDeploymentConfig["gpt-4"]
+	deployment.Type, deployment.ExtraParameters = BackendInference, "pass-through"
+	deployment.ModelName, deployment.DeploymentName = "phi-4", "Phi-4"
+	deployment.ApiVersion = "2024-05-01-preview"
+	assert.NoError(t, initBackend(&deployment))
+	ModelDeploymentConfig["phi-4"] = deployment
+	defer delete(ModelDeploymentConfig, "phi-4")
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"phi-4","messages":[],"safe_prompt":true}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	deployment.ExtraParameters = "ignore"
+	assert.Error(t, initBackend(&deployment))
+}
+
+func TestProxyOllama(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		assert.Empty(t, r.Header.Get("Authorization"))
+		assert.Empty(t, r.Header.Get(AuthHeaderKey))
+		body, _ := io.ReadAll(r.Body)
+		assert.JSONEq(t, `{"model":"llama3.2","max_tokens":64,"messages":[{"role":"system","content":"be brief"}]}`, string(body))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	deployment := DeploymentConfig{Type: BackendOllama, DeploymentName: "llama3.2", ModelName: "gpt-4"}
+	assert.NoError(t, initBackend(&deployment))
+	assert.Equal(t, defaultOllamaEndpoint, deployment.Endpoint)
+	deployment.Endpoint = upstream.URL + "/v1"
+	deployment.EndpointUrl, _ = url.Parse(deployment.Endpoint)
+	ModelDeploymentConfig["gpt-4"] = deployment
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions",
+		strings.NewReader(`{"model":"gpt-4","max_completion_tokens":64,"messages":[{"role":"developer","content":"be brief"}]}`))
+	req.Header.Set("Authorization", "Bearer client-key")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestConvertLiteLLMConfig(t *testing.T) {
+	t.Setenv("AZURE_API_KEY", "secret")
+	deployments, warnings, err := ConvertLiteLLMConfig([]byte(`
+model_list:
+  - model_name: gpt-4
+    litellm_params:
+      model: azure/gpt4-prod
+      api_base: https://xxx.openai.azure.com/
+      api_key: os.environ/AZURE_API_KEY
+      api_version: "2024-02-01"
+  - model_name: gpt-4
+    litellm_params:
+      model: azure/gpt4-backup
+      api_base: https://yyy.openai.azure.com/
+  - model_name: mistral-large
+    litellm_params:
+      model: azure_ai/mistral-large
+      api_base: https://mistral-large-xxx.eastus2.models.ai.azure.com
+  - model_name: llama3
+    litellm_params:
+      model: ollama/llama3
+      api_base: http://localhost:11434
+  - model_name: claude
+    litellm_params:
+      model: bedrock/anthropic.claude-v2
+`))
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 2)
+	if assert.Len(t, deployments, 3) {
+		assert.Equal(t, "gpt4-prod", deployments[0].DeploymentName)
+		assert.Equal(t, "secret", deployments[0].ApiKey)
+		assert.Equal(t, BackendServerless, deployments[1].Type)
+		assert.Equal(t, BackendOllama, deployments[2].Type)
+		assert.Equal(t, "http://localhost:11434/v1", deployments[2].Endpoint)
+	}
+
+	out, err := MarshalDeploymentConfig(deployments[:1])
+	assert.NoError(t, err)
+	assert.Equal(t, `deployment_config:
+    - deployment_name: gpt4-prod
+      model_name: gpt-4
+      endpoint: https://xxx.openai.azure.com/
+      api_key: secret
+      api_version: "2024-02-01"
+`, string(out))
+
+	// the printed config doesn't show the secrets of the environment
+	deployments, warnings, err = ConvertLiteLLMConfigRedacted([]byte(`
+model_list:
+  - model_name: gpt-4
+    litellm_params:
+      model: azure/gpt4-prod
+      api_base: https://xxx.openai.azure.com/
+      api_key: os.environ/AZURE_API_KEY
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"the secret of os.environ/AZURE_API_KEY is printed as REDACTED, fill it in"}, warnings)
+	if assert.Len(t, deployments, 1) {
+		assert.Equal(t, "REDACTED", deployments[0].ApiKey)
+	}
+}
+
+func TestAzureDeploymentProxy(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/openai/deployments/gpt4/chat/completions", r.URL.Path)
+		assert.Equal(t, "2024-02-01", r.URL.Query().Get("api-version"))
+		assert.Equal(t, "key", r.Header.Get(AuthHeaderKey))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Any("/openai/deployments/:deployment/chat/completions", AzureDeploymentProxy)
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	// the deployment name of the client is either a model or the deployment_name of a deployment
+	for _, name := range []string{"gpt-4", "gpt4"} {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/openai/deployments/"+name+"/chat/completions?api-version=2023-05-15",
+			strings.NewReader(`{"messages":[]}`))
+		req.Header.Set(AuthHeaderKey, "client-key")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, "unknown", deploymentModel("unknown"))
+
+	// models sharing a deployment_name resolve to the first one by name
+	for _, model := range []string{"gpt-4-b", "gpt-4-a"} {
+		ModelDeploymentConfig[model] = DeploymentConfig{DeploymentName: "shared", ModelName: model}
+	}
+	defer delete(ModelDeploymentConfig, "gpt-4-a")
+	defer delete(ModelDeploymentConfig, "gpt-4-b")
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "gpt-4-a", deploymentModel("shared"))
+	}
+}
+
+func TestProxyMock(t *testing.T) {
+	mockUpstream = true
+	defer func() { mockUpstream = false }()
+	r := newTestRouter()
+	r.Any("/v1/embeddings", ProxyWithConverter(NewStripPrefixConverter("/v1")))
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	post := func(path, body string) (*http.Response, string) {
+		resp, err := http.Post(proxy.URL+path, "application/json", strings.NewReader(body))
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(data)
+	}
+	resp, body := post("/v1/chat/completions", `{"model":"any-model","messages":[{"role":"user","content":"hi"}]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, defaultMockContent)
+	assert.Contains(t, body, `"model":"any-model"`)
+
+	resp, body = post("/v1/chat/completions", `{"model":"any-model","stream":true,"messages":[]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, `"delta":{"content":"mock "}`)
+	assert.Contains(t, body, `"usage":`)
+	assert.True(t, strings.HasSuffix(strings.TrimSpace(body), "data: [DONE]"))
+
+	_, first := post("/v1/embeddings", `{"model":"ada","input":["a","b"],"dimensions":4}`)
+	_, second := post("/v1/embeddings", `{"model":"ada","input":["a","b"],"dimensions":4}`)
+	assert.Equal(t, first, second)
+	var embeddings struct {
+		Data []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(first), &embeddings))
+	if assert.Len(t, embeddings.Data, 2) {
+		assert.Len(t, embeddings.Data[0].Embedding, 4)
+		assert.NotEqual(t, embeddings.Data[0].Embedding, embeddings.Data[1].Embedding)
+	}
+}
+
+func TestProxyDryRun(t *testing.T) {
+	var called atomic.Int64
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		called.Add(1)
+		assert.Empty(t, r.Header.Get(DryRunHeader))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+	post := func() (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4","messages":[]}`))
+		req.Header.Set(DryRunHeader, "1")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, data
+	}
+
+	// ignored unless enabled
+	post()
+	assert.Equal(t, int64(1), called.Load())
+
+	C.DryRun = true
+	defer func() { C.DryRun = false }()
+	resp, data := post()
+	assert.Equal(t, int64(1), called.Load())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var result DryRunRequest
+	assert.NoError(t, json.Unmarshal(data, &result))
+	assert.Equal(t, "gpt4", result.Deployment)
+	assert.Equal(t, upstream.URL+"/openai/deployments/gpt4/chat/completions?api-version=2024-02-01", result.URL)
+	assert.Equal(t, []string{"REDACTED"}, result.Headers["Api-Key"])
+	assert.Equal(t, map[string]interface{}{"model": "gpt-4", "messages": []interface{}{}}, result.Body)
+}
+
+// syncBuffer collects log output written by the handlers while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestProxyGracefulShutdown(t *testing.T) {
+	streaming, finish := make(chan struct{}), make(chan struct{})
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, `data: {"choices":[{"delta":{"content":"a"}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		close(streaming)
+		<-finish
+		_, _ = io.WriteString(w, `data: {"choices":[{"delta":{"content":"b"}}]}`+"\n\n")
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	})
+	router := newTestRouter()
+	router.GET("/readyz", ReadyzHandler)
+	defer func() {
+		readiness.Lock()
+		readiness.draining = false
+		readiness.Unlock()
+	}()
+	// the old process of a restart, served like the binary serves it
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := &http.Server{Handler: router}
+	go func() { _ = srv.Serve(ln) }()
+	base := "http://" + ln.Addr().String()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Post(base+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4","stream":true}`))
+		if !assert.NoError(t, err) {
+			body <- ""
+			return
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(data)
+	}()
+	<-streaming
+
+	// draining takes the proxy out of rotation while the stream keeps going
+	SetDraining()
+	resp, err := http.Get(base + "/readyz")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	// shutdown waits for the open stream, which ends complete
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+	returned := false
+	select {
+	case <-shutdown:
+		returned = true
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.False(t, returned, "shutdown returned with a stream in flight")
+	close(finish)
+	if !returned {
+		assert.NoError(t, <-shutdown)
+	}
+	out := <-body
+	assert.Contains(t, out, `"content":"a"`)
+	assert.Contains(t, out, `"content":"b"`)
+	assert.Contains(t, out, "data: [DONE]")
+}
+
+func TestProxyDebug(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get(DebugHeader))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	C.InjectUser = true
+	defer func() { C.InjectUser = false }()
+	post := func(token string) {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(DebugHeader, "1")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	C.Debug.Keys = []string{callerKeyID(&http.Request{Header: http.Header{"Authorization": {"Bearer allowed"}}})}
+	defer func() { C.Debug.Keys = nil }()
+	post("other")
+	assert.NotContains(t, logs.String(), "DEBUG")
+
+	post("allowed")
+	out := logs.String()
+	assert.Contains(t, out, "DEBUG")
+	assert.Contains(t, out, "served by deployment gpt4")
+	assert.Contains(t, out, "rewriteInjectUser: added user")
+	assert.Contains(t, out, "/openai/deployments/gpt4/chat/completions?api-version=2024-02-01")
+	assert.Contains(t, out, "upstream header Api-Key: REDACTED")
+	assert.Contains(t, out, "upstream responded 200")
+}
+
+func TestProxyLogContent(t *testing.T) {
+	status := http.StatusOK
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, `{"choices":[]}`)
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	defer func() { C.LogContent = "" }()
+	C.Debug.Keys = []string{callerKeyID(&http.Request{Header: http.Header{"Authorization": {"Bearer debugged"}}})}
+	defer func() { C.Debug.Keys = nil }()
+
+	// logged returns whether the prompt of a request answered with code made it into the logs
+	logged := func(mode string, code int, debug bool) bool {
+		C.LogContent, status = mode, code
+		logs.mu.Lock()
+		logs.buf.Reset()
+		logs.mu.Unlock()
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions",
+			strings.NewReader(`{"model":"gpt-4","messages":[{"role":"user","content":"top secret prompt"}]}`))
+		if debug {
+			req.Header.Set("Authorization", "Bearer debugged")
+			req.Header.Set(DebugHeader, "1")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+		// the access log line is written once the request content was logged
+		assert.Eventually(t, func() bool { return strings.Contains(logs.String(), "access request_id=") }, time.Second, time.Millisecond)
+		return strings.Contains(logs.String(), "top secret prompt")
+	}
+
+	assert.True(t, logged(LogContentAlways, http.StatusOK, false))
+	assert.False(t, logged(LogContentErrorsOnly, http.StatusOK, false))
+	assert.True(t, logged(LogContentErrorsOnly, http.StatusBadRequest, false))
+	assert.False(t, logged("", http.StatusOK, false))
+	assert.True(t, logged("", http.StatusBadRequest, false))
+
+	// never keeps the prompt out of error logs and debug logs, only its digest is logged
+	assert.False(t, logged(LogContentNever, http.StatusBadRequest, false))
+	assert.Contains(t, logs.String(), "sha256=")
+	assert.False(t, logged(LogContentNever, http.StatusOK, true))
+	assert.Contains(t, logs.String(), "DEBUG")
+	assert.True(t, logged(LogContentErrorsOnly, http.StatusOK, true))
+}
+
+func TestCapture(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"hello"}}]}`)
+	})
+	r := newTestRouter()
+	r.Any("/admin/capture", CaptureHandler)
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+	C.Capture.Dir = t.TempDir()
+	defer func() { C.Capture.Dir = "" }()
+	send := func(method, path, token, body string) []byte {
+		req, _ := http.NewRequest(method, proxy.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return data
+	}
+	keyID := callerKeyID(&http.Request{Header: http.Header{"Authorization": {"Bearer captured"}}})
+	chat := `{"model":"gpt-4","messages":[],"data_sources":[{"type":"azure_search","parameters":{"authentication":{"type":"api_key","key":"search-secret"}}}]}`
+
+	var started struct {
+		Capture TrafficCapture `json:"capture"`
+	}
+	assert.NoError(t, json.Unmarshal(send(http.MethodPut, "/admin/capture", "", `{"key_id":"`+keyID+`","count":2}`), &started))
+	assert.Equal(t, 2, started.Capture.Remaining)
+	send(http.MethodPost, "/v1/chat/completions", "other", chat)
+	send(http.MethodPost, "/v1/chat/completions", "captured", chat)
+	send(http.MethodPost, "/v1/chat/completions", "captured", chat)
+	send(http.MethodPost, "/v1/chat/completions", "captured", chat)
+	assert.JSONEq(t, `{"capture":null}`, string(send(http.MethodGet, "/admin/capture", "", "")))
+
+	data, err := os.ReadFile(started.Capture.File)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+	var record captureRecord
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, keyID, record.KeyID)
+	assert.Equal(t, "gpt4", record.Deployment)
+	assert.Equal(t, http.StatusOK, record.Status)
+	assert.Equal(t, []string{"REDACTED"}, record.RequestHeaders["Authorization"])
+	assert.Contains(t, record.RequestBody, `"key":"REDACTED"`)
+	assert.NotContains(t, string(data), "search-secret")
+	assert.Contains(t, record.ResponseBody, "hello")
+
+	// bodies stay out of captures with log_content never
+	C.LogContent = LogContentNever
+	defer func() { C.LogContent = "" }()
+	assert.Contains(t, string(send(http.MethodPut, "/admin/capture", "", `{"key_id":"`+keyID+`","count":2}`)), "content_logging_disabled")
+	buf := &cappedBuffer{limit: 64}
+	buf.keep([]byte(chat))
+	assert.NotContains(t, capturedBody(buf, "application/json"), "gpt-4")
+}
+
+func TestDeploymentsAdmin(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"deployment":"`+strings.Split(r.URL.Path, "/")[3]+`"}`)
+	})
+	r := newTestRouter()
+	r.GET("/admin/deployments", DeploymentsHandler)
+	r.PUT("/admin/deployments/*model", DeploymentHandler)
+	r.DELETE("/admin/deployments/*model", DeploymentHandler)
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("# proxy config\napi_base: /v1\ndeployment_config:\n  - deployment_name: gpt4\n    model_name: gpt-4\n    endpoint: https://example.openai.azure.com/\n"), 0o640))
+	loadedConfigFile = path
+	defer func() { loadedConfigFile = "" }()
+	send := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, proxy.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(data)
+	}
+	chat := func(model string) string {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"`+model+`","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer key")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(data)
+	}
+
+	status, body := send(http.MethodPut, "/admin/deployments/gpt-4o", `{"deployment_name":"gpt4o","endpoint":"`+upstream.URL+`","api_key":"secret","api_version":"2024-02-01","bogus":1}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, "bogus")
+	status, body = send(http.MethodPut, "/admin/deployments/gpt-4o", `{"deployment_name":"gpt4o","endpoint":"`+upstream.URL+`","api_key":"secret","api_version":"2024-02-01"}`)
+	assert.Equal(t, http.StatusOK, status, body)
+	defer delete(ModelDeploymentConfig, "gpt-4o")
+	assert.Contains(t, body, `"persisted":true`)
+	assert.JSONEq(t, `{"deployment":"gpt4o"}`, chat("gpt-4o"))
+
+	_, body = send(http.MethodGet, "/admin/deployments", "")
+	assert.Contains(t, body, `"model_name":"gpt-4o"`)
+	assert.Contains(t, body, `"api_key":"REDACTED"`)
+	assert.NotContains(t, body, "secret")
+	masked := maskedDeployment(DeploymentConfig{DataSources: []map[string]interface{}{{"type": "azure_search",
+		"parameters": map[string]interface{}{"authentication": map[string]interface{}{"type": "api_key", "key": "search-key"}}}}})
+	assert.Equal(t, "REDACTED", masked.DataSources[0]["parameters"].(map[string]interface{})["authentication"].(map[string]interface{})["key"])
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "# proxy config")
+	assert.Contains(t, string(data), "deployment_name: gpt4o")
+	assert.Contains(t, string(data), "api_key: secret")
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	config, problems, err := CheckConfigFile(path)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+	assert.Len(t, config.DeploymentConfig, 2)
+
+	status, _ = send(http.MethodDelete, "/admin/deployments/gpt-4o", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, chat("gpt-4o"), "not found")
+	status, _ = send(http.MethodDelete, "/admin/deployments/gpt-4o", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	data, _ = os.ReadFile(path)
+	assert.NotContains(t, string(data), "gpt4o")
+	assert.Contains(t, string(data), "deployment_name: gpt4")
+}
+
+func TestReloadConfig(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"deployment":"`+strings.Split(r.URL.Path, "/")[3]+`"}`)
+	})
+	r := newTestRouter()
+	r.POST("/admin/reload", ReloadHandler)
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	deployments, transports, level := currentDeployments(), deploymentTransports, util.GetLogLevel()
+	defer func() {
+		swapDeployments(deployments, transports)
+		util.SetLogLevel(level)
+		SetConfigError(nil)
+		loadedConfigFile, fileConfig = "", Config{}
+	}()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(config string) {
+		assert.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+	}
+	gpt4 := "  - deployment_name: gpt4\n    model_name: gpt-4\n    endpoint: " + upstream.URL + "\n    api_key: key\n    api_version: 2024-02-01\n"
+	write("deployment_config:\n" + gpt4)
+	loadedConfigFile = path
+	data, _ := os.ReadFile(path)
+	assert.NoError(t, yaml.Unmarshal(data, &fileConfig))
+	reload := func() (int, string) {
+		resp, err := http.Post(proxy.URL+"/admin/reload", "application/json", nil)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+	chat := func(model string) string {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"`+model+`","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer key")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(body)
+	}
+
+	diff, err := ReloadConfig()
+	assert.NoError(t, err)
+	assert.True(t, diff.Empty(), "%+v", diff)
+
+	write("log_level: debug\ntimeout:\n  total: 30s\ndeployment_config:\n" + strings.Replace(gpt4, "2024-02-01", "2024-06-01", 1) +
+		"  - deployment_name: gpt4o\n    model_name: gpt-4o\n    endpoint: " + upstream.URL + "\n    api_key: key\n    api_version: 2024-02-01\n")
+	status, body := reload()
+	assert.Equal(t, http.StatusOK, status, body)
+	assert.JSONEq(t, `{"reloaded":true,"diff":{"added":["gpt-4o"],"removed":[],"updated":{"gpt-4":["api_version"]},
+		"log_level":"debug","restart_required":["timeout"],"problems":[]}}`, body)
+	assert.JSONEq(t, `{"deployment":"gpt4o"}`, chat("gpt-4o"))
+	assert.Equal(t, "2024-06-01", currentDeployments()["gpt-4"].ApiVersion)
+	assert.Equal(t, util.LevelDebug, util.GetLogLevel())
+	assert.Empty(t, notReadyReason())
+
+	// an invalid config changes nothing and fails readiness until a reload succeeds
+	write("log_level: debug\ntimeout:\n  total: 30s\ndeployment_config:\n  - deployment_name: gpt4o\n    endpoint: " + upstream.URL + "\n")
+	status, body = reload()
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Contains(t, body, "model_name")
+	assert.JSONEq(t, `{"deployment":"gpt4o"}`, chat("gpt-4o"))
+	assert.Contains(t, notReadyReason(), "config reload failed")
+	write("deployment_config: [")
+	status, _ = reload()
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.JSONEq(t, `{"deployment":"gpt4o"}`, chat("gpt-4o"))
+
+	write("log_level: debug\ntimeout:\n  total: 30s\ndeployment_config:\n" + gpt4)
+	diff, err = ReloadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gpt-4o"}, diff.Removed)
+	assert.Empty(t, diff.RestartRequired)
+	assert.Contains(t, chat("gpt-4o"), "not found")
+	assert.Empty(t, notReadyReason())
+}
+
+func TestDeploymentDrain(t *testing.T) {
+	received, release := make(chan struct{}, 1), make(chan struct{})
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		deployment := strings.Split(r.URL.Path, "/")[3]
+		if strings.Contains(r.URL.RawQuery, "slow") {
+			received <- struct{}{}
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"model":"`+deployment+`","deployment":"`+deployment+`"}`)
+	})
+	u, _ := url.Parse(upstream.URL)
+	ModelDeploymentConfig["gpt-4o"] = DeploymentConfig{DeploymentName: "gpt4o", ModelName: "gpt-4o", Endpoint: upstream.URL,
+		EndpointUrl: u, ApiKey: "key", ApiVersion: "2024-02-01"}
+	defer delete(ModelDeploymentConfig, "gpt-4o")
+	defer func() { drains = map[string]*DeploymentDrain{} }()
+
+	r := newTestRouter()
+	r.GET("/admin/drain", DrainsHandler)
+	r.PUT("/admin/drain/*model", DrainHandler)
+	r.DELETE("/admin/drain/*model", DrainHandler)
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+	send := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, proxy.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(data)
+	}
+	chat := func(query string) (int, string) {
+		return send(http.MethodPost, "/v1/chat/completions"+query, `{"model":"gpt-4","messages":[]}`)
+	}
+
+	done := make(chan string)
+	go func() {
+		_, body := chat("?slow=1")
+		done <- body
+	}()
+	<-received
+	status, body := send(http.MethodPut, "/admin/drain/gpt-4", `{"to":"gpt-4"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, body = send(http.MethodPut, "/admin/drain/gpt-4", `{"to":"gpt-4o"}`)
+	assert.Equal(t, http.StatusOK, status, body)
+	assert.Contains(t, body, `"in_flight":1`)
+
+	// new requests go to the sibling under the requested name, the request in flight completes on the drained one
+	status, body = chat("")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"model":"gpt-4","deployment":"gpt4o"}`, body)
+	close(release)
+	assert.JSONEq(t, `{"model":"gpt4","deployment":"gpt4"}`, <-done)
+	_, body = send(http.MethodGet, "/admin/drain", "")
+	assert.Contains(t, body, `"in_flight":0`)
+	assert.Contains(t, body, `"to":"gpt-4o"`)
+
+	status, _ = send(http.MethodPut, "/admin/drain/gpt-4", "")
+	assert.Equal(t, http.StatusOK, status)
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4","messages":[]}`))
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	status, _ = send(http.MethodDelete, "/admin/drain/gpt-4", "")
+	assert.Equal(t, http.StatusOK, status)
+	_, body = chat("")
+	assert.JSONEq(t, `{"model":"gpt4","deployment":"gpt4"}`, body)
+	status, _ = send(http.MethodDelete, "/admin/drain/gpt-4", "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestMaintenance(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"ok"}`)
+	})
+	defer initMaintenance(MaintenanceConfig{})
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Maintenance())
+	r.Any("/v1/chat/completions", ProxyWithConverter(NewStripPrefixConverter("/v1")))
+	r.Any("/v1/embeddings", ProxyWithConverter(NewStripPrefixConverter("/v1")))
+	r.GET("/readyz", ReadyzHandler)
+	r.GET("/admin/maintenance", MaintenanceHandler)
+	r.PUT("/admin/maintenance", MaintenanceHandler)
+	r.DELETE("/admin/maintenance", MaintenanceHandler)
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+	send := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, proxy.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	chat := func(path string) (int, string) {
+		resp := send(http.MethodPost, path, `{"model":"gpt-4","messages":[],"input":"hi"}`)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(data)
+	}
+
+	initMaintenance(MaintenanceConfig{Enabled: true, RetryAfter: 2 * time.Minute})
+	resp := send(http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4"}`)
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "120", resp.Header.Get("Retry-After"))
+	assert.JSONEq(t, `{"error":{"code":"maintenance","message":"`+defaultMaintenanceMessage+`","type":"server_error"}}`, string(data))
+	resp = send(http.MethodGet, "/readyz", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = send(http.MethodPut, "/admin/maintenance", `{"message":"Be right back","routes":["/v1/chat"]}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	status, body := chat("/v1/chat/completions")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Contains(t, body, "Be right back")
+	status, _ = chat("/v1/embeddings")
+	assert.Equal(t, http.StatusOK, status)
+	resp = send(http.MethodPut, "/admin/maintenance", `{"retry_after":"soon"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = send(http.MethodDelete, "/admin/maintenance", "")
+	data, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.JSONEq(t, `{"maintenance":null}`, string(data))
+	status, _ = chat("/v1/chat/completions")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestConfigDiff(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	r := gin.New()
+	r.POST("/admin/config/diff", ConfigDiffHandler)
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	gpt4 := "  - deployment_name: gpt4\n    model_name: gpt-4\n    endpoint: " + upstream.URL + "\n    api_key: key\n    api_version: 2024-02-01\n"
+	assert.NoError(t, yaml.Unmarshal([]byte("deployment_config:\n"+gpt4), &fileConfig))
+	defer func() { fileConfig = Config{} }()
+	post := func(config string) (int, string) {
+		resp, err := http.Post(proxy.URL+"/admin/config/diff", "application/yaml", strings.NewReader(config))
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(data)
+	}
+
+	status, body := post("stream_usage: inject\ndeployment_config:\n" + strings.Replace(gpt4, upstream.URL, "https://example.openai.azure.com/", 1) +
+		"  - deployment_name: gpt4o\n    model_name: gpt-4o\n    endpoint: https://example.openai.azure.com/\n")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"valid":true,"diff":{"added":["gpt-4o"],"removed":[],"updated":{"gpt-4":["endpoint"]},
+		"restart_required":["stream_usage"],"problems":[]}}`, body)
+	assert.Equal(t, upstream.URL, currentDeployments()["gpt-4"].Endpoint)
+	assert.NotContains(t, currentDeployments(), "gpt-4o")
+
+	status, body = post("deployment_config:\n  - deployment_name: gpt4\n    endpoint: https://example.openai.azure.com/\n    bogus: 1\n")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"valid":false`)
+	assert.Contains(t, body, `"removed":["gpt-4"]`)
+	assert.Contains(t, body, "bogus")
+	assert.Contains(t, body, "model_name is required")
+
+	status, body = post("deployment_config: [")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"valid":false`)
+	assert.Contains(t, body, `"removed":[]`)
+	status, _ = post("")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestRegisterRoutes(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/openai/deployments/gpt4/chat/completions", r.URL.Path)
+		assert.Equal(t, "key", r.Header.Get(AuthHeaderKey))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"chatcmpl-1"}`)
+	})
+	config, deployments, level := C, ModelDeploymentConfig, util.GetLogLevel()
+	transport, transports := upstreamTransport, deploymentTransports
+	defer func() {
+		C, ModelDeploymentConfig = config, deployments
+		upstreamTransport, deploymentTransports = transport, transports
+		util.SetLogLevel(level)
+		initMaintenance(MaintenanceConfig{})
+	}()
+
+	_, err := NewHandler(Config{JSONEngine: "bogus"})
+	assert.Error(t, err)
+
+	assert.NoError(t, Setup(Config{
+		ApiBase: "llm/v1/",
+		DeploymentConfig: []DeploymentConfig{{
+			DeploymentName: "gpt4",
+			ModelName:      "gpt-4",
+			Endpoint:       upstream.URL,
+			ApiKey:         "key",
+			ApiVersion:     "2024-02-01",
+		}},
+	}))
+	assert.Equal(t, "/llm/v1", C.ApiBase)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Header("X-Host", "yes")
+	})
+	r.GET("/internal", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	RegisterRoutes(r)
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	chat := func() *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/llm/v1/chat/completions", strings.NewReader(`{"model":"gpt-4","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer key")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	resp := chat()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "yes", resp.Header.Get("X-Host"))
+	assert.NotEmpty(t, resp.Header.Get(RequestIDHeader))
+
+	// maintenance covers the proxy routes only
+	initMaintenance(MaintenanceConfig{Enabled: true})
+	assert.Equal(t, http.StatusServiceUnavailable, chat().StatusCode)
+	resp, err = http.Get(proxy.URL + "/internal")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(RequestIDHeader))
+}
+
+func TestHTTPHandler(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet {
+			_, _ = io.WriteString(w, `{"data":[{"id":"gpt4","model":"gpt-4"}]}`)
+			return
+		}
+		assert.Equal(t, "/openai/deployments/gpt4/chat/completions", r.URL.Path)
+		assert.Equal(t, "key", r.Header.Get(AuthHeaderKey))
+		_, _ = io.WriteString(w, `{"id":"chatcmpl-1"}`)
+	})
+	defer initMaintenance(MaintenanceConfig{})
+
+	// a router reading the deployment from /openai/deployments/{deployment}/...
+	param := func(r *http.Request, name string) string {
+		if parts := strings.Split(r.URL.Path, "/"); name == "deployment" && len(parts) > 3 {
+			return parts[3]
+		}
+		return ""
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/v1/chat/completions", ProxyHandler(NewStripPrefixConverter("/v1"), nil))
+	mux.Handle("/v1/models", HTTPHandler(ModelProxy, nil))
+	mux.Handle("/openai/deployments/", AzureDeploymentHandler(param))
+	proxy := httptest.NewServer(mux)
+	defer proxy.Close()
+
+	post := func(path string, header http.Header) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+path, strings.NewReader(`{"model":"gpt-4","messages":[]}`))
+		for name := range header {
+			req.Header.Set(name, header.Get(name))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+	resp, body := post("/v1/chat/completions", http.Header{"Authorization": {"Bearer key"}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"id":"chatcmpl-1"}`, body)
+	assert.NotEmpty(t, resp.Header.Get(RequestIDHeader))
+
+	resp, body = post("/openai/deployments/gpt4/chat/completions?api-version=2024-02-01", http.Header{AuthHeaderKey: {"key"}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"id":"chatcmpl-1"}`, body)
+
+	resp, err := http.Get(proxy.URL + "/v1/models")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	initMaintenance(MaintenanceConfig{Enabled: true})
+	resp, body = post("/v1/chat/completions", http.Header{"Authorization": {"Bearer key"}})
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Contains(t, body, `"code":"maintenance"`)
+}
+
+func TestMarshalRedactedConfig(t *testing.T) {
+	out, err := MarshalRedactedConfig(Config{
+		LogLevel: "debug",
+		DeploymentConfig: []DeploymentConfig{{
+			ModelName:  "gpt-4",
+			ApiKey:     "azure-key",
+			ApiVersion: "2024-02-01",
+			Headers:    map[string]string{"Ocp-Apim-Subscription-Key": "apim-key", "X-Team": "search"},
+			DataSources: []map[string]interface{}{{"type": "azure_search", "parameters": map[string]interface{}{
+				"index_name": "docs", "authentication": map[string]interface{}{"type": "api_key", "key": "search-key"},
+			}}},
+		}},
+		Admin: AdminConfig{Token: "admin-token"},
+		Usage: UsageConfig{Store: UsageStoreConfig{Driver: "postgres", DSN: "postgres://user:pass@db/usage"}},
+	})
+	assert.NoError(t, err)
+	text := string(out)
+	for _, secret := range []string{"azure-key", "apim-key", "admin-token", "user:pass", "search-key"} {
+		assert.NotContains(t, text, secret)
+	}
+	assert.Contains(t, text, "index_name: docs")
+	assert.Contains(t, text, "api_key: REDACTED")
+	assert.Contains(t, text, "Ocp-Apim-Subscription-Key: REDACTED")
+	assert.Contains(t, text, "X-Team: search")
+	assert.Contains(t, text, "log_level: debug")
+	assert.Contains(t, text, "api_version: \"2024-02-01\"")
+	// unset credentials stay empty
+	assert.Contains(t, text, "connection_string: \"\"")
+}
+
+func TestTenantRouting(t *testing.T) {
+	upstream := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, r.Header.Get(DefaultTenantHeader))
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"upstream":"`+name+`","key":"`+r.Header.Get(AuthHeaderKey)+`"}`)
+		}
+	}
+	newTestUpstream(t, upstream("shared"))
+	acme := httptest.NewServer(upstream("acme"))
+	defer acme.Close()
+	defer func() {
+		assert.NoError(t, initTenants(OutboundConfig{}, nil))
+	}()
+	assert.NoError(t, initTenants(OutboundConfig{}, []TenantConfig{
+		{ID: "acme", DeploymentConfig: []DeploymentConfig{{
+			DeploymentName: "gpt4", ModelName: "gpt-4", Endpoint: acme.URL, ApiKey: "acme-key", ApiVersion: "2024-02-01",
+		}}},
+		{ID: "globex"},
+		{ID: "initech", Fallback: true},
+	}))
+
+	r := newTestRouter()
+	r.GET("/v1/models/:model", ModelRetrieveProxy)
+	r.PUT("/admin/drain/*model", DrainHandler)
+	r.DELETE("/admin/drain/*model", DrainHandler)
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+	chat := func(tenant string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer key")
+		if tenant != "" {
+			req.Header.Set(DefaultTenantHeader, tenant)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := chat("")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"upstream":"shared","key":"key"}`, body)
+	// a key not issued to a tenant can't pick one with the header
+	status, body = chat("acme")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"tenant_mismatch"`)
+
+	C.TrustTenantHeader = true
+	defer func() { C.TrustTenantHeader = false }()
+	status, body = chat("acme")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"upstream":"acme","key":"acme-key"}`, body)
+	status, body = chat("globex")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Contains(t, body, `"code":"model_not_found"`)
+	status, body = chat("initech")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"upstream":"shared","key":"key"}`, body)
+	status, body = chat("hooli")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, `"code":"unknown_tenant"`)
+
+	// drains follow the deployment, whichever tenant it serves
+	defer func() { drains = map[string]*DeploymentDrain{} }()
+	drain := func(method, path string) int {
+		req, _ := http.NewRequest(method, proxy.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, drain(http.MethodPut, "/admin/drain/gpt-4?tenant=acme"))
+	status, _ = chat("acme")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	status, _ = chat("initech")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusOK, drain(http.MethodDelete, "/admin/drain/gpt-4?tenant=acme"))
+	assert.Equal(t, http.StatusOK, drain(http.MethodPut, "/admin/drain/gpt-4"))
+	status, _ = chat("initech")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	status, _ = chat("acme")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusOK, drain(http.MethodDelete, "/admin/drain/gpt-4"))
+	assert.Equal(t, http.StatusNotFound, drain(http.MethodPut, "/admin/drain/gpt-4?tenant=hooli"))
+
+	retrieve := func(tenant string) int {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/v1/models/gpt-4", nil)
+		req.Header.Set(DefaultTenantHeader, tenant)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, retrieve("acme"))
+	assert.Equal(t, http.StatusNotFound, retrieve("globex"))
+	assert.Equal(t, http.StatusOK, retrieve("initech"))
+
+	// without tenants the header is ignored
+	assert.NoError(t, initTenants(OutboundConfig{}, nil))
+	status, body = chat("hooli")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"upstream":"shared","key":"key"}`, body)
+}
+
+func TestTenantLimits(t *testing.T) {
+	C.Pricing = []ModelPrice{{Model: "gpt-4", Input: 1, Output: 1}}
+	C.TrustTenantHeader = true
+	tenantUsage.tenants = map[string]*TenantUsage{}
+	defer func() {
+		C.Pricing, C.TrustTenantHeader = nil, false
+		assert.NoError(t, initTenants(OutboundConfig{}, nil))
+	}()
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"usage":{"prompt_tokens":5,"completion_tokens":3,"total_tokens":8}}`)
+	})
+	assert.NoError(t, initTenants(OutboundConfig{}, []TenantConfig{
+		{ID: "acme", Fallback: true, TokensPerMinute: 10},
+		{ID: "globex", Fallback: true, Budget: 0.01, BudgetPeriod: "day"},
+	}))
+
+	router := newTestRouter()
+	router.GET("/admin/usage/tenants", TenantUsageHandler)
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+	chat := func(tenant string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4"}`))
+		req.Header.Set("Authorization", "Bearer key")
+		req.Header.Set(DefaultTenantHeader, tenant)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	for _, tenant := range []string{"acme", "globex"} {
+		for i := 0; i < 2; i++ {
+			resp := chat(tenant)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}
+	resp := chat("acme")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Contains(t, string(body), `"code":"rate_limit_exceeded"`)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	resp = chat("globex")
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Contains(t, string(body), `"code":"insufficient_quota"`)
+
+	resp, err := http.Get(proxy.URL + "/admin/usage/tenants")
+	assert.NoError(t, err)
+	var usage struct {
+		Data []TenantUsage `json:"data"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&usage))
+	resp.Body.Close()
+	assert.Len(t, usage.Data, 2)
+	assert.Equal(t, "acme", usage.Data[0].Tenant)
+	assert.Equal(t, int64(2), usage.Data[0].Requests)
+	assert.Equal(t, int64(16), usage.Data[0].MinuteTokens)
+	assert.Equal(t, int64(10), usage.Data[0].TokensPerMinute)
+	assert.Equal(t, int64(2), usage.Data[1].Models["gpt-4"].Requests)
+	assert.InDelta(t, 0.016, usage.Data[1].PeriodCost, 1e-9)
+	assert.Equal(t, "day", usage.Data[1].BudgetPeriod)
+}
+
+func TestTenantOnboarding(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"upstream":"shared"}`)
+	})
+	acme := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "acme-key", r.Header.Get(AuthHeaderKey))
+		_, _ = io.WriteString(w, `{"upstream":"acme"}`)
+	}))
+	defer acme.Close()
+	dir := t.TempDir()
+	assert.NoError(t, loadVirtualKeys(filepath.Join(dir, "keys.json")))
+	path := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("log_level: info\n"), 0o600))
+	loadedConfigFile = path
+	defer func() {
+		_ = loadVirtualKeys("")
+		loadedConfigFile, fileConfig, C.Tenants = "", Config{}, nil
+		assert.NoError(t, initTenants(OutboundConfig{}, nil))
+	}()
+
+	r := newTestRouter()
+	registerAdminRoutes(r.Group("/admin"))
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+	do := func(method, path, body string, header ...string) (int, string) {
+		req, _ := http.NewRequest(method, proxy.URL+path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(data)
+	}
+
+	onboarding := `{"id":"acme","tokens_per_minute":1000,"deployment_config":[{"deployment_name":"gpt4","model_name":"gpt-4",` +
+		`"endpoint":"` + acme.URL + `","api_key":"acme-key","api_version":"2024-02-01"}],"keys":[{"name":"acme-prod"}]}`
+	status, body := do(http.MethodPost, "/admin/tenants", onboarding)
+	assert.Equal(t, http.StatusCreated, status)
+	var created struct {
+		Tenant    TenantConfig       `json:"tenant"`
+		Keys      []issuedVirtualKey `json:"keys"`
+		Persisted bool               `json:"persisted"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &created))
+	assert.True(t, created.Persisted)
+	assert.Equal(t, "REDACTED", created.Tenant.DeploymentConfig[0].ApiKey)
+	assert.Len(t, created.Keys, 1)
+	assert.Equal(t, "acme", created.Keys[0].Key.Tenant)
+	data, _ := os.ReadFile(path)
+	assert.Contains(t, string(data), "log_level: info\ntenants:\n")
+	assert.Contains(t, string(data), "    id: acme\n")
+	assert.Contains(t, string(data), "tokens_per_minute: 1000")
+	assert.NotContains(t, string(data), "acme-prod")
+
+	status, body = do(http.MethodPost, "/admin/tenants", onboarding)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Contains(t, body, `"code":"tenant_exists"`)
+	status, body = do(http.MethodPost, "/admin/tenants", `{"id":"globex","deployment_config":[{"deployment_name":"gpt4","model_name":"gpt-4"}]}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, "endpoint is required")
+	status, body = do(http.MethodGet, "/admin/tenants", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"id":"acme"`)
+	assert.NotContains(t, body, "globex")
+
+	// the key serves the tenant without the tenant header
+	chat := `{"model":"gpt-4"}`
+	status, body = do(http.MethodPost, "/v1/chat/completions", chat, "Authorization", "Bearer "+created.Keys[0].Secret)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"upstream":"acme"}`, body)
+
+	status, _ = do(http.MethodDelete, "/admin/tenants/acme", "")
+	assert.Equal(t, http.StatusOK, status)
+	data, _ = os.ReadFile(path)
+	assert.NotContains(t, string(data), "acme")
+	status, body = do(http.MethodPost, "/v1/chat/completions", chat, "Authorization", "Bearer "+created.Keys[0].Secret)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"tenant_mismatch"`)
+	status, _ = do(http.MethodGet, "/admin/tenants/acme", "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestTenantLogs(t *testing.T) {
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"usage":{"prompt_tokens":5,"completion_tokens":3,"total_tokens":8}}`)
+	})
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	C.TrustTenantHeader = true
+	defer func() { C.TrustTenantHeader = false }()
+	path := filepath.Join(t.TempDir(), "acme.log")
+	assert.NoError(t, initTenants(OutboundConfig{}, []TenantConfig{
+		{ID: "acme", Fallback: true, LogFile: path},
+		{ID: "globex", Fallback: true},
+	}))
+	defer func() {
+		assert.NoError(t, initTenants(OutboundConfig{}, nil))
+	}()
+
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+	for _, tenant := range []string{"acme", "globex", ""} {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4"}`))
+		req.Header.Set("Authorization", "Bearer key")
+		req.Header.Set(RequestIDHeader, "request-"+tenant)
+		if tenant != "" {
+			req.Header.Set(DefaultTenantHeader, tenant)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Contains(t, logs.String(), "[request-acme] tenant=acme proxying request [gpt-4]")
+	assert.Contains(t, logs.String(), "access request_id=request-globex key_id=")
+	assert.Contains(t, logs.String(), " tenant=globex model=gpt-4 ")
+	assert.Contains(t, logs.String(), "[request-] proxying request [gpt-4]")
+	assert.Contains(t, logs.String(), " tenant=- model=gpt-4 ")
+
+	// the log file of a tenant only gets the lines of its requests
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "[request-acme] tenant=acme proxying request [gpt-4]")
+	assert.Contains(t, string(data), "access request_id=request-acme ")
+	assert.NotContains(t, string(data), "globex")
+	assert.NotContains(t, string(data), "request-\n")
+	assert.NotContains(t, string(data), "[request-] ")
+}
+
+func TestChaos(t *testing.T) {
+	var called atomic.Int64
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		called.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"hello world"}}]}`)
+	})
+	r := newTestRouter()
+	r.Any("/admin/chaos", ChaosHandler)
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+	defer func() { chaosRules = nil }()
+
+	setRules := func(rules string) int {
+		req, _ := http.NewRequest(http.MethodPut, proxy.URL+"/admin/chaos", strings.NewReader(rules))
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	post := func() (*http.Response, string) {
+		resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4","messages":[]}`))
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(data)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, setRules(`{"rules":[{"rate":2,"status":503}]}`))
+	assert.Equal(t, http.StatusBadRequest, setRules(`{"rules":[{"rate":1}]}`))
+
+	assert.Equal(t, http.StatusOK, setRules(`{"rules":[{"models":["gpt-4"],"rate":1,"status":429,"latency":"10ms"}]}`))
+	start := time.Now()
+	resp, _ := post()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+	assert.Equal(t, int64(0), called.Load())
+
+	assert.Equal(t, http.StatusOK, setRules(`{"rules":[{"models":["other"],"rate":1,"status":500}]}`))
+	resp, _ = post()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(1), called.Load())
+
+	assert.Equal(t, http.StatusOK, setRules(`{"rules":[{"rate":1,"cut_after":20}]}`))
+	_, body := post()
+	assert.Len(t, body, 20)
+
+	req, _ := http.NewRequest(http.MethodDelete, proxy.URL+"/admin/chaos", nil)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Empty(t, chaosRules)
+}
+
+func TestCheckConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := `log_levle: debug
+deployment_config:
+  - deployment_name: gpt4
+    model_name: gpt-4
+    endpoint: https://example.openai.azure.com/
+  - deployment_name: gpt4o
+    model_name: gpt-4
+    endpoint: https://example.openai.azure.com/
+    type: bogus
+stream_usage: always
+log_content: sometimes
+`
+	assert.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+	_, problems, err := CheckConfigFile(path)
+	assert.NoError(t, err)
+	if !assert.Len(t, problems, 5) {
+		return
+	}
+	assert.Equal(t, 1, problems[0].Line)
+	assert.Contains(t, problems[0].Message, "log_levle")
+	assert.Equal(t, 6, problems[1].Line)
+	assert.Contains(t, problems[1].Message, "configured on line 3 too")
+	assert.Equal(t, 6, problems[2].Line)
+	assert.Contains(t, problems[2].Message, "invalid type")
+	assert.Equal(t, 10, problems[3].Line)
+	assert.Contains(t, problems[3].Message, "stream_usage")
+	assert.Equal(t, 11, problems[4].Line)
+	assert.Contains(t, problems[4].Message, "log_content")
+
+	assert.NoError(t, os.WriteFile(path, []byte("deployment_config:\n  - model_name: [gpt-4\n"), 0o600))
+	_, problems, err = CheckConfigFile(path)
+	assert.NoError(t, err)
+	if !assert.Len(t, problems, 1) {
+		return
+	}
+	assert.NotZero(t, problems[0].Line)
+}
+
+func TestCheckDeployments(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Header.Get(AuthHeaderKey) != "key":
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":{"code":"401","message":"Access denied due to invalid subscription key."}}`))
+		case r.URL.Query().Get("api-version") != "2024-02-01":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":{"code":"404","message":"Resource not found"}}`))
+		case r.URL.Path != "/openai/deployments/gpt4/chat/completions":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":{"code":"DeploymentNotFound","message":"The API deployment for this resource does not exist."}}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":{"code":"BadRequest","message":"'$.messages' is too short."}}`))
+		}
+	}))
+	defer upstream.Close()
+	saved := upstreamTransport
+	defer func() { upstreamTransport = saved }()
+
+	deployment := func(name, model, key, version string) DeploymentConfig {
+		return DeploymentConfig{DeploymentName: name, ModelName: model, Endpoint: upstream.URL, ApiKey: key, ApiVersion: version}
+	}
+	checks, err := CheckDeployments(&Config{DeploymentConfig: []DeploymentConfig{
+		deployment("gpt4", "gpt-4", "key", "2024-02-01"),
+		deployment("gpt4", "gpt-4-bad-key", "wrong", "2024-02-01"),
+		deployment("gpt4", "gpt-4-old", "key", "2021-01-01"),
+		deployment("missing", "gpt-4-missing", "key", "2024-02-01"),
+		deployment("gpt4", "gpt-4-client-keys", "", "2024-02-01"),
+	}}, time.Second)
+	assert.NoError(t, err)
+	if !assert.Len(t, checks, 5) {
+		return
+	}
+	assert.Equal(t, CheckOK, checks[0].Status)
+	assert.Equal(t, CheckFailed, checks[1].Status)
+	assert.Contains(t, checks[1].Detail, "authentication failed")
+	assert.Equal(t, CheckFailed, checks[2].Status)
+	assert.Contains(t, checks[2].Detail, "api_version 2021-01-01")
+	assert.Equal(t, CheckFailed, checks[3].Status)
+	assert.Contains(t, checks[3].Detail, "does not exist")
+	assert.Equal(t, CheckSkipped, checks[4].Status)
+}
+
+// benchmarkProxy drives chat completions through the proxy against a mock upstream answering with events
+// tokens, besides allocations it reports the time to the first byte and the relayed tokens per second
+func benchmarkProxy(b *testing.B, stream bool, events int) {
+	level := util.GetLogLevel()
+	util.SetLogLevel(util.LevelError)
+	defer util.SetLogLevel(level)
+
+	chunk := `data: {"id":"x","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"token "}}]}` + "\n\n"
+	completion := `{"id":"x","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"` +
+		strings.Repeat("token ", events) + `"}}],"usage":{"prompt_tokens":1,"completion_tokens":` + strconv.Itoa(events) + `,"total_tokens":` + strconv.Itoa(events+1) + `}}`
+	newTestUpstream(b, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		if !stream {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, completion)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < events; i++ {
+			_, _ = io.WriteString(w, chunk)
+			w.(http.Flusher).Flush()
+		}
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	})
+	proxy := httptest.NewServer(newTestRouter())
+	defer proxy.Close()
+	client := proxy.Client()
+	body := `{"model":"gpt-4","stream":` + strconv.FormatBool(stream) + `,"messages":[{"role":"user","content":"hi"}]}`
+
+	var ttft time.Duration
+	first := make([]byte, 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		resp, err := client.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(resp.Body, first); err != nil {
+			b.Fatal(err)
+		}
+		ttft += time.Since(start)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(ttft.Microseconds())/1000/float64(b.N), "ttft-ms")
+	b.ReportMetric(float64(b.N*events)/b.Elapsed().Seconds(), "tokens/s")
+}
+
+func BenchmarkProxyStream(b *testing.B) {
+	benchmarkProxy(b, true, 200)
+}
+
+func BenchmarkProxyJSON(b *testing.B) {
+	benchmarkProxy(b, false, 200)
+}
@@ -0,0 +1,34 @@
+package azure
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// QueryPassthrough lists the incoming query parameters forwarded to azure for a route
+type QueryPassthrough struct {
+	Route  string   `yaml:"route" mapstructure:"route"`   // path the allowlist applies to, e.g. /v1/chat/completions, empty matches every route
+	Params []string `yaml:"params" mapstructure:"params"` // query parameters forwarded upstream
+}
+
+// filterQuery strips the query parameters not allowed for the route once query_passthrough is configured,
+// api-version is always set from the deployment by the converter
+func filterQuery(req *http.Request, route string) {
+	if len(C.QueryPassthrough) == 0 || req.URL.RawQuery == "" {
+		return
+	}
+
+	query := req.URL.Query()
+	filtered := url.Values{}
+	for _, p := range C.QueryPassthrough {
+		if p.Route != "" && p.Route != route {
+			continue
+		}
+		for _, param := range p.Params {
+			if values, ok := query[param]; ok && param != "api-version" {
+				filtered[param] = values
+			}
+		}
+	}
+	req.URL.RawQuery = filtered.Encode()
+}
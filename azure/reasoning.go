@@ -0,0 +1,60 @@
+package azure
+
+import (
+	"regexp"
+)
+
+// ReasoningApiVersion is the first api-version accepting max_completion_tokens and the developer role
+const ReasoningApiVersion = "2024-12-01-preview"
+
+var (
+	reasoningModelPattern = regexp.MustCompile(`^o\d+(-|$)`)
+	// earlyReasoningModelPattern matches the o1 previews, they accept neither the system nor the developer role
+	earlyReasoningModelPattern = regexp.MustCompile(`^o1-(mini|preview)(-|$)`)
+	// reasoningUnsupportedParams are rejected by o-series deployments
+	reasoningUnsupportedParams = []string{"temperature", "top_p", "presence_penalty", "frequency_penalty", "logprobs", "top_logprobs", "logit_bias"}
+)
+
+// isReasoningDeployment reports whether the deployment serves an o-series model
+func isReasoningDeployment(deployment *DeploymentConfig) bool {
+	return deployment.Reasoning || reasoningModelPattern.MatchString(deployment.ModelName)
+}
+
+// rewriteReasoning maps chat parameters of unmodified openai clients to what o-series deployments accept
+func rewriteReasoning(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if !isChatCompletions(rc.req) || !isReasoningDeployment(rc.deployment) {
+		return false, nil
+	}
+	if err := ensureApiVersion(rc.deployment, ReasoningApiVersion, "reasoning models"); err != nil {
+		return false, err
+	}
+
+	changed := false
+	if maxTokens, ok := payload["max_tokens"]; ok {
+		if _, ok := payload["max_completion_tokens"]; !ok {
+			payload["max_completion_tokens"] = maxTokens
+		}
+		delete(payload, "max_tokens")
+		changed = true
+	}
+	for _, param := range reasoningUnsupportedParams {
+		if _, ok := payload[param]; ok {
+			delete(payload, param)
+			changed = true
+		}
+	}
+
+	// system instructions go in developer messages, the o1 previews only take them as user messages
+	role := "developer"
+	if earlyReasoningModelPattern.MatchString(rc.deployment.ModelName) {
+		role = "user"
+	}
+	messages, _ := payload["messages"].([]interface{})
+	for _, item := range messages {
+		if message, ok := item.(map[string]interface{}); ok && message["role"] == "system" {
+			message["role"] = role
+			changed = true
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,40 @@
+package azure
+
+import (
+	"errors"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// Recovery turns panics of handlers into a 500 in the OpenAI error format carrying the request id,
+// the stack trace is logged and the process keeps serving
+func Recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if err, ok := recovered.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				// the reverse proxy aborts responses it can no longer complete, nothing to report
+				c.Abort()
+				return
+			}
+
+			id := requestID(c)
+			util.Errorf("[%s] tenant=%s panic serving %s %s: %v\n%s", id, logValue(c.GetString(tenantKey)), c.Request.Method, c.Request.URL.Path, recovered, debug.Stack())
+			if c.Writer.Written() {
+				// a response is already on its way, the client sees a truncated body
+				c.Abort()
+				return
+			}
+			util.SendOpenAIError(c, http.StatusInternalServerError, "server_error", "internal_error", "",
+				errors.New("the proxy failed to handle the request, request id "+id))
+			c.Abort()
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,193 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// reloadedSettings are the settings a reload applies, every other setting only changes with a restart
+var reloadedSettings = map[string]bool{"deployment_config": true, "litellm_config": true, "log_level": true}
+
+// ConfigDiff is what applying a config changes compared to the running one
+type ConfigDiff struct {
+	Added           []string            `json:"added"`               // models without deployment so far
+	Removed         []string            `json:"removed"`             // models whose deployment goes away
+	Updated         map[string][]string `json:"updated"`             // changed deployment settings by model, e.g. endpoint
+	LogLevel        string              `json:"log_level,omitempty"` // the new log level when it changes
+	RestartRequired []string            `json:"restart_required"`    // changed settings only applied by a restart
+	Problems        []ConfigProblem     `json:"problems"`            // validation errors, nothing is applied when there are any
+}
+
+// Empty tells whether the config changes nothing
+func (d *ConfigDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Updated) == 0 && d.LogLevel == "" && len(d.RestartRequired) == 0
+}
+
+// preparedDeployments maps the deployments of a validated config by model
+func preparedDeployments(config *Config) map[string]DeploymentConfig {
+	deployments := make(map[string]DeploymentConfig, len(config.DeploymentConfig))
+	for _, deployment := range config.DeploymentConfig {
+		if prepareDeployment(&deployment) == nil {
+			deployments[deployment.ModelName] = deployment
+		}
+	}
+	return deployments
+}
+
+func newConfigDiff() *ConfigDiff {
+	return &ConfigDiff{Added: []string{}, Removed: []string{}, Updated: map[string][]string{}, RestartRequired: []string{}, Problems: []ConfigProblem{}}
+}
+
+// checkedConfigDiff diffs a checked config against the running one, deploymentChangeMu must be held, nothing is
+// compared when the config couldn't be parsed
+func checkedConfigDiff(config *Config, problems []ConfigProblem) (*ConfigDiff, map[string]DeploymentConfig) {
+	diff, next := newConfigDiff(), map[string]DeploymentConfig{}
+	if config != nil {
+		next = preparedDeployments(config)
+		diff = diffConfig(&fileConfig, currentDeployments(), config, next)
+	}
+	if len(problems) > 0 {
+		diff.Problems = problems
+	}
+	return diff, next
+}
+
+// diffConfig compares the running deployments and settings with those of next
+func diffConfig(current *Config, deployments map[string]DeploymentConfig, next *Config, nextDeployments map[string]DeploymentConfig) *ConfigDiff {
+	diff := newConfigDiff()
+	for model, deployment := range nextDeployments {
+		previous, ok := deployments[model]
+		if !ok {
+			diff.Added = append(diff.Added, model)
+			continue
+		}
+		if fields := changedFields(reflect.ValueOf(previous), reflect.ValueOf(deployment)); len(fields) > 0 {
+			diff.Updated[model] = fields
+		}
+	}
+	for model := range deployments {
+		if _, ok := nextDeployments[model]; !ok {
+			diff.Removed = append(diff.Removed, model)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+
+	// a level set through /admin/loglevel stays until the level of the file changes
+	currentLevel, _ := util.ParseLogLevel(current.LogLevel)
+	if level, err := util.ParseLogLevel(next.LogLevel); err == nil && level != currentLevel {
+		diff.LogLevel = level.String()
+	}
+	for _, field := range changedFields(reflect.ValueOf(*current), reflect.ValueOf(*next)) {
+		if !reloadedSettings[field] {
+			diff.RestartRequired = append(diff.RestartRequired, field)
+		}
+	}
+	return diff
+}
+
+// changedFields lists the yaml names of the fields differing between two structs of the same type
+func changedFields(a, b reflect.Value) []string {
+	var fields []string
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// ReloadConfig reads the config file again and applies its deployments and log level when it is valid, other
+// changed settings are reported as restart required, a failed reload fails readiness until a reload succeeds
+func ReloadConfig() (*ConfigDiff, error) {
+	deploymentChangeMu.Lock()
+	defer deploymentChangeMu.Unlock()
+
+	if loadedConfigFile == "" {
+		return nil, errors.New("the proxy was not started from a config file")
+	}
+	config, problems, err := CheckConfigFile(loadedConfigFile)
+	if err != nil {
+		SetConfigError(err)
+		return nil, err
+	}
+	diff, next := checkedConfigDiff(config, problems)
+	if len(problems) > 0 {
+		err := errors.Errorf("%d problems in %s, nothing was applied", len(problems), loadedConfigFile)
+		SetConfigError(err)
+		return diff, err
+	}
+	transports, err := buildDeploymentTransports(C.Outbound, next)
+	if err != nil {
+		SetConfigError(err)
+		return diff, err
+	}
+
+	swapDeployments(next, transports)
+	if diff.LogLevel != "" {
+		level, _ := util.ParseLogLevel(diff.LogLevel)
+		util.SetLogLevel(level)
+	}
+	fileConfig = *config
+	SetConfigError(nil)
+	util.Warnf("config reloaded: %d models added, %d removed, %d updated", len(diff.Added), len(diff.Removed), len(diff.Updated))
+	if len(diff.RestartRequired) > 0 {
+		util.Warnf("config reloaded: changes of %s apply after a restart", strings.Join(diff.RestartRequired, ", "))
+	}
+	return diff, nil
+}
+
+// ReloadHandler reloads the config file on POST and answers with what changed, or with the problems
+// preventing the reload
+func ReloadHandler(c *gin.Context) {
+	diff, err := ReloadConfig()
+	if err != nil {
+		status := http.StatusUnprocessableEntity
+		if diff == nil {
+			status = http.StatusInternalServerError
+		}
+		util.SendJSON(c, status, gin.H{"reloaded": false, "error": err.Error(), "diff": diff})
+		return
+	}
+	util.SendJSON(c, http.StatusOK, gin.H{"reloaded": true, "diff": diff})
+}
+
+// maxConfigSize bounds the config posted to /admin/config/diff
+const maxConfigSize = 4 << 20
+
+// ConfigDiffHandler validates the config file posted as yaml and answers with what a reload would change,
+// nothing is applied, a relative litellm_config is read next to the running config file
+func ConfigDiffHandler(c *gin.Context) {
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxConfigSize))
+	if err != nil {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", errors.Wrap(err, "read config"))
+		return
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", errors.New("post the config file as yaml"))
+		return
+	}
+	path := loadedConfigFile
+	if path == "" {
+		path = ConfigFilePath()
+	}
+
+	deploymentChangeMu.Lock()
+	defer deploymentChangeMu.Unlock()
+	config, problems := checkConfig(data, path)
+	diff, _ := checkedConfigDiff(config, problems)
+	util.SendJSON(c, http.StatusOK, gin.H{"valid": len(problems) == 0, "diff": diff})
+}
@@ -0,0 +1,118 @@
+package azure
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+)
+
+// upstreamRequestIDHeaders are the azure request ids worth quoting in support tickets
+var upstreamRequestIDHeaders = []string{"apim-request-id", "x-ms-request-id"}
+
+// RequestID assigns every request an id, an incoming X-Request-ID is kept, and returns it to the client
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID(c)
+		c.Next()
+	}
+}
+
+// requestID returns the id of the request, generating it on first use
+func requestID(c *gin.Context) string {
+	if id := c.GetString(requestIDKey); id != "" {
+		return id
+	}
+	id := c.GetHeader(RequestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	c.Set(requestIDKey, id)
+	c.Request.Header.Set(RequestIDHeader, id)
+	c.Header(RequestIDHeader, id)
+	return id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// upstreamRequestID returns the azure request id of resp
+func upstreamRequestID(header http.Header) string {
+	for _, key := range upstreamRequestIDHeaders {
+		if id := header.Get(key); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// copyUpstreamRequestIDs relays the azure request ids to responses the proxy writes itself
+func copyUpstreamRequestIDs(dst, src http.Header) {
+	for _, key := range upstreamRequestIDHeaders {
+		if id := src.Get(key); id != "" {
+			dst.Set(key, id)
+		}
+	}
+}
+
+// logf, debugf and warnf prefix log lines of a request with its id and tenant, the lines of a tenant's requests
+// also go to its log_file
+func (rc *rewriteContext) logf(format string, args ...interface{}) {
+	util.Infof(rc.logPrefix()+format, args...)
+	if util.Enabled(util.LevelInfo) {
+		rc.tenant.logf(rc.logPrefix()+format, args...)
+	}
+}
+
+func (rc *rewriteContext) debugf(format string, args ...interface{}) {
+	if rc.debug {
+		util.ForceDebugf(rc.logPrefix()+format, args...)
+		rc.tenant.logf("DEBUG "+rc.logPrefix()+format, args...)
+		return
+	}
+	util.Debugf(rc.logPrefix()+format, args...)
+	if util.Enabled(util.LevelDebug) {
+		rc.tenant.logf("DEBUG "+rc.logPrefix()+format, args...)
+	}
+}
+
+func (rc *rewriteContext) warnf(format string, args ...interface{}) {
+	util.Warnf(rc.logPrefix()+format, args...)
+	if util.Enabled(util.LevelWarn) {
+		rc.tenant.logf("WARN "+rc.logPrefix()+format, args...)
+	}
+}
+
+func (rc *rewriteContext) logPrefix() string {
+	prefix := ""
+	if rc.requestID != "" {
+		prefix = "[" + strings.ReplaceAll(rc.requestID, "%", "%%") + "] "
+	}
+	if rc.tenant != nil {
+		prefix += "tenant=" + strings.ReplaceAll(logValue(rc.tenant.id), "%", "%%") + " "
+	}
+	return prefix
+}
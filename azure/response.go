@@ -0,0 +1,119 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// responseRewriter mutates one decoded json payload of the upstream response, either the whole body
+// or a single SSE data event when stream is true, returning false drops the stream event
+type responseRewriter func(payload map[string]interface{}, stream bool) bool
+
+// streamEndHook returns extra payloads emitted right before the final [DONE] event of a stream
+type streamEndHook func() []map[string]interface{}
+
+// rewriteResponse applies the response rewriters of the request to json and event-stream upstream responses
+func rewriteResponse(resp *http.Response, rc *rewriteContext) error {
+	if resp.StatusCode >= http.StatusBadRequest {
+		return normalizeErrorResponse(resp)
+	}
+	if err := applyResponseRewriters(resp, rc); err != nil {
+		return err
+	}
+	if rc.synthesizeStream {
+		return synthesizeStream(resp, rc.streamIncludeUsage)
+	}
+	return nil
+}
+
+// rewritesResponse reports whether resp is going to be modified by the proxy
+func (rc *rewriteContext) rewritesResponse(resp *http.Response) bool {
+	return resp.StatusCode >= http.StatusBadRequest ||
+		rc.synthesizeStream ||
+		len(rc.responseRewriters) > 0 ||
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+func applyResponseRewriters(resp *http.Response, rc *rewriteContext) error {
+	rewriters := rc.responseRewriters
+	rewrite := func(data []byte, stream bool) []byte {
+		if len(rewriters) == 0 {
+			return data
+		}
+		payload, err := decodeJSON(data)
+		if err != nil {
+			return data
+		}
+		for _, rewriter := range rewriters {
+			if !rewriter(payload, stream) && stream {
+				return nil
+			}
+		}
+		out, err := util.JSONMarshal(payload)
+		if err != nil {
+			return data
+		}
+		return out
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "text/event-stream"):
+		if len(rewriters) == 0 && len(rc.streamEndHooks) == 0 && len(rc.streamCutHooks) == 0 && len(streamMiddlewares) == 0 {
+			return nil
+		}
+		middlewares := newStreamMiddlewareChain(rc.deployment)
+		hooks := func(hooks []streamEndHook) [][]byte {
+			var events [][]byte
+			for _, event := range runStreamHooks(hooks) {
+				if event = middlewares(event); event != nil {
+					events = append(events, event)
+				}
+			}
+			return events
+		}
+		var cut func() [][]byte
+		if len(rc.streamCutHooks) > 0 {
+			cut = func() [][]byte {
+				return hooks(rc.streamCutHooks)
+			}
+		}
+		resp.Body = newSSERewriter(resp.Body, func(data []byte) []byte {
+			if data = rewrite(data, true); data == nil {
+				return nil
+			}
+			return middlewares(data)
+		}, func() [][]byte {
+			return hooks(rc.streamEndHooks)
+		}, cut)
+	case strings.HasPrefix(contentType, "application/json") && len(rewriters) > 0:
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		body = rewrite(body, false)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return nil
+}
+
+// runStreamHooks collects the encoded events of stream hooks
+func runStreamHooks(hooks []streamEndHook) [][]byte {
+	var events [][]byte
+	for _, hook := range hooks {
+		for _, payload := range hook() {
+			if data, err := util.JSONMarshal(payload); err == nil {
+				events = append(events, data)
+			}
+		}
+	}
+	return events
+}
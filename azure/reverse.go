@@ -0,0 +1,62 @@
+package azure
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// azureDeploymentsPrefix is the path prefix of the azure openai deployment api
+const azureDeploymentsPrefix = "/openai/deployments/"
+
+// DeploymentPathConverter converts requests made against the azure openai api, /openai/deployments/{name}/chat/completions,
+// for the deployment the name was resolved to, which may be another azure deployment or any other backend
+type DeploymentPathConverter struct{}
+
+func (c *DeploymentPathConverter) Name() string {
+	return "DeploymentPath"
+}
+
+func (c *DeploymentPathConverter) Convert(req *http.Request, config *DeploymentConfig) (*http.Request, error) {
+	if rest, ok := strings.CutPrefix(req.URL.Path, azureDeploymentsPrefix); ok {
+		if i := strings.Index(rest, "/"); i >= 0 {
+			req.URL.Path = rest[i:]
+		}
+	}
+	return (&StripPrefixConverter{}).Convert(req, config)
+}
+
+// AzureDeploymentProxy serves clients written against the azure openai api, they send the key in an api-key header
+// and name a deployment instead of a model, see deploymentModel
+func AzureDeploymentProxy(c *gin.Context) {
+	if key := c.GetHeader(AuthHeaderKey); key != "" {
+		if c.GetHeader("Authorization") == "" {
+			c.Request.Header.Set("Authorization", "Bearer "+key)
+		}
+		c.Request.Header.Del(AuthHeaderKey)
+	}
+	Proxy(c, &DeploymentPathConverter{})
+}
+
+// deploymentModel resolves the deployment name of an azure style request to a model: a configured model of that name,
+// else the model of the deployment with that deployment_name, else the name itself so model_aliases can map it.
+// when several models share the deployment_name the first one by name wins, so the choice is the same on every request
+func deploymentModel(name string) string {
+	deployments := currentDeployments()
+	if _, ok := deployments[name]; ok {
+		return name
+	}
+	var models []string
+	for model, deployment := range deployments {
+		if deployment.DeploymentName == name {
+			models = append(models, model)
+		}
+	}
+	if len(models) == 0 {
+		return name
+	}
+	sort.Strings(models)
+	return models[0]
+}
@@ -0,0 +1,101 @@
+package azure
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// RegisterRoutes registers the openai api under api_base, the azure openai api and the /admin api on r, after Init
+// or Setup. Maintenance and request ids apply to these routes only, the other routes of r keep their own middleware
+func RegisterRoutes(r gin.IRouter) {
+	registerAdminRoutes(r.Group("/admin", RequestID(), AdminAuth()))
+
+	api := r.Group("", RequestID(), Maintenance())
+	stripPrefixConverter := NewStripPrefixConverter(C.ApiBase)
+	api.GET(stripPrefixConverter.Prefix+"/models", ModelProxy)
+	api.GET(stripPrefixConverter.Prefix+"/models/:model", ModelRetrieveProxy)
+	templateConverter := NewTemplateConverter("/openai/deployments/{{.DeploymentName}}/embeddings")
+	apiBasedRouter := api.Group(C.ApiBase)
+	{
+		apiBasedRouter.Any("/engines/:model/embeddings", ProxyWithConverter(templateConverter))
+		apiBasedRouter.Any("/completions", ProxyWithConverter(stripPrefixConverter))
+		apiBasedRouter.Any("/chat/completions", ProxyWithConverter(stripPrefixConverter))
+		apiBasedRouter.Any("/embeddings", ProxyWithConverter(stripPrefixConverter))
+		apiBasedRouter.Any("/audio/transcriptions", ProxyWithConverter(stripPrefixConverter))
+		apiBasedRouter.Any("/audio/translations", ProxyWithConverter(stripPrefixConverter))
+		apiBasedRouter.GET("/templates", TemplateListHandler)
+		apiBasedRouter.POST("/templates/:name", TemplateProxy(C.ApiBase, stripPrefixConverter))
+	}
+	// clients of the azure openai api such as the azure sdks, the deployment names they send are mapped to models
+	azureRouter := api.Group("/openai/deployments/:deployment")
+	{
+		azureRouter.Any("/completions", AzureDeploymentProxy)
+		azureRouter.Any("/chat/completions", AzureDeploymentProxy)
+		azureRouter.Any("/embeddings", AzureDeploymentProxy)
+		azureRouter.Any("/audio/transcriptions", AzureDeploymentProxy)
+		azureRouter.Any("/audio/translations", AzureDeploymentProxy)
+	}
+}
+
+func registerAdminRoutes(admin gin.IRouter) {
+	admin.GET("/usage", UsageReportHandler)
+	admin.GET("/usage/keys", KeyUsageHandler)
+	admin.GET("/usage/tenants", TenantUsageHandler)
+	admin.GET("/loglevel", LogLevelHandler)
+	admin.PUT("/loglevel", LogLevelHandler)
+	admin.GET("/chaos", ChaosHandler)
+	admin.PUT("/chaos", ChaosHandler)
+	admin.DELETE("/chaos", ChaosHandler)
+	admin.GET("/capture", CaptureHandler)
+	admin.PUT("/capture", CaptureHandler)
+	admin.DELETE("/capture", CaptureHandler)
+	admin.GET("/deployments", DeploymentsHandler)
+	admin.PUT("/deployments/*model", DeploymentHandler)
+	admin.DELETE("/deployments/*model", DeploymentHandler)
+	admin.POST("/reload", ReloadHandler)
+	admin.POST("/config/diff", ConfigDiffHandler)
+	admin.GET("/stats", StatsHandler)
+	admin.GET("/dashboard", DashboardHandler)
+	admin.GET("/dashboard/data", DashboardDataHandler)
+	admin.GET("/keys", VirtualKeysHandler)
+	admin.POST("/keys", VirtualKeysHandler)
+	admin.GET("/keys/:id", VirtualKeyHandler)
+	admin.PATCH("/keys/:id", VirtualKeyHandler)
+	admin.POST("/keys/:id/rotate", RotateVirtualKeyHandler)
+	admin.GET("/tenants", TenantsHandler)
+	admin.POST("/tenants", TenantsHandler)
+	admin.GET("/tenants/:id", TenantHandler)
+	admin.DELETE("/tenants/:id", TenantHandler)
+	admin.GET("/drain", DrainsHandler)
+	admin.PUT("/drain/*model", DrainHandler)
+	admin.DELETE("/drain/*model", DrainHandler)
+	admin.GET("/maintenance", MaintenanceHandler)
+	admin.PUT("/maintenance", MaintenanceHandler)
+	admin.DELETE("/maintenance", MaintenanceHandler)
+}
+
+// RegisterHealthRoutes registers the kubernetes probes on r
+func RegisterHealthRoutes(r gin.IRouter) {
+	r.GET("/healthz", HealthzHandler)
+	r.GET("/livez", LivezHandler)
+	r.GET("/readyz", ReadyzHandler)
+}
+
+// RegisterMetricsRoute registers the prometheus metrics as /metrics on r
+func RegisterMetricsRoute(r gin.IRouter) {
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+}
+
+// NewHandler sets the proxy up from cfg and returns an engine serving its routes, to mount in a service that
+// doesn't use gin or to run it in-process. It calls Setup, so it is called once
+func NewHandler(cfg Config) (*gin.Engine, error) {
+	if err := Setup(cfg); err != nil {
+		return nil, err
+	}
+	r := gin.New()
+	r.Use(Recovery())
+	RegisterHealthRoutes(r)
+	RegisterMetricsRoute(r)
+	RegisterRoutes(r)
+	return r, nil
+}
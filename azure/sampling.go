@@ -0,0 +1,108 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SamplingPolicy forces or bounds sampling parameters of the matching requests
+type SamplingPolicy struct {
+	PolicyMatch      `yaml:",inline" mapstructure:",squash"`
+	Temperature      *ParamBound `yaml:"temperature" mapstructure:"temperature"`
+	TopP             *ParamBound `yaml:"top_p" mapstructure:"top_p"`
+	FrequencyPenalty *ParamBound `yaml:"frequency_penalty" mapstructure:"frequency_penalty"`
+}
+
+// ParamBound sets a parameter to a fixed value or clamps it to [min, max]
+type ParamBound struct {
+	Set *float64 `yaml:"set" mapstructure:"set"`
+	Min *float64 `yaml:"min" mapstructure:"min"`
+	Max *float64 `yaml:"max" mapstructure:"max"`
+}
+
+// samplingDefaults are the values applied by the api when a parameter is missing
+var samplingDefaults = map[string]float64{
+	"temperature":       1,
+	"top_p":             1,
+	"frequency_penalty": 0,
+}
+
+// rewriteSamplingPolicy applies the first sampling policy matching the caller key, tenant and model to chat completions and
+// completions, the only requests taking sampling parameters
+func rewriteSamplingPolicy(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if len(C.SamplingPolicies) == 0 || !strings.HasSuffix(rc.req.URL.Path, "/completions") {
+		return false, nil
+	}
+	var policy *SamplingPolicy
+	for i := range C.SamplingPolicies {
+		if C.SamplingPolicies[i].matches(rc) {
+			policy = &C.SamplingPolicies[i]
+			break
+		}
+	}
+	if policy == nil {
+		return false, nil
+	}
+
+	changed := false
+	params := []struct {
+		name  string
+		bound *ParamBound
+	}{
+		{"temperature", policy.Temperature},
+		{"top_p", policy.TopP},
+		{"frequency_penalty", policy.FrequencyPenalty},
+	}
+	for _, p := range params {
+		if p.bound != nil && applyParamBound(rc, payload, p.name, p.bound) {
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// applyParamBound enforces bound on param, a missing param is judged by its api default
+func applyParamBound(rc *rewriteContext, payload map[string]interface{}, param string, bound *ParamBound) bool {
+	value, present := samplingDefaults[param], false
+	if raw, ok := payload[param]; ok && raw != nil {
+		if v, ok := numberValue(raw); ok {
+			value, present = v, true
+		}
+	}
+
+	target := value
+	switch {
+	case bound.Set != nil:
+		target = *bound.Set
+	case bound.Max != nil && value > *bound.Max:
+		target = *bound.Max
+	case bound.Min != nil && value < *bound.Min:
+		target = *bound.Min
+	}
+	if present && target == value {
+		return false
+	}
+	if !present && bound.Set == nil && target == value {
+		return false
+	}
+
+	payload[param] = json.Number(strconv.FormatFloat(target, 'f', -1, 64))
+	if present {
+		rc.addWarning(fmt.Sprintf("%s changed from %s to %s by policy", param,
+			strconv.FormatFloat(value, 'f', -1, 64), strconv.FormatFloat(target, 'f', -1, 64)))
+	}
+	return true
+}
+
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
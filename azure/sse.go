@@ -0,0 +1,99 @@
+package azure
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+var (
+	sseDataPrefix = []byte("data:")
+	sseDone       = []byte("[DONE]")
+)
+
+// sseRewriter rewrites the data lines of a server-sent events stream, other lines are passed through,
+// a nil result from rewrite drops the data line, events returned by done are emitted before [DONE].
+// When cut is set, a stream ending without [DONE] is terminated with the events returned by cut and [DONE]
+type sseRewriter struct {
+	src     *bufio.Reader
+	closer  io.Closer
+	rewrite func(data []byte) []byte
+	done    func() [][]byte
+	cut     func() [][]byte
+	sawDone bool
+	buf     []byte
+	err     error
+}
+
+func newSSERewriter(body io.ReadCloser, rewrite func(data []byte) []byte, done, cut func() [][]byte) io.ReadCloser {
+	return &sseRewriter{
+		src:     bufio.NewReader(body),
+		closer:  body,
+		rewrite: rewrite,
+		done:    done,
+		cut:     cut,
+	}
+}
+
+func (r *sseRewriter) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		line, err := r.src.ReadBytes('\n')
+		if len(line) > 0 {
+			r.buf = r.rewriteLine(line)
+		}
+		if err == io.EOF && !r.sawDone && r.cut != nil {
+			r.buf = append(r.buf, '\n')
+			r.buf = append(r.buf, formatSSEEvents(r.cut())...)
+			r.buf = append(r.buf, r.rewriteLine([]byte("data: [DONE]\n"))...)
+			r.buf = append(r.buf, '\n')
+		}
+		r.err = err
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *sseRewriter) rewriteLine(line []byte) []byte {
+	if !bytes.HasPrefix(line, sseDataPrefix) {
+		return line
+	}
+	data := bytes.TrimSpace(line[len(sseDataPrefix):])
+	if len(data) == 0 {
+		return line
+	}
+	if bytes.Equal(data, sseDone) {
+		r.sawDone = true
+		if r.done == nil {
+			return line
+		}
+		return append(formatSSEEvents(r.done()), line...)
+	}
+
+	data = r.rewrite(data)
+	if data == nil {
+		return nil
+	}
+	out := make([]byte, 0, len(data)+8)
+	out = append(out, "data: "...)
+	out = append(out, data...)
+	return append(out, '\n')
+}
+
+func formatSSEEvents(events [][]byte) []byte {
+	var out []byte
+	for _, event := range events {
+		out = append(out, "data: "...)
+		out = append(out, event...)
+		out = append(out, "\n\n"...)
+	}
+	return out
+}
+
+func (r *sseRewriter) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,289 @@
+package azure
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamUsageEstimate(t *testing.T) {
+	C.StreamUsage = StreamUsageEstimate
+	defer func() { C.StreamUsage = "" }()
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	rc := &rewriteContext{req: req, deployment: &DeploymentConfig{ApiVersion: "2024-02-01"}}
+	_, err := rewriteBody(rc, []byte(`{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"hello"}]}`))
+	assert.NoError(t, err)
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body: io.NopCloser(strings.NewReader("data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\"hi there\"}}]}\n\n" +
+			"data: [DONE]\n\n")),
+	}
+	assert.NoError(t, rewriteResponse(resp, rc))
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	// 3 tokens of message overhead, "user", "hello" and 3 tokens priming the reply, "hi there" is 2 tokens
+	assert.Contains(t, string(body), `"usage":{"prompt_tokens":8,"completion_tokens":2,"total_tokens":10}`)
+	assert.True(t, strings.HasSuffix(string(body), "}\n\ndata: [DONE]\n\n"))
+	assert.Equal(t, int64(10), rc.usage.TotalTokens)
+	assert.True(t, rc.usageEstimated)
+
+	// counted with the tokenizer of the model, not by characters
+	assert.Equal(t, int64(6), estimateTokens("gpt-4", "antidisestablishmentarianism"))
+}
+
+func TestSynthesizeStream(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	rc := &rewriteContext{req: req, deployment: &DeploymentConfig{ApiVersion: "2024-02-01", SynthesizeStream: true}}
+	body, err := rewriteBody(rc, []byte(`{"model":"o1","stream":true,"stream_options":{"include_usage":true},"messages":[]}`))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(body), "stream")
+	assert.True(t, rc.synthesizeStream)
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body: io.NopCloser(strings.NewReader(`{"id":"1","created":1,"model":"o1","choices":[{"index":0,"finish_reason":"stop",` +
+			`"message":{"role":"assistant","content":"hello"}}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)),
+	}
+	assert.NoError(t, rewriteResponse(resp, rc))
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	data, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	events := strings.Split(strings.TrimSuffix(string(data), "\n\n"), "\n\n")
+	if !assert.Len(t, events, 4) {
+		return
+	}
+	assert.Contains(t, events[0], `"delta":{"content":"hello","role":"assistant"}`)
+	assert.Contains(t, events[1], `"finish_reason":"stop"`)
+	assert.Contains(t, events[2], `"usage":{"completion_tokens":1,"prompt_tokens":1,"total_tokens":2}`)
+	assert.Equal(t, "data: [DONE]", events[3])
+}
+
+func TestStripAzureFields(t *testing.T) {
+	assert.False(t, stripAzureFields(map[string]interface{}{
+		"choices":               []interface{}{},
+		"prompt_filter_results": []interface{}{},
+	}, true))
+	assert.False(t, stripAzureFields(map[string]interface{}{
+		"choices": []interface{}{map[string]interface{}{"delta": map[string]interface{}{}, "finish_reason": nil, "content_filter_results": map[string]interface{}{}}},
+	}, true))
+
+	payload := map[string]interface{}{
+		"choices": []interface{}{map[string]interface{}{"delta": map[string]interface{}{"content": "hi"}, "content_filter_results": map[string]interface{}{}}},
+	}
+	assert.True(t, stripAzureFields(payload, true))
+	assert.NotContains(t, payload["choices"].([]interface{})[0], "content_filter_results")
+
+	assert.True(t, stripAzureFields(map[string]interface{}{"choices": []interface{}{}, "usage": map[string]interface{}{}}, true))
+}
+
+func TestStreamTermination(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	rc := &rewriteContext{req: req, deployment: &DeploymentConfig{ApiVersion: "2024-02-01"}}
+	_, err := rewriteBody(rc, []byte(`{"model":"gpt-4","stream":true}`))
+	assert.NoError(t, err)
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body: io.NopCloser(strings.NewReader("data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n" +
+			"data: {\"error\":{\"code\":\"content_filter\",\"message\":\"filtered\"}}\n\n")),
+	}
+	assert.NoError(t, rewriteResponse(resp, rc))
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	assert.Contains(t, string(body), `"finish_reason":"content_filter"`)
+	assert.NotContains(t, string(body), `"error"`)
+	assert.True(t, strings.HasSuffix(string(body), "data: [DONE]\n\n"))
+
+	rc = &rewriteContext{req: req, deployment: &DeploymentConfig{ApiVersion: "2024-02-01"}}
+	_, err = rewriteBody(rc, []byte(`{"model":"gpt-4","stream":true}`))
+	assert.NoError(t, err)
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body: io.NopCloser(strings.NewReader("data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n" +
+			"data: {\"error\":{\"code\":\"server_error\",\"message\":\"boom\"}}\n\n" +
+			"data: {\"id\":\"1\",\"choices\":[{\"delta\":{\"content\":\"late\"}}]}\n\n")),
+	}
+	assert.NoError(t, rewriteResponse(resp, rc))
+	body, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	assert.Contains(t, string(body), `"code":"server_error"`)
+	assert.NotContains(t, string(body), "late")
+	assert.True(t, strings.HasSuffix(string(body), "data: [DONE]\n\n"))
+}
+
+func TestStreamMiddleware(t *testing.T) {
+	var metas []StreamMeta
+	RegisterStreamMiddleware(func(chunk []byte, meta StreamMeta) []byte {
+		metas = append(metas, meta)
+		return []byte(strings.ReplaceAll(string(chunk), "secret", "******"))
+	})
+	defer func() { streamMiddlewares = nil }()
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	rc := &rewriteContext{req: req, deployment: &DeploymentConfig{ModelName: "gpt-4", DeploymentName: "gpt4"}}
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader("data: {\"a\":\"secret\"}\n\ndata: {\"b\":1}\n\ndata: [DONE]\n\n")),
+	}
+	assert.NoError(t, rewriteResponse(resp, rc))
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "data: {\"a\":\"******\"}\n\ndata: {\"b\":1}\n\ndata: [DONE]\n\n", string(body))
+	assert.Equal(t, []StreamMeta{{Model: "gpt-4", Deployment: "gpt4", Index: 0}, {Model: "gpt-4", Deployment: "gpt4", Index: 1}}, metas)
+}
+
+func TestObserveUsage(t *testing.T) {
+	body := "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}],\"usage\":null}\n\n" +
+		"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":2,\"total_tokens\":9}}\n\n" +
+		"data: [DONE]\n\n"
+	resp := &http.Response{
+		Header: http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:   io.NopCloser(strings.NewReader(body)),
+	}
+	rc := &rewriteContext{}
+	observeUsage(resp, rc)
+	out, _ := io.ReadAll(resp.Body)
+
+	assert.Equal(t, body, string(out))
+	assert.Equal(t, &Usage{PromptTokens: 7, CompletionTokens: 2, TotalTokens: 9}, rc.usage)
+}
+
+type recordingPublisher struct {
+	batches chan [][]byte
+}
+
+func (p *recordingPublisher) publish(_ context.Context, events [][]byte) error {
+	p.batches <- append([][]byte(nil), events...)
+	return nil
+}
+
+func (p *recordingPublisher) close() error {
+	return nil
+}
+
+func TestEventPublisherBatches(t *testing.T) {
+	publisher := &recordingPublisher{batches: make(chan [][]byte, 10)}
+	eventQueue, eventsDone = make(chan []byte, 10), make(chan struct{})
+	go runEventPublisher(publisher, EventsConfig{BatchSize: 2, FlushInterval: time.Hour}, eventQueue, eventsDone)
+
+	for _, id := range []string{"a", "b", "c"} {
+		publishEvent(RequestEvent{RequestID: id, Status: 200})
+	}
+	batch := <-publisher.batches
+	assert.Len(t, batch, 2)
+	assert.Contains(t, string(batch[0]), `"request_id":"a"`)
+
+	CloseEvents()
+	batch = <-publisher.batches
+	assert.Len(t, batch, 1)
+	assert.Contains(t, string(batch[0]), `"request_id":"c"`)
+
+	// events published while closing are dropped, not sent on the closed queue
+	eventQueue, eventsDone = make(chan []byte, 10), make(chan struct{})
+	go runEventPublisher(publisher, EventsConfig{BatchSize: 100, FlushInterval: time.Hour}, eventQueue, eventsDone)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				publishEvent(RequestEvent{RequestID: "late"})
+			}
+		}()
+	}
+	CloseEvents()
+	wg.Wait()
+}
+
+func TestMutators(t *testing.T) {
+	RegisterRequestMutator(RequestMutatorFunc(func(body map[string]interface{}, meta *RequestMeta) (bool, error) {
+		if body["reject"] == true {
+			return false, &RequestError{Param: "reject", Message: "rejected"}
+		}
+		body["seed"] = 1
+		meta.Header.Set("X-Tenant", meta.KeyID)
+		return true, nil
+	}))
+	RegisterResponseMutator(ResponseMutatorFunc(func(payload map[string]interface{}, stream bool, meta RequestMeta) bool {
+		payload["deployment"] = meta.Deployment
+		return true
+	}))
+	defer func() {
+		requestMutators, responseMutators = nil, nil
+	}()
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	rc := &rewriteContext{req: req, deployment: &DeploymentConfig{DeploymentName: "gpt4"}, keyID: "k1"}
+	body, err := rewriteBody(rc, []byte(`{"messages":[]}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"messages":[],"seed":1}`, string(body))
+	assert.Equal(t, "k1", req.Header.Get("X-Tenant"))
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"id":"x"}`)),
+	}
+	assert.NoError(t, rewriteResponse(resp, rc))
+	out, _ := io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"id":"x","deployment":"gpt4"}`, string(out))
+
+	_, err = rewriteBody(rc, []byte(`{"reject":true}`))
+	assert.EqualError(t, err, "rejected")
+}
+
+func TestCompletionHooks(t *testing.T) {
+	RegisterCompletionHook(func(text string, final bool, meta RequestMeta) string {
+		text = strings.ReplaceAll(text, "<internal>", "")
+		if final {
+			text += " [AI]"
+		}
+		return text
+	})
+	defer func() { completionHooks = nil }()
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	rc := &rewriteContext{req: req, deployment: &DeploymentConfig{}}
+	_, err := rewriteBody(rc, []byte(`{"messages":[]}`))
+	assert.NoError(t, err)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"choices":[{"message":{"role":"assistant","content":"hi<internal>"}}]}`)),
+	}
+	assert.NoError(t, rewriteResponse(resp, rc))
+	out, _ := io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"choices":[{"message":{"role":"assistant","content":"hi [AI]"}}]}`, string(out))
+
+	rc = &rewriteContext{req: req, deployment: &DeploymentConfig{}}
+	_, err = rewriteBody(rc, []byte(`{"messages":[],"stream":true}`))
+	assert.NoError(t, err)
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body: io.NopCloser(strings.NewReader("data: {\"choices\":[{\"delta\":{\"content\":\"a<internal>\"},\"finish_reason\":null}]}\n\n" +
+			"data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n")),
+	}
+	assert.NoError(t, rewriteResponse(resp, rc))
+	out, _ = io.ReadAll(resp.Body)
+	assert.Contains(t, string(out), `"delta":{"content":"a"}`)
+	assert.Contains(t, string(out), `"delta":{"content":" [AI]"}`)
+}
@@ -0,0 +1,160 @@
+package azure
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// RequestStats counts the requests of a model or deployment since the proxy started
+type RequestStats struct {
+	Requests         int64   `json:"requests"`
+	Errors           int64   `json:"errors"`       // answered with a 4xx or 5xx, 429s included
+	RateLimited      int64   `json:"rate_limited"` // answered with a 429
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	CacheHits        int64   `json:"cache_hits"`    // requests whose prompt was partly served from the azure prompt cache
+	CachedTokens     int64   `json:"cached_tokens"` // prompt tokens served from the azure prompt cache
+	AvgLatencyMs     float64 `json:"avg_latency_ms"`
+
+	latency time.Duration
+}
+
+func (s *RequestStats) add(status int, usage *Usage, latency time.Duration) {
+	s.Requests++
+	if status >= http.StatusBadRequest {
+		s.Errors++
+	}
+	if status == http.StatusTooManyRequests {
+		s.RateLimited++
+	}
+	if usage != nil {
+		s.PromptTokens += usage.PromptTokens
+		s.CompletionTokens += usage.CompletionTokens
+		s.TotalTokens += usage.PromptTokens + usage.CompletionTokens
+		if cached := usage.cachedTokens(); cached > 0 {
+			s.CacheHits++
+			s.CachedTokens += cached
+		}
+	}
+	s.latency += latency
+	s.AvgLatencyMs = float64(s.latency.Milliseconds()) / float64(s.Requests)
+}
+
+// ModelStats are the counters of a model, broken down by the deployments that served it
+type ModelStats struct {
+	RequestStats
+	Deployments map[string]*RequestStats `json:"deployments"`
+}
+
+const (
+	rateBucketWidth = 10 * time.Second
+	rateBuckets     = 60
+)
+
+// RateBucket counts the model requests finished in a 10s window
+type RateBucket struct {
+	Time     time.Time `json:"time"`
+	Requests int64     `json:"requests"`
+	Errors   int64     `json:"errors"`
+}
+
+// requestStats aggregates the model requests since start for GET /admin/stats
+type requestStats struct {
+	mu     sync.Mutex
+	start  time.Time
+	total  RequestStats
+	models map[string]*ModelStats
+	// rates is a ring of the last rateBuckets windows, the dashboard draws the request rate from it
+	rates [rateBuckets]RateBucket
+}
+
+// unknownDeployment is the deployment the stats count the requests of a model rejected before one was chosen under
+const unknownDeployment = "unknown"
+
+var stats = &requestStats{start: time.Now(), models: map[string]*ModelStats{}}
+
+// record counts a finished request, requests without a model, e.g. model listings, are left out
+func (s *requestStats) record(model, deployment string, status int, usage *Usage, latency time.Duration) {
+	if model == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total.add(status, usage, latency)
+	bucket := s.rateBucket(time.Now())
+	bucket.Requests++
+	if status >= http.StatusBadRequest {
+		bucket.Errors++
+	}
+	m := s.models[model]
+	if m == nil {
+		m = &ModelStats{Deployments: map[string]*RequestStats{}}
+		s.models[model] = m
+	}
+	m.add(status, usage, latency)
+	if deployment == "" {
+		// rejected before a deployment was chosen, e.g. by a policy or an unknown model, so the deployments add up
+		// to the model
+		deployment = unknownDeployment
+	}
+	d := m.Deployments[deployment]
+	if d == nil {
+		d = &RequestStats{}
+		m.Deployments[deployment] = d
+	}
+	d.add(status, usage, latency)
+}
+
+// rateBucket returns the bucket of the window of now, s.mu must be held
+func (s *requestStats) rateBucket(now time.Time) *RateBucket {
+	window := now.Truncate(rateBucketWidth)
+	bucket := &s.rates[(window.Unix()/int64(rateBucketWidth/time.Second))%rateBuckets]
+	if !bucket.Time.Equal(window) {
+		*bucket = RateBucket{Time: window}
+	}
+	return bucket
+}
+
+// rate returns the buckets of the last 10 minutes, oldest first
+func (s *requestStats) rate() []RateBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().Truncate(rateBucketWidth)
+	result := make([]RateBucket, 0, rateBuckets)
+	for i := rateBuckets - 1; i >= 0; i-- {
+		result = append(result, *s.rateBucket(now.Add(-time.Duration(i) * rateBucketWidth)))
+	}
+	return result
+}
+
+// snapshot copies the counters
+func (s *requestStats) snapshot() (RequestStats, map[string]ModelStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	models := make(map[string]ModelStats, len(s.models))
+	for name, model := range s.models {
+		m := ModelStats{RequestStats: model.RequestStats, Deployments: make(map[string]*RequestStats, len(model.Deployments))}
+		for deployment, d := range model.Deployments {
+			copied := *d
+			m.Deployments[deployment] = &copied
+		}
+		models[name] = m
+	}
+	return s.total, models
+}
+
+// StatsHandler returns the request, error, token and latency counters by model and deployment since start
+func StatsHandler(c *gin.Context) {
+	total, models := stats.snapshot()
+	util.SendJSON(c, http.StatusOK, gin.H{
+		"since":          stats.start.UTC(),
+		"uptime_seconds": int64(time.Since(stats.start).Seconds()),
+		"total":          total,
+		"models":         models,
+	})
+}
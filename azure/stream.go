@@ -0,0 +1,210 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// rewriteSynthesizeStream strips stream from requests to deployments that reject it,
+// the blocking response is re-emitted to the client as SSE chunks
+func rewriteSynthesizeStream(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if !isChatCompletions(rc.req) || !rc.deployment.SynthesizeStream || payload["stream"] != true {
+		return false, nil
+	}
+
+	if options, ok := payload["stream_options"].(map[string]interface{}); ok {
+		rc.streamIncludeUsage = options["include_usage"] == true
+	}
+	delete(payload, "stream")
+	delete(payload, "stream_options")
+	rc.synthesizeStream = true
+	return true, nil
+}
+
+// synthesizeStream converts a chat completion response into openai shaped chat.completion.chunk events
+func synthesizeStream(resp *http.Response, includeUsage bool) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	completion, err := decodeJSON(body)
+	if err != nil {
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return nil
+	}
+
+	newChunk := func(choices []interface{}) map[string]interface{} {
+		chunk := map[string]interface{}{
+			"id":      completion["id"],
+			"object":  "chat.completion.chunk",
+			"created": completion["created"],
+			"model":   completion["model"],
+			"choices": choices,
+		}
+		if fingerprint, ok := completion["system_fingerprint"]; ok {
+			chunk["system_fingerprint"] = fingerprint
+		}
+		return chunk
+	}
+
+	var chunks []map[string]interface{}
+	var finishChoices []interface{}
+	choices, _ := completion["choices"].([]interface{})
+	for _, item := range choices {
+		choice, _ := item.(map[string]interface{})
+		if choice == nil {
+			continue
+		}
+		delta, _ := choice["message"].(map[string]interface{})
+		if delta == nil {
+			delta = map[string]interface{}{}
+		}
+		if toolCalls, ok := delta["tool_calls"].([]interface{}); ok {
+			for i, tc := range toolCalls {
+				if toolCall, ok := tc.(map[string]interface{}); ok {
+					toolCall["index"] = i
+				}
+			}
+		}
+		contentChoice := map[string]interface{}{"index": choice["index"], "delta": delta, "finish_reason": nil}
+		for _, key := range []string{"logprobs", "content_filter_results"} {
+			if value, ok := choice[key]; ok {
+				contentChoice[key] = value
+			}
+		}
+		chunks = append(chunks, newChunk([]interface{}{contentChoice}))
+		finishChoices = append(finishChoices, map[string]interface{}{
+			"index": choice["index"], "delta": map[string]interface{}{}, "finish_reason": choice["finish_reason"],
+		})
+	}
+	chunks = append(chunks, newChunk(finishChoices))
+	if usage, ok := completion["usage"]; ok && includeUsage {
+		chunk := newChunk([]interface{}{})
+		chunk["usage"] = usage
+		chunks = append(chunks, chunk)
+	}
+
+	buf := new(bytes.Buffer)
+	for _, chunk := range chunks {
+		data, err := util.JSONMarshal(chunk)
+		if err != nil {
+			return err
+		}
+		buf.WriteString("data: ")
+		buf.Write(data)
+		buf.WriteString("\n\n")
+	}
+	buf.WriteString("data: [DONE]\n\n")
+
+	resp.Body = io.NopCloser(buf)
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Type", "text/event-stream")
+	resp.Header.Set("Cache-Control", "no-cache")
+	return nil
+}
+
+// rewriteStreamTermination makes sure chat streams cut by azure content filtering or errors end
+// with a well-formed finish chunk and [DONE]
+func rewriteStreamTermination(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if !isChatCompletions(rc.req) || payload["stream"] != true {
+		return false, nil
+	}
+
+	terminator := &streamTerminator{}
+	rc.addResponseRewriter(terminator.rewrite)
+	rc.addStreamCutHook(terminator.cut)
+	return false, nil
+}
+
+// streamTerminator follows a stream to finish it with finish_reason content_filter if azure cuts it,
+// any other error event is passed on as the last event before [DONE]
+type streamTerminator struct {
+	last     map[string]interface{}
+	filtered bool
+	finished bool
+	errored  bool
+}
+
+func (t *streamTerminator) rewrite(payload map[string]interface{}, stream bool) bool {
+	if !stream {
+		return true
+	}
+	if t.errored {
+		return false
+	}
+
+	if errObj, ok := payload["error"].(map[string]interface{}); ok {
+		t.errored = true
+		if isContentFilterError(errObj) && !t.finished {
+			finish := t.finishChunk()
+			for key := range payload {
+				delete(payload, key)
+			}
+			for key, value := range finish {
+				payload[key] = value
+			}
+			t.finished = true
+		}
+		return true
+	}
+
+	choices, ok := payload["choices"].([]interface{})
+	if !ok {
+		return true
+	}
+	t.last = payload
+	for _, item := range choices {
+		choice, _ := item.(map[string]interface{})
+		if choice == nil {
+			continue
+		}
+		if choice["finish_reason"] != nil {
+			t.finished = true
+		}
+		if results, ok := choice["content_filter_results"].(map[string]interface{}); ok {
+			for _, r := range results {
+				if result, ok := r.(map[string]interface{}); ok && result["filtered"] == true {
+					t.filtered = true
+				}
+			}
+		}
+	}
+	return true
+}
+
+func (t *streamTerminator) cut() []map[string]interface{} {
+	if t.finished || !t.filtered {
+		return nil
+	}
+	t.finished = true
+	return []map[string]interface{}{t.finishChunk()}
+}
+
+func (t *streamTerminator) finishChunk() map[string]interface{} {
+	chunk := map[string]interface{}{
+		"object":  "chat.completion.chunk",
+		"choices": []interface{}{map[string]interface{}{"index": 0, "delta": map[string]interface{}{}, "finish_reason": "content_filter"}},
+	}
+	for _, key := range []string{"id", "created", "model"} {
+		if t.last != nil {
+			chunk[key] = t.last[key]
+		}
+	}
+	return chunk
+}
+
+func isContentFilterError(errObj map[string]interface{}) bool {
+	if errObj["code"] == "content_filter" {
+		return true
+	}
+	innerError, _ := errObj["innererror"].(map[string]interface{})
+	return innerError != nil && innerError["code"] == "ResponsibleAIPolicyViolation"
+}
@@ -0,0 +1,34 @@
+package azure
+
+// rewriteStripAzureFields removes azure only response fields that confuse strict openai clients
+func rewriteStripAzureFields(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if C.StripAzureFields || rc.deployment.StripAzureFields {
+		rc.addResponseRewriter(stripAzureFields)
+	}
+	return false, nil
+}
+
+// stripAzureFields drops content filter annotations, stream events left without any choice, delta or usage are dropped too
+func stripAzureFields(payload map[string]interface{}, stream bool) bool {
+	delete(payload, "prompt_filter_results")
+	delete(payload, "prompt_annotations")
+
+	choices, _ := payload["choices"].([]interface{})
+	empty := true
+	for _, item := range choices {
+		choice, _ := item.(map[string]interface{})
+		if choice == nil {
+			continue
+		}
+		delete(choice, "content_filter_results")
+		if delta, ok := choice["delta"].(map[string]interface{}); !stream || !ok || len(delta) > 0 || choice["finish_reason"] != nil {
+			empty = false
+		}
+	}
+
+	if !stream || !empty {
+		return true
+	}
+	usage, ok := payload["usage"]
+	return ok && usage != nil
+}
@@ -0,0 +1,73 @@
+package azure
+
+const (
+	// SystemPromptPrepend adds the system message in front of the messages of the client
+	SystemPromptPrepend = "prepend"
+	// SystemPromptEnforce replaces all system messages of the client with the configured one
+	SystemPromptEnforce = "enforce"
+)
+
+// PolicyMatch selects the requests a policy applies to
+type PolicyMatch struct {
+	Keys    []string `yaml:"keys" mapstructure:"keys"`       // caller key ids as shown in the access log, empty matches every key
+	Tenants []string `yaml:"tenants" mapstructure:"tenants"` // tenant ids, empty matches every request, untagged ones too
+	Models  []string `yaml:"models" mapstructure:"models"`   // models, empty matches every model
+}
+
+func (m *PolicyMatch) matches(rc *rewriteContext) bool {
+	return (len(m.Keys) == 0 || containsString(m.Keys, rc.keyID)) &&
+		(len(m.Tenants) == 0 || rc.tenant != nil && containsString(m.Tenants, rc.tenant.id)) &&
+		(len(m.Models) == 0 || containsString(m.Models, rc.deployment.ModelName))
+}
+
+// SystemPromptConfig is a system message the proxy applies to chat completions of some keys
+type SystemPromptConfig struct {
+	PolicyMatch `yaml:",inline" mapstructure:",squash"`
+	Content     string `yaml:"content" mapstructure:"content"` // the system message
+	Mode        string `yaml:"mode" mapstructure:"mode"`       // prepend (default) or enforce
+}
+
+// systemPromptFor returns the first system prompt configured for the key, tenant and model of the request
+func systemPromptFor(rc *rewriteContext) *SystemPromptConfig {
+	for i := range C.SystemPrompts {
+		if C.SystemPrompts[i].matches(rc) {
+			return &C.SystemPrompts[i]
+		}
+	}
+	return nil
+}
+
+// rewriteSystemPrompt applies the server side system prompt of the caller key to chat completions
+func rewriteSystemPrompt(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if !isChatCompletions(rc.req) || len(C.SystemPrompts) == 0 {
+		return false, nil
+	}
+	prompt := systemPromptFor(rc)
+	if prompt == nil {
+		return false, nil
+	}
+
+	messages, _ := payload["messages"].([]interface{})
+	system := map[string]interface{}{"role": "system", "content": prompt.Content}
+	result := make([]interface{}, 0, len(messages)+1)
+	result = append(result, system)
+	for _, item := range messages {
+		if prompt.Mode == SystemPromptEnforce {
+			if message, ok := item.(map[string]interface{}); ok && (message["role"] == "system" || message["role"] == "developer") {
+				continue
+			}
+		}
+		result = append(result, item)
+	}
+	payload["messages"] = result
+	return true, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
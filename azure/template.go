@@ -0,0 +1,184 @@
+package azure
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// PromptTemplate is a named prompt expanded by the proxy into the messages of a chat completion
+type PromptTemplate struct {
+	Name     string            `yaml:"name" mapstructure:"name"`         // name clients refer to
+	Model    string            `yaml:"model" mapstructure:"model"`       // model used when the client sends none
+	Messages []TemplateMessage `yaml:"messages" mapstructure:"messages"` // messages put in front of the messages of the client
+}
+
+// TemplateMessage is one message of a prompt template, content is a go text/template
+// rendered with the variables of the client, e.g. "Summarize {{.text}}"
+type TemplateMessage struct {
+	Role    string `yaml:"role" mapstructure:"role"`
+	Content string `yaml:"content" mapstructure:"content"`
+}
+
+type compiledTemplate struct {
+	PromptTemplate
+	contents []*template.Template
+}
+
+var promptTemplates map[string]*compiledTemplate
+
+// compilePromptTemplates parses the configured prompt templates, it fails on duplicate names and invalid templates
+func compilePromptTemplates(templates []PromptTemplate) error {
+	compiled, err := buildPromptTemplates(templates)
+	if err != nil {
+		return err
+	}
+	promptTemplates = compiled
+	return nil
+}
+
+func buildPromptTemplates(templates []PromptTemplate) (map[string]*compiledTemplate, error) {
+	compiled := make(map[string]*compiledTemplate, len(templates))
+	for _, t := range templates {
+		if t.Name == "" {
+			return nil, errors.New("prompt template without name")
+		}
+		if _, ok := compiled[t.Name]; ok {
+			return nil, errors.Errorf("duplicate prompt template %q", t.Name)
+		}
+		ct := &compiledTemplate{PromptTemplate: t}
+		for i, message := range t.Messages {
+			content, err := template.New(fmt.Sprintf("%s[%d]", t.Name, i)).Option("missingkey=error").Parse(message.Content)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse prompt template %q", t.Name)
+			}
+			ct.contents = append(ct.contents, content)
+		}
+		compiled[t.Name] = ct
+	}
+	return compiled, nil
+}
+
+// render expands the template messages with the variables of the client
+func (t *compiledTemplate) render(variables map[string]interface{}) ([]interface{}, error) {
+	messages := make([]interface{}, 0, len(t.contents))
+	for i, content := range t.contents {
+		var buf bytes.Buffer
+		if err := content.Execute(&buf, variables); err != nil {
+			return nil, newRequestError("template.variables", "can not render prompt template %q: %s", t.Name, templateErrorMessage(err))
+		}
+		messages = append(messages, map[string]interface{}{"role": t.Messages[i].Role, "content": buf.String()})
+	}
+	return messages, nil
+}
+
+// templateErrorMessage strips the template position from execution errors, e.g. map has no entry for key "text"
+func templateErrorMessage(err error) string {
+	message := err.Error()
+	if i := strings.LastIndex(message, ": "); i >= 0 {
+		return message[i+2:]
+	}
+	return message
+}
+
+// rewriteTemplate expands the template extension field of chat completions,
+// either "template": "name" or "template": {"name": "name", "variables": {...}}
+func rewriteTemplate(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	value, ok := payload["template"]
+	if !ok || !isChatCompletions(rc.req) {
+		return false, nil
+	}
+	delete(payload, "template")
+
+	var name string
+	var variables map[string]interface{}
+	switch v := value.(type) {
+	case string:
+		name = v
+	case map[string]interface{}:
+		name, _ = v["name"].(string)
+		if vars, ok := v["variables"]; ok && vars != nil {
+			if variables, ok = vars.(map[string]interface{}); !ok {
+				return false, newRequestError("template.variables", "template.variables must be an object")
+			}
+		}
+	default:
+		return false, newRequestError("template", "template must be a string or an object")
+	}
+
+	t, ok := promptTemplates[name]
+	if !ok {
+		return false, newRequestError("template", "unknown prompt template %q", name)
+	}
+	messages, err := t.render(variables)
+	if err != nil {
+		return false, err
+	}
+	client, _ := payload["messages"].([]interface{})
+	payload["messages"] = append(messages, client...)
+	rc.debugf("expanded prompt template %s", name)
+	return true, nil
+}
+
+// TemplateProxy serves POST {api_base}/templates/:name, the body holds the variables and optionally
+// any chat completion parameter, the expanded template is forwarded as a chat completion
+func TemplateProxy(apiBase string, requestConverter RequestConverter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		t, ok := promptTemplates[name]
+		if !ok {
+			util.SendOpenAIError(c, http.StatusNotFound, "invalid_request_error", "template_not_found", "template", errors.Errorf("unknown prompt template %q", name))
+			return
+		}
+
+		payload := map[string]interface{}{}
+		if c.Request.Body != nil {
+			body, err := io.ReadAll(c.Request.Body)
+			if err != nil {
+				util.SendError(c, errors.Wrap(err, "error reading request body"))
+				return
+			}
+			if len(bytes.TrimSpace(body)) > 0 {
+				if payload, err = decodeJSON(body); err != nil {
+					util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_body", "", errors.New("request body must be a json object"))
+					return
+				}
+			}
+		}
+		payload["template"] = map[string]interface{}{"name": name, "variables": payload["variables"]}
+		delete(payload, "variables")
+		if _, ok := payload["model"]; !ok && t.Model != "" {
+			payload["model"] = t.Model
+		}
+
+		body, err := util.JSONMarshal(payload)
+		if err != nil {
+			util.SendError(c, errors.Wrap(err, "encode request body"))
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Request.ContentLength = int64(len(body))
+		c.Request.URL.Path = strings.TrimSuffix(apiBase, "/") + "/chat/completions"
+		Proxy(c, requestConverter)
+	}
+}
+
+// TemplateListHandler serves GET {api_base}/templates listing the prompt templates being served
+func TemplateListHandler(c *gin.Context) {
+	data := make([]gin.H, 0, len(promptTemplates))
+	for _, t := range promptTemplates {
+		data = append(data, gin.H{"name": t.Name, "model": t.Model, "object": "prompt_template"})
+	}
+	sort.Slice(data, func(i, j int) bool {
+		return data[i]["name"].(string) < data[j]["name"].(string)
+	})
+	util.SendJSON(c, http.StatusOK, gin.H{"object": "list", "data": data})
+}
@@ -0,0 +1,236 @@
+package azure
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+const (
+	// DefaultTenantHeader names the tenant of a request when tenant_header isn't set
+	DefaultTenantHeader = "X-Tenant-ID"
+	// tenantKey holds the tenant id in the gin context of tenant requests
+	tenantKey = "tenant"
+)
+
+// TenantConfig is a customer whose requests, tagged with the tenant header, are served by deployments of its own
+type TenantConfig struct {
+	ID               string             `yaml:"id" json:"id" mapstructure:"id"`                                              // value of the tenant header
+	DeploymentConfig []DeploymentConfig `yaml:"deployment_config" json:"deployment_config" mapstructure:"deployment_config"` // deployments of the tenant, like the top level deployment_config
+	Fallback         bool               `yaml:"fallback" json:"fallback" mapstructure:"fallback"`                            // serve the models missing from deployment_config with the default deployments
+	TokensPerMinute  int64              `yaml:"tokens_per_minute" json:"tokens_per_minute" mapstructure:"tokens_per_minute"` // tokens the tenant may use per minute, further requests get a 429 until the next minute
+	Budget           float64            `yaml:"budget" json:"budget" mapstructure:"budget"`                                  // estimated cost the tenant may spend per budget_period, priced with pricing
+	BudgetPeriod     string             `yaml:"budget_period" json:"budget_period" mapstructure:"budget_period"`             // day or month (default)
+	LogFile          string             `yaml:"log_file" json:"log_file" mapstructure:"log_file"`                            // file the log lines of the tenant's requests are appended to as well
+}
+
+// tenant is a TenantConfig ready to serve, the tenants are replaced as a whole like the deployments
+type tenant struct {
+	id              string
+	deployments     map[string]DeploymentConfig
+	fallback        bool
+	tokensPerMinute int64
+	budget          float64
+	budgetPeriod    string
+	log             *log.Logger // log_file of the tenant, nil when not set
+}
+
+var (
+	// tenants by id, guarded by deploymentsMu
+	tenants = map[string]*tenant{}
+	// tenantTransports holds the transports of tenant deployments setting their own proxy or client certificate
+	tenantTransports = map[string]*http.Transport{}
+
+	// tenantLogs are the open log files of the tenants by path, kept open across republishes for requests in flight
+	tenantLogsMu sync.Mutex
+	tenantLogs   = map[string]*log.Logger{}
+)
+
+// initTenants prepares the deployments of the tenants and publishes them
+func initTenants(outbound OutboundConfig, configs []TenantConfig) error {
+	next, transports, err := prepareTenants(outbound, configs)
+	if err != nil {
+		return err
+	}
+	publishTenants(next, transports)
+	return nil
+}
+
+// prepareTenants builds the tenants and the transports of their deployments without publishing them
+func prepareTenants(outbound OutboundConfig, configs []TenantConfig) (map[string]*tenant, map[string]*http.Transport, error) {
+	next, err := buildTenants(configs)
+	if err != nil {
+		return nil, nil, err
+	}
+	all := map[string]DeploymentConfig{}
+	for id, t := range next {
+		for model, deployment := range t.deployments {
+			all[id+"/"+model] = deployment
+		}
+	}
+	transports, err := buildDeploymentTransports(outbound, all)
+	if err != nil {
+		return nil, nil, err
+	}
+	return next, transports, nil
+}
+
+// publishTenants replaces the tenants like swapDeployments replaces the deployments
+func publishTenants(next map[string]*tenant, transports map[string]*http.Transport) {
+	deploymentsMu.Lock()
+	unused := keepTransports(tenantTransports, transports)
+	tenants, tenantTransports = next, transports
+	deploymentsMu.Unlock()
+
+	for _, transport := range unused {
+		transport.CloseIdleConnections()
+	}
+	pruneDrains()
+}
+
+// tenantsConfigured tells if any tenant is served
+func tenantsConfigured() bool {
+	deploymentsMu.RLock()
+	defer deploymentsMu.RUnlock()
+	return len(tenants) > 0
+}
+
+func buildTenants(configs []TenantConfig) (map[string]*tenant, error) {
+	result := make(map[string]*tenant, len(configs))
+	for _, cfg := range configs {
+		if cfg.ID == "" {
+			return nil, errors.New("tenant id is required")
+		}
+		if _, ok := result[cfg.ID]; ok {
+			return nil, errors.Errorf("duplicate tenant %s", cfg.ID)
+		}
+		budgetPeriod := cfg.BudgetPeriod
+		switch budgetPeriod {
+		case "":
+			budgetPeriod = "month"
+		case "day", "month":
+		default:
+			return nil, errors.Errorf("tenant %s: budget_period must be day or month, not %q", cfg.ID, cfg.BudgetPeriod)
+		}
+		t := &tenant{
+			id:              cfg.ID,
+			deployments:     make(map[string]DeploymentConfig, len(cfg.DeploymentConfig)),
+			fallback:        cfg.Fallback,
+			tokensPerMinute: cfg.TokensPerMinute,
+			budget:          cfg.Budget,
+			budgetPeriod:    budgetPeriod,
+		}
+		if cfg.LogFile != "" {
+			logger, err := openTenantLog(cfg.LogFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "tenant %s", cfg.ID)
+			}
+			t.log = logger
+		}
+		for _, deployment := range cfg.DeploymentConfig {
+			if err := prepareDeployment(&deployment); err != nil {
+				return nil, errors.Wrapf(err, "tenant %s", cfg.ID)
+			}
+			t.deployments[deployment.ModelName] = deployment
+		}
+		result[cfg.ID] = t
+	}
+	return result, nil
+}
+
+// openTenantLog opens a tenant log file for appending, a file is opened once
+func openTenantLog(path string) (*log.Logger, error) {
+	tenantLogsMu.Lock()
+	defer tenantLogsMu.Unlock()
+	if logger := tenantLogs[path]; logger != nil {
+		return logger, nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "open log_file")
+	}
+	logger := log.New(file, "", log.LstdFlags)
+	tenantLogs[path] = logger
+	return logger, nil
+}
+
+func tenantHeader() string {
+	if C.TenantHeader != "" {
+		return C.TenantHeader
+	}
+	return DefaultTenantHeader
+}
+
+// selectTenant returns the tenant serving the request of the caller key, nil for callers outside the tenants and
+// when no tenant is configured. A virtual key issued to a tenant selects it, the tenant header is only trusted with
+// trust_tenant_header, e.g. behind a gateway setting it, else it must name the tenant of the key. False when the
+// request was answered with an error
+func selectTenant(c *gin.Context, key *VirtualKey) (*tenant, bool) {
+	id := c.GetHeader(tenantHeader())
+	configured := tenantsConfigured()
+
+	switch {
+	case key != nil && key.Tenant != "":
+		if id != "" && id != key.Tenant {
+			util.SendOpenAIError(c, http.StatusForbidden, "invalid_request_error", "tenant_mismatch", "",
+				errors.Errorf("api key %s is issued to another tenant than %s", key.ID, id))
+			return nil, false
+		}
+		id = key.Tenant
+	case !configured || id == "":
+		return nil, true
+	case !C.TrustTenantHeader:
+		util.SendOpenAIError(c, http.StatusForbidden, "invalid_request_error", "tenant_mismatch", "",
+			errors.Errorf("the api key isn't issued to tenant %s", id))
+		return nil, false
+	}
+
+	deploymentsMu.RLock()
+	t := tenants[id]
+	deploymentsMu.RUnlock()
+	if t == nil && key != nil && key.Tenant == id {
+		// the tenant of the key was removed
+		util.SendOpenAIError(c, http.StatusForbidden, "invalid_request_error", "tenant_mismatch", "",
+			errors.Errorf("api key %s is issued to tenant %s which no longer exists", key.ID, id))
+		return nil, false
+	}
+	if t == nil {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "unknown_tenant", "",
+			errors.Errorf("unknown tenant %q", id))
+		return nil, false
+	}
+	return t, true
+}
+
+// deployment returns the tenant's own deployment of the model, nil when it has none or for untagged requests
+func (t *tenant) deployment(model string) *DeploymentConfig {
+	if t == nil {
+		return nil
+	}
+	if deployment, ok := t.deployments[model]; ok {
+		return &deployment
+	}
+	return nil
+}
+
+// name returns the id of the tenant, empty for untagged requests
+func (t *tenant) name() string {
+	if t == nil {
+		return ""
+	}
+	return t.id
+}
+
+// logf appends a log line of a request of the tenant to its log_file, the callers check the log level
+func (t *tenant) logf(format string, args ...interface{}) {
+	if t == nil || t.log == nil {
+		return
+	}
+	_ = t.log.Output(3, fmt.Sprintf(format, args...))
+}
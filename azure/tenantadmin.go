@@ -0,0 +1,252 @@
+package azure
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// issuedVirtualKey is a key issued with its tenant, the secret is only shown in the answer of the onboarding
+type issuedVirtualKey struct {
+	Key    VirtualKey `json:"key"`
+	Secret string     `json:"secret"`
+}
+
+// decodeTenant decodes a tenants entry sent to the admin api and validates it like a config check does
+func decodeTenant(entry map[string]interface{}) (TenantConfig, error) {
+	var cfg TenantConfig
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           &cfg,
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+	})
+	if err != nil {
+		return cfg, err
+	}
+	if err := decoder.Decode(entry); err != nil {
+		return cfg, err
+	}
+	if cfg.ID == "" {
+		return cfg, errors.New("id is required")
+	}
+	models := map[string]bool{}
+	for i, deployment := range cfg.DeploymentConfig {
+		if deployment.ModelName == "" {
+			return cfg, errors.Errorf("deployment_config[%d]: model_name is required", i)
+		}
+		if models[deployment.ModelName] {
+			return cfg, errors.Errorf("deployment_config[%d]: model %s is configured twice", i, deployment.ModelName)
+		}
+		models[deployment.ModelName] = true
+		if problems := deploymentProblems(deployment, 0, "deployment_config["+deployment.ModelName+"]"); len(problems) > 0 {
+			return cfg, errors.New(problems[0].Message)
+		}
+	}
+	return cfg, nil
+}
+
+// maskedTenant hides the secrets of the deployments of a tenant shown by the admin api
+func maskedTenant(cfg TenantConfig) TenantConfig {
+	deployments := make([]DeploymentConfig, len(cfg.DeploymentConfig))
+	for i, deployment := range cfg.DeploymentConfig {
+		deployments[i] = maskedDeployment(deployment)
+	}
+	cfg.DeploymentConfig = deployments
+	return cfg
+}
+
+// issueTenantKeys issues the keys of a new tenant and writes them to the key file, nothing is issued on errors
+func issueTenantKeys(id string, settings []virtualKeySettings) ([]issuedVirtualKey, error) {
+	if len(settings) == 0 {
+		return []issuedVirtualKey{}, nil
+	}
+	issued := make([]issuedVirtualKey, 0, len(settings))
+	stored := make([]*storedVirtualKey, 0, len(settings))
+	for _, s := range settings {
+		secret, keyID, err := newVirtualKeySecret()
+		if err != nil {
+			return nil, err
+		}
+		key := &storedVirtualKey{VirtualKey: VirtualKey{ID: keyID, Models: []string{}, Created: time.Now().UTC()}, Hash: hashVirtualKey(secret)}
+		s.Tenant = nil
+		if err := s.apply(&key.VirtualKey); err != nil {
+			return nil, errors.Wrapf(err, "keys[%d]", len(stored))
+		}
+		key.Tenant = id
+		stored = append(stored, key)
+		issued = append(issued, issuedVirtualKey{Key: key.VirtualKey, Secret: secret})
+	}
+
+	virtualKeys.mu.Lock()
+	defer virtualKeys.mu.Unlock()
+	for _, key := range stored {
+		virtualKeys.keys[key.ID] = key
+		virtualKeys.hashes[key.Hash] = key.ID
+	}
+	if err := virtualKeys.save(); err != nil {
+		for _, key := range stored {
+			delete(virtualKeys.keys, key.ID)
+			delete(virtualKeys.hashes, key.Hash)
+		}
+		return nil, err
+	}
+	return issued, nil
+}
+
+// revokeTenantKeys removes keys issued by issueTenantKeys when the onboarding fails afterwards
+func revokeTenantKeys(issued []issuedVirtualKey) {
+	if len(issued) == 0 {
+		return
+	}
+	virtualKeys.mu.Lock()
+	defer virtualKeys.mu.Unlock()
+	for _, key := range issued {
+		delete(virtualKeys.keys, key.Key.ID)
+	}
+	virtualKeys.index()
+	if err := virtualKeys.save(); err != nil {
+		util.Warnf("revoke virtual keys of a failed onboarding error: %v", err)
+	}
+}
+
+// TenantsHandler lists the tenants on GET, secrets are masked, and onboards a tenant on POST with the keys of a
+// tenants entry and its virtual keys, {"id": "acme", "deployment_config": [...], "tokens_per_minute": 100000,
+// "keys": [{"name": "acme-prod"}]}. The tenant is written to the config file and served at once, the answer of
+// the POST is the only time the secrets of the keys are shown
+func TenantsHandler(c *gin.Context) {
+	deploymentChangeMu.Lock()
+	defer deploymentChangeMu.Unlock()
+
+	if c.Request.Method != http.MethodPost {
+		result := make([]TenantConfig, 0, len(C.Tenants))
+		for _, cfg := range C.Tenants {
+			result = append(result, maskedTenant(cfg))
+		}
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].ID < result[j].ID
+		})
+		util.SendJSON(c, http.StatusOK, gin.H{"object": "list", "data": result})
+		return
+	}
+
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		util.SendError(c, err)
+		return
+	}
+	var entry map[string]interface{}
+	var keys struct {
+		Keys []virtualKeySettings `json:"keys"`
+	}
+	if err := util.JSONUnmarshal(data, &entry); err != nil || entry == nil {
+		if err == nil {
+			err = errors.New("a tenants entry is required")
+		}
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+		return
+	}
+	if err := util.JSONUnmarshal(data, &keys); err != nil {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "keys", err)
+		return
+	}
+	delete(entry, "keys")
+	cfg, err := decodeTenant(entry)
+	if err != nil {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+		return
+	}
+	if len(keys.Keys) > 0 && !virtualKeys.enabled() {
+		sendVirtualKeysDisabled(c)
+		return
+	}
+	for _, existing := range C.Tenants {
+		if existing.ID == cfg.ID {
+			util.SendOpenAIError(c, http.StatusConflict, "invalid_request_error", "tenant_exists", "id",
+				errors.Errorf("tenant %s already exists", cfg.ID))
+			return
+		}
+	}
+
+	configs := append(append(make([]TenantConfig, 0, len(C.Tenants)+1), C.Tenants...), cfg)
+	next, transports, err := prepareTenants(C.Outbound, configs)
+	if err != nil {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+		return
+	}
+	issued, err := issueTenantKeys(cfg.ID, keys.Keys)
+	if err != nil {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "keys", err)
+		return
+	}
+	persisted, err := persistListEntry(loadedConfigFile, "tenants", "id", cfg.ID, entry)
+	if err != nil {
+		revokeTenantKeys(issued)
+		util.SendOpenAIError(c, http.StatusInternalServerError, "server_error", "config_not_written", "",
+			errors.Wrap(err, "the config file was not updated, nothing changed"))
+		return
+	}
+	publishTenants(next, transports)
+	C.Tenants = configs
+	if persisted {
+		fileConfig.Tenants = append(append([]TenantConfig{}, fileConfig.Tenants...), cfg)
+	}
+	util.Warnf("tenant %s onboarded with %d deployments and %d keys", cfg.ID, len(cfg.DeploymentConfig), len(issued))
+	util.SendJSON(c, http.StatusCreated, gin.H{"tenant": maskedTenant(cfg), "keys": issued, "persisted": persisted})
+}
+
+// TenantHandler shows a tenant on GET and removes it on DELETE, the keys issued to a removed tenant stop working
+func TenantHandler(c *gin.Context) {
+	deploymentChangeMu.Lock()
+	defer deploymentChangeMu.Unlock()
+
+	id := c.Param("id")
+	configs := make([]TenantConfig, 0, len(C.Tenants))
+	var found *TenantConfig
+	for i := range C.Tenants {
+		if C.Tenants[i].ID == id {
+			found = &C.Tenants[i]
+			continue
+		}
+		configs = append(configs, C.Tenants[i])
+	}
+	if found == nil {
+		util.SendOpenAIError(c, http.StatusNotFound, "invalid_request_error", "tenant_not_found", "id",
+			errors.Errorf("tenant %s not found", id))
+		return
+	}
+	if c.Request.Method != http.MethodDelete {
+		util.SendJSON(c, http.StatusOK, gin.H{"tenant": maskedTenant(*found)})
+		return
+	}
+
+	next, transports, err := prepareTenants(C.Outbound, configs)
+	if err != nil {
+		util.SendError(c, err)
+		return
+	}
+	persisted, err := persistListEntry(loadedConfigFile, "tenants", "id", id, nil)
+	if err != nil {
+		util.SendOpenAIError(c, http.StatusInternalServerError, "server_error", "config_not_written", "",
+			errors.Wrap(err, "the config file was not updated, nothing changed"))
+		return
+	}
+	publishTenants(next, transports)
+	C.Tenants = configs
+	if persisted {
+		remaining := make([]TenantConfig, 0, len(fileConfig.Tenants))
+		for _, cfg := range fileConfig.Tenants {
+			if cfg.ID != id {
+				remaining = append(remaining, cfg)
+			}
+		}
+		fileConfig.Tenants = remaining
+	}
+	util.Warnf("tenant %s removed", id)
+	util.SendJSON(c, http.StatusOK, gin.H{"deleted": id, "persisted": persisted})
+}
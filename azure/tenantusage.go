@@ -0,0 +1,192 @@
+package azure
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// TenantUsage is the usage of a tenant since the proxy started, with the usage counted against its limits
+type TenantUsage struct {
+	Tenant           string                 `json:"tenant"`
+	Requests         int64                  `json:"requests"`
+	PromptTokens     int64                  `json:"prompt_tokens"`
+	CompletionTokens int64                  `json:"completion_tokens"`
+	TotalTokens      int64                  `json:"total_tokens"`
+	Cost             float64                `json:"cost"`
+	Models           map[string]*ModelUsage `json:"models"`
+	MinuteTokens     int64                  `json:"minute_tokens"`               // tokens of the current minute
+	TokensPerMinute  int64                  `json:"tokens_per_minute,omitempty"` // limit of minute_tokens
+	PeriodCost       float64                `json:"period_cost"`                 // estimated cost of the current budget period
+	Budget           float64                `json:"budget,omitempty"`            // limit of period_cost
+	BudgetPeriod     string                 `json:"budget_period"`
+	PeriodStart      time.Time              `json:"period_start"`
+
+	minute time.Time
+}
+
+var tenantUsage = struct {
+	mu      sync.Mutex
+	tenants map[string]*TenantUsage
+}{tenants: map[string]*TenantUsage{}}
+
+// tenantUsageOf returns the usage of the tenant with its minute and budget period moved to now, tenantUsage.mu must
+// be held
+func tenantUsageOf(t *tenant, now time.Time) *TenantUsage {
+	u := tenantUsage.tenants[t.id]
+	if u == nil {
+		u = &TenantUsage{Tenant: t.id, Models: map[string]*ModelUsage{}}
+		tenantUsage.tenants[t.id] = u
+	}
+	u.TokensPerMinute, u.Budget = t.tokensPerMinute, t.budget
+	if minute := now.UTC().Truncate(time.Minute); !u.minute.Equal(minute) {
+		u.minute, u.MinuteTokens = minute, 0
+	}
+	if u.BudgetPeriod != t.budgetPeriod {
+		u.BudgetPeriod, u.PeriodStart, u.PeriodCost = t.budgetPeriod, time.Time{}, 0
+	}
+	if start, ok := quotaPeriodStart(t.budgetPeriod, now); ok && u.PeriodStart.Before(start) {
+		u.PeriodStart, u.PeriodCost = start, 0
+	}
+	return u
+}
+
+// admitTenant answers the requests of a tenant over its tokens per minute or its budget with a 429, false when it did
+func admitTenant(c *gin.Context, t *tenant) bool {
+	if t == nil || t.tokensPerMinute <= 0 && t.budget <= 0 {
+		return true
+	}
+	now := time.Now()
+	tenantUsage.mu.Lock()
+	u := tenantUsageOf(t, now)
+	minuteTokens, periodCost := u.MinuteTokens, u.PeriodCost
+	tenantUsage.mu.Unlock()
+
+	if t.tokensPerMinute > 0 && minuteTokens >= t.tokensPerMinute {
+		retryAfter := now.Truncate(time.Minute).Add(time.Minute).Sub(now)
+		c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		util.SendOpenAIError(c, http.StatusTooManyRequests, "tokens", "rate_limit_exceeded", "",
+			errors.Errorf("tenant %s used its %d tokens per minute, retry after the minute", t.id, t.tokensPerMinute))
+		return false
+	}
+	if t.budget > 0 && periodCost >= t.budget {
+		util.SendOpenAIError(c, http.StatusTooManyRequests, "insufficient_quota", "insufficient_quota", "",
+			errors.Errorf("tenant %s spent its %s budget of %g", t.id, t.budgetPeriod, t.budget))
+		return false
+	}
+	return true
+}
+
+// consumeTenant counts the usage of a request against its tenant, alerting when the tenant spends its budget
+func consumeTenant(record UsageRecord) {
+	if record.Tenant == "" {
+		return
+	}
+	deploymentsMu.RLock()
+	t := tenants[record.Tenant]
+	deploymentsMu.RUnlock()
+	if t == nil {
+		return
+	}
+
+	tenantUsage.mu.Lock()
+	u := tenantUsageOf(t, time.Now())
+	tokens := record.PromptTokens + record.CompletionTokens
+	u.Requests++
+	u.PromptTokens += record.PromptTokens
+	u.CompletionTokens += record.CompletionTokens
+	u.TotalTokens += tokens
+	u.Cost += record.Cost
+	u.MinuteTokens += tokens
+	before := u.PeriodCost
+	u.PeriodCost += record.Cost
+	model := u.Models[record.Model]
+	if model == nil {
+		model = &ModelUsage{}
+		u.Models[record.Model] = model
+	}
+	model.Requests++
+	model.PromptTokens += record.PromptTokens
+	model.CompletionTokens += record.CompletionTokens
+	model.Cost += record.Cost
+	exceeded := t.budget > 0 && before < t.budget && u.PeriodCost >= t.budget
+	spent := u.PeriodCost
+	tenantUsage.mu.Unlock()
+
+	if exceeded {
+		sendAlert(AlertQuotaExceeded, "tenant "+t.id, "tenant %s spent %.2f of its %s budget of %g", t.id, spent, t.budgetPeriod, t.budget)
+	}
+}
+
+// seedTenantBudgets restores the spending of the current budget periods from the usage store, so a restart doesn't
+// reset the budgets
+func seedTenantBudgets(reporter UsageReporter) {
+	deploymentsMu.RLock()
+	budgeted := make([]*tenant, 0, len(tenants))
+	for _, t := range tenants {
+		if t.budget > 0 {
+			budgeted = append(budgeted, t)
+		}
+	}
+	deploymentsMu.RUnlock()
+
+	now := time.Now()
+	for _, t := range budgeted {
+		start, _ := quotaPeriodStart(t.budgetPeriod, now)
+		groups, err := reporter.QueryUsage(start, now, "tenant", t.id)
+		if err != nil {
+			log.Printf("restore budget of tenant %s error: %v", t.id, err)
+			continue
+		}
+		tenantUsage.mu.Lock()
+		u := tenantUsageOf(t, now)
+		for _, g := range groups {
+			u.PeriodCost += g.Cost
+		}
+		tenantUsage.mu.Unlock()
+	}
+}
+
+// tenantUsageSnapshot returns the usage of all tenants, with the tenants not used yet
+func tenantUsageSnapshot() []TenantUsage {
+	deploymentsMu.RLock()
+	current := make([]*tenant, 0, len(tenants))
+	for _, t := range tenants {
+		current = append(current, t)
+	}
+	deploymentsMu.RUnlock()
+
+	now := time.Now()
+	tenantUsage.mu.Lock()
+	defer tenantUsage.mu.Unlock()
+	result := make([]TenantUsage, 0, len(current))
+	for _, t := range current {
+		usage := *tenantUsageOf(t, now)
+		usage.Models = make(map[string]*ModelUsage, len(usage.Models))
+		for name, model := range tenantUsage.tenants[t.id].Models {
+			m := *model
+			usage.Models[name] = &m
+		}
+		result = append(result, usage)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Tenant < result[j].Tenant
+	})
+	return result
+}
+
+// TenantUsageHandler lists the usage of every tenant since start with the usage counted against its limits,
+// the stored usage of a tenant is reported by /admin/usage?tenant=
+func TenantUsageHandler(c *gin.Context) {
+	util.SendJSON(c, http.StatusOK, gin.H{
+		"object": "list",
+		"data":   tenantUsageSnapshot(),
+	})
+}
@@ -0,0 +1,132 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TimeoutConfig struct {
+	FirstByte           time.Duration `yaml:"first_byte" mapstructure:"first_byte"`                       // max wait for the upstream response headers
+	StreamIdle          time.Duration `yaml:"stream_idle" mapstructure:"stream_idle"`                     // max gap between two chunks of an upstream stream
+	Total               time.Duration `yaml:"total" mapstructure:"total"`                                 // max duration of the whole request
+	TotalIncludesStream bool          `yaml:"total_includes_stream" mapstructure:"total_includes_stream"` // apply total to streaming requests too
+}
+
+// requestTimeouts cancels the upstream request once one of the configured timeouts is exceeded
+type requestTimeouts struct {
+	cfg       TimeoutConfig
+	cancel    context.CancelFunc
+	firstByte *time.Timer
+	mu        sync.Mutex
+	reason    string
+}
+
+// withTimeouts binds req to a context canceled by the configured timeouts, stop must be called when the request is done
+func withTimeouts(req *http.Request, cfg TimeoutConfig, stream bool) (*http.Request, *requestTimeouts) {
+	t := &requestTimeouts{cfg: cfg}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	if cfg.Total > 0 && (!stream || cfg.TotalIncludesStream) {
+		var cancelTotal context.CancelFunc
+		ctx, cancelTotal = context.WithTimeout(ctx, cfg.Total)
+		cancelCtx := cancel
+		cancel = func() {
+			cancelTotal()
+			cancelCtx()
+		}
+	}
+	t.cancel = cancel
+	if cfg.FirstByte > 0 {
+		t.firstByte = time.AfterFunc(cfg.FirstByte, func() {
+			t.expire(fmt.Sprintf("no response from upstream within %s", cfg.FirstByte))
+		})
+	}
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			t.expire(fmt.Sprintf("request exceeded the total timeout of %s", cfg.Total))
+		}
+	}()
+	return req.WithContext(ctx), t
+}
+
+func (t *requestTimeouts) expire(reason string) {
+	t.mu.Lock()
+	if t.reason == "" {
+		t.reason = reason
+	}
+	t.mu.Unlock()
+	t.cancel()
+}
+
+// exceeded returns why the request timed out, or an empty string
+func (t *requestTimeouts) exceeded() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reason
+}
+
+// gotResponse stops the first byte timer and guards event streams against idle gaps and the total timeout
+func (t *requestTimeouts) gotResponse(resp *http.Response) {
+	if t.firstByte != nil {
+		t.firstByte.Stop()
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		resp.Body = &timeoutReader{body: resp.Body, timeouts: t}
+	}
+}
+
+func (t *requestTimeouts) stop() {
+	if t.firstByte != nil {
+		t.firstByte.Stop()
+	}
+	t.cancel()
+}
+
+// timeoutReader ends an event stream with a timeout error event instead of a broken connection
+type timeoutReader struct {
+	body     io.ReadCloser
+	timeouts *requestTimeouts
+	tail     []byte
+	done     bool
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	if r.done {
+		n := copy(p, r.tail)
+		r.tail = r.tail[n:]
+		if len(r.tail) == 0 {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+
+	var idle *time.Timer
+	if r.timeouts.cfg.StreamIdle > 0 {
+		idle = time.AfterFunc(r.timeouts.cfg.StreamIdle, func() {
+			r.timeouts.expire(fmt.Sprintf("upstream stream was idle for %s", r.timeouts.cfg.StreamIdle))
+		})
+	}
+	n, err := r.body.Read(p)
+	if idle != nil {
+		idle.Stop()
+	}
+
+	if err != nil && err != io.EOF {
+		if reason := r.timeouts.exceeded(); reason != "" {
+			r.done = true
+			r.tail = []byte(fmt.Sprintf("\ndata: {\"error\":{\"message\":%q,\"type\":\"timeout_error\",\"code\":\"timeout\"}}\n\n", reason))
+			return n, nil
+		}
+	}
+	return n, err
+}
+
+func (r *timeoutReader) Close() error {
+	return r.body.Close()
+}
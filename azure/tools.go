@@ -0,0 +1,246 @@
+package azure
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+)
+
+// ToolsApiVersion is the first api-version accepting tools/tool_choice instead of functions/function_call
+const ToolsApiVersion = "2023-12-01-preview"
+
+// rewriteTools translates between tools/tool_choice and the legacy functions/function_call fields
+// depending on what the deployment api-version accepts, the response is translated back for the client
+func rewriteTools(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if !isChatCompletions(rc.req) {
+		return false, nil
+	}
+
+	supportsTools := apiVersionAtLeast(rc.deployment.ApiVersion, ToolsApiVersion)
+	if _, ok := payload["tools"]; ok && !supportsTools {
+		if err := toolsToFunctions(payload); err != nil {
+			return false, err
+		}
+		rc.addResponseRewriter(newFunctionsToToolsRewriter())
+		return true, nil
+	}
+	if _, ok := payload["functions"]; ok && supportsTools {
+		functionsToTools(payload)
+		rc.addResponseRewriter(toolsToFunctionsResponse)
+		return true, nil
+	}
+	return false, nil
+}
+
+// toolsToFunctions converts a tools request for api-versions that only know functions
+func toolsToFunctions(payload map[string]interface{}) error {
+	tools, _ := payload["tools"].([]interface{})
+	functions := make([]interface{}, 0, len(tools))
+	for _, item := range tools {
+		tool, _ := item.(map[string]interface{})
+		if tool == nil || tool["type"] != "function" {
+			return newRequestError("tools", "only function tools are supported by api-versions before %s", ToolsApiVersion)
+		}
+		functions = append(functions, tool["function"])
+	}
+	payload["functions"] = functions
+
+	if toolChoice, ok := payload["tool_choice"]; ok {
+		switch choice := toolChoice.(type) {
+		case string:
+			if choice == "required" {
+				if len(functions) != 1 {
+					return newRequestError("tool_choice", "tool_choice required is not supported by api-versions before %s", ToolsApiVersion)
+				}
+				payload["function_call"] = map[string]interface{}{"name": functionName(functions[0])}
+			} else {
+				payload["function_call"] = choice
+			}
+		case map[string]interface{}:
+			payload["function_call"] = map[string]interface{}{"name": functionName(choice["function"])}
+		}
+	}
+	delete(payload, "tools")
+	delete(payload, "tool_choice")
+	delete(payload, "parallel_tool_calls")
+
+	messages, _ := payload["messages"].([]interface{})
+	callNames := map[string]string{}
+	for _, item := range messages {
+		message, _ := item.(map[string]interface{})
+		if message == nil {
+			continue
+		}
+		if toolCalls, ok := message["tool_calls"].([]interface{}); ok {
+			if len(toolCalls) > 1 {
+				return newRequestError("messages", "parallel tool calls are not supported by api-versions before %s", ToolsApiVersion)
+			}
+			for _, tc := range toolCalls {
+				toolCall, _ := tc.(map[string]interface{})
+				if toolCall == nil {
+					continue
+				}
+				callNames[stringValue(toolCall["id"])] = functionName(toolCall["function"])
+				message["function_call"] = toolCall["function"]
+			}
+			delete(message, "tool_calls")
+		}
+		if message["role"] == "tool" {
+			message["role"] = "function"
+			message["name"] = callNames[stringValue(message["tool_call_id"])]
+			delete(message, "tool_call_id")
+		}
+	}
+	return nil
+}
+
+// functionsToTools converts a legacy functions request for api-versions that prefer tools
+func functionsToTools(payload map[string]interface{}) {
+	functions, _ := payload["functions"].([]interface{})
+	tools := make([]interface{}, 0, len(functions))
+	for _, function := range functions {
+		tools = append(tools, map[string]interface{}{"type": "function", "function": function})
+	}
+	payload["tools"] = tools
+
+	if functionCall, ok := payload["function_call"]; ok {
+		switch call := functionCall.(type) {
+		case string:
+			payload["tool_choice"] = call
+		case map[string]interface{}:
+			payload["tool_choice"] = map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": call["name"]}}
+		}
+	}
+	delete(payload, "functions")
+	delete(payload, "function_call")
+
+	// every call gets its own id, a function result answers the oldest unanswered call of that function
+	messages, _ := payload["messages"].([]interface{})
+	pending := map[string][]string{}
+	for _, item := range messages {
+		message, _ := item.(map[string]interface{})
+		if message == nil {
+			continue
+		}
+		if functionCall, ok := message["function_call"]; ok {
+			id, name := newCallId(), functionName(functionCall)
+			pending[name] = append(pending[name], id)
+			message["tool_calls"] = []interface{}{
+				map[string]interface{}{"id": id, "type": "function", "function": functionCall},
+			}
+			delete(message, "function_call")
+		}
+		if message["role"] == "function" {
+			name := stringValue(message["name"])
+			id := ""
+			if ids := pending[name]; len(ids) > 0 {
+				id, pending[name] = ids[0], ids[1:]
+			}
+			message["role"] = "tool"
+			message["tool_call_id"] = id
+			delete(message, "name")
+		}
+	}
+}
+
+// newFunctionsToToolsRewriter translates function_call responses back to tool_calls, each choice gets
+// its own call id, kept for all chunks of that choice in a stream
+func newFunctionsToToolsRewriter() responseRewriter {
+	callIds := map[string]string{}
+	callId := func(choice map[string]interface{}, position int) string {
+		index := stringValue(choice["index"])
+		if index == "" {
+			index = strconv.Itoa(position)
+		}
+		if _, ok := callIds[index]; !ok {
+			callIds[index] = newCallId()
+		}
+		return callIds[index]
+	}
+	return func(payload map[string]interface{}, stream bool) bool {
+		choices, _ := payload["choices"].([]interface{})
+		for i, item := range choices {
+			choice, _ := item.(map[string]interface{})
+			if choice == nil {
+				continue
+			}
+			key := "message"
+			if stream {
+				key = "delta"
+			}
+			if message, ok := choice[key].(map[string]interface{}); ok {
+				if functionCall, ok := message["function_call"].(map[string]interface{}); ok {
+					toolCall := map[string]interface{}{"function": functionCall}
+					if stream {
+						toolCall["index"] = 0
+					}
+					if !stream || functionCall["name"] != nil {
+						toolCall["id"] = callId(choice, i)
+						toolCall["type"] = "function"
+					}
+					message["tool_calls"] = []interface{}{toolCall}
+					delete(message, "function_call")
+				}
+			}
+			if choice["finish_reason"] == "function_call" {
+				choice["finish_reason"] = "tool_calls"
+			}
+		}
+		return true
+	}
+}
+
+// toolsToFunctionsResponse translates tool_calls responses back to function_call, only the first call is kept
+func toolsToFunctionsResponse(payload map[string]interface{}, stream bool) bool {
+	choices, _ := payload["choices"].([]interface{})
+	for _, item := range choices {
+		choice, _ := item.(map[string]interface{})
+		if choice == nil {
+			continue
+		}
+		key := "message"
+		if stream {
+			key = "delta"
+		}
+		if message, ok := choice[key].(map[string]interface{}); ok {
+			if toolCalls, ok := message["tool_calls"].([]interface{}); ok {
+				for _, tc := range toolCalls {
+					toolCall, _ := tc.(map[string]interface{})
+					if toolCall == nil || (stream && stringValue(toolCall["index"]) != "0") {
+						continue
+					}
+					message["function_call"] = toolCall["function"]
+					break
+				}
+				delete(message, "tool_calls")
+			}
+		}
+		if choice["finish_reason"] == "tool_calls" {
+			choice["finish_reason"] = "function_call"
+		}
+	}
+	return true
+}
+
+func functionName(function interface{}) string {
+	if f, ok := function.(map[string]interface{}); ok {
+		return stringValue(f["name"])
+	}
+	return ""
+}
+
+func stringValue(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case interface{ String() string }:
+		return value.String()
+	}
+	return ""
+}
+
+func newCallId() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "call_" + hex.EncodeToString(b)
+}
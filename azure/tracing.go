@@ -0,0 +1,149 @@
+package azure
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	tracer          = otel.Tracer("github.com/stulzq/azure-openai-proxy/azure")
+	tracingShutdown func(ctx context.Context) error
+)
+
+type TracingConfig struct {
+	Enabled     bool    `yaml:"enabled" mapstructure:"enabled"`           // export spans of proxied requests
+	Endpoint    string  `yaml:"endpoint" mapstructure:"endpoint"`         // otlp/http collector host:port, OTEL_EXPORTER_OTLP_* env vars apply when empty
+	Insecure    bool    `yaml:"insecure" mapstructure:"insecure"`         // plain http towards the collector
+	ServiceName string  `yaml:"service_name" mapstructure:"service_name"` // defaults to azure-openai-proxy
+	SampleRatio float64 `yaml:"sample_ratio" mapstructure:"sample_ratio"` // share of root traces sampled, 0 means all
+}
+
+// initTracing installs the w3c trace context propagator and, when tracing is enabled, the otlp exporter. Without
+// exporter the incoming traceparent is still forwarded to azure and logged
+func initTracing(cfg TracingConfig) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !cfg.Enabled {
+		return nil
+	}
+
+	var opts []otlptracehttp.Option
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "azure-openai-proxy"
+	}
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 && cfg.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	tracingShutdown = provider.Shutdown
+	return nil
+}
+
+// ShutdownTracing flushes the spans not yet exported
+func ShutdownTracing(ctx context.Context) error {
+	if tracingShutdown == nil {
+		return nil
+	}
+	return tracingShutdown(ctx)
+}
+
+// startRequestSpan continues the trace of the incoming traceparent header
+func startRequestSpan(req *http.Request) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	return tracer.Start(ctx, req.Method+" "+req.URL.Path, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String(req.Method), semconv.URLPath(req.URL.Path)))
+}
+
+// startUpstreamSpan starts the span of the azure call and propagates it through the request headers
+func startUpstreamSpan(req *http.Request, deployment *DeploymentConfig) (*http.Request, trace.Span) {
+	ctx, span := tracer.Start(req.Context(), "azure "+deployment.DeploymentName, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.ServerAddress(req.URL.Host),
+			attribute.String("azure.deployment", deployment.DeploymentName),
+			attribute.String("openai.model", deployment.ModelName),
+		))
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, span
+}
+
+// endSpan records the status code and ends span
+func endSpan(span trace.Span, status int, err error) {
+	if status > 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// traceStream covers the streamed body of resp with a span ending when the body is drained or closed
+func traceStream(ctx context.Context, resp *http.Response) {
+	_, span := tracer.Start(ctx, "stream")
+	resp.Body = &tracedBody{ReadCloser: resp.Body, span: span}
+}
+
+type tracedBody struct {
+	io.ReadCloser
+	span  trace.Span
+	bytes int64
+	ended bool
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	if err == io.EOF {
+		b.end(nil)
+	} else if err != nil {
+		b.end(err)
+	}
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	b.end(nil)
+	return b.ReadCloser.Close()
+}
+
+func (b *tracedBody) end(err error) {
+	if b.ended {
+		return
+	}
+	b.ended = true
+	b.span.SetAttributes(attribute.Int64("stream.bytes", b.bytes))
+	endSpan(b.span, 0, err)
+}
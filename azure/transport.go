@@ -0,0 +1,279 @@
+package azure
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+	"golang.org/x/net/http2"
+)
+
+// TLSConfig adjusts the TLS settings of connections to azure, e.g. behind a TLS inspecting proxy
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file" mapstructure:"ca_file"`                           // PEM bundle trusted in addition to the system roots
+	MinVersion         string `yaml:"min_version" mapstructure:"min_version"`                   // 1.0, 1.1, 1.2 (default) or 1.3
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" mapstructure:"insecure_skip_verify"` // INSECURE, accept any certificate, for lab environments only
+	CertFile           string `yaml:"cert_file" mapstructure:"cert_file"`                       // PEM client certificate presented for mutual TLS
+	KeyFile            string `yaml:"key_file" mapstructure:"key_file"`                         // PEM private key of cert_file
+}
+
+// HostOverride pins a host name to an ip, e.g. an azure openai resource to its private endpoint
+type HostOverride struct {
+	Host string `yaml:"host" mapstructure:"host"` // e.g. my-resource.openai.azure.com
+	IP   string `yaml:"ip" mapstructure:"ip"`     // e.g. 10.0.0.5
+}
+
+// OutboundConfig configures the connections made to azure, without a proxy HTTP_PROXY and HTTPS_PROXY are honored
+type OutboundConfig struct {
+	MaxIdleConns          int            `yaml:"max_idle_conns" mapstructure:"max_idle_conns"`                   // idle connections kept over all hosts, 0 for no limit
+	MaxIdleConnsPerHost   int            `yaml:"max_idle_conns_per_host" mapstructure:"max_idle_conns_per_host"` // idle connections kept per host, 100 by default
+	IdleConnTimeout       time.Duration  `yaml:"idle_conn_timeout" mapstructure:"idle_conn_timeout"`             // idle connections are closed after it, 90s by default
+	TLSHandshakeTimeout   time.Duration  `yaml:"tls_handshake_timeout" mapstructure:"tls_handshake_timeout"`     // 10s by default
+	ResponseHeaderTimeout time.Duration  `yaml:"response_header_timeout" mapstructure:"response_header_timeout"` // wait for response headers after the request was written, 0 for no limit
+	Hosts                 []HostOverride `yaml:"hosts" mapstructure:"hosts"`                                     // static host name to ip overrides, e.g. private endpoints
+	Resolver              string         `yaml:"resolver" mapstructure:"resolver"`                               // dns server host:port used instead of the system resolver
+
+	TLS   TLSConfig `yaml:"tls" mapstructure:"tls"`
+	Proxy string    `yaml:"proxy" mapstructure:"proxy"` // http, https, socks5 or socks5h proxy url or direct, overrides AZURE_OPENAI_SOCKS_PROXY, AZURE_OPENAI_HTTP_PROXY and ALL_PROXY
+}
+
+// defaultMaxIdleConnsPerHost keeps enough idle connections to an azure endpoint for bursts,
+// the net/http default of 2 makes most requests under load open a new connection
+const defaultMaxIdleConnsPerHost = 100
+
+// ProxyDirect as proxy connects to azure without a proxy, ignoring the environment
+const ProxyDirect = "direct"
+
+// upstreamTransport is shared by all requests to azure, it negotiates http/2 so concurrent
+// streams are multiplexed over few connections
+var upstreamTransport = defaultUpstreamTransport()
+
+// defaultUpstreamTransport serves until Init applies the outbound config, an invalid proxy in the environment
+// is logged and connects directly, Init fails on it
+func defaultUpstreamTransport() *http.Transport {
+	transport, err := newUpstreamTransport(OutboundConfig{})
+	if err == nil {
+		return transport
+	}
+	log.Printf("outbound proxy of the environment error: %v, connecting directly until the config is applied", err)
+	if transport, err = newUpstreamTransport(OutboundConfig{Proxy: ProxyDirect}); err != nil {
+		panic(err)
+	}
+	return transport
+}
+
+// deploymentTransports holds a transport per distinct proxy and client certificate of deployments overriding them
+var deploymentTransports = map[string]*http.Transport{}
+
+// transportKey identifies the outbound settings of a deployment, empty when it uses the shared transport
+func transportKey(deployment *DeploymentConfig) string {
+	if deployment.Proxy == "" && deployment.ClientCert == "" {
+		return ""
+	}
+	return deployment.Proxy + "|" + deployment.ClientCert + "|" + deployment.ClientKey
+}
+
+// initDeploymentTransports builds the transports of deployments setting their own proxy or client certificate
+func initDeploymentTransports(outbound OutboundConfig, deployments map[string]DeploymentConfig) error {
+	transports, err := buildDeploymentTransports(outbound, deployments)
+	if err != nil {
+		return err
+	}
+	deploymentsMu.Lock()
+	deploymentTransports = transports
+	deploymentsMu.Unlock()
+	return nil
+}
+
+func buildDeploymentTransports(outbound OutboundConfig, deployments map[string]DeploymentConfig) (map[string]*http.Transport, error) {
+	transports := map[string]*http.Transport{}
+	for _, deployment := range deployments {
+		key := transportKey(&deployment)
+		if _, ok := transports[key]; ok || key == "" {
+			continue
+		}
+		config := outbound
+		if deployment.Proxy != "" {
+			config.Proxy = deployment.Proxy
+		}
+		if deployment.ClientCert != "" {
+			config.TLS.CertFile, config.TLS.KeyFile = deployment.ClientCert, deployment.ClientKey
+		}
+		transport, err := newUpstreamTransport(config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "deployment %s", deployment.DeploymentName)
+		}
+		transports[key] = transport
+	}
+	return transports, nil
+}
+
+// keepTransports moves the previous transports still used by next into it, so their connections survive a republish,
+// and returns the transports that are no longer used, the caller closes their idle connections
+func keepTransports(previous, next map[string]*http.Transport) []*http.Transport {
+	var unused []*http.Transport
+	for key, transport := range previous {
+		if _, ok := next[key]; ok {
+			unused = append(unused, next[key])
+			next[key] = transport
+			continue
+		}
+		unused = append(unused, transport)
+	}
+	return unused
+}
+
+// transportFor returns the transport to reach a deployment, the shared one unless the deployment sets its own
+// proxy or client certificate, in mock mode the fake azure
+func transportFor(deployment *DeploymentConfig) http.RoundTripper {
+	if mockUpstream {
+		return mockTransport{config: C.Mock}
+	}
+	deploymentsMu.RLock()
+	transport, ok := deploymentTransports[transportKey(deployment)]
+	if !ok {
+		transport, ok = tenantTransports[transportKey(deployment)]
+	}
+	deploymentsMu.RUnlock()
+	if ok {
+		return transport
+	}
+	return upstreamTransport
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func newUpstreamTransport(config OutboundConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = config.MaxIdleConns
+	transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if config.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	}
+	if config.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+	if config.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	}
+	transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	tlsConfig, err := newTLSConfig(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	if len(config.Hosts) > 0 || config.Resolver != "" {
+		dial, err := newDialContext(config)
+		if err != nil {
+			return nil, err
+		}
+		transport.DialContext = dial
+	}
+	proxyAddress := config.Proxy
+	if proxyAddress == "" {
+		proxyAddress = util.ProxyAddressFromEnv()
+	}
+	if proxyAddress == ProxyDirect {
+		transport.Proxy = nil
+	} else if proxyAddress != "" {
+		if err := util.ApplyProxy(transport, proxyAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	h2, err := http2.ConfigureTransports(transport)
+	if err != nil {
+		log.Printf("configure http/2 transport error: %v", err)
+		transport.ForceAttemptHTTP2 = true
+		return transport, nil
+	}
+	// health check idle http/2 connections so a dead connection doesn't stall every stream on it
+	h2.ReadIdleTimeout = 30 * time.Second
+	h2.PingTimeout = 15 * time.Second
+	return transport, nil
+}
+
+func newTLSConfig(config TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.MinVersion != "" {
+		version, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, errors.Errorf("invalid tls min_version %q, use 1.0, 1.1, 1.2 or 1.3", config.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read tls ca_file")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in tls ca_file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load tls client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.InsecureSkipVerify {
+		log.Printf("WARNING: outbound tls certificate verification is disabled, never use insecure_skip_verify in production")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// newDialContext returns a dial func applying the host overrides and the custom resolver,
+// it is replaced by socks proxies which resolve host names themselves
+func newDialContext(config OutboundConfig) (func(ctx context.Context, network, address string) (net.Conn, error), error) {
+	hosts := make(map[string]string, len(config.Hosts))
+	for _, h := range config.Hosts {
+		if net.ParseIP(h.IP) == nil {
+			return nil, errors.Errorf("invalid ip %q for host %s", h.IP, h.Host)
+		}
+		hosts[strings.ToLower(h.Host)] = h.IP
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if config.Resolver != "" {
+		server := config.Resolver
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if host, port, err := net.SplitHostPort(address); err == nil {
+			if ip, ok := hosts[strings.ToLower(host)]; ok {
+				address = net.JoinHostPort(ip, port)
+			}
+		}
+		return dialer.DialContext(ctx, network, address)
+	}, nil
+}
@@ -0,0 +1,223 @@
+package azure
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+const (
+	// TruncateDropOldest drops the oldest conversation messages first
+	TruncateDropOldest = "drop_oldest"
+	// TruncateDropMiddle keeps the first conversation message, usually the task, and drops the ones after it
+	TruncateDropMiddle = "drop_middle"
+
+	defaultTruncationReserve = 1024
+)
+
+// TruncationConfig trims chat prompts exceeding the context window of the deployment instead of
+// forwarding them to fail with a context length error, system and developer messages and the last message are kept
+type TruncationConfig struct {
+	Enabled  bool   `yaml:"enabled" mapstructure:"enabled"`   // trim prompts exceeding the context window
+	Strategy string `yaml:"strategy" mapstructure:"strategy"` // drop_oldest (default) or drop_middle
+	Reserve  int    `yaml:"reserve" mapstructure:"reserve"`   // tokens kept for the completion when the request sets no max_tokens, 1024 by default
+}
+
+// contextWindows are the context windows of known models by model name prefix, longest prefix first
+var contextWindows = []struct {
+	prefix string
+	tokens int
+}{
+	{"gpt-4.1", 1047576},
+	{"gpt-4o", 128000},
+	{"gpt-4-turbo", 128000},
+	{"gpt-4-32k", 32768},
+	{"gpt-4", 8192},
+	{"gpt-35-turbo-16k", 16384},
+	{"gpt-35-turbo", 16385},
+	{"gpt-3.5-turbo", 16385},
+	{"o1", 200000},
+	{"o3", 200000},
+	{"o4", 200000},
+}
+
+// contextWindow returns the context window of the deployment, 0 when unknown
+func contextWindow(deployment *DeploymentConfig) int {
+	if deployment.ContextWindow > 0 {
+		return deployment.ContextWindow
+	}
+	for _, w := range contextWindows {
+		if strings.HasPrefix(deployment.ModelName, w.prefix) {
+			return w.tokens
+		}
+	}
+	return 0
+}
+
+var (
+	encodingsOnce sync.Once
+	encodings     sync.Map
+)
+
+// encodingFor returns the tokenizer of a model, o200k_base for gpt-4o and newer and cl100k_base otherwise
+func encodingFor(model string) (*tiktoken.Tiktoken, error) {
+	encodingsOnce.Do(func() {
+		tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+	})
+	name := tiktoken.MODEL_CL100K_BASE
+	for _, prefix := range []string{"gpt-4o", "gpt-4.1", "o1", "o3", "o4"} {
+		if strings.HasPrefix(model, prefix) {
+			name = tiktoken.MODEL_O200K_BASE
+			break
+		}
+	}
+	if enc, ok := encodings.Load(name); ok {
+		return enc.(*tiktoken.Tiktoken), nil
+	}
+	enc, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	encodings.Store(name, enc)
+	return enc, nil
+}
+
+// messageTokens counts the tokens of a chat message including the per message overhead
+func messageTokens(enc *tiktoken.Tiktoken, item interface{}) int {
+	message, _ := item.(map[string]interface{})
+	tokens := 3
+	count := func(s string) {
+		tokens += len(enc.Encode(s, nil, nil))
+	}
+	count(stringValue(message["role"]))
+	if name, ok := message["name"].(string); ok {
+		count(name)
+		tokens++
+	}
+	switch content := message["content"].(type) {
+	case string:
+		count(content)
+	case []interface{}:
+		for _, p := range content {
+			part, _ := p.(map[string]interface{})
+			switch part["type"] {
+			case "text":
+				count(stringValue(part["text"]))
+			case "image_url":
+				// the low detail cost, high detail images are not resolved here
+				tokens += 85
+			}
+		}
+	}
+	if toolCalls, ok := message["tool_calls"]; ok {
+		data, _ := util.JSONMarshal(toolCalls)
+		count(string(data))
+	}
+	return tokens
+}
+
+// rewriteTruncate drops conversation messages of chat prompts exceeding the context window of the deployment
+func rewriteTruncate(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if !C.Truncation.Enabled || !isChatCompletions(rc.req) {
+		return false, nil
+	}
+	window := contextWindow(rc.deployment)
+	messages, _ := payload["messages"].([]interface{})
+	if window == 0 || len(messages) < 2 {
+		return false, nil
+	}
+	enc, err := encodingFor(rc.deployment.ModelName)
+	if err != nil {
+		rc.warnf("load tokenizer: %v", err)
+		return false, nil
+	}
+
+	reserve := C.Truncation.Reserve
+	if reserve <= 0 {
+		reserve = defaultTruncationReserve
+	}
+	for _, param := range []string{"max_completion_tokens", "max_tokens"} {
+		if n, ok := numberValue(payload[param]); ok && n > 0 {
+			reserve = int(n)
+			break
+		}
+	}
+
+	budget := window - reserve - 3
+	if tools, ok := payload["tools"]; ok {
+		data, _ := util.JSONMarshal(tools)
+		budget -= len(enc.Encode(string(data), nil, nil))
+	}
+	costs := make([]int, len(messages))
+	total := 0
+	for i, message := range messages {
+		costs[i] = messageTokens(enc, message)
+		total += costs[i]
+	}
+	if total <= budget {
+		return false, nil
+	}
+
+	units := droppableUnits(messages)
+	if C.Truncation.Strategy == TruncateDropMiddle && len(units) > 0 {
+		units = units[1:]
+	}
+	dropped := make(map[int]bool)
+	for _, unit := range units {
+		if total <= budget {
+			break
+		}
+		for _, i := range unit {
+			dropped[i] = true
+			total -= costs[i]
+		}
+	}
+	if total > budget {
+		rc.debugf("prompt exceeds the context window of %d tokens even without the conversation history", window)
+		return false, nil
+	}
+
+	kept := make([]interface{}, 0, len(messages)-len(dropped))
+	for i, message := range messages {
+		if !dropped[i] {
+			kept = append(kept, message)
+		}
+	}
+	payload["messages"] = kept
+	rc.addWarning(fmt.Sprintf("prompt truncated: dropped %d messages to fit the context window of %d tokens", len(dropped), window))
+	return true, nil
+}
+
+// droppableUnits groups the messages which may be dropped, oldest first, an assistant message
+// is grouped with the tool results following it so tool calls and results are dropped together
+func droppableUnits(messages []interface{}) [][]int {
+	var units [][]int
+	for i := 0; i < len(messages)-1; i++ {
+		message, _ := messages[i].(map[string]interface{})
+		role := message["role"]
+		if role == "system" || role == "developer" {
+			continue
+		}
+		if role == "tool" && len(units) > 0 {
+			last := units[len(units)-1]
+			if last[len(last)-1] == i-1 {
+				units[len(units)-1] = append(last, i)
+				continue
+			}
+		}
+		units = append(units, []int{i})
+	}
+	// the tool results answering the last message's tool calls are never split from it
+	if len(units) > 0 {
+		last := units[len(units)-1]
+		message, _ := messages[len(messages)-1].(map[string]interface{})
+		if message["role"] == "tool" && last[len(last)-1] == len(messages)-2 {
+			units = units[:len(units)-1]
+		}
+	}
+	return units
+}
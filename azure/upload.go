@@ -0,0 +1,57 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// requestBodyPrefix is the part of a request body buffered up front, larger non-json bodies such as
+// audio uploads are streamed to azure and only this prefix is kept for logging
+const requestBodyPrefix = 64 << 10
+
+// readRequestBody buffers json bodies completely and other bodies up to requestBodyPrefix,
+// for streamed bodies rest yields the complete body and body holds the prefix only
+func readRequestBody(r *http.Request) (body []byte, rest io.Reader, err error) {
+	prefix, err := io.ReadAll(io.LimitReader(r.Body, requestBodyPrefix+1))
+	if err != nil || len(prefix) <= requestBodyPrefix {
+		return prefix, nil, err
+	}
+	if !isMultipart(r.Header.Get("Content-Type")) && !isOctetStream(r.Header.Get("Content-Type")) {
+		// json bodies are rewritten and need to be complete
+		remaining, err := io.ReadAll(r.Body)
+		return append(prefix, remaining...), nil, err
+	}
+	return prefix[:requestBodyPrefix], io.MultiReader(bytes.NewReader(prefix), r.Body), nil
+}
+
+func isMultipart(contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(contentType), "multipart/")
+}
+
+func isOctetStream(contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(contentType), "application/octet-stream")
+}
+
+// multipartModel returns the model form field of a multipart body, it has to come before the file
+// when the body is streamed since only the buffered prefix is searched
+func multipartModel(body []byte, contentType string) string {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		return ""
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return ""
+		}
+		if part.FormName() == "model" {
+			value, _ := io.ReadAll(io.LimitReader(part, 256))
+			return strings.TrimSpace(string(value))
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package azure
+
+import (
+	"unicode/utf8"
+
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+const (
+	// StreamOptionsApiVersion is the first api-version accepting stream_options
+	StreamOptionsApiVersion = "2024-09-01-preview"
+
+	// StreamUsageInject asks upstream for a usage chunk and falls back to an estimate when unsupported
+	StreamUsageInject = "inject"
+	// StreamUsageEstimate always computes the usage chunk locally
+	StreamUsageEstimate = "estimate"
+)
+
+type Usage struct {
+	PromptTokens        int64                `json:"prompt_tokens"`
+	CompletionTokens    int64                `json:"completion_tokens"`
+	TotalTokens         int64                `json:"total_tokens"`
+	PromptTokensDetails *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+type PromptTokensDetails struct {
+	CachedTokens int64 `json:"cached_tokens"` // prompt tokens served from the prompt cache
+}
+
+func (u *Usage) cachedTokens() int64 {
+	if u.PromptTokensDetails == nil {
+		return 0
+	}
+	return u.PromptTokensDetails.CachedTokens
+}
+
+// estimateTokens counts the tokens of text with the tokenizer of the model, when the tokenizer can't be loaded it
+// falls back to about 4 ascii characters per token and one token per other character
+func estimateTokens(model, text string) int64 {
+	if enc, err := encodingFor(model); err == nil {
+		return int64(len(enc.Encode(text, nil, nil)))
+	}
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return int64((ascii+3)/4 + other)
+}
+
+// estimatePromptTokens counts the prompt tokens of chat messages including the per message overhead and the
+// priming of the reply, images are counted at their low detail cost
+func estimatePromptTokens(model string, messages interface{}) int64 {
+	items, _ := messages.([]interface{})
+	tokens := int64(3)
+	enc, err := encodingFor(model)
+	for _, item := range items {
+		if err == nil {
+			tokens += int64(messageTokens(enc, item))
+			continue
+		}
+		message, _ := item.(map[string]interface{})
+		tokens += 4
+		switch content := message["content"].(type) {
+		case string:
+			tokens += estimateTokens(model, content)
+		case []interface{}:
+			for _, p := range content {
+				if part, ok := p.(map[string]interface{}); ok && part["type"] == "text" {
+					tokens += estimateTokens(model, stringValue(part["text"]))
+				}
+			}
+		}
+	}
+	return tokens
+}
+
+// rewriteStreamUsage makes every streamed chat completion end with a usage chunk, either by asking upstream
+// through stream_options or by estimating it locally
+func rewriteStreamUsage(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if C.StreamUsage == "" || !isChatCompletions(rc.req) || payload["stream"] != true {
+		return false, nil
+	}
+
+	changed := false
+	tracker := &streamUsageTracker{rc: rc}
+	if C.StreamUsage == StreamUsageInject && apiVersionAtLeast(rc.deployment.ApiVersion, StreamOptionsApiVersion) {
+		options, _ := payload["stream_options"].(map[string]interface{})
+		if options == nil {
+			options = map[string]interface{}{}
+			payload["stream_options"] = options
+		}
+		if options["include_usage"] != true {
+			options["include_usage"] = true
+			changed = true
+		}
+	} else {
+		if _, ok := payload["stream_options"]; ok && !apiVersionAtLeast(rc.deployment.ApiVersion, StreamOptionsApiVersion) {
+			delete(payload, "stream_options")
+			changed = true
+		}
+	}
+
+	rc.addResponseRewriter(tracker.rewrite)
+	rc.addStreamEndHook(tracker.end)
+	return changed, nil
+}
+
+// streamUsageTracker records the upstream usage chunk, without one it ends the stream with the estimate of
+// rewriteUsageEstimate
+type streamUsageTracker struct {
+	rc   *rewriteContext
+	last map[string]interface{}
+}
+
+func (t *streamUsageTracker) rewrite(payload map[string]interface{}, stream bool) bool {
+	if !stream {
+		return true
+	}
+	t.last = payload
+
+	if usage, ok := payload["usage"].(map[string]interface{}); ok {
+		data, _ := util.JSONMarshal(usage)
+		t.rc.usage = new(Usage)
+		_ = util.JSONUnmarshal(data, t.rc.usage)
+	}
+	return true
+}
+
+func (t *streamUsageTracker) end() []map[string]interface{} {
+	if t.rc.usage != nil || t.last == nil {
+		return nil
+	}
+
+	t.rc.usage = t.rc.estimatedUsage()
+	return []map[string]interface{}{{
+		"id":      t.last["id"],
+		"object":  "chat.completion.chunk",
+		"created": t.last["created"],
+		"model":   t.last["model"],
+		"choices": []interface{}{},
+		"usage":   t.rc.usage,
+	}}
+}
+
+// rewriteUsageEstimate estimates the usage of chat streams, used when the stream carries no usage chunk: the prompt
+// is counted here and the streamed text and tool call arguments as the chunks pass
+func rewriteUsageEstimate(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if rc.stream && isChatCompletions(rc.req) {
+		rc.promptEstimate = estimatePromptTokens(rc.deployment.ModelName, payload["messages"])
+		rc.addResponseRewriter(rc.countCompletion)
+	}
+	return false, nil
+}
+
+// countCompletion adds the tokens of the deltas of a stream chunk to completionEstimate
+func (rc *rewriteContext) countCompletion(payload map[string]interface{}, stream bool) bool {
+	if !stream {
+		return true
+	}
+	choices, _ := payload["choices"].([]interface{})
+	for _, item := range choices {
+		choice, _ := item.(map[string]interface{})
+		delta, _ := choice["delta"].(map[string]interface{})
+		rc.completionEstimate += estimateTokens(rc.deployment.ModelName, stringValue(delta["content"]))
+		if toolCalls, ok := delta["tool_calls"].([]interface{}); ok {
+			for _, tc := range toolCalls {
+				toolCall, _ := tc.(map[string]interface{})
+				function, _ := toolCall["function"].(map[string]interface{})
+				rc.completionEstimate += estimateTokens(rc.deployment.ModelName, stringValue(function["arguments"]))
+			}
+		}
+	}
+	return true
+}
+
+// estimatedUsage returns the estimated usage of a stream and marks the usage of the request as estimated
+func (rc *rewriteContext) estimatedUsage() *Usage {
+	rc.usageEstimated = true
+	return &Usage{
+		PromptTokens:     rc.promptEstimate,
+		CompletionTokens: rc.completionEstimate,
+		TotalTokens:      rc.promptEstimate + rc.completionEstimate,
+	}
+}
@@ -0,0 +1,161 @@
+package azure
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// UsageGroup is the aggregated usage of one key, tenant, model or day
+type UsageGroup struct {
+	Group            string  `json:"group"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// UsageReporter is implemented by usage stores able to aggregate their records
+type UsageReporter interface {
+	QueryUsage(from, to time.Time, groupBy, tenant string) ([]UsageGroup, error)
+}
+
+var usageGroupColumns = map[string]string{
+	"key":    "key_id",
+	"tenant": "tenant",
+	"model":  "model",
+	"day":    "substr(CAST(time AS TEXT), 1, 10)",
+}
+
+// QueryUsage aggregates the records in [from, to) by key, tenant, model or day, only the records of tenant when it
+// isn't empty
+func (s *sqlUsageStore) QueryUsage(from, to time.Time, groupBy, tenant string) ([]UsageGroup, error) {
+	column, ok := usageGroupColumns[groupBy]
+	if !ok {
+		return nil, errors.Errorf("unknown group_by %q", groupBy)
+	}
+	params := strings.Split(s.placeholders(1, 3), ", ")
+	where, args := "time >= "+params[0]+" AND time < "+params[1], []interface{}{from.UTC(), to.UTC()}
+	if tenant != "" {
+		where, args = where+" AND tenant = "+params[2], append(args, tenant)
+	}
+	rows, err := s.db.Query("SELECT "+column+", COUNT(*), SUM(prompt_tokens), SUM(completion_tokens), SUM(cost)"+
+		" FROM usage_records WHERE "+where+" GROUP BY 1 ORDER BY 1", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []UsageGroup{}
+	for rows.Next() {
+		var g UsageGroup
+		if err = rows.Scan(&g.Group, &g.Requests, &g.PromptTokens, &g.CompletionTokens, &g.Cost); err != nil {
+			return nil, err
+		}
+		g.TotalTokens = g.PromptTokens + g.CompletionTokens
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// UsageReportHandler reports the stored usage aggregated by key, tenant, model or day as json or csv,
+// from and to take RFC 3339 times or dates, a date for to includes that day, tenant restricts it to one tenant
+func UsageReportHandler(c *gin.Context) {
+	accountant.mu.Lock()
+	reporter, _ := accountant.store.(UsageReporter)
+	accountant.mu.Unlock()
+	if reporter == nil {
+		util.SendOpenAIError(c, http.StatusNotFound, "invalid_request_error", "usage_store_disabled", "",
+			errors.New("usage reports need a usage store, configure usage.store"))
+		return
+	}
+
+	now := time.Now().UTC()
+	from, err := parseReportTime(c.Query("from"), time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), false)
+	if err != nil {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "from", err)
+		return
+	}
+	to, err := parseReportTime(c.Query("to"), now, true)
+	if err != nil {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "to", err)
+		return
+	}
+	if !from.Before(to) {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "to",
+			errors.Errorf("to must be after from, got from %s and to %s", from.Format(time.RFC3339), to.Format(time.RFC3339)))
+		return
+	}
+	groupBy := c.DefaultQuery("group_by", "key")
+	if _, ok := usageGroupColumns[groupBy]; !ok {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "group_by",
+			errors.Errorf("group_by must be key, tenant, model or day, got %q", groupBy))
+		return
+	}
+
+	// include the records still buffered in memory
+	accountant.flush()
+	tenant := c.Query("tenant")
+	groups, err := reporter.QueryUsage(from, to, groupBy, tenant)
+	if err != nil {
+		util.SendError(c, errors.Wrap(err, "query usage error"))
+		return
+	}
+
+	if c.Query("format") == "csv" || strings.Contains(c.GetHeader("Accept"), "text/csv") {
+		writeUsageCSV(c, groupBy, groups)
+		return
+	}
+	util.SendJSON(c, http.StatusOK, gin.H{
+		"object":   "list",
+		"from":     from,
+		"to":       to,
+		"group_by": groupBy,
+		"tenant":   tenant,
+		"data":     groups,
+	})
+}
+
+func parseReportTime(value string, fallback time.Time, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid time %q, use RFC 3339 or YYYY-MM-DD", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func writeUsageCSV(c *gin.Context, groupBy string, groups []UsageGroup) {
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", `attachment; filename="usage-by-`+groupBy+`.csv"`)
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write([]string{groupBy, "requests", "prompt_tokens", "completion_tokens", "total_tokens", "cost"})
+	for _, g := range groups {
+		_ = w.Write([]string{
+			g.Group,
+			strconv.FormatInt(g.Requests, 10),
+			strconv.FormatInt(g.PromptTokens, 10),
+			strconv.FormatInt(g.CompletionTokens, 10),
+			strconv.FormatInt(g.TotalTokens, 10),
+			strconv.FormatFloat(g.Cost, 'f', -1, 64),
+		})
+	}
+	w.Flush()
+}
@@ -0,0 +1,129 @@
+package azure
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	UsageStoreSQLite   = "sqlite"
+	UsageStorePostgres = "postgres"
+)
+
+type UsageStoreConfig struct {
+	Driver string `yaml:"driver" mapstructure:"driver"` // sqlite or postgres, the store is disabled when empty
+	DSN    string `yaml:"dsn" mapstructure:"dsn"`       // sqlite file path or postgres connection string
+}
+
+const createUsageTable = `CREATE TABLE IF NOT EXISTS usage_records (
+	time TIMESTAMP NOT NULL,
+	request_id TEXT NOT NULL,
+	key_id TEXT NOT NULL,
+	model TEXT NOT NULL,
+	deployment TEXT NOT NULL,
+	prompt_tokens BIGINT NOT NULL,
+	completion_tokens BIGINT NOT NULL,
+	cost DOUBLE PRECISION NOT NULL,
+	estimated BOOLEAN NOT NULL,
+	stream BOOLEAN NOT NULL,
+	tenant TEXT NOT NULL DEFAULT ''
+)`
+
+const createUsageIndex = `CREATE INDEX IF NOT EXISTS usage_records_time ON usage_records (time)`
+
+// addUsageTenant migrates the tables created before tenants
+const addUsageTenant = `ALTER TABLE usage_records ADD COLUMN tenant TEXT NOT NULL DEFAULT ''`
+
+var usageColumns = []string{"time", "request_id", "key_id", "model", "deployment",
+	"prompt_tokens", "completion_tokens", "cost", "estimated", "stream", "tenant"}
+
+// sqlUsageStore keeps usage records in a sqlite or postgres table
+type sqlUsageStore struct {
+	db     *sql.DB
+	driver string
+	insert string
+}
+
+// openUsageStore connects to the configured database and creates the usage table when missing
+func openUsageStore(cfg UsageStoreConfig) (*sqlUsageStore, error) {
+	var driverName string
+	switch cfg.Driver {
+	case UsageStoreSQLite:
+		driverName = "sqlite"
+	case UsageStorePostgres:
+		driverName = "postgres"
+	default:
+		return nil, errors.Errorf("unknown usage store driver %q, use sqlite or postgres", cfg.Driver)
+	}
+
+	db, err := sql.Open(driverName, cfg.DSN)
+	if err != nil {
+		return nil, errors.Wrap(err, "open usage store error")
+	}
+	if cfg.Driver == UsageStoreSQLite {
+		// sqlite allows a single writer, serialize on one connection instead of failing with SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	}
+	for _, stmt := range []string{createUsageTable, createUsageIndex} {
+		if _, err = db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "create usage table error")
+		}
+	}
+	if _, err = db.Exec("SELECT tenant FROM usage_records LIMIT 0"); err != nil {
+		if _, err = db.Exec(addUsageTenant); err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "add tenant to usage table error")
+		}
+	}
+
+	store := &sqlUsageStore{db: db, driver: cfg.Driver}
+	store.insert = fmt.Sprintf("INSERT INTO usage_records (%s) VALUES (%s)",
+		strings.Join(usageColumns, ", "), store.placeholders(1, len(usageColumns)))
+	return store, nil
+}
+
+// placeholders returns n bind parameters starting at from in the syntax of the driver
+func (s *sqlUsageStore) placeholders(from, n int) string {
+	params := make([]string, n)
+	for i := range params {
+		if s.driver == UsageStorePostgres {
+			params[i] = fmt.Sprintf("$%d", from+i)
+		} else {
+			params[i] = "?"
+		}
+	}
+	return strings.Join(params, ", ")
+}
+
+// WriteUsage inserts the records in a single transaction
+func (s *sqlUsageStore) WriteUsage(records []UsageRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(s.insert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		if _, err = stmt.Exec(r.Time.UTC(), r.RequestID, r.KeyID, r.Model, r.Deployment,
+			r.PromptTokens, r.CompletionTokens, r.Cost, r.Estimated, r.Stream, r.Tenant); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlUsageStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,109 @@
+package azure
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLiteUsageStore(t *testing.T) {
+	store, err := openUsageStore(UsageStoreConfig{Driver: UsageStoreSQLite, DSN: filepath.Join(t.TempDir(), "usage.db")})
+	assert.NoError(t, err)
+	defer store.Close()
+
+	assert.NoError(t, store.WriteUsage([]UsageRecord{
+		{Time: time.Now(), RequestID: "a", KeyID: "k1", Model: "gpt-4", Deployment: "gpt4", PromptTokens: 5, CompletionTokens: 3},
+		{Time: time.Now(), RequestID: "b", KeyID: "k1", Model: "gpt-4", Deployment: "gpt4", PromptTokens: 2, CompletionTokens: 1, Stream: true},
+	}))
+
+	var requests, tokens int64
+	assert.NoError(t, store.db.QueryRow("SELECT COUNT(*), SUM(prompt_tokens + completion_tokens) FROM usage_records").Scan(&requests, &tokens))
+	assert.Equal(t, int64(2), requests)
+	assert.Equal(t, int64(11), tokens)
+}
+
+func TestSQLiteUsageReport(t *testing.T) {
+	store, err := openUsageStore(UsageStoreConfig{Driver: UsageStoreSQLite, DSN: filepath.Join(t.TempDir(), "usage.db")})
+	assert.NoError(t, err)
+	defer store.Close()
+
+	day := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, store.WriteUsage([]UsageRecord{
+		{Time: day, KeyID: "k1", Model: "gpt-4", PromptTokens: 5, CompletionTokens: 3, Cost: 0.5},
+		{Time: day.Add(time.Hour), KeyID: "k2", Model: "gpt-4", PromptTokens: 2, CompletionTokens: 1, Cost: 0.25},
+		{Time: day.AddDate(0, 0, 1), KeyID: "k1", Model: "gpt-35", PromptTokens: 1, CompletionTokens: 1},
+	}))
+
+	groups, err := store.QueryUsage(day.Add(-time.Hour), day.AddDate(0, 0, 2), "day", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []UsageGroup{
+		{Group: "2024-05-01", Requests: 2, PromptTokens: 7, CompletionTokens: 4, TotalTokens: 11, Cost: 0.75},
+		{Group: "2024-05-02", Requests: 1, PromptTokens: 1, CompletionTokens: 1, TotalTokens: 2},
+	}, groups)
+
+	groups, err = store.QueryUsage(day, day.Add(2*time.Hour), "key", "")
+	assert.NoError(t, err)
+	assert.Len(t, groups, 2)
+	assert.Equal(t, "k1", groups[0].Group)
+	assert.Equal(t, int64(8), groups[0].TotalTokens)
+}
+
+func TestSQLiteUsageReportByTenant(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "usage.db")
+	// a table created before tenants gets the column added
+	db, err := sql.Open("sqlite", dsn)
+	assert.NoError(t, err)
+	_, err = db.Exec(strings.Replace(createUsageTable, ",\n\ttenant TEXT NOT NULL DEFAULT ''", "", 1))
+	assert.NoError(t, err)
+	db.Close()
+
+	store, err := openUsageStore(UsageStoreConfig{Driver: UsageStoreSQLite, DSN: dsn})
+	assert.NoError(t, err)
+	defer store.Close()
+
+	day := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, store.WriteUsage([]UsageRecord{
+		{Time: day, KeyID: "k1", Tenant: "acme", Model: "gpt-4", PromptTokens: 5, CompletionTokens: 3, Cost: 0.5},
+		{Time: day, KeyID: "k1", Tenant: "acme", Model: "gpt-35", PromptTokens: 1, CompletionTokens: 1, Cost: 0.1},
+		{Time: day, KeyID: "k2", Tenant: "globex", Model: "gpt-4", PromptTokens: 2, CompletionTokens: 1, Cost: 0.25},
+		{Time: day, KeyID: "k3", Model: "gpt-4", PromptTokens: 1, CompletionTokens: 1},
+	}))
+
+	groups, err := store.QueryUsage(day, day.Add(time.Hour), "tenant", "")
+	assert.NoError(t, err)
+	assert.Len(t, groups, 3)
+	assert.Equal(t, UsageGroup{Group: "acme", Requests: 2, PromptTokens: 6, CompletionTokens: 4, TotalTokens: 10, Cost: 0.6}, groups[1])
+
+	groups, err = store.QueryUsage(day, day.Add(time.Hour), "model", "acme")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gpt-35", "gpt-4"}, []string{groups[0].Group, groups[1].Group})
+}
+
+func TestUsageReportHandlerRange(t *testing.T) {
+	store, err := openUsageStore(UsageStoreConfig{Driver: UsageStoreSQLite, DSN: filepath.Join(t.TempDir(), "usage.db")})
+	assert.NoError(t, err)
+	defer store.Close()
+	SetUsageStore(store)
+	defer SetUsageStore(nil)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/admin/usage", UsageReportHandler)
+	report := func(query string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/usage?"+query, nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, report("from=2024-05-01&to=2024-05-01"))
+	assert.Equal(t, http.StatusBadRequest, report("from=2024-05-02&to=2024-05-01"))
+	assert.Equal(t, http.StatusBadRequest, report("from=2024-05-01T10:00:00Z&to=2024-05-01T10:00:00Z"))
+	assert.Equal(t, http.StatusBadRequest, report("from=2999-01-01"))
+}
@@ -0,0 +1,23 @@
+package azure
+
+import "strings"
+
+// rewriteInjectUser sets the user field of requests lacking one to the caller key id, prefixed with the tenant of
+// tenant requests, giving azure abuse monitoring a stable identifier without exposing the key
+func rewriteInjectUser(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if !C.InjectUser || rc.keyID == "" && rc.tenant == nil {
+		return false, nil
+	}
+	if user, ok := payload["user"].(string); ok && user != "" {
+		return false, nil
+	}
+	var parts []string
+	if rc.tenant != nil {
+		parts = append(parts, "tenant-"+rc.tenant.id)
+	}
+	if rc.keyID != "" {
+		parts = append(parts, "key-"+rc.keyID)
+	}
+	payload["user"] = strings.Join(parts, "/")
+	return true, nil
+}
@@ -0,0 +1,309 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+var messageRoles = []string{"system", "developer", "user", "assistant", "tool", "function"}
+
+// rewriteValidate checks the request body against the OpenAI schema and rejects malformed requests
+// with a precise 400 instead of relaying the vaguer azure error, unknown fields are left alone
+func rewriteValidate(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	if !C.ValidateRequests {
+		return false, nil
+	}
+
+	path := rc.req.URL.Path
+	var err error
+	switch {
+	case strings.HasSuffix(path, "/chat/completions"):
+		err = validateChatCompletion(payload)
+	case strings.HasSuffix(path, "/completions"):
+		err = validateCompletion(payload)
+	case strings.HasSuffix(path, "/embeddings"):
+		err = validateEmbeddings(payload)
+	case strings.HasSuffix(path, "/images/generations"):
+		err = validateImageGeneration(payload)
+	}
+	return false, err
+}
+
+func validateChatCompletion(payload map[string]interface{}) error {
+	messages, ok := payload["messages"].([]interface{})
+	if !ok {
+		return invalidParam("messages", "is required and must be an array")
+	}
+	if len(messages) == 0 {
+		return invalidParam("messages", "must contain at least one message")
+	}
+	for i, item := range messages {
+		if err := validateMessage(fmt.Sprintf("messages[%d]", i), item); err != nil {
+			return err
+		}
+	}
+
+	if tools, ok := payload["tools"]; ok {
+		list, ok := tools.([]interface{})
+		if !ok {
+			return invalidParam("tools", "must be an array")
+		}
+		for i, item := range list {
+			param := fmt.Sprintf("tools[%d]", i)
+			tool, ok := item.(map[string]interface{})
+			if !ok {
+				return invalidParam(param, "must be an object")
+			}
+			if tool["type"] != "function" {
+				return invalidParam(param+".type", "must be \"function\"")
+			}
+			function, ok := tool["function"].(map[string]interface{})
+			if !ok {
+				return invalidParam(param+".function", "is required and must be an object")
+			}
+			if name, ok := function["name"].(string); !ok || name == "" {
+				return invalidParam(param+".function.name", "is required and must be a string")
+			}
+		}
+	}
+	if choice, ok := payload["tool_choice"]; ok {
+		if err := oneOf("tool_choice", choice, "a string or an object", isString, isObject); err != nil {
+			return err
+		}
+	}
+	if format, ok := payload["response_format"]; ok {
+		object, ok := format.(map[string]interface{})
+		if !ok {
+			return invalidParam("response_format", "must be an object")
+		}
+		if _, ok := object["type"].(string); !ok {
+			return invalidParam("response_format.type", "is required and must be a string")
+		}
+	}
+	return validateSampling(payload)
+}
+
+func validateMessage(param string, item interface{}) error {
+	message, ok := item.(map[string]interface{})
+	if !ok {
+		return invalidParam(param, "must be an object")
+	}
+	role, ok := message["role"].(string)
+	if !ok {
+		return invalidParam(param+".role", "is required and must be a string")
+	}
+	if !containsString(messageRoles, role) {
+		return invalidParam(param+".role", "must be one of %s, got %q", strings.Join(messageRoles, ", "), role)
+	}
+
+	content, present := message["content"]
+	switch c := content.(type) {
+	case string:
+	case []interface{}:
+		for j, p := range c {
+			if err := validateContentPart(fmt.Sprintf("%s.content[%d]", param, j), p); err != nil {
+				return err
+			}
+		}
+	case nil:
+		_, toolCalls := message["tool_calls"]
+		_, functionCall := message["function_call"]
+		if role != "assistant" || (!toolCalls && !functionCall) {
+			if !present {
+				return invalidParam(param+".content", "is required")
+			}
+			return invalidParam(param+".content", "can only be null for assistant messages with tool_calls")
+		}
+	default:
+		return invalidParam(param+".content", "must be a string or array")
+	}
+
+	if role == "tool" {
+		if id, ok := message["tool_call_id"].(string); !ok || id == "" {
+			return invalidParam(param+".tool_call_id", "is required for tool messages and must be a string")
+		}
+	}
+	return nil
+}
+
+func validateContentPart(param string, item interface{}) error {
+	part, ok := item.(map[string]interface{})
+	if !ok {
+		return invalidParam(param, "must be an object")
+	}
+	switch part["type"] {
+	case "text":
+		if _, ok := part["text"].(string); !ok {
+			return invalidParam(param+".text", "is required and must be a string")
+		}
+	case "image_url":
+		image, ok := part["image_url"].(map[string]interface{})
+		if !ok {
+			return invalidParam(param+".image_url", "is required and must be an object")
+		}
+		if _, ok := image["url"].(string); !ok {
+			return invalidParam(param+".image_url.url", "is required and must be a string")
+		}
+	case nil:
+		return invalidParam(param+".type", "is required")
+	}
+	return nil
+}
+
+func validateCompletion(payload map[string]interface{}) error {
+	if prompt, ok := payload["prompt"]; ok {
+		if err := oneOf("prompt", prompt, "a string or an array", isString, isArray); err != nil {
+			return err
+		}
+	}
+	return validateSampling(payload)
+}
+
+func validateEmbeddings(payload map[string]interface{}) error {
+	input, ok := payload["input"]
+	if !ok {
+		return invalidParam("input", "is required")
+	}
+	switch in := input.(type) {
+	case string:
+		if in == "" {
+			return invalidParam("input", "must not be empty")
+		}
+	case []interface{}:
+		if len(in) == 0 {
+			return invalidParam("input", "must not be empty")
+		}
+		for i, item := range in {
+			if err := oneOf(fmt.Sprintf("input[%d]", i), item, "a string, a token or an array of tokens", isString, isInteger, isArray); err != nil {
+				return err
+			}
+		}
+	default:
+		return invalidParam("input", "must be a string or an array")
+	}
+	if dimensions, ok := payload["dimensions"]; ok {
+		return integerAtLeast("dimensions", dimensions, 1)
+	}
+	return nil
+}
+
+func validateImageGeneration(payload map[string]interface{}) error {
+	if prompt, ok := payload["prompt"].(string); !ok || prompt == "" {
+		return invalidParam("prompt", "is required and must be a string")
+	}
+	if n, ok := payload["n"]; ok {
+		if err := integerAtLeast("n", n, 1); err != nil {
+			return err
+		}
+	}
+	if size, ok := payload["size"]; ok && !isString(size) {
+		return invalidParam("size", "must be a string")
+	}
+	return nil
+}
+
+// validateSampling checks the sampling parameters shared by chat and text completions
+func validateSampling(payload map[string]interface{}) error {
+	ranges := []struct {
+		param    string
+		min, max float64
+	}{
+		{"temperature", 0, 2},
+		{"top_p", 0, 1},
+		{"presence_penalty", -2, 2},
+		{"frequency_penalty", -2, 2},
+	}
+	for _, r := range ranges {
+		value, ok := payload[r.param]
+		if !ok || value == nil {
+			continue
+		}
+		f, ok := numberValue(value)
+		if !ok {
+			return invalidParam(r.param, "must be a number")
+		}
+		if f < r.min || f > r.max {
+			return invalidParam(r.param, "must be between %g and %g, got %g", r.min, r.max, f)
+		}
+	}
+	for _, param := range []string{"n", "max_tokens", "max_completion_tokens"} {
+		if value, ok := payload[param]; ok && value != nil {
+			if err := integerAtLeast(param, value, 1); err != nil {
+				return err
+			}
+		}
+	}
+	if stream, ok := payload["stream"]; ok && stream != nil && !isBool(stream) {
+		return invalidParam("stream", "must be a boolean")
+	}
+	if stop, ok := payload["stop"]; ok && stop != nil {
+		if list, ok := stop.([]interface{}); ok {
+			for i, item := range list {
+				if !isString(item) {
+					return invalidParam(fmt.Sprintf("stop[%d]", i), "must be a string")
+				}
+			}
+		} else if !isString(stop) {
+			return invalidParam("stop", "must be a string or an array of strings")
+		}
+	}
+	return nil
+}
+
+func invalidParam(param, format string, args ...interface{}) *RequestError {
+	return newRequestError(param, param+" "+format, args...)
+}
+
+func oneOf(param string, value interface{}, expected string, checks ...func(interface{}) bool) error {
+	for _, check := range checks {
+		if check(value) {
+			return nil
+		}
+	}
+	return invalidParam(param, "must be %s", expected)
+}
+
+func integerAtLeast(param string, value interface{}, min int64) error {
+	n, ok := value.(json.Number)
+	if !ok {
+		return invalidParam(param, "must be an integer")
+	}
+	i, err := n.Int64()
+	if err != nil {
+		return invalidParam(param, "must be an integer")
+	}
+	if i < min {
+		return invalidParam(param, "must be at least %d, got %d", min, i)
+	}
+	return nil
+}
+
+func isString(v interface{}) bool {
+	_, ok := v.(string)
+	return ok
+}
+
+func isArray(v interface{}) bool {
+	_, ok := v.([]interface{})
+	return ok
+}
+
+func isObject(v interface{}) bool {
+	_, ok := v.(map[string]interface{})
+	return ok
+}
+
+func isBool(v interface{}) bool {
+	_, ok := v.(bool)
+	return ok
+}
+
+func isInteger(v interface{}) bool {
+	n, ok := v.(json.Number)
+	if !ok {
+		return false
+	}
+	_, err := n.Int64()
+	return err == nil
+}
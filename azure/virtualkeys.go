@@ -0,0 +1,472 @@
+package azure
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/stulzq/azure-openai-proxy/util"
+)
+
+// virtualKeyPrefix starts every proxy-issued key, it tells them apart from azure keys in client configs
+const virtualKeyPrefix = "sk-proxy-"
+
+type VirtualKeysConfig struct {
+	File string `yaml:"file" mapstructure:"file"` // json file the proxy-issued keys are stored in, hashed, virtual keys are disabled when empty
+}
+
+// VirtualKey is a client key issued by the proxy through /admin/keys, the key itself is only shown on creation
+// and rotation, requests authenticate with it instead of an azure key
+type VirtualKey struct {
+	ID          string     `json:"id"` // stable across rotations, the key_id of the access log, policies and usage
+	Name        string     `json:"name"`
+	Models      []string   `json:"models"`           // models the key may use, empty allows every model
+	TokenQuota  int64      `json:"token_quota"`      // prompt and completion tokens per quota period, 0 is unlimited
+	QuotaPeriod string     `json:"quota_period"`     // day, month or empty for the lifetime of the key
+	Tenant      string     `json:"tenant,omitempty"` // requests with the key are served as this tenant
+	UsedTokens  int64      `json:"used_tokens"`      // tokens used in the current quota period
+	PeriodStart time.Time  `json:"period_start"`
+	Disabled    bool       `json:"disabled"`
+	Created     time.Time  `json:"created"`
+	Rotated     *time.Time `json:"rotated,omitempty"`
+}
+
+// storedVirtualKey is a key as written to the key file
+type storedVirtualKey struct {
+	VirtualKey
+	Hash string `json:"hash"`
+	// PreviousHash stays valid until PreviousExpires after a rotation with a grace period
+	PreviousHash    string     `json:"previous_hash,omitempty"`
+	PreviousExpires *time.Time `json:"previous_expires,omitempty"`
+}
+
+// virtualKeyStore holds the issued keys, the file is rewritten on every change and usage is saved when flushing
+type virtualKeyStore struct {
+	mu     sync.Mutex
+	path   string
+	keys   map[string]*storedVirtualKey // by id
+	hashes map[string]string            // id by key hash, rotated keys in their grace period included
+	dirty  bool
+}
+
+var virtualKeys = &virtualKeyStore{keys: map[string]*storedVirtualKey{}, hashes: map[string]string{}}
+
+// loadVirtualKeys reads the key file, a missing file starts without keys
+func loadVirtualKeys(path string) error {
+	store := &virtualKeyStore{path: path, keys: map[string]*storedVirtualKey{}, hashes: map[string]string{}}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "read virtual keys")
+		}
+		if len(data) > 0 {
+			var file struct {
+				Keys []*storedVirtualKey `json:"keys"`
+			}
+			if err := util.JSONUnmarshal(data, &file); err != nil {
+				return errors.Wrapf(err, "parse virtual keys %s", path)
+			}
+			for _, key := range file.Keys {
+				store.keys[key.ID] = key
+			}
+			store.index()
+		}
+	}
+	virtualKeys = store
+	return nil
+}
+
+func (s *virtualKeyStore) enabled() bool {
+	return s.path != ""
+}
+
+// index rebuilds the hash lookup, s.mu must be held
+func (s *virtualKeyStore) index() {
+	s.hashes = make(map[string]string, len(s.keys))
+	for id, key := range s.keys {
+		s.hashes[key.Hash] = id
+		if key.PreviousHash != "" {
+			s.hashes[key.PreviousHash] = id
+		}
+	}
+}
+
+// save writes the keys to the file, s.mu must be held
+func (s *virtualKeyStore) save() error {
+	keys := make([]*storedVirtualKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	data, err := util.JSONMarshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return errors.Wrap(err, "write virtual keys")
+	}
+	s.dirty = false
+	return nil
+}
+
+// flush saves the token usage of the keys, used with the usage flush
+func (s *virtualKeyStore) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.enabled() || !s.dirty {
+		return
+	}
+	if err := s.save(); err != nil {
+		util.Warnf("flush virtual key usage error: %v", err)
+	}
+}
+
+// lookup returns the key a token authenticates as, nil for unknown tokens and rotated keys past their grace period
+func (s *virtualKeyStore) lookup(token string) *storedVirtualKey {
+	if !s.enabled() || !strings.HasPrefix(token, virtualKeyPrefix) {
+		return nil
+	}
+	hash := hashVirtualKey(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.keys[s.hashes[hash]]
+	if key == nil {
+		return nil
+	}
+	if hash == key.PreviousHash && time.Now().After(*key.PreviousExpires) {
+		return nil
+	}
+	return key
+}
+
+// resetPeriod starts a new quota period when the current one is over, s.mu must be held
+func (key *storedVirtualKey) resetPeriod(now time.Time) {
+	start, ok := quotaPeriodStart(key.QuotaPeriod, now)
+	if ok && key.PeriodStart.Before(start) {
+		key.PeriodStart, key.UsedTokens = start, 0
+	}
+}
+
+// quotaPeriodStart returns the start of the day or month period containing now, false for other periods
+func quotaPeriodStart(period string, now time.Time) (time.Time, bool) {
+	now = now.UTC()
+	switch period {
+	case "day":
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), true
+	case "month":
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), true
+	}
+	return time.Time{}, false
+}
+
+// authorizeVirtualKey checks the proxy-issued key of a request when virtual keys are enabled, the key is removed
+// from the request so it never reaches azure, false when the request was answered with an error
+func authorizeVirtualKey(c *gin.Context, req *http.Request) (*VirtualKey, bool) {
+	if !virtualKeys.enabled() {
+		return nil, true
+	}
+	key := virtualKeys.lookup(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	if key == nil {
+		util.SendOpenAIError(c, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "", errors.New("invalid api key"))
+		return nil, false
+	}
+	req.Header.Del("Authorization")
+
+	virtualKeys.mu.Lock()
+	defer virtualKeys.mu.Unlock()
+	if key.Disabled {
+		util.SendOpenAIError(c, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "",
+			errors.Errorf("api key %s is disabled", key.ID))
+		return nil, false
+	}
+	key.resetPeriod(time.Now())
+	if key.TokenQuota > 0 && key.UsedTokens >= key.TokenQuota {
+		util.SendOpenAIError(c, http.StatusTooManyRequests, "insufficient_quota", "insufficient_quota", "",
+			errors.Errorf("api key %s used its quota of %d tokens", key.ID, key.TokenQuota))
+		return nil, false
+	}
+	copied := key.VirtualKey
+	return &copied, true
+}
+
+// callerVirtualKey returns the enabled virtual key of a request without authorizing it, for the routes that don't
+// call azure with the key of the caller, nil for other keys
+func callerVirtualKey(req *http.Request) *VirtualKey {
+	key := virtualKeys.lookup(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	if key == nil {
+		return nil
+	}
+	virtualKeys.mu.Lock()
+	defer virtualKeys.mu.Unlock()
+	if key.Disabled {
+		return nil
+	}
+	copied := key.VirtualKey
+	return &copied
+}
+
+// allowsModel tells whether the key may use the model
+func (key *VirtualKey) allowsModel(model string) bool {
+	return len(key.Models) == 0 || containsString(key.Models, model)
+}
+
+// consumeVirtualKey counts the tokens of a request against the quota of its key and alerts when it runs out
+func consumeVirtualKey(keyID string, tokens int64) {
+	if !virtualKeys.enabled() || tokens <= 0 {
+		return
+	}
+	virtualKeys.mu.Lock()
+	key := virtualKeys.keys[keyID]
+	if key == nil {
+		virtualKeys.mu.Unlock()
+		return
+	}
+	key.resetPeriod(time.Now())
+	before := key.UsedTokens
+	key.UsedTokens += tokens
+	virtualKeys.dirty = true
+	exceeded := key.TokenQuota > 0 && before < key.TokenQuota && key.UsedTokens >= key.TokenQuota
+	used, quota := key.UsedTokens, key.TokenQuota
+	virtualKeys.mu.Unlock()
+
+	if exceeded {
+		sendAlert(AlertQuotaExceeded, keyID, "key %s used %d of its %d tokens", keyID, used, quota)
+	}
+}
+
+func hashVirtualKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newVirtualKeySecret returns a new key and a new id
+func newVirtualKeySecret() (string, string, error) {
+	secret := make([]byte, 24)
+	id := make([]byte, 4)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	return virtualKeyPrefix + hex.EncodeToString(secret), hex.EncodeToString(id), nil
+}
+
+// virtualKeySettings are the settings of a key sent on creation and update, missing fields are kept on update
+type virtualKeySettings struct {
+	Name        *string   `json:"name"`
+	Models      *[]string `json:"models"`
+	TokenQuota  *int64    `json:"token_quota"`
+	QuotaPeriod *string   `json:"quota_period"`
+	Tenant      *string   `json:"tenant"`
+	Disabled    *bool     `json:"disabled"`
+}
+
+func (settings *virtualKeySettings) apply(key *VirtualKey) error {
+	if settings.Name != nil {
+		key.Name = *settings.Name
+	}
+	if settings.Models != nil {
+		key.Models = *settings.Models
+	}
+	if settings.TokenQuota != nil {
+		if *settings.TokenQuota < 0 {
+			return errors.New("token_quota must not be negative")
+		}
+		key.TokenQuota = *settings.TokenQuota
+	}
+	if settings.QuotaPeriod != nil {
+		switch *settings.QuotaPeriod {
+		case "", "day", "month":
+		default:
+			return errors.Errorf("quota_period must be day, month or empty, not %q", *settings.QuotaPeriod)
+		}
+		if key.QuotaPeriod != *settings.QuotaPeriod {
+			key.QuotaPeriod, key.PeriodStart, key.UsedTokens = *settings.QuotaPeriod, time.Time{}, 0
+		}
+	}
+	if settings.Tenant != nil {
+		if *settings.Tenant != "" {
+			deploymentsMu.RLock()
+			_, ok := tenants[*settings.Tenant]
+			deploymentsMu.RUnlock()
+			if !ok {
+				return errors.Errorf("unknown tenant %q", *settings.Tenant)
+			}
+		}
+		key.Tenant = *settings.Tenant
+	}
+	if settings.Disabled != nil {
+		key.Disabled = *settings.Disabled
+	}
+	return nil
+}
+
+// VirtualKeysHandler lists the keys on GET and issues one on POST with {"name": "...", "models": ["gpt-4"],
+// "token_quota": 100000, "quota_period": "day"}, the answer of the POST is the only time the key is shown
+func VirtualKeysHandler(c *gin.Context) {
+	if !virtualKeys.enabled() {
+		sendVirtualKeysDisabled(c)
+		return
+	}
+	if c.Request.Method == http.MethodPost {
+		var settings virtualKeySettings
+		if err := util.NewJSONDecoder(c.Request.Body).Decode(&settings); err != nil {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+			return
+		}
+		secret, id, err := newVirtualKeySecret()
+		if err != nil {
+			util.SendError(c, err)
+			return
+		}
+		key := &storedVirtualKey{VirtualKey: VirtualKey{ID: id, Models: []string{}, Created: time.Now().UTC()}, Hash: hashVirtualKey(secret)}
+		if err := settings.apply(&key.VirtualKey); err != nil {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+			return
+		}
+
+		virtualKeys.mu.Lock()
+		defer virtualKeys.mu.Unlock()
+		virtualKeys.keys[id] = key
+		virtualKeys.hashes[key.Hash] = id
+		if err := virtualKeys.save(); err != nil {
+			delete(virtualKeys.keys, id)
+			delete(virtualKeys.hashes, key.Hash)
+			util.SendOpenAIError(c, http.StatusInternalServerError, "server_error", "key_not_written", "", err)
+			return
+		}
+		util.Warnf("virtual key %s (%s) issued", id, key.Name)
+		util.SendJSON(c, http.StatusCreated, gin.H{"key": key.VirtualKey, "secret": secret})
+		return
+	}
+
+	virtualKeys.mu.Lock()
+	defer virtualKeys.mu.Unlock()
+	keys := make([]VirtualKey, 0, len(virtualKeys.keys))
+	for _, key := range virtualKeys.keys {
+		key.resetPeriod(time.Now())
+		keys = append(keys, key.VirtualKey)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	util.SendJSON(c, http.StatusOK, gin.H{"object": "list", "data": keys})
+}
+
+// VirtualKeyHandler shows a key on GET and changes its settings on PATCH, {"disabled": true} disables it
+func VirtualKeyHandler(c *gin.Context) {
+	if !virtualKeys.enabled() {
+		sendVirtualKeysDisabled(c)
+		return
+	}
+	var settings virtualKeySettings
+	if c.Request.Method == http.MethodPatch {
+		if err := util.NewJSONDecoder(c.Request.Body).Decode(&settings); err != nil {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+			return
+		}
+	}
+
+	virtualKeys.mu.Lock()
+	defer virtualKeys.mu.Unlock()
+	key := virtualKeys.keys[c.Param("id")]
+	if key == nil {
+		sendVirtualKeyNotFound(c)
+		return
+	}
+	if c.Request.Method == http.MethodPatch {
+		updated := key.VirtualKey
+		if err := settings.apply(&updated); err != nil {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+			return
+		}
+		previous := key.VirtualKey
+		key.VirtualKey = updated
+		if err := virtualKeys.save(); err != nil {
+			key.VirtualKey = previous
+			util.SendOpenAIError(c, http.StatusInternalServerError, "server_error", "key_not_written", "", err)
+			return
+		}
+		if previous.Disabled != updated.Disabled {
+			util.Warnf("virtual key %s disabled: %t", key.ID, updated.Disabled)
+		}
+	}
+	key.resetPeriod(time.Now())
+	util.SendJSON(c, http.StatusOK, gin.H{"key": key.VirtualKey})
+}
+
+// RotateVirtualKeyHandler replaces a key on POST, the previous key stops working at once or, with
+// {"grace": "1h"}, once the grace period is over
+func RotateVirtualKeyHandler(c *gin.Context) {
+	if !virtualKeys.enabled() {
+		sendVirtualKeysDisabled(c)
+		return
+	}
+	var body struct {
+		Grace string `json:"grace"`
+	}
+	if err := util.NewJSONDecoder(c.Request.Body).Decode(&body); err != nil && err != io.EOF {
+		util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "", err)
+		return
+	}
+	var grace time.Duration
+	if body.Grace != "" {
+		var err error
+		if grace, err = time.ParseDuration(body.Grace); err != nil || grace < 0 {
+			util.SendOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_value", "grace",
+				errors.Errorf("invalid grace %q", body.Grace))
+			return
+		}
+	}
+	secret, _, err := newVirtualKeySecret()
+	if err != nil {
+		util.SendError(c, err)
+		return
+	}
+
+	virtualKeys.mu.Lock()
+	defer virtualKeys.mu.Unlock()
+	key := virtualKeys.keys[c.Param("id")]
+	if key == nil {
+		sendVirtualKeyNotFound(c)
+		return
+	}
+	previous := *key
+	now := time.Now().UTC()
+	key.Hash, key.PreviousHash, key.PreviousExpires, key.Rotated = hashVirtualKey(secret), "", nil, &now
+	if grace > 0 {
+		expires := now.Add(grace)
+		key.PreviousHash, key.PreviousExpires = previous.Hash, &expires
+	}
+	virtualKeys.index()
+	if err := virtualKeys.save(); err != nil {
+		*key = previous
+		virtualKeys.index()
+		util.SendOpenAIError(c, http.StatusInternalServerError, "server_error", "key_not_written", "", err)
+		return
+	}
+	util.Warnf("virtual key %s rotated, the previous key is valid for %s", key.ID, grace)
+	util.SendJSON(c, http.StatusOK, gin.H{"key": key.VirtualKey, "secret": secret})
+}
+
+func sendVirtualKeysDisabled(c *gin.Context) {
+	util.SendOpenAIError(c, http.StatusNotFound, "invalid_request_error", "virtual_keys_disabled", "",
+		errors.New("virtual keys are disabled, set virtual_keys.file to enable them"))
+}
+
+func sendVirtualKeyNotFound(c *gin.Context) {
+	util.SendOpenAIError(c, http.StatusNotFound, "invalid_request_error", "key_not_found", "id",
+		errors.Errorf("virtual key %s not found", c.Param("id")))
+}
@@ -0,0 +1,150 @@
+package azure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	_ "image/gif"
+
+	"golang.org/x/image/draw"
+)
+
+type VisionConfig struct {
+	MaxImages          int  `yaml:"max_images" mapstructure:"max_images"`                       // max image parts per request, 0 means unlimited
+	MaxImageBytes      int  `yaml:"max_image_bytes" mapstructure:"max_image_bytes"`             // max decoded size of a base64 image, 0 means unlimited
+	MaxTotalImageBytes int  `yaml:"max_total_image_bytes" mapstructure:"max_total_image_bytes"` // max decoded size of all base64 images, 0 means unlimited
+	Downscale          bool `yaml:"downscale" mapstructure:"downscale"`                         // downscale base64 images over max_image_bytes instead of rejecting
+}
+
+const maxDownscaleSteps = 6
+
+// maxDownscalePixels bounds the images decoded for downscaling, a small file may declare a huge canvas
+const maxDownscalePixels = 4096 * 4096
+
+// rewriteVision validates image parts of chat messages and downscales oversized base64 images if enabled
+func rewriteVision(rc *rewriteContext, payload map[string]interface{}) (bool, error) {
+	cfg := C.Vision
+	if !isChatCompletions(rc.req) || (cfg.MaxImages == 0 && cfg.MaxImageBytes == 0 && cfg.MaxTotalImageBytes == 0) {
+		return false, nil
+	}
+
+	changed := false
+	images, totalBytes := 0, 0
+	messages, _ := payload["messages"].([]interface{})
+	for i, item := range messages {
+		message, _ := item.(map[string]interface{})
+		parts, _ := message["content"].([]interface{})
+		for j, p := range parts {
+			part, _ := p.(map[string]interface{})
+			if part == nil || part["type"] != "image_url" {
+				continue
+			}
+			param := fmt.Sprintf("messages[%d].content[%d]", i, j)
+
+			images++
+			if cfg.MaxImages > 0 && images > cfg.MaxImages {
+				return false, newRequestError(param, "too many images, at most %d images are allowed per request", cfg.MaxImages)
+			}
+
+			imageUrl, _ := part["image_url"].(map[string]interface{})
+			mediaType, data, ok := parseDataUrl(stringValue(imageUrl["url"]))
+			if !ok {
+				continue
+			}
+			if cfg.MaxImageBytes > 0 && len(data) > cfg.MaxImageBytes {
+				if !cfg.Downscale {
+					return false, newRequestError(param, "image is %s, the limit is %s", formatBytes(len(data)), formatBytes(cfg.MaxImageBytes))
+				}
+				scaled, scaledType, err := downscaleImage(data, mediaType, cfg.MaxImageBytes)
+				if err != nil {
+					return false, newRequestError(param, "image is %s and could not be downscaled below %s: %s",
+						formatBytes(len(data)), formatBytes(cfg.MaxImageBytes), err.Error())
+				}
+				rc.debugf("downscaled %s from %s to %s", param, formatBytes(len(data)), formatBytes(len(scaled)))
+				data = scaled
+				imageUrl["url"] = "data:" + scaledType + ";base64," + base64.StdEncoding.EncodeToString(scaled)
+				changed = true
+			}
+
+			totalBytes += len(data)
+			if cfg.MaxTotalImageBytes > 0 && totalBytes > cfg.MaxTotalImageBytes {
+				return false, newRequestError(param, "images exceed the total limit of %s per request", formatBytes(cfg.MaxTotalImageBytes))
+			}
+		}
+	}
+	return changed, nil
+}
+
+// parseDataUrl decodes a base64 data url like data:image/png;base64,xxx
+func parseDataUrl(url string) (string, []byte, bool) {
+	if !strings.HasPrefix(url, "data:") {
+		return "", nil, false
+	}
+	meta, encoded, found := strings.Cut(url[len("data:"):], ",")
+	if !found || !strings.HasSuffix(meta, ";base64") {
+		return "", nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, false
+	}
+	return strings.TrimSuffix(meta, ";base64"), data, true
+}
+
+// downscaleImage shrinks the image until its encoding fits into maxBytes, png stays png and everything else becomes jpeg
+func downscaleImage(data []byte, mediaType string, maxBytes int) ([]byte, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > maxDownscalePixels {
+		return nil, "", fmt.Errorf("%dx%d pixels exceed the limit of %d pixels", config.Width, config.Height, maxDownscalePixels)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	for i := 0; i < maxDownscaleSteps; i++ {
+		width, height = width*3/4, height*3/4
+		if width == 0 || height == 0 {
+			break
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+		buf := new(bytes.Buffer)
+		outType := "image/jpeg"
+		if mediaType == "image/png" {
+			outType = mediaType
+			err = png.Encode(buf, dst)
+		} else {
+			err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: 85})
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if buf.Len() <= maxBytes {
+			return buf.Bytes(), outType, nil
+		}
+	}
+	return nil, "", fmt.Errorf("gave up after %d steps", maxDownscaleSteps)
+}
+
+func formatBytes(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -8,6 +8,6 @@ rm -rf bin
 
 export GOOS=linux
 export GOARCH=amd64
-go build -trimpath -ldflags "-s -w" -o bin/azure-openai-proxy ./cmd
+go build -trimpath -ldflags "-s -w -X main.version=$VERSION -X main.gitCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" -o bin/azure-openai-proxy ./cmd
 
 docker build -t stulzq/azure-openai-proxy:$VERSION .
\ No newline at end of file
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+func inheritedFiles() []*os.File {
+	return nil
+}
@@ -0,0 +1,54 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd, see sd_listen_fds(3)
+const listenFdsStart = 3
+
+// inheritedFiles returns the sockets passed by systemd socket activation, named after LISTEN_FDNAMES, nil when the
+// process wasn't socket activated. The LISTEN_ variables are unset so processes started by the proxy don't take them
+func inheritedFiles() []*os.File {
+	names := listenFdNames(os.Getenv, os.Getpid())
+	if names == nil {
+		return nil
+	}
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(name)
+	}
+
+	files := make([]*os.File, 0, len(names))
+	for i, name := range names {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	return files
+}
+
+// listenFdNames returns the names of the sockets passed to the process pid by the LISTEN_ variables, one per
+// descriptor and unknown when unnamed, nil when they are missing or meant for another process
+func listenFdNames(getenv func(string) string, pid int) []string {
+	if listenPid, err := strconv.Atoi(getenv("LISTEN_PID")); err != nil || listenPid != pid {
+		return nil
+	}
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil
+	}
+	fdNames := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	names := make([]string, count)
+	for i := range names {
+		names[i] = "unknown"
+		if i < len(fdNames) && fdNames[i] != "" {
+			names[i] = fdNames[i]
+		}
+	}
+	return names
+}
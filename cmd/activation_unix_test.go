@@ -0,0 +1,76 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenFdNames(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(name string) string { return vars[name] }
+	}
+
+	assert.Nil(t, listenFdNames(env(nil), 42))
+	assert.Nil(t, listenFdNames(env(map[string]string{"LISTEN_PID": "41", "LISTEN_FDS": "1"}), 42))
+	assert.Nil(t, listenFdNames(env(map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "0"}), 42))
+	assert.Nil(t, listenFdNames(env(map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "x"}), 42))
+	assert.Equal(t, []string{"unknown"}, listenFdNames(env(map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "1"}), 42))
+	assert.Equal(t, []string{"api", "metrics", "unknown"}, listenFdNames(env(map[string]string{
+		"LISTEN_PID": "42", "LISTEN_FDS": "3", "LISTEN_FDNAMES": "api:metrics",
+	}), 42))
+	assert.Equal(t, []string{"unknown", "metrics"}, listenFdNames(env(map[string]string{
+		"LISTEN_PID": "42", "LISTEN_FDS": "2", "LISTEN_FDNAMES": ":metrics:extra",
+	}), 42))
+}
+
+// inheritedSocket opens a socket on a free port named like a descriptor passed by systemd
+func inheritedSocket(t *testing.T, name string) (*os.File, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return os.NewFile(uintptr(fd), name), ln.Addr().String()
+}
+
+func TestActivatedListener(t *testing.T) {
+	metrics, metricsAddr := inheritedSocket(t, "metrics")
+	api, apiAddr := inheritedSocket(t, "unknown")
+	unused, _ := inheritedSocket(t, "metrics")
+	activatedOnce.Do(func() {})
+	activatedFiles = []*os.File{metrics, api, unused}
+	defer func() { activatedFiles = nil }()
+
+	ln, err := activatedListener("api")
+	if assert.NoError(t, err) && assert.NotNil(t, ln) {
+		assert.Equal(t, apiAddr, ln.Addr().String())
+		ln.Close()
+	}
+	ln, err = activatedListener("metrics")
+	if assert.NoError(t, err) && assert.NotNil(t, ln) {
+		assert.Equal(t, metricsAddr, ln.Addr().String())
+		ln.Close()
+	}
+	ln, err = activatedListener("api")
+	assert.NoError(t, err)
+	assert.Nil(t, ln)
+
+	closeActivatedFiles()
+	assert.Equal(t, []*os.File{nil, nil, nil}, activatedFiles)
+	assert.Error(t, unused.Close())
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	activatedOnce  sync.Once
+	activatedFiles []*os.File
+)
+
+// listen opens the listener of srv, with reusePort a new process can bind the same address while the
+// old one drains its connections, so binaries are rolled without refusing connections. Under systemd socket
+// activation the inherited socket is used instead, systemd keeps it open and queues connections across restarts
+func listen(srv *http.Server) (net.Listener, error) {
+	if ln, err := activatedListener("api"); ln != nil || err != nil {
+		return ln, err
+	}
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	config := net.ListenConfig{}
+	if viper.GetBool("reusePort") {
+		config.Control = reusePortControl
+	}
+	return config.Listen(context.Background(), "tcp", addr)
+}
+
+// activatedListener returns the socket passed by systemd for the role, api or metrics, nil without socket
+// activation. The metrics socket is the one named metrics with FileDescriptorName=, the api socket the first other one
+func activatedListener(role string) (net.Listener, error) {
+	activatedOnce.Do(func() {
+		activatedFiles = inheritedFiles()
+	})
+	for i, f := range activatedFiles {
+		if f == nil || (f.Name() == "metrics") != (role == "metrics") {
+			continue
+		}
+		activatedFiles[i] = nil
+		ln, err := net.FileListener(f)
+		// the listener holds a duplicate of the descriptor
+		_ = f.Close()
+		return ln, err
+	}
+	return nil, nil
+}
+
+// closeActivatedFiles closes the inherited sockets neither the api nor the metrics listener took, e.g. a second
+// metrics socket, so they don't stay open unserved for the life of the process
+func closeActivatedFiles() {
+	for i, f := range activatedFiles {
+		if f == nil {
+			continue
+		}
+		log.Printf("closing unused socket %s passed by systemd\n", f.Name())
+		_ = f.Close()
+		activatedFiles[i] = nil
+	}
+}
@@ -3,17 +3,27 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/stulzq/azure-openai-proxy/azure"
+	"github.com/stulzq/azure-openai-proxy/constant"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
@@ -22,53 +32,246 @@ var (
 	gitCommit = ""
 )
 
+func init() {
+	// builds without ldflags still know their commit from the embedded vcs info
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && gitCommit == "":
+			gitCommit = setting.Value
+		case setting.Key == "vcs.time" && buildDate == "":
+			buildDate = setting.Value
+		}
+	}
+	if version == "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+}
+
 func main() {
 	viper.AutomaticEnv()
 	parseFlag()
+	if viper.GetBool("print-config") {
+		os.Exit(printConfig(os.Stdout, os.Stderr))
+	}
 
 	err := azure.Init()
 	if err != nil {
 		panic(err)
 	}
+	log.Printf("azure-openai-proxy version=%s commit=%s built=%s features=%s\n",
+		version, gitCommit, buildDate, strings.Join(azure.EnabledFeatures(), ","))
 
 	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
-	registerRoute(r)
+	r := gin.New()
+	r.Use(gin.Logger(), azure.RequestID(), azure.Recovery())
+	metricsListener, err := listenMetrics()
+	if err != nil {
+		panic(errors.Errorf("listen metrics: %s\n", err))
+	}
+	registerRoute(r, metricsListener == nil)
 
 	srv := &http.Server{
-		Addr:    viper.GetString("listen"),
+		Addr:    listenAddr(),
 		Handler: r,
 	}
+	// cleartext http/2 for load balancers talking h2c to the proxy
+	if viper.GetBool("h2c") {
+		srv.Handler = h2c.NewHandler(r, &http2.Server{})
+	}
 
+	if metricsListener != nil {
+		metrics := serveMetrics(metricsListener)
+		defer metrics.Close()
+	}
 	runServer(srv)
 }
 
+// listenAddr is the address of --listen, or all interfaces with --port or PORT
+func listenAddr() string {
+	if port := viper.GetInt("port"); port > 0 {
+		return ":" + strconv.Itoa(port)
+	}
+	return viper.GetString("listen")
+}
+
+// listenMetrics opens the listener of /metrics when it is served apart from the api, from --metrics-addr or the
+// socket named metrics under systemd socket activation, nil otherwise
+func listenMetrics() (net.Listener, error) {
+	if ln, err := activatedListener("metrics"); ln != nil || err != nil {
+		return ln, err
+	}
+	if addr := viper.GetString("metrics-addr"); addr != "" {
+		return net.Listen("tcp", addr)
+	}
+	return nil, nil
+}
+
+// serveMetrics serves /metrics on its own listener, away from the api
+func serveMetrics(ln net.Listener) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: ln.Addr().String(), Handler: mux}
+	go func() {
+		log.Printf("Metrics listening at %s\n", srv.Addr)
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			panic(errors.Errorf("listen metrics: %s\n", err))
+		}
+	}()
+	return srv
+}
+
+// printConfig prints the configuration the proxy would run with, flags and environment variables applied and
+// credentials redacted, it returns the exit code
+func printConfig(stdout, stderr io.Writer) int {
+	if err := azure.LoadConfig(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	out, err := azure.MarshalRedactedConfig(azure.EffectiveConfig())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	_, _ = stdout.Write(out)
+	return 0
+}
+
 func runServer(srv *http.Server) {
+	certFile, keyFile := viper.GetString("tlsCertFile"), viper.GetString("tlsKeyFile")
+	ln, err := listen(srv)
+	if err != nil {
+		panic(errors.Errorf("listen: %s\n", err))
+	}
+	closeActivatedFiles()
 	go func() {
-		log.Printf("Server listening at %s\n", srv.Addr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if certFile != "" && keyFile != "" {
+			// http/2 is negotiated automatically over tls
+			log.Printf("Server listening at %s (https)\n", ln.Addr())
+			err = srv.ServeTLS(ln, certFile, keyFile)
+		} else {
+			log.Printf("Server listening at %s\n", ln.Addr())
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			panic(errors.Errorf("listen: %s\n", err))
 		}
 	}()
 
+	go reloadOnHangup()
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
+	// fail readiness first so load balancers stop sending new requests while in-flight ones complete
+	azure.SetDraining()
+	if delay := viper.GetDuration("drainDelay"); delay > 0 {
+		log.Printf("Draining for %s...\n", delay)
+		time.Sleep(delay)
+	}
+	// Shutdown waits for in-flight requests including open streams, shutdownTimeout bounds the wait
 	log.Println("Server Shutdown...")
-	if err := srv.Shutdown(context.Background()); err != nil {
-		log.Fatal("Server Shutdown:", err)
+	ctx := context.Background()
+	if timeout := viper.GetDuration("shutdownTimeout"); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Server Shutdown:", err)
+		_ = srv.Close()
+	}
+	azure.FlushUsage()
+	azure.FlushAppInsights()
+	azure.CloseEvents()
+	if err := azure.ShutdownTracing(context.Background()); err != nil {
+		log.Println("Tracing Shutdown:", err)
 	}
 	log.Println("Server exiting")
 }
 
+// reloadOnHangup reloads the config file on SIGHUP, like POST /admin/reload
+func reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if _, err := azure.ReloadConfig(); err != nil {
+			log.Println("Config Reload:", err)
+		}
+	}
+}
+
 func parseFlag() {
-	pflag.StringP("configFile", "c", "config.yaml", "config file")
+	// the kebab-case flags mirror environment variables and config file settings and override both
+	pflag.CommandLine.SetNormalizeFunc(func(f *pflag.FlagSet, name string) pflag.NormalizedName {
+		if name == "config" {
+			name = "configFile"
+		}
+		return pflag.NormalizedName(name)
+	})
+	pflag.StringP("configFile", "c", "config.yaml", "config file, also --config")
 	pflag.StringP("listen", "l", ":8080", "listen address")
+	pflag.Int("port", 0, "listen on this port of all interfaces instead of --listen, also PORT")
+	pflag.String("metrics-addr", "", "serve /metrics on this address instead of the listen address")
+	pflag.String("log-level", "", "debug, info, warn or error, overrides log_level")
+	pflag.String("api-base", "", "path prefix of the openai api, overrides api_base")
+	pflag.String("json-engine", "", "sonic or std, overrides json_engine")
+	pflag.String("admin-token", "", "bearer token of the /admin endpoints, overrides admin.token")
+	pflag.String("endpoint", "", "azure openai endpoint, overrides "+constant.ENV_AZURE_OPENAI_ENDPOINT)
+	pflag.String("api-version", "", "azure openai api version, overrides "+constant.ENV_AZURE_OPENAI_API_VER)
+	pflag.String("model-mapper", "", "model=deployment pairs, overrides "+constant.ENV_AZURE_OPENAI_MODEL_MAPPER)
+	pflag.String("http-proxy", "", "http proxy to azure, overrides "+constant.ENV_AZURE_OPENAI_HTTP_PROXY)
+	pflag.String("socks-proxy", "", "socks5 proxy to azure, overrides "+constant.ENV_AZURE_OPENAI_SOCKS_PROXY)
+	pflag.Bool("print-config", false, "print the effective configuration with credentials redacted and exit")
+	pflag.String("tlsCertFile", "", "tls certificate file, serves https and http/2")
+	pflag.String("tlsKeyFile", "", "tls private key file")
+	pflag.Bool("h2c", false, "serve cleartext http/2 (h2c)")
+	pflag.Duration("drainDelay", 0, "time /readyz fails before the server shuts down")
+	pflag.Duration("shutdownTimeout", 0, "max wait for in-flight requests and streams on shutdown, 0 waits for all of them")
+	pflag.Bool("reusePort", false, "listen with SO_REUSEPORT so a new binary can take over the address while this one drains")
+	pflag.Bool("mock", false, "serve fake completions without calling azure, for local development and CI")
+	pflag.String("convertLiteLLM", "", "print the deployment_config of a litellm config.yaml and exit")
+	pflag.Bool("live", false, "with validate, make a tiny call against every deployment")
+	pflag.Duration("liveTimeout", 10*time.Second, "with validate --live, timeout of the call against a deployment")
 	pflag.BoolP("version", "v", false, "version information")
 	pflag.Parse()
-	if err := viper.BindPFlags(pflag.CommandLine); err != nil {
-		panic(err)
+	// --mock is bound apart from the mock section of the config file, a bool there fails decoding the file
+	pflag.VisitAll(func(f *pflag.Flag) {
+		key := f.Name
+		if key == "mock" {
+			key = "mock_upstream"
+		}
+		if err := viper.BindPFlag(key, f); err != nil {
+			panic(err)
+		}
+	})
+	_ = viper.BindEnv("mock_upstream", "MOCK")
+	for key, flag := range map[string]string{
+		"log_level":                            "log-level",
+		"api_base":                             "api-base",
+		"json_engine":                          "json-engine",
+		"admin.token":                          "admin-token",
+		constant.ENV_AZURE_OPENAI_ENDPOINT:     "endpoint",
+		constant.ENV_AZURE_OPENAI_API_VER:      "api-version",
+		constant.ENV_AZURE_OPENAI_MODEL_MAPPER: "model-mapper",
+	} {
+		if err := viper.BindPFlag(key, pflag.Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
+	// the outbound proxies are read from the environment when the transports are built
+	for env, flag := range map[string]string{
+		constant.ENV_AZURE_OPENAI_HTTP_PROXY:  "http-proxy",
+		constant.ENV_AZURE_OPENAI_SOCKS_PROXY: "socks-proxy",
+	} {
+		if value := viper.GetString(flag); value != "" {
+			_ = os.Setenv(env, value)
+		}
 	}
 	if viper.GetBool("v") {
 		fmt.Println("version:", version)
@@ -76,4 +279,37 @@ func parseFlag() {
 		fmt.Println("gitCommit:", gitCommit)
 		os.Exit(0)
 	}
+	// azure-openai-proxy validate [-c config.yaml] [--live] checks the config and exits
+	if pflag.Arg(0) == "validate" {
+		os.Exit(validate(os.Stdout, os.Stderr))
+	}
+	if file := viper.GetString("convertLiteLLM"); file != "" {
+		if err := convertLiteLLM(file); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+}
+
+// convertLiteLLM prints the deployments of a litellm config.yaml in the format of deployment_config, secrets of
+// the environment are redacted, they and the entries that can't be converted are reported on stderr
+func convertLiteLLM(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	deployments, warnings, err := azure.ConvertLiteLLMConfigRedacted(data)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	out, err := azure.MarshalDeploymentConfig(deployments)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
 }
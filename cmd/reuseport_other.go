@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("reusePort is only supported on unix systems")
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"runtime"
+
 	"github.com/gin-gonic/gin"
-	"github.com/spf13/viper"
 	"github.com/stulzq/azure-openai-proxy/azure"
+	"github.com/stulzq/azure-openai-proxy/util"
 )
 
-// registerRoute registers all routes
-func registerRoute(r *gin.Engine) {
+// registerRoute registers all routes, /metrics only when it isn't served on a listener of its own
+func registerRoute(r *gin.Engine, metrics bool) {
 	// https://platform.openai.com/docs/api-reference
 	r.HEAD("/", func(c *gin.Context) {
 		c.Status(200)
@@ -15,15 +17,18 @@ func registerRoute(r *gin.Engine) {
 	r.Any("/health", func(c *gin.Context) {
 		c.Status(200)
 	})
-	apiBase := viper.GetString("api_base")
-	stripPrefixConverter := azure.NewStripPrefixConverter(apiBase)
-	r.GET(stripPrefixConverter.Prefix+"/models", azure.ModelProxy)
-	templateConverter := azure.NewTemplateConverter("/openai/deployments/{{.DeploymentName}}/embeddings")
-	apiBasedRouter := r.Group(apiBase)
-	{
-		apiBasedRouter.Any("/engines/:model/embeddings", azure.ProxyWithConverter(templateConverter))
-		apiBasedRouter.Any("/completions", azure.ProxyWithConverter(stripPrefixConverter))
-		apiBasedRouter.Any("/chat/completions", azure.ProxyWithConverter(stripPrefixConverter))
-		apiBasedRouter.Any("/embeddings", azure.ProxyWithConverter(stripPrefixConverter))
+	azure.RegisterHealthRoutes(r)
+	if metrics {
+		azure.RegisterMetricsRoute(r)
 	}
+	r.GET("/version", func(c *gin.Context) {
+		util.SendJSON(c, 200, gin.H{
+			"version":    version,
+			"git_commit": gitCommit,
+			"build_date": buildDate,
+			"go_version": runtime.Version(),
+			"features":   azure.EnabledFeatures(),
+		})
+	})
+	azure.RegisterRoutes(r)
 }
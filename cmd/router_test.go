@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionRoute(t *testing.T) {
+	defer func(v, c, d string) { version, gitCommit, buildDate = v, c, d }(version, gitCommit, buildDate)
+	version, gitCommit, buildDate = "v1.2.3", "abc1234", "2024-05-01T10:00:00Z"
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerRoute(r, false)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/json")
+	var info struct {
+		Version   string   `json:"version"`
+		GitCommit string   `json:"git_commit"`
+		BuildDate string   `json:"build_date"`
+		GoVersion string   `json:"go_version"`
+		Features  []string `json:"features"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, "v1.2.3", info.Version)
+	assert.Equal(t, "abc1234", info.GitCommit)
+	assert.Equal(t, "2024-05-01T10:00:00Z", info.BuildDate)
+	assert.Equal(t, runtime.Version(), info.GoVersion)
+	assert.NotNil(t, info.Features)
+}
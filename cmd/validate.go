@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stulzq/azure-openai-proxy/azure"
+)
+
+// validate checks the config file before it is rolled out: schema and setting errors are printed with their line,
+// with --live every deployment gets a tiny call checking the key, the api-version and the deployment name,
+// it returns the exit code, 1 when anything is wrong
+func validate(stdout, stderr io.Writer) int {
+	path := azure.ConfigFilePath()
+	config, problems, err := azure.CheckConfigFile(path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	name := filepath.Base(path)
+	for _, problem := range problems {
+		if problem.Line > 0 {
+			fmt.Fprintf(stderr, "%s:%d: %s\n", name, problem.Line, problem.Message)
+		} else {
+			fmt.Fprintf(stderr, "%s: %s\n", name, problem.Message)
+		}
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(stderr, "%s: %d problems\n", name, len(problems))
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: ok, %d deployments\n", name, len(config.DeploymentConfig))
+	if !viper.GetBool("live") {
+		return 0
+	}
+
+	timeout := viper.GetDuration("liveTimeout")
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	checks, err := azure.CheckDeployments(config, timeout)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	code := 0
+	for _, check := range checks {
+		line := fmt.Sprintf("%-8s %s (deployment %s)", check.Status, check.Model, check.Deployment)
+		if check.Detail != "" {
+			line += ": " + check.Detail
+		}
+		if check.Status == azure.CheckFailed {
+			code = 1
+			fmt.Fprintln(stderr, line)
+		} else {
+			fmt.Fprintln(stdout, line)
+		}
+	}
+	return code
+}
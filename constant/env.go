@@ -7,4 +7,6 @@ const (
 
 	ENV_AZURE_OPENAI_HTTP_PROXY  = "AZURE_OPENAI_HTTP_PROXY"
 	ENV_AZURE_OPENAI_SOCKS_PROXY = "AZURE_OPENAI_SOCKS_PROXY"
+
+	ENV_AZURE_OPENAI_JSON_ENGINE = "AZURE_OPENAI_JSON_ENGINE"
 )
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bytedance/sonic"
+)
+
+const (
+	JSONEngineSonic = "sonic"
+	JSONEngineStd   = "std"
+)
+
+// JSONDecoder is the part of json.Decoder used by the proxy
+type JSONDecoder interface {
+	Decode(v interface{}) error
+	UseNumber()
+}
+
+// JSONEngine encodes and decodes every json body and payload of the proxy
+type JSONEngine interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	NewDecoder(r io.Reader) JSONDecoder
+}
+
+type stdEngine struct{}
+
+func (stdEngine) Name() string {
+	return JSONEngineStd
+}
+
+func (stdEngine) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (stdEngine) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (stdEngine) NewDecoder(r io.Reader) JSONDecoder {
+	return json.NewDecoder(r)
+}
+
+// sonicEngine uses the encoding/json compatible config of sonic, output is the same as with the standard library,
+// on architectures without sonic support it falls back to encoding/json itself
+type sonicEngine struct{}
+
+func (sonicEngine) Name() string {
+	return JSONEngineSonic
+}
+
+func (sonicEngine) Marshal(v interface{}) ([]byte, error) {
+	return sonic.ConfigStd.Marshal(v)
+}
+
+func (sonicEngine) Unmarshal(data []byte, v interface{}) error {
+	return sonic.ConfigStd.Unmarshal(data, v)
+}
+
+func (sonicEngine) NewDecoder(r io.Reader) JSONDecoder {
+	return sonic.ConfigStd.NewDecoder(r)
+}
+
+var jsonEngine JSONEngine = sonicEngine{}
+
+// ParseJSONEngine parses sonic or std, empty is sonic
+func ParseJSONEngine(name string) (JSONEngine, error) {
+	switch strings.ToLower(name) {
+	case JSONEngineSonic, "":
+		return sonicEngine{}, nil
+	case JSONEngineStd, "encoding/json":
+		return stdEngine{}, nil
+	}
+	return nil, fmt.Errorf("unknown json engine %q, use sonic or std", name)
+}
+
+// SetJSONEngine changes the json engine, it must be called before serving requests
+func SetJSONEngine(engine JSONEngine) {
+	jsonEngine = engine
+}
+
+func GetJSONEngine() JSONEngine {
+	return jsonEngine
+}
+
+// JSONMarshal encodes v with the configured json engine
+func JSONMarshal(v interface{}) ([]byte, error) {
+	return jsonEngine.Marshal(v)
+}
+
+// JSONUnmarshal decodes data with the configured json engine
+func JSONUnmarshal(data []byte, v interface{}) error {
+	return jsonEngine.Unmarshal(data, v)
+}
+
+// NewJSONDecoder returns a decoder of the configured json engine
+func NewJSONDecoder(r io.Reader) JSONDecoder {
+	return jsonEngine.NewDecoder(r)
+}
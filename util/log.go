@@ -0,0 +1,93 @@
+package util
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(int32(LevelInfo))
+}
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// ParseLogLevel parses debug, info, warn or error
+func ParseLogLevel(level string) (LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, use debug, info, warn or error", level)
+}
+
+// SetLogLevel changes the minimum level logged, safe to call at any time
+func SetLogLevel(level LogLevel) {
+	logLevel.Store(int32(level))
+}
+
+func GetLogLevel() LogLevel {
+	return LogLevel(logLevel.Load())
+}
+
+// Enabled tells whether messages of the level are logged
+func Enabled(level LogLevel) bool {
+	return level >= GetLogLevel()
+}
+
+func logf(level LogLevel, prefix, format string, args ...interface{}) {
+	if !Enabled(level) {
+		return
+	}
+	log.Output(3, prefix+fmt.Sprintf(format, args...))
+}
+
+func Debugf(format string, args ...interface{}) {
+	logf(LevelDebug, "DEBUG ", format, args...)
+}
+
+// ForceDebugf logs a debug message whatever the log level, for requests debugged on their own
+func ForceDebugf(format string, args ...interface{}) {
+	log.Output(2, "DEBUG "+fmt.Sprintf(format, args...))
+}
+
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, "", format, args...)
+}
+
+func Warnf(format string, args ...interface{}) {
+	logf(LevelWarn, "WARN ", format, args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	logf(LevelError, "ERROR ", format, args...)
+}
@@ -0,0 +1,48 @@
+package util
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevel(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	defer SetLogLevel(GetLogLevel())
+
+	level, err := ParseLogLevel("WARNING")
+	assert.NoError(t, err)
+	assert.Equal(t, LevelWarn, level)
+	level, err = ParseLogLevel("")
+	assert.NoError(t, err)
+	assert.Equal(t, LevelInfo, level)
+	_, err = ParseLogLevel("verbose")
+	assert.Error(t, err)
+
+	// messages below the level are dropped
+	SetLogLevel(LevelWarn)
+	assert.False(t, Enabled(LevelInfo))
+	assert.True(t, Enabled(LevelError))
+	Debugf("debug message")
+	Infof("info message")
+	Warnf("warn message")
+	Errorf("error message")
+	assert.NotContains(t, out.String(), "debug message")
+	assert.NotContains(t, out.String(), "info message")
+	assert.Contains(t, out.String(), "WARN warn message")
+	assert.Contains(t, out.String(), "ERROR error message")
+
+	// debugged requests are logged whatever the level
+	ForceDebugf("forced message")
+	assert.Contains(t, out.String(), "DEBUG forced message")
+
+	out.Reset()
+	SetLogLevel(LevelDebug)
+	Debugf("debug message")
+	assert.Contains(t, out.String(), "DEBUG debug message")
+}
@@ -1,14 +1,54 @@
 package util
 
 import (
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 )
 
 func SendError(c *gin.Context, err error) {
-	c.JSON(500, ApiResponse{
+	SendJSON(c, 500, ApiResponse{
 		Error: ErrorDescription{
 			Code:    "500",
 			Message: err.Error(),
 		},
 	})
 }
+
+// SendOpenAIError writes err in the OpenAI error format with the given status, type and code
+func SendOpenAIError(c *gin.Context, status int, errType, code, param string, err error) {
+	SendJSON(c, status, ApiResponse{
+		Error: ErrorDescription{
+			Code:    code,
+			Message: err.Error(),
+			Type:    errType,
+			Param:   param,
+		},
+	})
+}
+
+// jsonRender renders with the configured json engine instead of the one gin was built with
+type jsonRender struct {
+	data interface{}
+}
+
+func (r jsonRender) Render(w http.ResponseWriter) error {
+	r.WriteContentType(w)
+	data, err := JSONMarshal(r.data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (r jsonRender) WriteContentType(w http.ResponseWriter) {
+	if header := w.Header(); len(header["Content-Type"]) == 0 {
+		header["Content-Type"] = []string{"application/json; charset=utf-8"}
+	}
+}
+
+// SendJSON writes obj as json with the given status
+func SendJSON(c *gin.Context, status int, obj interface{}) {
+	c.Render(status, jsonRender{data: obj})
+}
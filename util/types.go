@@ -7,4 +7,6 @@ type ApiResponse struct {
 type ErrorDescription struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
+	Type    string `json:"type,omitempty"`
+	Param   string `json:"param,omitempty"`
 }